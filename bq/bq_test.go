@@ -1,15 +1,23 @@
 package bq_test
 
 import (
+	"bytes"
+	"errors"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 
 	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/fake"
+	"github.com/m-lab/etl/metrics"
+	"github.com/m-lab/etl/schema"
 )
 
 func init() {
@@ -21,10 +29,51 @@ func foobar(vs bigquery.ValueSaver) {
 }
 
 func TestMapSaver(t *testing.T) {
-	fns := bq.MapSaver{map[string]bigquery.Value{"filename": "foobar"}}
+	fns := bq.MapSaver{Values: map[string]bigquery.Value{"filename": "foobar"}}
 	foobar(&fns)
 }
 
+func TestMapSaverOmitEmpty(t *testing.T) {
+	values := map[string]bigquery.Value{
+		"test_id":   "foo",
+		"log_time":  nil,
+		"count":     int64(0),
+		"tls":       false,
+		"empty":     "",
+		"deltas":    []schema.Web100ValueMap{},
+		"anomalies": schema.Web100ValueMap{},
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip":          "1.2.3.4",
+			"server_ip":          "",
+			"client_geolocation": schema.Web100ValueMap{"city": nil},
+		},
+	}
+	saver := bq.MapSaver{Values: values, OmitEmpty: true}
+	row, _, err := saver.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bigquery.Value{
+		"test_id":         "foo",
+		"count":           int64(0),
+		"tls":             false,
+		"connection_spec": map[string]bigquery.Value{"client_ip": "1.2.3.4"},
+	}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("Got %v, want %v", row, want)
+	}
+	// The original values are unchanged.
+	if len(values) != 8 || len(values["connection_spec"].(schema.Web100ValueMap)) != 3 {
+		t.Errorf("Values modified: %v", values)
+	}
+
+	// By default, all values are saved.
+	saver.OmitEmpty = false
+	if row, _, _ = saver.Save(); len(row) != 8 {
+		t.Errorf("Expected all values, got %v", row)
+	}
+}
+
 // Item represents a row item.
 type Item struct {
 	Name   string
@@ -45,7 +94,7 @@ func xTestRealPartitionInsert(t *testing.T) {
 		Item{Name: tag + "_x1", Count: 12, Foobar: 44}}
 
 	in, err := bq.NewBQInserter(
-		etl.InserterParams{"mlab_sandbox", "test2", "_20160201", 10 * time.Second, 1}, nil)
+		etl.InserterParams{Dataset: "mlab_sandbox", Table: "test2", Suffix: "_20160201", Timeout: 10 * time.Second, BufferSize: 1}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,7 +121,7 @@ func TestBasicInsert(t *testing.T) {
 		Item{Name: tag + "_x1", Count: 12, Foobar: 44}}
 
 	in, err := fake.NewFakeInserter(
-		etl.InserterParams{"mlab_sandbox", "test2", "", 10 * time.Second, 1})
+		etl.InserterParams{Dataset: "mlab_sandbox", Table: "test2", Suffix: "", Timeout: 10 * time.Second, BufferSize: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,7 +147,7 @@ func TestBufferingAndFlushing(t *testing.T) {
 	// Set up an Inserter with a fake Uploader backend for testing.
 	// Buffer 3 rows, so that we can test the buffering.
 	in, err := fake.NewFakeInserter(
-		etl.InserterParams{"mlab_sandbox", "test2", "", 10 * time.Second, 3})
+		etl.InserterParams{Dataset: "mlab_sandbox", Table: "test2", Suffix: "", Timeout: 10 * time.Second, BufferSize: 3})
 	if err != nil {
 		log.Printf("%v\n", err)
 		t.Fatal()
@@ -157,10 +206,66 @@ func TestBufferingAndFlushing(t *testing.T) {
 
 }
 
+// batchUploader records the number of rows in each call to Put.
+type batchUploader struct {
+	*fake.FakeUploader
+	batches []int
+}
+
+func (u *batchUploader) Put(ctx context.Context, src interface{}) error {
+	u.batches = append(u.batches, len(src.([]interface{})))
+	return u.FakeUploader.Put(ctx, src)
+}
+
+func TestBatchBoundaries(t *testing.T) {
+	tests := []struct {
+		bufferSize int
+		inserts    []int // Number of rows in each InsertRows call.
+		batches    []int // Expected rows in each Put, including the final Flush.
+	}{
+		{bufferSize: 3, inserts: []int{1, 1, 1, 1}, batches: []int{3, 1}},
+		{bufferSize: 3, inserts: []int{7}, batches: []int{3, 3, 1}},
+		{bufferSize: 3, inserts: []int{2, 2, 2}, batches: []int{3, 3}},
+		{bufferSize: 4, inserts: []int{1, 5, 2}, batches: []int{4, 4}},
+		// Zero is treated as unbuffered.
+		{bufferSize: 0, inserts: []int{2}, batches: []int{1, 1}},
+	}
+	for _, test := range tests {
+		uploader := &batchUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader)}
+		in, err := bq.NewBQInserter(
+			etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+				BufferSize: test.bufferSize}, uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, n := range test.inserts {
+			rows := make([]interface{}, n)
+			for i := range rows {
+				rows[i] = Item{Name: "x", Count: total}
+				total++
+			}
+			if err := in.InsertRows(rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := in.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(uploader.batches, test.batches) {
+			t.Errorf("Buffer %d, inserts %v: batches %v, want %v",
+				test.bufferSize, test.inserts, uploader.batches, test.batches)
+		}
+		if in.Committed() != total {
+			t.Errorf("Committed %d, want %d", in.Committed(), total)
+		}
+	}
+}
+
 // Just manual testing for now - need to assert something useful.
 func TestHandleInsertErrors(t *testing.T) {
 	in, e := bq.NewBQInserter(
-		etl.InserterParams{"dataset", "table", "", time.Minute, 5},
+		etl.InserterParams{Dataset: "dataset", Table: "table", Suffix: "", Timeout: time.Minute, BufferSize: 5},
 		fake.NewFakeUploader())
 	if e != nil {
 		log.Printf("%v\n", e)
@@ -182,3 +287,701 @@ func TestHandleInsertErrors(t *testing.T) {
 
 	// TODO - assert something.
 }
+
+func TestOrderedInserter(t *testing.T) {
+	uploader := fake.NewFakeUploader()
+	base, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 100}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := bq.NewOrderedInserter(base)
+
+	// Rows arrive out of order, e.g. from concurrent processing.
+	for _, index := range []int{3, 0, 4, 1, 2} {
+		row := &bq.MapSaver{Values: map[string]bigquery.Value{"archive_index": index, "name": "indexed"}}
+		if err = in.InsertRow(row); err != nil {
+			t.Error(err)
+		}
+	}
+	// Rows without an index go last.
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "unindexed"}})
+	if in.RowsInBuffer() != 6 || in.Accepted() != 6 {
+		t.Errorf("Buffer = %d, Accepted = %d", in.RowsInBuffer(), in.Accepted())
+	}
+
+	if err = in.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rows := uploader.(*fake.FakeUploader).Rows
+	if len(rows) != 6 {
+		t.Fatalf("Expected 6 rows, got %d", len(rows))
+	}
+	for i := 0; i < 5; i++ {
+		if rows[i].Row["archive_index"] != i {
+			t.Errorf("Row %d has archive_index %v", i, rows[i].Row["archive_index"])
+		}
+	}
+	if rows[5].Row["name"] != "unindexed" {
+		t.Error("Unindexed row should be last")
+	}
+	if in.RowsInBuffer() != 0 || in.Committed() != 6 {
+		t.Errorf("Buffer = %d, Committed = %d", in.RowsInBuffer(), in.Committed())
+	}
+}
+
+// workerRow is a struct row with a worker_id column.
+type workerRow struct {
+	Name     string
+	WorkerID string `bigquery:"worker_id"`
+}
+
+func (r workerRow) WithWorkerID(id string) interface{} {
+	r.WorkerID = id
+	return r
+}
+
+func TestWorkerIDWrapper(t *testing.T) {
+	uploader := fake.NewFakeUploader()
+	base, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 100}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := bq.WorkerIDWrapper{Inserter: base, ID: "worker-1"}
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "a"}})
+	in.InsertRows([]interface{}{&bq.MapSaver{Values: map[string]bigquery.Value{"name": "b"}}})
+	in.Flush()
+	rows := uploader.(*fake.FakeUploader).Rows
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row.Row["worker_id"] != "worker-1" {
+			t.Errorf("Expected worker_id, got %v", row.Row)
+		}
+	}
+
+	// Struct rows are tagged if they have a worker_id column.
+	in.InsertRow(workerRow{Name: "d"})
+	in.InsertRows([]interface{}{&bigquery.StructSaver{Struct: workerRow{Name: "e"}}})
+	in.Flush()
+	rows = uploader.(*fake.FakeUploader).Rows
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row.Row["worker_id"] != "worker-1" {
+			t.Errorf("Expected worker_id, got %v", row.Row)
+		}
+	}
+
+	// Without an ID, the field is absent.
+	in = bq.WorkerIDWrapper{Inserter: base}
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "c"}})
+	in.Flush()
+	rows = uploader.(*fake.FakeUploader).Rows
+	if _, ok := rows[0].Row["worker_id"]; ok {
+		t.Errorf("Expected no worker_id, got %v", rows[0].Row)
+	}
+}
+
+// fakeClock runs timer functions only when Advance is called.
+type fakeClock struct {
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Duration
+	f        func()
+	stopped  bool
+}
+
+func (ft *fakeTimer) Stop() bool {
+	wasActive := !ft.stopped
+	ft.stopped = true
+	return wasActive
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) bq.Stopper {
+	ft := &fakeTimer{deadline: fc.now + d, f: f}
+	fc.timers = append(fc.timers, ft)
+	return ft
+}
+
+// Advance moves the clock forward, and runs any expired timers.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now += d
+	for _, ft := range fc.timers {
+		if !ft.stopped && ft.deadline <= fc.now {
+			ft.stopped = true
+			ft.f()
+		}
+	}
+}
+
+func TestIdleFlush(t *testing.T) {
+	uploader := fake.NewFakeUploader()
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+			BufferSize: 100, FlushInterval: 10 * time.Second}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{}
+	ins.(*bq.BQInserter).SetClock(clock)
+
+	ins.InsertRow(Item{Name: "x1", Count: 17, Foobar: 44})
+	clock.Advance(5 * time.Second)
+	// A new row restarts the idle period.
+	ins.InsertRow(Item{Name: "x2", Count: 12, Foobar: 44})
+	clock.Advance(9 * time.Second)
+	if ins.RowsInBuffer() != 2 {
+		t.Fatal("Flushed before idle interval, RowsInBuffer = ", ins.RowsInBuffer())
+	}
+
+	clock.Advance(1 * time.Second)
+	if ins.RowsInBuffer() != 0 {
+		t.Error("Expected idle flush, RowsInBuffer = ", ins.RowsInBuffer())
+	}
+	if ins.Committed() != 2 {
+		t.Error("Committed = ", ins.Committed())
+	}
+	if len(uploader.(*fake.FakeUploader).Rows) != 2 {
+		t.Error("Expected 2 uploaded rows")
+	}
+}
+
+func TestNoIdleFlushByDefault(t *testing.T) {
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+			BufferSize: 100}, fake.NewFakeUploader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{}
+	ins.(*bq.BQInserter).SetClock(clock)
+	ins.InsertRow(Item{Name: "x1", Count: 17, Foobar: 44})
+	clock.Advance(time.Hour)
+	if ins.RowsInBuffer() != 1 {
+		t.Error("Unexpected flush, RowsInBuffer = ", ins.RowsInBuffer())
+	}
+	if len(clock.timers) != 0 {
+		t.Error("No timers expected")
+	}
+}
+
+func TestRowOptions(t *testing.T) {
+	schema := bigquery.Schema{{Name: "name"}, {Name: "count"}}
+	rows := []interface{}{
+		&bq.MapSaver{Values: map[string]bigquery.Value{"name": "a", "count": 1}},
+		&bq.MapSaver{Values: map[string]bigquery.Value{"name": "b", "count": 2, "extra": 3}},
+	}
+	tests := []struct {
+		params    etl.InserterParams
+		committed int
+		failed    int
+	}{
+		// Default skips the row with an unknown field.
+		{params: etl.InserterParams{}, committed: 1, failed: 1},
+		// Lenient drops the unknown field, and commits both rows.
+		{params: etl.InserterParams{IgnoreUnknownValues: true}, committed: 2, failed: 0},
+		// Strict rejects the entire insert.
+		{params: etl.InserterParams{RejectInvalidRows: true}, committed: 0, failed: 2},
+	}
+	for _, test := range tests {
+		uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+		uploader.Schema = schema
+		params := test.params
+		params.Dataset = "dataset"
+		params.Table = "table"
+		params.Timeout = time.Minute
+		params.BufferSize = 10
+		in, err := bq.NewBQInserter(params, uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.InsertRows(rows)
+		in.Flush()
+
+		if uploader.Request.SkipInvalidRows == params.RejectInvalidRows {
+			t.Errorf("%+v: wrong SkipInvalidRows in request", test.params)
+		}
+		if uploader.Request.IgnoreUnknownValues != params.IgnoreUnknownValues {
+			t.Errorf("%+v: wrong IgnoreUnknownValues in request", test.params)
+		}
+		if in.Committed() != test.committed || in.Failed() != test.failed {
+			t.Errorf("%+v: committed %d, failed %d; want %d, %d", test.params,
+				in.Committed(), in.Failed(), test.committed, test.failed)
+		}
+		for _, row := range uploader.Rows {
+			if _, ok := row.Row["extra"]; ok {
+				t.Errorf("%+v: unknown field should be dropped", test.params)
+			}
+		}
+	}
+}
+
+// flakyUploader fails the first n calls to Put with err.
+type flakyUploader struct {
+	*fake.FakeUploader
+	n     int
+	err   error
+	calls int
+}
+
+func (u *flakyUploader) Put(ctx context.Context, src interface{}) error {
+	u.calls++
+	if u.calls <= u.n {
+		return u.err
+	}
+	return u.FakeUploader.Put(ctx, src)
+}
+
+func TestInsertRetry(t *testing.T) {
+	unavailable := &googleapi.Error{Code: 503}
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		calls     int
+		committed int
+		wantErr   bool
+	}{
+		{name: "transient", failures: 2, err: unavailable, calls: 3, committed: 2},
+		{name: "exhausted", failures: 5, err: unavailable, calls: 4, committed: 0, wantErr: true},
+		{name: "deadline", failures: 1, err: context.DeadlineExceeded, calls: 2, committed: 2},
+		{name: "permanent", failures: 1, err: &googleapi.Error{Code: 400}, calls: 1, committed: 0},
+	}
+	for _, test := range tests {
+		uploader := &flakyUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader),
+			n: test.failures, err: test.err}
+		in, err := bq.NewBQInserter(
+			etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+				BufferSize: 10, MaxRetries: 3, RetryBaseDelay: time.Second}, uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delays := []time.Duration{}
+		in.(*bq.BQInserter).SetSleep(func(d time.Duration) { delays = append(delays, d) })
+
+		in.InsertRows([]interface{}{Item{Name: "x1"}, Item{Name: "x2"}})
+		err = in.Flush()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if uploader.calls != test.calls {
+			t.Errorf("%s: %d calls, want %d", test.name, uploader.calls, test.calls)
+		}
+		for i, d := range delays {
+			if d != time.Second<<uint(i) {
+				t.Errorf("%s: retry %d delay %v", test.name, i, d)
+			}
+		}
+		if in.Committed() != test.committed || in.Committed()+in.Failed() != 2 {
+			t.Errorf("%s: committed %d, failed %d", test.name, in.Committed(), in.Failed())
+		}
+	}
+}
+
+func TestInsertRetryExhaustedIsSticky(t *testing.T) {
+	uploader := &flakyUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader),
+		n: 4, err: &googleapi.Error{Code: 503}}
+	in, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+			BufferSize: 2, MaxRetries: 3, RetryBaseDelay: time.Second}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.(*bq.BQInserter).SetSleep(func(d time.Duration) {})
+
+	// The full buffer is flushed by InsertRows, and the rows are lost.
+	if err := in.InsertRows([]interface{}{Item{Name: "x1"}, Item{Name: "x2"}}); err == nil {
+		t.Error("Expected error from InsertRows")
+	}
+	// Later inserts succeed, but Flush still reports the lost rows.
+	in.InsertRow(Item{Name: "x3"})
+	if err := in.Flush(); err == nil {
+		t.Error("Expected Flush to return the earlier error")
+	}
+	if in.Committed() != 1 || in.Failed() != 2 {
+		t.Errorf("committed %d, failed %d", in.Committed(), in.Failed())
+	}
+}
+
+func TestInsertRetryDoesNotBlockInserts(t *testing.T) {
+	uploader := &flakyUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader),
+		n: 1, err: &googleapi.Error{Code: 503}}
+	in, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute,
+			BufferSize: 10, MaxRetries: 3, RetryBaseDelay: time.Second}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// While the flush waits to retry, another row can be inserted.
+	in.(*bq.BQInserter).SetSleep(func(d time.Duration) {
+		done := make(chan struct{})
+		go func() {
+			in.InsertRow(Item{Name: "x2"})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("InsertRow blocked during retry backoff")
+		}
+	})
+	in.InsertRow(Item{Name: "x1"})
+	if err := in.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The row inserted during the backoff is still buffered.
+	if in.Committed() != 1 || in.RowsInBuffer() != 1 {
+		t.Errorf("committed %d, buffered %d", in.Committed(), in.RowsInBuffer())
+	}
+	if err := in.Flush(); err != nil || in.Committed() != 2 {
+		t.Errorf("committed %d, %v", in.Committed(), err)
+	}
+}
+
+func TestInferSchema(t *testing.T) {
+	s, err := bq.InferSchema(schema.PT{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range s {
+		names = append(names, f.Name)
+	}
+	expected := []string{"Test_id", "Project", "Log_time", "Connection_spec", "Paris_traceroute_hop", "Type", "Archive_index"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	hop := s[4]
+	if hop.Type != bigquery.RecordFieldType {
+		t.Fatalf("Expected RECORD, got %v", hop.Type)
+	}
+	for _, f := range hop.Schema {
+		if f.Name == "Src_geolocation" && (f.Type != bigquery.RecordFieldType || f.Required) {
+			t.Errorf("Expected nullable RECORD for %s, got %+v", f.Name, f)
+		}
+	}
+
+	if _, err := bq.InferSchema(map[string]bigquery.Value{}); err == nil {
+		t.Error("Expected error for non-struct")
+	}
+}
+
+func TestTableMetadata(t *testing.T) {
+	s := bigquery.Schema{
+		{Name: "test_id", Type: bigquery.StringFieldType},
+		{Name: "log_time", Type: bigquery.TimestampFieldType},
+	}
+	md, suffix, err := bq.TableMetadata(s, bq.TableOptions{TemplateSuffix: "_20170601"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suffix != "_20170601" || md.TimePartitioning != nil {
+		t.Errorf("Wrong template table: %q %+v", suffix, md.TimePartitioning)
+	}
+
+	md, suffix, err = bq.TableMetadata(s, bq.TableOptions{
+		PartitionField: "log_time", PartitionExpiration: 30 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType,
+		Field: "log_time", Expiration: 30 * 24 * time.Hour}
+	if suffix != "" || !reflect.DeepEqual(md.TimePartitioning, expected) {
+		t.Errorf("Wrong partitioned table: %q %+v", suffix, md.TimePartitioning)
+	}
+
+	_, _, err = bq.TableMetadata(s, bq.TableOptions{TemplateSuffix: "_20170601", PartitionField: "log_time"})
+	if err != bq.ErrTemplateAndPartition {
+		t.Errorf("Expected ErrTemplateAndPartition, got %v", err)
+	}
+	for _, opts := range []bq.TableOptions{
+		{PartitionField: "test_id"},
+		{PartitionField: "parse_time"},
+		{PartitionExpiration: time.Hour},
+	} {
+		if _, _, err := bq.TableMetadata(s, opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+func TestInsertID(t *testing.T) {
+	uploader := fake.NewFakeUploader()
+	in, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bq.InsertID("test1", "_20170601")
+	if id != bq.InsertID("test1", "_20170601") {
+		t.Error("InsertID should be deterministic")
+	}
+	if id == bq.InsertID("test1", "_20170602") || id == bq.InsertID("test2", "_20170601") {
+		t.Error("InsertID should depend on the test and suffix")
+	}
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "a"}, InsertID: id})
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "b"}})
+	in.Flush()
+	rows := uploader.(*fake.FakeUploader).Request.Rows
+	if len(rows) != 2 || rows[0].InsertId != id || rows[1].InsertId != "" {
+		t.Errorf("Wrong insert ids: %+v", rows)
+	}
+}
+
+func TestPartitionedInserter(t *testing.T) {
+	params := etl.InserterParams{Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 10}
+	newInserter := func(partition time.Time) (etl.Inserter, *fake.FakeUploader) {
+		uploader := fake.NewFakeUploader()
+		p := params
+		p.Suffix = partition.Format("$20060102")
+		in, err := bq.NewBQInserter(p, uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in, uploader.(*fake.FakeUploader)
+	}
+	task := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	in, taskUploader := newInserter(task)
+	uploaders := map[string]*fake.FakeUploader{}
+	pi := bq.NewPartitionedInserter(in, task, func(partition time.Time) (etl.Inserter, error) {
+		ins, uploader := newInserter(partition)
+		uploaders[ins.TableSuffix()] = uploader
+		return ins, nil
+	})
+
+	// Rows straddling midnight UTC at the end of the task day.
+	row := func(name string, date time.Time) *bq.MapSaver {
+		return &bq.MapSaver{Values: map[string]bigquery.Value{"name": name}, PartitionDate: date}
+	}
+	pi.InsertRow(row("undated", time.Time{}))
+	pi.InsertRow(row("before", time.Date(2017, 6, 1, 23, 59, 59, 0, time.UTC)))
+	pi.InsertRows([]interface{}{
+		row("after", time.Date(2017, 6, 2, 0, 0, 1, 0, time.UTC)),
+		// Same instant as "after", but not in UTC.
+		row("after-est", time.Date(2017, 6, 1, 19, 0, 1, 0, time.FixedZone("EST", -5*3600))),
+	})
+	if pi.Accepted() != 4 || pi.RowsInBuffer() != 4 {
+		t.Errorf("Accepted %d, RowsInBuffer %d, want 4, 4", pi.Accepted(), pi.RowsInBuffer())
+	}
+	if err := pi.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if pi.Committed() != 4 || pi.RowsInBuffer() != 0 {
+		t.Errorf("Committed %d, RowsInBuffer %d, want 4, 0", pi.Committed(), pi.RowsInBuffer())
+	}
+	if pi.FullTableName() != "table$20170601" {
+		t.Errorf("FullTableName = %s", pi.FullTableName())
+	}
+
+	if len(taskUploader.Request.Rows) != 2 {
+		t.Errorf("Expected 2 rows for the task date, got %d", len(taskUploader.Request.Rows))
+	}
+	if len(uploaders) != 1 || uploaders["$20170602"] == nil {
+		t.Fatalf("Expected only an inserter for $20170602, got %v", uploaders)
+	}
+	if len(uploaders["$20170602"].Request.Rows) != 2 {
+		t.Errorf("Expected 2 rows for 20170602, got %d", len(uploaders["$20170602"].Request.Rows))
+	}
+}
+
+// errorCount returns the current value of the ErrorCount metric.
+func errorCount(t *testing.T, table, label string) float64 {
+	var m dto.Metric
+	if err := metrics.ErrorCount.WithLabelValues(table, "unknown", label).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestInsertErrorCategory(t *testing.T) {
+	rowErr := func(reason string) bigquery.RowInsertionError {
+		return bigquery.RowInsertionError{Errors: bigquery.MultiError{&bigquery.Error{Reason: reason}}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"unavailable", &googleapi.Error{Code: 503}, bq.TransientInsertError},
+		{"rate limit", &googleapi.Error{Code: 403,
+			Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, bq.TransientInsertError},
+		{"deadline", context.DeadlineExceeded, bq.TransientInsertError},
+		{"bad request", &googleapi.Error{Code: 400}, bq.PermanentInsertError},
+		{"backend rows", bigquery.PutMultiError{rowErr("backendError"), rowErr("stopped")}, bq.TransientInsertError},
+		{"invalid rows", bigquery.PutMultiError{rowErr("stopped"), rowErr("invalid")}, bq.PermanentInsertError},
+	}
+	for _, test := range tests {
+		if got := bq.InsertErrorCategory(test.err); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInsertErrorMetrics(t *testing.T) {
+	// Without SkipInvalidRows, the invalid row is a permanent error, and the
+	// valid row, which is stopped, is transient.
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	uploader.Schema = bigquery.Schema{{Name: "Name", Type: bigquery.StringFieldType}}
+	in, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "classify", Timeout: time.Minute,
+			BufferSize: 10, RejectInvalidRows: true}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permanent := errorCount(t, "classify", "insert row error: permanent")
+	transient := errorCount(t, "classify", "insert row error: transient")
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"Name": 1}})
+	in.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"Name": "ok"}})
+	in.Flush()
+	if got := errorCount(t, "classify", "insert row error: permanent") - permanent; got != 1 {
+		t.Errorf("%v permanent row errors, want 1", got)
+	}
+	if got := errorCount(t, "classify", "insert row error: transient") - transient; got != 1 {
+		t.Errorf("%v transient row errors, want 1", got)
+	}
+
+	// Row errors from the backend are transient.
+	backend := &flakyUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader), n: 1,
+		err: bigquery.PutMultiError{{Errors: bigquery.MultiError{&bigquery.Error{Reason: "backendError"}}}}}
+	in, err = bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "classify", Timeout: time.Minute, BufferSize: 10}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transient = errorCount(t, "classify", "insert row error: transient")
+	in.InsertRow(Item{Name: "x1"})
+	in.Flush()
+	if got := errorCount(t, "classify", "insert row error: transient") - transient; got != 1 {
+		t.Errorf("%v transient row errors, want 1", got)
+	}
+
+	// Other errors that are not retried are permanent.
+	bad := &flakyUploader{FakeUploader: fake.NewFakeUploader().(*fake.FakeUploader), n: 1,
+		err: &googleapi.Error{Code: 400}}
+	in, err = bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "classify", Timeout: time.Minute, BufferSize: 10}, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permanent = errorCount(t, "classify", "UNHANDLED insert error: permanent")
+	in.InsertRow(Item{Name: "x1"})
+	in.Flush()
+	if got := errorCount(t, "classify", "UNHANDLED insert error: permanent") - permanent; got != 1 {
+		t.Errorf("%v permanent insert errors, want 1", got)
+	}
+}
+
+func TestJSONLInserter(t *testing.T) {
+	var out bytes.Buffer
+	var ins etl.Inserter = bq.NewJSONLInserter(
+		etl.InserterParams{Dataset: "mlab_sandbox", Table: "ndt", Suffix: "$20170509", BufferSize: 2}, &out)
+	if ins.FullTableName() != "ndt$20170509" || ins.Dataset() != "mlab_sandbox" {
+		t.Errorf("Wrong table names %q %q", ins.FullTableName(), ins.Dataset())
+	}
+
+	err := ins.InsertRows([]interface{}{
+		&bq.MapSaver{Values: map[string]bigquery.Value{"test_id": "a",
+			"web100_log_entry": schema.Web100ValueMap{"snap": schema.Web100ValueMap{"CurCwnd": int64(4344)}}}},
+		Item{Name: "b", Count: 2, Foobar: 3},
+		func() {}, // Not encodable.
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The full buffer was written, and the bad row is buffered.
+	if ins.Committed() != 2 || ins.RowsInBuffer() != 1 {
+		t.Errorf("Committed %d, buffered %d, want 2, 1", ins.Committed(), ins.RowsInBuffer())
+	}
+	if err = ins.Flush(); err == nil {
+		t.Error("Expected encoding error")
+	}
+	if ins.Accepted() != 3 || ins.Committed() != 2 || ins.Failed() != 1 || ins.RowsInBuffer() != 0 {
+		t.Errorf("Accepted %d, Committed %d, Failed %d, want 3, 2, 1",
+			ins.Accepted(), ins.Committed(), ins.Failed())
+	}
+
+	want := `{"test_id":"a","web100_log_entry":{"snap":{"CurCwnd":4344}}}` + "\n" +
+		`{"Name":"b","Count":2,"foobar":3}` + "\n"
+	if out.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCSVInserter(t *testing.T) {
+	var out bytes.Buffer
+	ins := bq.NewCSVInserter(etl.InserterParams{Table: "ndt"}, &out, nil)
+	rows := []interface{}{
+		&bq.MapSaver{Values: map[string]bigquery.Value{"test_id": "a,b",
+			"web100_log_entry": schema.Web100ValueMap{
+				"version": "2.5.27",
+				"snap":    schema.Web100ValueMap{"CurCwnd": int64(9007199254740993), "SACK": true}}}},
+		// Missing columns are empty, and unknown columns are dropped.
+		&bq.MapSaver{Values: map[string]bigquery.Value{"test_id": `"c"`,
+			"web100_log_entry": schema.Web100ValueMap{"snap": schema.Web100ValueMap{"CurCwnd": nil}},
+			"extra":            []int{1, 2}}},
+	}
+	if err := ins.InsertRows(rows); err != nil {
+		t.Fatal(err)
+	}
+	if ins.Committed() != 2 {
+		t.Errorf("Committed %d, want 2", ins.Committed())
+	}
+	want := `test_id,web100_log_entry.snap.CurCwnd,web100_log_entry.snap.SACK,web100_log_entry.version
+"a,b",9007199254740993,true,2.5.27
+"""c""",,,
+`
+	if out.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// Structs use the JSON names, and repeated fields are written as JSON.
+	out.Reset()
+	ins = bq.NewCSVInserter(etl.InserterParams{Table: "disco"}, &out, []string{"foobar", "Name", "List"})
+	ins.InsertRow(struct {
+		Item
+		List []int
+	}{Item{Name: "b", Count: 2, Foobar: 3}, []int{4, 5}})
+	ins.Flush()
+	want = "foobar,Name,List\n3,b,\"[4,5]\"\n"
+	if out.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	calls := 0
+	var result error
+	check := func(ctx context.Context) error {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Check should have a deadline")
+		}
+		return result
+	}
+
+	// Results are cached for maxAge.
+	hc := bq.NewHealthCheck(check, time.Second, time.Hour)
+	if err := hc.Err(); err != nil || calls != 1 {
+		t.Errorf("Got %v after %d calls", err, calls)
+	}
+	result = errors.New("unreachable")
+	if err := hc.Err(); err != nil || calls != 1 {
+		t.Errorf("Expected cached result, got %v after %d calls", err, calls)
+	}
+
+	// Once the result expires, the check is run again.
+	hc = bq.NewHealthCheck(check, time.Second, time.Millisecond)
+	hc.Err()
+	time.Sleep(5 * time.Millisecond)
+	if err := hc.Err(); err != result || calls != 3 {
+		t.Errorf("Expected %v, got %v after %d calls", result, err, calls)
+	}
+}
@@ -0,0 +1,52 @@
+package bq
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+)
+
+// HealthCheck runs a connectivity check, such as DatasetCheck, and caches the
+// result for a while, so that frequent health checks do not each call the
+// BigQuery API.
+type HealthCheck struct {
+	check   func(context.Context) error
+	timeout time.Duration // Timeout for each check.
+	maxAge  time.Duration // How long a result is reused.
+
+	mu      sync.Mutex // Protects the fields below, and serializes checks.
+	checked time.Time  // When the last check was run.
+	err     error      // Result of the last check.
+}
+
+// NewHealthCheck creates a HealthCheck that runs check with the given
+// timeout, at most once per maxAge.
+func NewHealthCheck(check func(context.Context) error, timeout, maxAge time.Duration) *HealthCheck {
+	return &HealthCheck{check: check, timeout: timeout, maxAge: maxAge}
+}
+
+// Err returns the result of the most recent check, running a new check if
+// the last result is older than maxAge.
+func (hc *HealthCheck) Err() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.checked.IsZero() && time.Since(hc.checked) < hc.maxAge {
+		return hc.err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	hc.err = hc.check(ctx)
+	hc.checked = time.Now()
+	return hc.err
+}
+
+// DatasetCheck returns a check that fetches the metadata of a dataset, which
+// is a lightweight test that BigQuery is reachable, and the dataset exists.
+func DatasetCheck(client *bigquery.Client, dataset string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := client.Dataset(dataset).Metadata(ctx)
+		return err
+	}
+}
@@ -15,13 +15,20 @@
 package bq
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -33,8 +40,19 @@ import (
 // magnitude below our 10MB max, so 100 might not be such a bad
 // default.
 func NewInserter(dataset string, dt etl.DataType, partition time.Time) (etl.Inserter, error) {
+	return NewInserterForRoute(
+		&etl.Route{DataType: dt, Dataset: dataset, Table: etl.DataTypeToTable[dt]}, partition)
+}
+
+// DefaultFlushInterval is the FlushInterval of the Inserters created by
+// NewInserterForRoute, so that the last partial buffer of a slow task is not
+// held until the task ends.
+const DefaultFlushInterval = time.Minute
+
+// NewInserterForRoute creates an Inserter for the project, dataset and table
+// of the route.  An empty route Project uses the default project.
+func NewInserterForRoute(route *etl.Route, partition time.Time) (etl.Inserter, error) {
 	suffix := ""
-	table := etl.DataTypeToTable[dt]
 	if time.Since(partition) < 30*24*time.Hour {
 		// If within past 30 days, we can stream directly to partition.
 		suffix = "$" + partition.Format("20060102")
@@ -44,9 +62,18 @@ func NewInserter(dataset string, dt etl.DataType, partition time.Time) (etl.Inse
 	}
 
 	return NewBQInserter(
-		etl.InserterParams{Dataset: dataset, Table: table, Suffix: suffix,
-			Timeout: 15 * time.Minute, BufferSize: etl.DataTypeToBQBufferSize[dt]}, nil)
+		etl.InserterParams{Project: route.Project, Dataset: route.Dataset,
+			Table: route.Table, Suffix: suffix, Timeout: 15 * time.Minute,
+			BufferSize:    etl.DataTypeToBQBufferSize[route.DataType],
+			FlushInterval: DefaultFlushInterval,
+			MaxRetries:    3, RetryBaseDelay: time.Second}, nil)
+
+}
 
+// rowOptionsSetter is implemented by custom uploaders, such as the fake
+// uploader, that support the invalid row and unknown value options.
+type rowOptionsSetter interface {
+	SetRowOptions(skipInvalidRows, ignoreUnknownValues bool)
 }
 
 // TODO - improve the naming between here and NewInserter.
@@ -54,6 +81,9 @@ func NewInserter(dataset string, dt etl.DataType, partition time.Time) (etl.Inse
 func NewBQInserter(params etl.InserterParams, uploader etl.Uploader) (etl.Inserter, error) {
 	if uploader == nil {
 		client := MustGetClient(params.Timeout)
+		if params.Project != "" {
+			client = MustGetProjectClient(params.Project, params.Timeout)
+		}
 		table := params.Table
 		if params.Suffix[0] == '$' {
 			// Suffix starting with $ is just a partition spec.
@@ -64,12 +94,21 @@ func NewBQInserter(params etl.InserterParams, uploader etl.Uploader) (etl.Insert
 			// Suffix starting with _ is a template suffix.
 			u.TableTemplateSuffix = params.Suffix
 		}
-		// This avoids problems when a single row of the insert has invalid
-		// data.  We then have to carefully parse the returned error object.
-		u.SkipInvalidRows = true
+		// Skipping invalid rows avoids problems when a single row of the insert
+		// has invalid data.  We then have to carefully parse the returned error
+		// object.
+		u.SkipInvalidRows = !params.RejectInvalidRows
+		u.IgnoreUnknownValues = params.IgnoreUnknownValues
 		uploader = u
+	} else if ros, ok := uploader.(rowOptionsSetter); ok {
+		ros.SetRowOptions(!params.RejectInvalidRows, params.IgnoreUnknownValues)
+	}
+	if params.BufferSize < 1 {
+		// A zero buffer would never make progress in InsertRows.
+		params.BufferSize = 1
 	}
-	in := BQInserter{params: params, uploader: uploader, timeout: params.Timeout}
+	in := BQInserter{params: params, uploader: uploader, timeout: params.Timeout,
+		clock: realClock{}, sleep: time.Sleep}
 	in.rows = make([]interface{}, 0, in.params.BufferSize)
 	return &in, nil
 }
@@ -103,6 +142,30 @@ func MustGetClient(timeout time.Duration) *bigquery.Client {
 	return bqClient
 }
 
+var (
+	projectClientsLock sync.Mutex
+	projectClients     = make(map[string]*bigquery.Client)
+)
+
+// MustGetProjectClient returns the Singleton bigquery client for a specific
+// project, for use by routes that write outside the default project.
+func MustGetProjectClient(project string, timeout time.Duration) *bigquery.Client {
+	projectClientsLock.Lock()
+	defer projectClientsLock.Unlock()
+	client, ok := projectClients[project]
+	if !ok {
+		ctx, _ := context.WithTimeout(context.Background(), timeout)
+		log.Printf("Using project: %s\n", project)
+		var err error
+		client, err = bigquery.NewClient(ctx, project)
+		if err != nil {
+			panic(err.Error())
+		}
+		projectClients[project] = client
+	}
+	return client
+}
+
 //===============================================================================
 
 // Generic implementation of bq.ValueSaver, based on map.  This avoids extra
@@ -110,14 +173,92 @@ func MustGetClient(timeout time.Duration) *bigquery.Client {
 // IMPLEMENTS: bigquery.ValueSaver
 type MapSaver struct {
 	Values map[string]bigquery.Value
+	// If non-empty, BigQuery uses the InsertID to dedup repeated inserts of
+	// the row.  Dedup is best effort, and only within a short window, about a
+	// minute, so rows from task retries much later may still be duplicated.
+	InsertID string
+	// If non-zero, a PartitionedInserter sends the row to the table for this
+	// date, usually the log_time, rather than the task date.
+	PartitionDate time.Time
+	// If true, Save omits nil values, empty strings, and empty maps and
+	// slices, including maps that are empty once their own empty values are
+	// omitted.  This shrinks the payload, and BigQuery stores NULL for the
+	// omitted fields anyway.  Numeric zeros and false are kept, since they
+	// are meaningful values, e.g. for web100 counters.
+	OmitEmpty bool
 }
 
 func (s *MapSaver) Save() (row map[string]bigquery.Value, insertID string, err error) {
-	return s.Values, "", nil
+	if s.OmitEmpty {
+		return omitEmpty(s.Values), s.InsertID, nil
+	}
+	return s.Values, s.InsertID, nil
+}
+
+var valueMapType = reflect.TypeOf(map[string]bigquery.Value{})
+
+// omitEmpty returns a copy of values, without the empty values, recursing
+// into nested maps, such as schema.Web100ValueMap.  values is not modified.
+func omitEmpty(values map[string]bigquery.Value) map[string]bigquery.Value {
+	out := make(map[string]bigquery.Value, len(values))
+	for name, value := range values {
+		if value == nil {
+			continue
+		}
+		v := reflect.ValueOf(value)
+		switch v.Kind() {
+		case reflect.String, reflect.Slice:
+			if v.Len() == 0 {
+				continue
+			}
+		case reflect.Ptr:
+			if v.IsNil() {
+				continue
+			}
+		case reflect.Map:
+			if v.Type().ConvertibleTo(valueMapType) {
+				nested := omitEmpty(v.Convert(valueMapType).Interface().(map[string]bigquery.Value))
+				if len(nested) == 0 {
+					continue
+				}
+				value = nested
+			} else if v.Len() == 0 {
+				continue
+			}
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// InsertID returns a deterministic insertID for the row with testID, inserted
+// into the table with suffix, so that retried inserts of the row, including
+// those from a retried task, have the same insertID.  The ID is a hash, since
+// insertIDs are limited to 128 characters.
+func InsertID(testID, suffix string) string {
+	h := sha256.Sum256([]byte(testID + "\x00" + suffix))
+	return hex.EncodeToString(h[:])
 }
 
 //----------------------------------------------------------------------------
 
+// Clock provides the timers used for time based flushing, so that tests can
+// control the passage of time.
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Stopper
+}
+
+// Stopper is implemented by *time.Timer.
+type Stopper interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Stopper {
+	return time.AfterFunc(d, f)
+}
+
 type BQInserter struct {
 	etl.Inserter
 	params   etl.InserterParams
@@ -127,6 +268,33 @@ type BQInserter struct {
 	inserted int // Number of rows successfully inserted.
 	badRows  int // Number of row failures, including rows in full failures.
 	failures int // Number of complete insert failures.
+
+	// The first insert that failed after exhausting its retries, if any.  It
+	// is returned by every later Flush, so that rows lost in a flush from
+	// InsertRows fail the task, even if the parser only counts the error.
+	flushErr error
+
+	// The timer flush runs on another goroutine, so mu protects all of the
+	// above state.
+	mu         sync.Mutex
+	clock      Clock
+	flushTimer Stopper // Pending time based flush, if any.
+
+	sleep func(time.Duration) // Used for retry backoff.
+}
+
+// SetClock replaces the clock used for time based flushing.  For testing.
+func (in *BQInserter) SetClock(clock Clock) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.clock = clock
+}
+
+// SetSleep replaces the function used to wait between retries.  For testing.
+func (in *BQInserter) SetSleep(sleep func(time.Duration)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.sleep = sleep
 }
 
 // Caller should check error, and take appropriate action before calling again.
@@ -142,13 +310,22 @@ func (in *BQInserter) InsertRows(data []interface{}) error {
 	metrics.WorkerState.WithLabelValues("insert").Inc()
 	defer metrics.WorkerState.WithLabelValues("insert").Dec()
 
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	// Any new rows restart the idle period.
+	defer in.resetFlushTimer()
+
 	for len(data)+len(in.rows) >= in.params.BufferSize {
-		// space >= len(data)
-		space := cap(in.rows) - len(in.rows)
+		// Other goroutines may add rows while flush waits to retry, so the
+		// buffer may already be full.
+		space := in.params.BufferSize - len(in.rows)
+		if space < 0 {
+			space = 0
+		}
 		var add []interface{}
-		add, data = data[:space], data[space:] // does this break?
+		add, data = data[:space], data[space:]
 		in.rows = append(in.rows, add...)
-		err := in.Flush()
+		err := in.flush()
 		if err != nil {
 			// TODO - handle errors in middle better?
 			return err
@@ -158,20 +335,59 @@ func (in *BQInserter) InsertRows(data []interface{}) error {
 	return nil
 }
 
+// resetFlushTimer schedules a flush after FlushInterval, if there are rows
+// in the buffer.  Caller must hold mu.
+func (in *BQInserter) resetFlushTimer() {
+	if in.flushTimer != nil {
+		in.flushTimer.Stop()
+		in.flushTimer = nil
+	}
+	if in.params.FlushInterval <= 0 || len(in.rows) == 0 {
+		return
+	}
+	in.flushTimer = in.clock.AfterFunc(in.params.FlushInterval, in.timedFlush)
+}
+
+// timedFlush flushes any rows that have been idle for FlushInterval.
+// If rows were added just as the timer fired, they may be flushed early.
+func (in *BQInserter) timedFlush() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.flushTimer = nil
+	if len(in.rows) == 0 {
+		return
+	}
+	metrics.WarningCount.WithLabelValues(
+		in.TableBase(), "unknown", "idle flush").Inc()
+	if err := in.flush(); err != nil {
+		log.Printf("Idle flush: %v\n", err)
+	}
+}
+
+// HandleInsertErrors updates the counts for the buffered rows, after an insert
+// error, and discards them.
 func (in *BQInserter) HandleInsertErrors(err error) error {
+	err = in.handleInsertErrors(in.rows, err)
+	// Allocate new slice of rows.  Any failed rows are lost.
+	in.rows = make([]interface{}, 0, in.params.BufferSize)
+	return err
+}
+
+// handleInsertErrors updates the counts after an insert of rows fails.
+func (in *BQInserter) handleInsertErrors(rows []interface{}, err error) error {
 	switch typedErr := err.(type) {
 	case bigquery.PutMultiError:
-		if len(typedErr) == len(in.rows) {
+		if len(typedErr) == len(rows) {
 			log.Printf("%v\n", err)
 			metrics.BackendFailureCount.WithLabelValues(
 				in.TableBase(), "failed insert").Inc()
 			in.failures += 1
 		}
 		// If ALL rows failed, and number of rows is large, just report single failure.
-		if len(typedErr) > 10 && len(typedErr) == len(in.rows) {
+		if len(typedErr) > 10 && len(typedErr) == len(rows) {
 			log.Printf("Insert error: %v\n", err)
 			metrics.ErrorCount.WithLabelValues(
-				in.TableBase(), "unknown", "insert row error").
+				in.TableBase(), "unknown", "insert row error: "+InsertErrorCategory(err)).
 				Add(float64(len(typedErr)))
 		} else {
 			// Handle each error individually.
@@ -183,11 +399,11 @@ func (in *BQInserter) HandleInsertErrors(err error) error {
 				for _, oneErr := range rowError.Errors {
 					log.Printf("Insert error: %v\n", oneErr)
 					metrics.ErrorCount.WithLabelValues(
-						in.TableBase(), "unknown", "insert row error").Inc()
+						in.TableBase(), "unknown", "insert row error: "+rowErrorCategory(oneErr)).Inc()
 				}
 			}
 		}
-		in.inserted += len(in.rows) - len(typedErr)
+		in.inserted += len(rows) - len(typedErr)
 		in.badRows += len(typedErr)
 		err = nil
 	default:
@@ -195,19 +411,32 @@ func (in *BQInserter) HandleInsertErrors(err error) error {
 		metrics.BackendFailureCount.WithLabelValues(
 			in.TableBase(), "failed insert").Inc()
 		metrics.ErrorCount.WithLabelValues(
-			in.TableBase(), "unknown", "UNHANDLED insert error").Inc()
+			in.TableBase(), "unknown", "UNHANDLED insert error: "+InsertErrorCategory(err)).Inc()
 		// TODO - Conservative, but possibly not correct.
 		// This at least preserves the count invariance.
-		in.badRows += len(in.rows)
+		in.badRows += len(rows)
 		err = nil
 	}
-	// Allocate new slice of rows.  Any failed rows are lost.
-	in.rows = make([]interface{}, 0, in.params.BufferSize)
 	return err
 }
 
 // TODO(dev) Should have a recovery mechanism for failed inserts.
+// Flush returns the error from the first insert that exhausted its retries,
+// including those flushed by InsertRows, since those rows are lost.
 func (in *BQInserter) Flush() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.resetFlushTimer()
+	err := in.flush()
+	if in.flushErr != nil {
+		return in.flushErr
+	}
+	return err
+}
+
+// flush writes the buffered rows to the uploader.  Caller must hold mu, which
+// is released while waiting to retry.
+func (in *BQInserter) flush() error {
 	metrics.WorkerState.WithLabelValues("flush").Inc()
 	defer metrics.WorkerState.WithLabelValues("flush").Dec()
 
@@ -215,19 +444,120 @@ func (in *BQInserter) Flush() error {
 		return nil
 	}
 
-	// This is heavyweight, and may run forever without a context deadline.
-	ctx, _ := context.WithTimeout(context.Background(), in.timeout)
-	err := in.uploader.Put(ctx, in.rows)
+	// Other rows may be buffered while waiting to retry, so the rows being
+	// inserted are removed from the buffer first.
+	rows := in.rows
+	in.rows = make([]interface{}, 0, in.params.BufferSize)
+	err := in.put(rows)
 	if err == nil {
-		in.inserted += len(in.rows)
-		in.rows = make([]interface{}, 0, in.params.BufferSize)
+		in.inserted += len(rows)
+	} else if isTransient(err) {
+		// Retries are exhausted.  Return the error, so that the caller can
+		// decide whether to retry the whole task.
+		log.Printf("Insert failed after %d retries: %v\n", in.params.MaxRetries, err)
+		metrics.BackendFailureCount.WithLabelValues(
+			in.TableBase(), "failed insert").Inc()
+		metrics.ErrorCount.WithLabelValues(
+			in.TableBase(), "unknown", "insert retries exhausted").Inc()
+		in.failures += 1
+		in.badRows += len(rows)
+		if in.flushErr == nil {
+			in.flushErr = err
+		}
 	} else {
-		// This adjusts the inserted count, failure count, and updates in.rows.
-		err = in.HandleInsertErrors(err)
+		// This adjusts the inserted and failure counts.
+		err = in.handleInsertErrors(rows, err)
 	}
 	return err
 }
 
+// put writes rows to the uploader, retrying with exponential backoff if the
+// error is transient.  Caller must hold mu, which is released while waiting,
+// so that other goroutines can buffer rows.
+func (in *BQInserter) put(rows []interface{}) error {
+	delay := in.params.RetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		// This is heavyweight, and may run forever without a context deadline.
+		ctx, cancel := context.WithTimeout(context.Background(), in.timeout)
+		err := in.uploader.Put(ctx, rows)
+		cancel()
+		if err == nil || !isTransient(err) || attempt >= in.params.MaxRetries {
+			return err
+		}
+		log.Printf("Retrying insert after %v: %v\n", delay, err)
+		metrics.WarningCount.WithLabelValues(
+			in.TableBase(), "unknown", "insert retry").Inc()
+		sleep := in.sleep
+		in.mu.Unlock()
+		sleep(delay)
+		in.mu.Lock()
+		delay *= 2
+	}
+}
+
+// Insert error categories, used in metric labels, so that transient errors,
+// which may succeed if retried, can be distinguished from permanent errors,
+// such as schema mismatches and bad values.
+const (
+	TransientInsertError = "transient"
+	PermanentInsertError = "permanent"
+)
+
+// InsertErrorCategory returns the category of an insert error.  A
+// PutMultiError is transient only if all of its row errors are transient.
+func InsertErrorCategory(err error) string {
+	if multi, ok := err.(bigquery.PutMultiError); ok {
+		for _, rowError := range multi {
+			for _, oneErr := range rowError.Errors {
+				if rowErrorCategory(oneErr) == PermanentInsertError {
+					return PermanentInsertError
+				}
+			}
+		}
+		return TransientInsertError
+	}
+	if isTransient(err) {
+		return TransientInsertError
+	}
+	return PermanentInsertError
+}
+
+// rowErrorCategory returns the category of a single row error, which is
+// normally a *bigquery.Error.  Rows that were "stopped" were valid, but were
+// not inserted because of errors in other rows of the same request.
+func rowErrorCategory(err error) string {
+	if bqErr, ok := err.(*bigquery.Error); ok {
+		switch bqErr.Reason {
+		case "stopped", "timeout", "backendError", "internalError", "rateLimitExceeded":
+			return TransientInsertError
+		}
+	}
+	return PermanentInsertError
+}
+
+// isTransient returns true if the insert error is likely to succeed if it
+// is retried, such as a server error, rate limit, or deadline.
+func isTransient(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "backendError" {
+			return true
+		}
+	}
+	return false
+}
+
 func (in *BQInserter) FullTableName() string {
 	return in.TableBase() + in.TableSuffix()
 }
@@ -243,15 +573,23 @@ func (in *BQInserter) Dataset() string {
 	return in.params.Dataset
 }
 func (in *BQInserter) RowsInBuffer() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return len(in.rows)
 }
 func (in *BQInserter) Accepted() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return in.inserted + in.badRows + len(in.rows)
 }
 func (in *BQInserter) Committed() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return in.inserted
 }
 func (in *BQInserter) Failed() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return in.badRows
 }
 
@@ -288,6 +626,15 @@ func (in *NullInserter) RowsInBuffer() int {
 func (in *NullInserter) Count() int {
 	return 0
 }
+func (in *NullInserter) Accepted() int {
+	return 0
+}
+func (in *NullInserter) Committed() int {
+	return 0
+}
+func (in *NullInserter) Failed() int {
+	return 0
+}
 
 //----------------------------------------------------------------------------
 
@@ -308,3 +655,146 @@ func (dw DurationWrapper) Flush() error {
 		dw.TableBase(), status).Observe(time.Since(t).Seconds())
 	return err
 }
+
+//----------------------------------------------------------------------------
+
+// Inserter wrapper that tags each row with the ID of the worker instance that
+// produced it, to help correlate rows with per-instance logs and metrics.
+// Map based rows (MapSaver) are always tagged, so the tables for NDT, raw
+// DISCO and SideStream rows need a worker_id column.  Struct rows, bare or in
+// a bigquery.StructSaver, are tagged only if they implement workerIDTagger,
+// since their schema is fixed by the struct type.  Other rows, such as PT
+// rows, are passed through unchanged.
+type WorkerIDWrapper struct {
+	etl.Inserter
+	ID string // If empty, rows are not tagged.
+}
+
+// workerIDTagger is implemented by struct rows with a worker_id column.
+type workerIDTagger interface {
+	// WithWorkerID returns a copy of the row, with the worker_id set.
+	WithWorkerID(id string) interface{}
+}
+
+// tag returns the row with the worker_id set, if it has one.
+func (ww WorkerIDWrapper) tag(data interface{}) interface{} {
+	if ww.ID == "" {
+		return data
+	}
+	switch row := data.(type) {
+	case MapSaver:
+		row.Values["worker_id"] = ww.ID
+	case *MapSaver:
+		row.Values["worker_id"] = ww.ID
+	case *bigquery.StructSaver:
+		if tagger, ok := row.Struct.(workerIDTagger); ok {
+			row.Struct = tagger.WithWorkerID(ww.ID)
+		}
+	case workerIDTagger:
+		return row.WithWorkerID(ww.ID)
+	}
+	return data
+}
+
+func (ww WorkerIDWrapper) InsertRow(data interface{}) error {
+	return ww.Inserter.InsertRow(ww.tag(data))
+}
+
+func (ww WorkerIDWrapper) InsertRows(data []interface{}) error {
+	for i, row := range data {
+		data[i] = ww.tag(row)
+	}
+	return ww.Inserter.InsertRows(data)
+}
+
+//----------------------------------------------------------------------------
+
+// OrderedInserter wraps an Inserter, holding all rows until Flush, and then
+// passing them to the wrapped Inserter in a stable order by archive_index,
+// the position of the test within the archive.  This allows deterministic
+// diffing of output, e.g. for validation, at the cost of buffering all rows
+// for the task and defeating incremental batching.  Rows without an
+// archive_index are passed after all indexed rows, in the order inserted.
+type OrderedInserter struct {
+	etl.Inserter
+	rows []interface{}
+}
+
+// NewOrderedInserter wraps ins so that rows are written in archive order.
+func NewOrderedInserter(ins etl.Inserter) *OrderedInserter {
+	return &OrderedInserter{Inserter: ins}
+}
+
+func (oi *OrderedInserter) InsertRow(data interface{}) error {
+	oi.rows = append(oi.rows, data)
+	return nil
+}
+
+func (oi *OrderedInserter) InsertRows(data []interface{}) error {
+	oi.rows = append(oi.rows, data...)
+	return nil
+}
+
+// Flush sorts the pending rows, and then inserts and flushes them through
+// the wrapped Inserter.
+func (oi *OrderedInserter) Flush() error {
+	rows := oi.rows
+	oi.rows = nil
+	if len(rows) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			return archiveIndex(rows[i]) < archiveIndex(rows[j])
+		})
+		if err := oi.Inserter.InsertRows(rows); err != nil {
+			return err
+		}
+	}
+	return oi.Inserter.Flush()
+}
+
+func (oi *OrderedInserter) RowsInBuffer() int {
+	return len(oi.rows) + oi.Inserter.RowsInBuffer()
+}
+func (oi *OrderedInserter) Accepted() int {
+	return len(oi.rows) + oi.Inserter.Accepted()
+}
+
+// archiveIndexer is implemented by struct rows with an archive_index column.
+type archiveIndexer interface {
+	ArchiveIndex() int64
+}
+
+// archiveIndex returns the archive_index value from a row, or MaxInt64 if
+// there is none, or it is negative, meaning unknown.
+func archiveIndex(row interface{}) int64 {
+	var values map[string]bigquery.Value
+	switch r := row.(type) {
+	case *bigquery.StructSaver:
+		return archiveIndex(r.Struct)
+	case archiveIndexer:
+		if index := r.ArchiveIndex(); index >= 0 {
+			return index
+		}
+		return math.MaxInt64
+	case MapSaver:
+		values = r.Values
+	case bigquery.ValueSaver:
+		v, _, err := r.Save()
+		if err != nil {
+			return math.MaxInt64
+		}
+		values = v
+	default:
+		return math.MaxInt64
+	}
+	switch index := values["archive_index"].(type) {
+	case int:
+		if index >= 0 {
+			return int64(index)
+		}
+	case int64:
+		if index >= 0 {
+			return index
+		}
+	}
+	return math.MaxInt64
+}
@@ -0,0 +1,109 @@
+package bq
+
+import (
+	"log"
+	"time"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
+)
+
+// PartitionedInserter sends each row to the table for the row's own date, so
+// that a task containing tests on both sides of midnight UTC writes each test
+// to the correct day.  Rows are dated by MapSaver.PartitionDate.  Undated
+// rows, and rows for the task date, go to the task Inserter, which also
+// provides the table names.
+type PartitionedInserter struct {
+	etl.Inserter // Inserter for the task date.
+
+	date        string // The task date, as YYYYMMDD.
+	newInserter func(partition time.Time) (etl.Inserter, error)
+	others      map[string]etl.Inserter // Inserters for other dates.
+	order       []string                // Other dates, in order of first use.
+}
+
+// NewPartitionedInserter creates a PartitionedInserter, using ins for rows
+// dated partition, and newInserter to create the Inserter for any other date.
+func NewPartitionedInserter(ins etl.Inserter, partition time.Time,
+	newInserter func(partition time.Time) (etl.Inserter, error)) *PartitionedInserter {
+	return &PartitionedInserter{Inserter: ins, date: partition.Format("20060102"),
+		newInserter: newInserter, others: make(map[string]etl.Inserter)}
+}
+
+// inserterFor returns the Inserter for the row's date.
+func (pi *PartitionedInserter) inserterFor(data interface{}) (etl.Inserter, error) {
+	ms, ok := data.(*MapSaver)
+	if !ok || ms.PartitionDate.IsZero() {
+		return pi.Inserter, nil
+	}
+	date := ms.PartitionDate.UTC().Format("20060102")
+	if date == pi.date {
+		return pi.Inserter, nil
+	}
+	if ins, ok := pi.others[date]; ok {
+		return ins, nil
+	}
+	ins, err := pi.newInserter(ms.PartitionDate)
+	if err != nil {
+		log.Printf("Error creating inserter for %s: %v\n", date, err)
+		metrics.ErrorCount.WithLabelValues(
+			pi.TableBase(), "unknown", "partition inserter error").Inc()
+		return nil, err
+	}
+	pi.others[date] = ins
+	pi.order = append(pi.order, date)
+	return ins, nil
+}
+
+func (pi *PartitionedInserter) InsertRow(data interface{}) error {
+	ins, err := pi.inserterFor(data)
+	if err != nil {
+		return err
+	}
+	return ins.InsertRow(data)
+}
+
+func (pi *PartitionedInserter) InsertRows(data []interface{}) error {
+	for _, row := range data {
+		if err := pi.InsertRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush flushes the Inserters for all dates, returning the first error.
+func (pi *PartitionedInserter) Flush() error {
+	err := pi.Inserter.Flush()
+	for _, date := range pi.order {
+		if e := pi.others[date].Flush(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// sum returns the total of stat across the Inserters for all dates.
+func (pi *PartitionedInserter) sum(stat func(etl.Inserter) int) int {
+	total := stat(pi.Inserter)
+	for _, ins := range pi.others {
+		total += stat(ins)
+	}
+	return total
+}
+
+func (pi *PartitionedInserter) RowsInBuffer() int {
+	return pi.sum(etl.Inserter.RowsInBuffer)
+}
+
+func (pi *PartitionedInserter) Accepted() int {
+	return pi.sum(etl.Inserter.Accepted)
+}
+
+func (pi *PartitionedInserter) Committed() int {
+	return pi.sum(etl.Inserter.Committed)
+}
+
+func (pi *PartitionedInserter) Failed() int {
+	return pi.sum(etl.Inserter.Failed)
+}
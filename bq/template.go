@@ -0,0 +1,98 @@
+package bq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+)
+
+// Timeout for table creation and other metadata operations.
+const tableTimeout = time.Minute
+
+// InferSchema returns the BigQuery schema for a struct, or pointer to struct,
+// such as schema.PT.  Field names come from the bigquery tags, if any, and
+// otherwise from the Go field names.  As in the bigquery library, fields are
+// REQUIRED, unless they are repeated, or tagged `bigquery:",nullable"`.
+func InferSchema(v interface{}) (bigquery.Schema, error) {
+	return bigquery.InferSchema(v)
+}
+
+// CreateTableFromStruct creates the table with the schema inferred from v.
+// An empty project uses the default project.
+func CreateTableFromStruct(project, dataset, table string, v interface{}) error {
+	schema, err := InferSchema(v)
+	if err != nil {
+		return err
+	}
+	return CreateTable(project, dataset, table, schema, TableOptions{})
+}
+
+// TableOptions control the kind of table created by CreateTable.  The zero
+// value creates a plain table.
+type TableOptions struct {
+	// If non-empty, the table is created with this template suffix, such as
+	// "_20170601", as streaming inserts with a TableTemplateSuffix would do.
+	TemplateSuffix string
+
+	// If non-empty, the table is partitioned by day on this top level
+	// TIMESTAMP or DATE column, such as "log_time".
+	PartitionField string
+	// If non-zero, partitions are deleted once they are this old.
+	PartitionExpiration time.Duration
+}
+
+// ErrTemplateAndPartition is returned when both a template suffix and
+// partitioning are requested.  Template tables cannot be partitioned.
+var ErrTemplateAndPartition = errors.New("template suffix and partitioning are mutually exclusive")
+
+// TableMetadata returns the metadata to create a table with the schema and
+// options, and the table name suffix, if any.
+func TableMetadata(schema bigquery.Schema, opts TableOptions) (*bigquery.TableMetadata, string, error) {
+	md := &bigquery.TableMetadata{Schema: schema}
+	if opts.PartitionField == "" {
+		if opts.PartitionExpiration != 0 {
+			return nil, "", errors.New("partition expiration requires a partition field")
+		}
+		return md, opts.TemplateSuffix, nil
+	}
+	if opts.TemplateSuffix != "" {
+		return nil, "", ErrTemplateAndPartition
+	}
+	var field *bigquery.FieldSchema
+	for _, f := range schema {
+		if f.Name == opts.PartitionField {
+			field = f
+		}
+	}
+	if field == nil {
+		return nil, "", fmt.Errorf("no partition field %s in schema", opts.PartitionField)
+	}
+	if field.Repeated || (field.Type != bigquery.TimestampFieldType && field.Type != bigquery.DateFieldType) {
+		return nil, "", fmt.Errorf("partition field %s must be TIMESTAMP or DATE", opts.PartitionField)
+	}
+	md.TimePartitioning = &bigquery.TimePartitioning{
+		Type:       bigquery.DayPartitioningType,
+		Field:      opts.PartitionField,
+		Expiration: opts.PartitionExpiration,
+	}
+	return md, "", nil
+}
+
+// CreateTable creates the table with the schema and options.  An empty
+// project uses the default project.
+func CreateTable(project, dataset, table string, schema bigquery.Schema, opts TableOptions) error {
+	md, suffix, err := TableMetadata(schema, opts)
+	if err != nil {
+		return err
+	}
+	client := MustGetClient(tableTimeout)
+	if project != "" {
+		client = MustGetProjectClient(project, tableTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tableTimeout)
+	defer cancel()
+	return client.Dataset(dataset).Table(table+suffix).Create(ctx, md)
+}
@@ -0,0 +1,268 @@
+package bq
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
+)
+
+// RowEncoder encodes a row for a WriterInserter.  Encode returns the bytes
+// to write for the row, which may include a header before the first row.
+type RowEncoder interface {
+	Encode(row interface{}) ([]byte, error)
+}
+
+// WriterInserter writes each row to an io.Writer, instead of to BigQuery.
+// This allows the parsers to be run offline, e.g. for local debugging, or by
+// analysts without BigQuery access, and the output to be diffed against
+// expected fixtures.  The table names come from the InserterParams, but are
+// only used for metrics.
+type WriterInserter struct {
+	params   etl.InserterParams
+	w        io.Writer
+	enc      RowEncoder
+	rows     []interface{}
+	inserted int // Number of rows successfully written.
+	badRows  int // Number of rows that could not be encoded or written.
+
+	mu sync.Mutex // Protects all of the above state.
+}
+
+// NewWriterInserter creates an Inserter that writes rows to w, encoded by enc.
+// Rows are buffered until Flush, or until params.BufferSize rows are buffered.
+func NewWriterInserter(params etl.InserterParams, w io.Writer, enc RowEncoder) *WriterInserter {
+	return &WriterInserter{params: params, w: w, enc: enc,
+		rows: make([]interface{}, 0, params.BufferSize)}
+}
+
+// NewJSONLInserter creates an Inserter that writes each row as a line of JSON.
+func NewJSONLInserter(params etl.InserterParams, w io.Writer) *WriterInserter {
+	return NewWriterInserter(params, w, jsonlEncoder{})
+}
+
+// NewCSVInserter creates an Inserter that writes rows as CSV, with the given
+// columns.  If columns is empty, the columns are the sorted column names of
+// the first row.  See CSVEncoder.
+func NewCSVInserter(params etl.InserterParams, w io.Writer, columns []string) *WriterInserter {
+	return NewWriterInserter(params, w, &CSVEncoder{Columns: columns, Table: params.Table})
+}
+
+// rowValues returns the value to encode for a row.  For a ValueSaver, such as
+// a MapSaver, that is the saved map, so that the output has the BigQuery
+// column names.  For a StructSaver, it is the struct.
+func rowValues(data interface{}) (interface{}, error) {
+	switch v := data.(type) {
+	case *bigquery.StructSaver:
+		return v.Struct, nil
+	case bigquery.ValueSaver:
+		row, _, err := v.Save()
+		return row, err
+	case MapSaver:
+		return v.Values, nil
+	}
+	return data, nil
+}
+
+func (in *WriterInserter) InsertRow(data interface{}) error {
+	return in.InsertRows([]interface{}{data})
+}
+
+func (in *WriterInserter) InsertRows(data []interface{}) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, row := range data {
+		in.rows = append(in.rows, row)
+		if len(in.rows) >= in.params.BufferSize {
+			if err := in.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (in *WriterInserter) Flush() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.flush()
+}
+
+// flush writes the buffered rows.  Rows that cannot be encoded are counted as
+// failed, and skipped.  If a write fails, that row and all later rows fail.
+// Caller must hold mu.
+func (in *WriterInserter) flush() error {
+	rows := in.rows
+	in.rows = make([]interface{}, 0, in.params.BufferSize)
+	var firstErr error
+	for i, row := range rows {
+		data, err := in.enc.Encode(row)
+		if err != nil {
+			log.Printf("Skipping row in %s: %v\n", in.TableBase(), err)
+			metrics.ErrorCount.WithLabelValues(
+				in.TableBase(), "unknown", "row encode error").Inc()
+			in.badRows++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if _, err = in.w.Write(data); err != nil {
+			metrics.ErrorCount.WithLabelValues(
+				in.TableBase(), "unknown", "row write error").Inc()
+			in.badRows += len(rows) - i
+			return err
+		}
+		in.inserted++
+	}
+	return firstErr
+}
+
+func (in *WriterInserter) FullTableName() string {
+	return in.TableBase() + in.TableSuffix()
+}
+func (in *WriterInserter) TableBase() string {
+	return in.params.Table
+}
+func (in *WriterInserter) TableSuffix() string {
+	return in.params.Suffix
+}
+func (in *WriterInserter) Dataset() string {
+	return in.params.Dataset
+}
+func (in *WriterInserter) RowsInBuffer() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.rows)
+}
+func (in *WriterInserter) Accepted() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.inserted + in.badRows + len(in.rows)
+}
+func (in *WriterInserter) Committed() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.inserted
+}
+func (in *WriterInserter) Failed() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.badRows
+}
+
+//----------------------------------------------------------------------------
+
+// jsonlEncoder encodes each row as a line of JSON.
+type jsonlEncoder struct{}
+
+func (jsonlEncoder) Encode(row interface{}) ([]byte, error) {
+	values, err := rowValues(row)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %T: %v", row, err)
+	}
+	return append(line, '\n'), nil
+}
+
+// CSVEncoder encodes rows as CSV.  Nested records are flattened into dotted
+// column names, e.g. web100_log_entry.snap.CurCwnd, and repeated fields are
+// written as JSON.  The header line is written before the first row.  Values
+// in columns that are not in the header are dropped, and counted.
+type CSVEncoder struct {
+	// The header columns.  If empty, the columns are set from the first row.
+	Columns []string
+	Table   string // Used only for metrics.
+
+	wroteHeader bool
+}
+
+func (ce *CSVEncoder) Encode(row interface{}) ([]byte, error) {
+	values, err := flattenRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %T: %v", row, err)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if !ce.wroteHeader {
+		if len(ce.Columns) == 0 {
+			for name := range values {
+				ce.Columns = append(ce.Columns, name)
+			}
+			sort.Strings(ce.Columns)
+		}
+		w.Write(ce.Columns)
+		ce.wroteHeader = true
+	}
+	record := make([]string, len(ce.Columns))
+	for i, name := range ce.Columns {
+		record[i] = values[name]
+		delete(values, name)
+	}
+	if len(values) > 0 {
+		metrics.WarningCount.WithLabelValues(
+			ce.Table, "unknown", "dropped csv column").Add(float64(len(values)))
+	}
+	w.Write(record)
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// flattenRow returns the row values, keyed by dotted column name.  The row is
+// converted through JSON, so that structs and maps are handled alike, with
+// their JSON column names.
+func flattenRow(row interface{}) (map[string]string, error) {
+	values, err := rowValues(row)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // Preserve integer precision.
+	var record map[string]interface{}
+	if err = dec.Decode(&record); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]string)
+	flatten("", record, flat)
+	return flat, nil
+}
+
+// flatten adds the values of record to flat, with the prefix prepended to the
+// column names.
+func flatten(prefix string, record map[string]interface{}, flat map[string]string) {
+	for name, value := range record {
+		name = prefix + name
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(name+".", v, flat)
+		case []interface{}:
+			data, _ := json.Marshal(v)
+			flat[name] = string(data)
+		case string:
+			flat[name] = v
+		case json.Number:
+			flat[name] = v.String()
+		case bool:
+			flat[name] = strconv.FormatBool(v)
+		case nil:
+			flat[name] = ""
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// etl_dump parses local archive files, and dumps the resulting rows as JSON or
+// CSV, for local validation of parsers without BigQuery or GCS.
+package main
+
+// example:
+// go build ./cmd/etl_dump
+// ./etl_dump -type ndt 20170509T000000Z-mlab1-vie01-ndt-0000.tgz
+// ./etl_dump -type ndt -dir archives/ -workers 8
+// ./etl_dump -type ndt -schema schema/ndt.json -dir archives/
+// ./etl_dump -type sidestream -format csv 20170509T000000Z-mlab1-vie01-sidestream-0000.tgz
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/fake"
+	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/storage"
+	"github.com/m-lab/etl/task"
+)
+
+var (
+	dataType   = flag.String("type", "ndt", "Data type: ndt, sidestream, traceroute, or disco.")
+	dir        = flag.String("dir", "", "Directory of archives to process.")
+	workers    = flag.Int("workers", 4, "Number of archives to process concurrently in -dir mode.")
+	ordered    = flag.Bool("ordered", false, "Write rows in archive order, for deterministic diffs.")
+	verbose    = flag.Bool("verbose", false, "Log the name of each skipped archive entry.")
+	strictGzip = flag.Bool("strict_gzip", false, "Drop gzipped tests with a CRC or size mismatch.")
+	format     = flag.String("format", "json", "Output format: json, or csv.")
+	schemaFile = flag.String("schema", "",
+		"BigQuery JSON schema file.  If set, rows are validated against the schema instead of dumped.")
+)
+
+// The schema loaded from -schema, if any.
+var validationSchema bigquery.Schema
+
+//---------------------------------------------------------------------------
+//          Archive processing
+//---------------------------------------------------------------------------
+
+// archiveStats summarizes the processing of one or more archives.
+type archiveStats struct {
+	Archives int
+	Tests    int
+	Rows     int
+	Failed   int
+	Errors   int
+}
+
+func (s *archiveStats) add(other archiveStats) {
+	s.Archives += other.Archives
+	s.Tests += other.Tests
+	s.Rows += other.Rows
+	s.Failed += other.Failed
+	s.Errors += other.Errors
+}
+
+// archiveResult holds the output and stats for a single archive.
+type archiveResult struct {
+	name   string
+	output bytes.Buffer
+	stats  archiveStats
+	err    error
+}
+
+// processArchive parses all tests in a single archive, buffering the output.
+func processArchive(path string, dt etl.DataType) *archiveResult {
+	result := &archiveResult{name: path}
+	result.stats.Archives = 1
+
+	src, err := storage.NewFileSource(path)
+	if err != nil {
+		result.err = err
+		result.stats.Errors = 1
+		return result
+	}
+	defer src.Close()
+	src.StrictGzip = *strictGzip
+
+	// With no BufferSize, each row is written as it is inserted.
+	params := etl.InserterParams{Dataset: "dump", Table: etl.DataTypeToTable[dt]}
+	var ins etl.Inserter = bq.NewJSONLInserter(params, &result.output)
+	if *format == "csv" {
+		// Each archive has its own header, from its first row.
+		ins = bq.NewCSVInserter(params, &result.output, nil)
+	}
+	if validationSchema != nil {
+		ins, err = fake.NewValidatingInserter(etl.InserterParams{
+			Dataset: "dump", Table: etl.DataTypeToTable[dt], Timeout: time.Minute,
+			BufferSize: etl.DataTypeToBQBufferSize[dt]}, validationSchema)
+		if err != nil {
+			result.err = err
+			result.stats.Errors = 1
+			return result
+		}
+	}
+	pins := ins
+	if *ordered {
+		pins = bq.NewOrderedInserter(ins)
+	}
+	p := parser.NewParser(dt, pins)
+	if p == nil {
+		result.err = errors.New("unknown data type: " + string(dt))
+		result.stats.Errors = 1
+		return result
+	}
+	tsk := task.NewTask(path, src, p)
+	tsk.Verbose = *verbose
+	tests, err := tsk.ProcessAllTests(context.Background())
+	// Not all parsers flush the inserter.
+	pins.Flush()
+	result.stats.Tests = tests
+	result.stats.Rows = ins.Accepted()
+	result.stats.Failed = ins.Failed()
+	if err != nil {
+		result.err = err
+		result.stats.Errors = 1
+	}
+	return result
+}
+
+// writeResult writes the labeled output for a single archive.
+func writeResult(w io.Writer, r *archiveResult) {
+	fmt.Fprintf(w, "=== %s\n", r.name)
+	w.Write(r.output.Bytes())
+	if r.err != nil {
+		fmt.Fprintf(w, "--- %s error: %v\n", r.name, r.err)
+	}
+	fmt.Fprintf(w, "--- %s tests: %d rows: %d failed: %d\n",
+		r.name, r.stats.Tests, r.stats.Rows, r.stats.Failed)
+}
+
+// processArchives processes the archives using numWorkers concurrent workers.
+// Output for each archive is written to w in the order of paths, as soon as
+// it and all preceding archives have completed.  Returns the aggregate stats.
+func processArchives(paths []string, dt etl.DataType, numWorkers int, w io.Writer) archiveStats {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	results := make([]chan *archiveResult, len(paths))
+	for i := range results {
+		results[i] = make(chan *archiveResult, 1)
+	}
+
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for n := 0; n < numWorkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] <- processArchive(paths[i], dt)
+			}
+		}()
+	}
+	go func() {
+		for i := range paths {
+			work <- i
+		}
+		close(work)
+	}()
+
+	total := archiveStats{}
+	for i := range paths {
+		r := <-results[i]
+		writeResult(w, r)
+		total.add(r.stats)
+	}
+	wg.Wait()
+	return total
+}
+
+// listArchives returns the sorted paths of all archives in dir.
+func listArchives(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, f := range files {
+		if f.Mode().IsRegular() && storage.IsArchive(f.Name()) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func main() {
+	flag.Parse()
+
+	paths := flag.Args()
+	if *dir != "" {
+		var err error
+		paths, err = listArchives(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(paths) == 0 {
+		log.Fatal("No archives specified.")
+	}
+
+	if *schemaFile != "" {
+		data, err := ioutil.ReadFile(*schemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		validationSchema, err = bigquery.SchemaFromJSON(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	total := processArchives(paths, etl.DataType(*dataType), *workers, os.Stdout)
+	fmt.Printf("=== total archives: %d tests: %d rows: %d failed: %d errors: %d\n",
+		total.Archives, total.Tests, total.Rows, total.Failed, total.Errors)
+	if total.Errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/etl"
+)
+
+// writeArchive writes a tgz archive containing numTests small test files.
+func writeArchive(t *testing.T, path string, numTests int) {
+	b := new(bytes.Buffer)
+	zw := gzip.NewWriter(b)
+	tw := tar.NewWriter(zw)
+	for i := 0; i < numTests; i++ {
+		data := []byte(fmt.Sprintf("test %d", i))
+		hdr := &tar.Header{
+			Name:     fmt.Sprintf("test%d.txt", i),
+			Mode:     0600,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	zw.Close()
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etl_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Five archives with 1..5 tests, plus a file that should be ignored.
+	for i := 1; i <= 5; i++ {
+		writeArchive(t, filepath.Join(dir, fmt.Sprintf("archive-%d.tgz", i)), i)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignore me"), 0644)
+
+	paths, err := listArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 5 {
+		t.Fatalf("Expected 5 archives, got %d", len(paths))
+	}
+
+	out := new(bytes.Buffer)
+	// The sidestream parser produces one row per test.
+	total := processArchives(paths, etl.SS, 3, out)
+	expected := archiveStats{Archives: 5, Tests: 15, Rows: 15}
+	if total != expected {
+		t.Errorf("Expected %+v, got %+v", expected, total)
+	}
+
+	// Output should be labeled and in archive order.
+	output := out.String()
+	last := -1
+	for _, path := range paths {
+		pos := strings.Index(output, "=== "+path+"\n")
+		if pos < 0 {
+			t.Errorf("Missing output for %s", path)
+			continue
+		}
+		if pos < last {
+			t.Errorf("Output for %s is out of order", path)
+		}
+		last = pos
+	}
+	if !strings.Contains(output, "--- "+paths[4]+" tests: 5 rows: 5 failed: 0\n") {
+		t.Error("Missing stats for", paths[4])
+	}
+}
+
+func TestProcessArchivesBadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etl_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.tgz")
+	writeArchive(t, good, 2)
+	bad := filepath.Join(dir, "bad.tgz")
+	ioutil.WriteFile(bad, []byte("not a gzip file"), 0644)
+
+	total := processArchives([]string{bad, good}, etl.SS, 2, ioutil.Discard)
+	expected := archiveStats{Archives: 2, Tests: 2, Rows: 2, Errors: 1}
+	if total != expected {
+		t.Errorf("Expected %+v, got %+v", expected, total)
+	}
+}
+
+func TestProcessArchivesSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etl_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.tgz")
+	writeArchive(t, path, 3)
+	defer func() { validationSchema = nil }()
+
+	// The sidestream parser rows contain the task meta data and testname.
+	validationSchema = bigquery.Schema{
+		{Name: "filename", Type: bigquery.StringFieldType},
+		{Name: "parse_time", Type: bigquery.TimestampFieldType},
+		{Name: "attempt", Type: bigquery.IntegerFieldType},
+		{Name: "archive_index", Type: bigquery.IntegerFieldType},
+		{Name: "testname", Type: bigquery.StringFieldType},
+	}
+	out := new(bytes.Buffer)
+	total := processArchives([]string{path}, etl.SS, 1, out)
+	expected := archiveStats{Archives: 1, Tests: 3, Rows: 3}
+	if total != expected {
+		t.Errorf("Expected %+v, got %+v", expected, total)
+	}
+	// Rows are validated, not dumped.
+	if strings.Contains(out.String(), "testname") {
+		t.Error("Unexpected row output:", out.String())
+	}
+
+	// A mismatched type fails every row.
+	validationSchema[4].Type = bigquery.IntegerFieldType
+	total = processArchives([]string{path}, etl.SS, 1, ioutil.Discard)
+	expected = archiveStats{Archives: 1, Tests: 3, Rows: 3, Failed: 3}
+	if total != expected {
+		t.Errorf("Expected %+v, got %+v", expected, total)
+	}
+}
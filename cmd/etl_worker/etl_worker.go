@@ -2,17 +2,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/geo"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
 	"github.com/m-lab/etl/storage"
@@ -35,14 +42,46 @@ func init() {
 //   login: admin
 // Return 200 status code.
 // Track reqeusts that last longer than 24 hrs.
-// Is task handling idempotent?
+// Task handling is idempotent only as far as BigQuery dedups retried rows by
+// insertID.  See task.SetAttempt.
+
+// taskHeaders holds the useful headers added by AppEngine when sending Tasks
+// via Push.
+type taskHeaders struct {
+	QueueName      string // X-AppEngine-QueueName
+	TaskName       string // X-AppEngine-TaskName
+	TaskETA        string // X-AppEngine-TaskETA
+	RetryCount     int    // X-AppEngine-TaskRetryCount
+	ExecutionCount int    // X-AppEngine-TaskExecutionCount
+}
 
-// Useful headers added by AppEngine when sending Tasks via Push.
-//   X-AppEngine-QueueName
-//   X-AppEngine-TaskETA
-//   X-AppEngine-TaskName
-//   X-AppEngine-TaskRetryCount
-//   X-AppEngine-TaskExecutionCount
+// getTaskHeaders reads the task queue headers.  Missing or invalid counts are
+// zero.
+func getTaskHeaders(r *http.Request) taskHeaders {
+	th := taskHeaders{
+		QueueName: r.Header.Get("X-AppEngine-QueueName"),
+		TaskName:  r.Header.Get("X-AppEngine-TaskName"),
+		TaskETA:   r.Header.Get("X-AppEngine-TaskETA"),
+	}
+	var err error
+	if retries := r.Header.Get("X-AppEngine-TaskRetryCount"); retries != "" {
+		if th.RetryCount, err = strconv.Atoi(retries); err != nil {
+			log.Printf("Invalid retries string: %s\n", retries)
+		}
+	}
+	if executions := r.Header.Get("X-AppEngine-TaskExecutionCount"); executions != "" {
+		if th.ExecutionCount, err = strconv.Atoi(executions); err != nil {
+			log.Printf("Invalid execution count string: %s\n", executions)
+		}
+	}
+	return th
+}
+
+// String formats the headers as key=value pairs, for logging.
+func (th taskHeaders) String() string {
+	return fmt.Sprintf("queue=%q task=%q eta=%q retries=%d executions=%d",
+		th.QueueName, th.TaskName, th.TaskETA, th.RetryCount, th.ExecutionCount)
+}
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
@@ -87,13 +126,49 @@ func decrementInFlight() {
 	atomic.AddInt32(&inFlight, -1)
 }
 
-func worker(w http.ResponseWriter, r *http.Request) {
-	// TODO(dev) Check how many times a request has already been attempted.
+// activeTasks returns the number of tasks in flight.
+func activeTasks() int {
+	return int(atomic.LoadInt32(&inFlight))
+}
+
+// Cancelled on shutdown, which rejects new tasks, and causes the tasks in
+// flight to stop after the current test, and flush their rows.  A stopped task
+// returns an error, so the queue retries it, and the retry inserts the flushed
+// rows again.  Their insert IDs are the same, so BigQuery dedups them if the
+// retry comes within its short dedup window, but a later retry leaves
+// duplicate rows.
+var shutdownCtx, shutdown = context.WithCancel(context.Background())
+
+// Bound on the wait for tasks in flight to flush, during shutdown.
+const shutdownTimeout = 20 * time.Second
+
+// handleShutdown waits for a signal, then stops the tasks in flight, and shuts
+// down srv, waiting up to shutdownTimeout for the responses to be written.
+// done is closed once the shutdown is complete.
+func handleShutdown(sigs <-chan os.Signal, srv *http.Server, done chan<- struct{}) {
+	defer close(done)
+	sig := <-sigs
+	log.Printf("Received %v, shutting down with %d tasks in flight\n", sig, activeTasks())
+	shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Exiting with %d tasks in flight: %v\n", activeTasks(), err)
+	}
+}
 
+func worker(w http.ResponseWriter, r *http.Request) {
 	// These keep track of the (nested) state of the worker.
 	metrics.WorkerState.WithLabelValues("worker").Inc()
 	defer metrics.WorkerState.WithLabelValues("worker").Dec()
 
+	if shutdownCtx.Err() != nil {
+		metrics.TaskCount.WithLabelValues("unknown", "ShuttingDown").Inc()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"message": "Shutting down."}`)
+		return
+	}
+
 	// Throttle by grabbing a semaphore from channel.
 	if shouldThrottle() {
 		metrics.TaskCount.WithLabelValues("unknown", "TooManyRequests").Inc()
@@ -107,23 +182,7 @@ func worker(w http.ResponseWriter, r *http.Request) {
 	metrics.WorkerCount.Inc()
 	defer metrics.WorkerCount.Dec()
 
-	var err error
-	retryCountStr := r.Header.Get("X-AppEngine-TaskRetryCount")
-	retryCount := 0
-	if retryCountStr != "" {
-		retryCount, err = strconv.Atoi(retryCountStr)
-		if err != nil {
-			log.Printf("Invalid retries string: %s\n", retryCountStr)
-		}
-	}
-	executionCountStr := r.Header.Get("X-AppEngine-TaskExecutionCount")
-	executionCount := 0
-	if executionCountStr != "" {
-		executionCount, err = strconv.Atoi(executionCountStr)
-		if err != nil {
-			log.Printf("Invalid execution count string: %s\n", executionCountStr)
-		}
-	}
+	headers := getTaskHeaders(r)
 
 	r.ParseForm()
 	// Log request data.
@@ -141,9 +200,7 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO(dev): log the originating task queue name from headers.
-	log.Printf("Received filename: %q  Retries: %d, Executions: %d\n",
-		fn, retryCount, executionCount)
+	log.Printf("Received filename=%q %v\n", fn, headers)
 
 	data, err := etl.ValidateTestPath(fn)
 	if err != nil {
@@ -152,7 +209,15 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"message": "Invalid filename."}`)
 		return
 	}
-	dataType := data.GetDataType()
+	route, err := routingTable.Route(fn)
+	if err != nil {
+		metrics.TaskCount.WithLabelValues("unknown", "NoRoute").Inc()
+		log.Printf("No route for filename: %s\n", fn)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"message": "Invalid filename."}`)
+		return
+	}
+	dataType := route.DataType
 
 	// Move this into Validate function
 	if dataType == etl.INVALID {
@@ -163,7 +228,7 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client, err := storage.GetStorageClient(false)
+	client, err := storage.GetStorageClient(false, storage.ArchiveTimeout)
 	if err != nil {
 		metrics.TaskCount.WithLabelValues("unknown", "ServiceUnavailable").Inc()
 		log.Printf("Error getting storage client: %v\n", err)
@@ -172,6 +237,15 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Skip archives that have already been completely processed.
+	generation, done := task.CheckCompletion(completionStore, fn, func(fn string) (int64, error) {
+		return storage.GetGeneration(client, fn)
+	})
+	if done {
+		fmt.Fprintf(w, `{"message": "Already processed"}`)
+		return
+	}
+
 	// TODO - add a timer for reading the file.
 	tr, err := storage.NewETLSource(client, fn)
 	if err != nil {
@@ -183,16 +257,16 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		// TODO - anything better we could do here?
 	}
 	defer tr.Close()
+	tr.StrictGzip = strictGzip
 
 	dateFormat := "20060102"
 	date, err := time.Parse(dateFormat, data.PackedDate)
 
-	dataset, ok := os.LookupEnv("BIGQUERY_DATASET")
-	if !ok {
-		// TODO - make this fatal.
-		dataset = "mlab_sandbox"
+	dest := *route
+	if dest.Dataset == "" {
+		dest.Dataset = defaultDataset()
 	}
-	ins, err := bq.NewInserter(dataset, dataType, date)
+	ins, err := bq.NewInserterForRoute(&dest, date)
 	if err != nil {
 		metrics.TaskCount.WithLabelValues(string(dataType), "NewInserterError").Inc()
 		log.Printf("Error creating BQ Inserter:  %v", err)
@@ -201,15 +275,78 @@ func worker(w http.ResponseWriter, r *http.Request) {
 		return
 		// TODO - anything better we could do here?
 	}
+	// Send tests from other days, e.g. just after midnight, to their own day.
+	ins = bq.NewPartitionedInserter(ins, date, func(partition time.Time) (etl.Inserter, error) {
+		return bq.NewInserterForRoute(&dest, partition)
+	})
 
 	// Wrap inserter to give insertion time metrics.
 	ins = bq.DurationWrapper{ins}
+	if workerID != "" {
+		ins = bq.WorkerIDWrapper{Inserter: ins, ID: workerID}
+	}
 
-	// Create parser, injecting Inserter
-	p := parser.NewParser(dataType, ins)
+	// Create parser, injecting Inserter.  Parsers registered for the path
+	// take precedence over the parser for the route's data type.
+	var p etl.Parser
+	if factory, ok := parser.LookupParser(fn); ok {
+		p = factory(ins)
+	} else if p = parser.NewParser(dataType, ins); p == nil {
+		metrics.TaskCount.WithLabelValues(string(dataType), "NoParser").Inc()
+		log.Printf("No parser for filename: %s\n", fn)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"message": "Invalid filename."}`)
+		return
+	}
+	switch tp := p.(type) {
+	case *parser.NDTParser:
+		if countryDB != nil {
+			tp.SetCountryDB(countryDB)
+		}
+		if locationDB != nil && annotationBatchSize >= 0 {
+			tp.SetBatchAnnotator(parser.NewLocationAnnotator(locationDB), annotationBatchSize)
+		}
+		if snapshotBudget > 0 {
+			// Each task gets its own budget.
+			tp.SetSnapshotBudget(parser.NewSnapshotBudget(snapshotBudget))
+		}
+		if anonymizer != nil {
+			tp.SetIPAnonymizer(anonymizer)
+		}
+		if maxSnapshots != nil {
+			tp.SetMaxSnapshots(*maxSnapshots)
+		}
+		tp.SetFileSizeThresholds(smallSnaplogSize, maxSnaplogSize)
+	case *parser.PTParser:
+		if locationDB != nil {
+			tp.SetLocationDB(locationDB)
+		}
+		if anonymizer != nil {
+			tp.SetIPAnonymizer(anonymizer)
+		}
+	case *parser.DiscoParser:
+		tp.SetRawJSON(discoRawJSON)
+	case *parser.TestParser:
+		if anonymizer != nil {
+			tp.SetIPAnonymizer(anonymizer)
+		}
+	}
 	tsk := task.NewTask(fn, tr, p)
-
-	files, err := tsk.ProcessAllTests()
+	// The first execution has a retry count of zero.
+	tsk.SetAttempt(headers.RetryCount + 1)
+	tsk.SetCompletion(completionStore, generation)
+
+	// Stop the task, flushing the rows so far, if the worker shuts down.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-shutdownCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	files, err := tsk.ProcessAllTests(ctx)
 
 	// Count the files processed per-host-module per-weekday.
 	// TODO(soltesz): evaluate separating hosts and pods as separate metrics.
@@ -219,9 +356,17 @@ func worker(w http.ResponseWriter, r *http.Request) {
 
 	metrics.WorkerState.WithLabelValues("finish").Inc()
 	defer metrics.WorkerState.WithLabelValues("finish").Dec()
+	if _, ok := err.(*storage.StreamError); ok {
+		// Stream errors are usually transient, so ask the queue to retry.
+		metrics.TaskCount.WithLabelValues(string(dataType), "StreamError").Inc()
+		log.Printf("Stream error processing tests:  %v filename=%q %v", err, fn, headers)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"message": "Stream error in ProcessAllTests"}`)
+		return
+	}
 	if err != nil {
 		metrics.TaskCount.WithLabelValues(string(dataType), "TaskError").Inc()
-		log.Printf("Error Processing Tests:  %v", err)
+		log.Printf("Error Processing Tests:  %v filename=%q %v", err, fn, headers)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"message": "Error in ProcessAllTests"}`)
 		return
@@ -235,8 +380,37 @@ func worker(w http.ResponseWriter, r *http.Request) {
 	metrics.TaskCount.WithLabelValues(string(dataType), "OK").Inc()
 }
 
+// defaultDataset returns the BigQuery dataset for routes that do not specify
+// one.
+func defaultDataset() string {
+	dataset, ok := os.LookupEnv("BIGQUERY_DATASET")
+	if !ok {
+		// TODO - make this fatal.
+		dataset = "mlab_sandbox"
+	}
+	return dataset
+}
+
+// Checks that BigQuery is reachable.  If nil, the health check always passes.
+var healthCheck *bq.HealthCheck
+
+// setupHealthCheck checks BigQuery connectivity by fetching the default
+// dataset metadata, reusing each result for a few seconds.
+func setupHealthCheck() {
+	client := bq.MustGetClient(time.Minute)
+	healthCheck = bq.NewHealthCheck(
+		bq.DatasetCheck(client, defaultDataset()), 5*time.Second, 10*time.Second)
+}
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO(soltesz): provide a real health check.
+	if healthCheck != nil {
+		if err := healthCheck.Err(); err != nil {
+			log.Printf("Health check failed: %v\n", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "BigQuery unavailable")
+			return
+		}
+	}
 	fmt.Fprint(w, "ok")
 }
 
@@ -256,6 +430,227 @@ func setMaxInFlight() {
 	}
 }
 
+// Optional country database, used to annotate NDT rows with client country.
+var countryDB *geo.CountryDB
+
+// loadCountryDB loads the country database named by GEO_COUNTRY_DB, if set.
+func loadCountryDB() {
+	path, ok := os.LookupEnv("GEO_COUNTRY_DB")
+	if !ok || path == "" {
+		return
+	}
+	db, err := geo.LoadCountryDB(path)
+	if err != nil {
+		log.Printf("Unable to load country db %s: %v\n", path, err)
+		return
+	}
+	countryDB = db
+}
+
+// Optional location database, used to annotate PT hops with geolocation.
+var locationDB *geo.LocationDB
+
+// loadLocationDB loads the location database named by GEO_LOCATION_DB, if set.
+func loadLocationDB() {
+	path, ok := os.LookupEnv("GEO_LOCATION_DB")
+	if !ok || path == "" {
+		return
+	}
+	db, err := geo.LoadLocationDB(path)
+	if err != nil {
+		log.Printf("Unable to load location db %s: %v\n", path, err)
+		return
+	}
+	locationDB = db
+}
+
+// Batch size for annotating NDT rows with the client geolocation from the
+// location database.  Negative disables the annotation, and zero annotates all
+// the rows of a task in a single batch.
+var annotationBatchSize = -1
+
+// setAnnotationBatchSize reads the batch size from NDT_ANNOTATION_BATCH_SIZE,
+// if set.
+func setAnnotationBatchSize() {
+	sizeString, ok := os.LookupEnv("NDT_ANNOTATION_BATCH_SIZE")
+	if !ok {
+		return
+	}
+	size, err := strconv.Atoi(sizeString)
+	if err != nil {
+		log.Printf("Invalid NDT_ANNOTATION_BATCH_SIZE: %s\n", sizeString)
+		return
+	}
+	annotationBatchSize = size
+}
+
+// Optional ID of this worker instance, added to each row.
+var workerID string
+
+// setWorkerID reads the worker ID from WORKER_ID, if set.  On AppEngine, this
+// may be set to the instance, e.g. from GAE_INSTANCE.
+func setWorkerID() {
+	workerID = os.Getenv("WORKER_ID")
+}
+
+// Optional limit on the total snapshots decoded per task.  Zero is unlimited.
+var snapshotBudget int
+
+// setSnapshotBudget reads the per task snapshot budget from SNAPSHOT_BUDGET.
+func setSnapshotBudget() {
+	budgetString, ok := os.LookupEnv("SNAPSHOT_BUDGET")
+	if !ok {
+		return
+	}
+	budget, err := strconv.Atoi(budgetString)
+	if err != nil {
+		log.Printf("Invalid SNAPSHOT_BUDGET: %s\n", budgetString)
+		return
+	}
+	snapshotBudget = budget
+}
+
+// Optional override of the per snaplog snapshot cap.  Zero is unlimited.
+var maxSnapshots *int
+
+// setMaxSnapshots reads the snapshot cap from MAX_SNAPSHOTS, if set.
+func setMaxSnapshots() {
+	maxString, ok := os.LookupEnv("MAX_SNAPSHOTS")
+	if !ok {
+		return
+	}
+	max, err := strconv.Atoi(maxString)
+	if err != nil {
+		log.Printf("Invalid MAX_SNAPSHOTS: %s\n", maxString)
+		return
+	}
+	maxSnapshots = &max
+}
+
+// Optional overrides of the snaplog size thresholds.  Zero means the default.
+var smallSnaplogSize, maxSnaplogSize int
+
+// setSnaplogSizes reads the snaplog size thresholds, in bytes, from
+// SMALL_SNAPLOG_SIZE and MAX_SNAPLOG_SIZE, if set.
+func setSnaplogSizes() {
+	for env, size := range map[string]*int{
+		"SMALL_SNAPLOG_SIZE": &smallSnaplogSize,
+		"MAX_SNAPLOG_SIZE":   &maxSnaplogSize,
+	} {
+		sizeString, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		value, err := strconv.Atoi(sizeString)
+		if err != nil || value <= 0 {
+			log.Printf("Invalid %s: %s\n", env, sizeString)
+			continue
+		}
+		*size = value
+	}
+}
+
+// Optional anonymizer for client addresses.  If nil, addresses are unmodified.
+var anonymizer *parser.IPAnonymizer
+
+// setupAnonymizer enables client address anonymization if ANONYMIZE_SALT is
+// set.  The salt should be unique to each run, so that client_ip_hash values
+// cannot be correlated across datasets.
+func setupAnonymizer() {
+	salt, ok := os.LookupEnv("ANONYMIZE_SALT")
+	if !ok || salt == "" {
+		return
+	}
+	anonymizer = parser.NewIPAnonymizer(salt)
+}
+
+// If true, DISCO rows store the original JSON in a raw column.
+var discoRawJSON bool
+
+// setDiscoRawJSON enables raw JSON DISCO rows if DISCO_RAW_JSON is true.
+func setDiscoRawJSON() {
+	value, ok := os.LookupEnv("DISCO_RAW_JSON")
+	if !ok {
+		return
+	}
+	raw, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid DISCO_RAW_JSON: %s\n", value)
+		return
+	}
+	discoRawJSON = raw
+}
+
+// If true, gzipped tests with a CRC or size mismatch are dropped.
+var strictGzip bool
+
+// setStrictGzip enables strict gzip checking if STRICT_GZIP is true.
+func setStrictGzip() {
+	value, ok := os.LookupEnv("STRICT_GZIP")
+	if !ok {
+		return
+	}
+	strict, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid STRICT_GZIP: %s\n", value)
+		return
+	}
+	strictGzip = strict
+}
+
+// Routing table mapping task paths to parsers and destination tables.
+var routingTable = etl.DefaultRoutingTable()
+
+// setupRoutingTable replaces the default routing table with the JSON list of
+// etl.Route in the file named by ROUTING_TABLE, if set.  An unreadable or
+// invalid table is fatal, rather than silently routing with the defaults.
+func setupRoutingTable() {
+	path, ok := os.LookupEnv("ROUTING_TABLE")
+	if !ok || path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Unable to read routing table %s: %v\n", path, err)
+	}
+	var routes []etl.Route
+	if err = json.Unmarshal(data, &routes); err != nil {
+		log.Fatalf("Invalid routing table %s: %v\n", path, err)
+	}
+	if len(routes) == 0 {
+		log.Fatalf("Routing table %s has no routes\n", path)
+	}
+	for _, r := range routes {
+		if _, ok := etl.DataTypeToTable[r.DataType]; !ok || r.DataType == etl.INVALID || r.Table == "" {
+			log.Fatalf("Invalid route in routing table %s: %+v\n", path, r)
+		}
+	}
+	routingTable = etl.NewRoutingTable(routes)
+}
+
+// Optional store of completed archives.  If nil, archives are always processed.
+var completionStore task.CompletionStore
+
+// setupCompletionStore enables skipping of already processed archives, if
+// COMPLETION_MARKER_BUCKET is set.
+func setupCompletionStore() {
+	bucket, ok := os.LookupEnv("COMPLETION_MARKER_BUCKET")
+	if !ok || bucket == "" {
+		return
+	}
+	client, err := storage.GetStorageClient(true, time.Minute)
+	if err != nil {
+		log.Printf("Unable to create marker client: %v\n", err)
+		return
+	}
+	store, err := storage.NewGCSCompletionStore(client, bucket)
+	if err != nil {
+		log.Printf("Unable to create completion store: %v\n", err)
+		return
+	}
+	completionStore = store
+}
+
 func main() {
 	// Define a custom serve mux for prometheus to listen on a separate port.
 	// We listen on a separate port so we can forward this port on the host VM.
@@ -276,14 +671,37 @@ func main() {
 	http.HandleFunc("/worker", metrics.DurationHandler("generic", worker))
 	http.HandleFunc("/_ah/health", healthCheckHandler)
 
+	// Flush the tasks in flight on SIGTERM, e.g. during deploys.
+	srv := &http.Server{Addr: ":8080"}
+	shutdownDone := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go handleShutdown(sigs, srv, shutdownDone)
+
 	// Enable block profiling
 	runtime.SetBlockProfileRate(1000000) // One event per msec.
 
 	setMaxInFlight()
+	loadCountryDB()
+	loadLocationDB()
+	setAnnotationBatchSize()
+	setupCompletionStore()
+	setSnapshotBudget()
+	setMaxSnapshots()
+	setSnaplogSizes()
+	setWorkerID()
+	setupAnonymizer()
+	setupRoutingTable()
+	setDiscoRawJSON()
+	setStrictGzip()
+	setupHealthCheck()
 
 	// We also setup another prometheus handler on a non-standard path. This
 	// path name will be accessible through the AppEngine service address,
 	// however it will be served by a random instance.
 	http.Handle("/random-metrics", promhttp.Handler())
-	http.ListenAndServe(":8080", nil)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
@@ -57,7 +57,9 @@ func main() {
 	snap.SnapshotValues(snapValues)
 
 	nestedConnSpec := make(schema.Web100ValueMap, 6)
-	snaplog.ConnectionSpecValues(nestedConnSpec)
+	if err := snaplog.ConnectionSpecValues(nestedConnSpec); err != nil {
+		fmt.Println("error:", err)
+	}
 
 	results := schema.NewWeb100MinimalRecord(
 		snaplog.Version, int64(snaplog.LogTime),
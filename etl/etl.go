@@ -12,6 +12,8 @@ import (
 // implemented by Parser.
 // RowStats implementations should provide the invariants:
 //   Accepted == Failed + Committed + RowsInBuffer
+// The counts cover the lifetime of the implementation.  The worker creates a
+// new Inserter and Parser for each task, so they are per task counts.
 type RowStats interface {
 	// RowsInBuffer returns the count of rows currently in the buffer.
 	RowsInBuffer() int
@@ -49,14 +51,29 @@ type Inserter interface {
 
 // Params for NewInserter
 type InserterParams struct {
-	// The project comes from os.GetEnv("GCLOUD_PROJECT")
-	// These specify the google cloud dataset/table to write to.
+	// If Project is empty, the project comes from os.GetEnv("GCLOUD_PROJECT")
+	// These specify the google cloud project/dataset/table to write to.
+	Project string
 	Dataset string
 	Table   string
 	// Suffix may be an actual _YYYYMMDD or partition $YYYYMMDD
 	Suffix     string        // Table name suffix for templated tables or partitions.
 	Timeout    time.Duration // max duration of backend calls.  (for context)
 	BufferSize int           // Number of rows to buffer before writing to backend.
+	// If non-zero, buffered rows are flushed after this much time without
+	// any new rows, so that a partial buffer is not held indefinitely.
+	FlushInterval time.Duration
+	// By default, invalid rows are skipped, and the valid rows committed.  If
+	// RejectInvalidRows is true, any invalid row fails the entire insert.
+	RejectInvalidRows bool
+	// If true, values that do not match the table schema are dropped, instead
+	// of making the row invalid.
+	IgnoreUnknownValues bool
+	// Number of times a failed insert is retried, if the error is transient,
+	// such as a 503, rate limit, or deadline.  Zero means no retries.
+	MaxRetries int
+	// Delay before the first retry.  The delay doubles on each further retry.
+	RetryBaseDelay time.Duration
 }
 
 type Parser interface {
@@ -65,6 +82,11 @@ type Parser interface {
 	// test - binary test data
 	ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error
 
+	// Finish processes any tests still cached by the parser, such as the
+	// last test group of an NDT archive, at the end of a task.  Stateless
+	// parsers may do nothing.
+	Finish() error
+
 	// Flush flushes any pending rows.
 	Flush() error
 
@@ -79,6 +101,13 @@ type Parser interface {
 	RowStats // Parser must implement RowStats
 }
 
+// SuffixCounter is optionally implemented by Parsers that count the test
+// files they receive by filename suffix, such as "meta", for the task summary.
+type SuffixCounter interface {
+	// SuffixCounts returns the number of files seen for each suffix.
+	SuffixCounts() map[string]int
+}
+
 //========================================================================
 // Interfaces to allow fakes.
 //========================================================================
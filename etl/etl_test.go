@@ -44,5 +44,10 @@ func TestValidation(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	data, err = etl.ValidateTestPath(
+		`gs://m-lab-sandbox/ndt/2016/07/14/20160714T000000Z-mlab1-lax04-ndt-0001.tar.xz`)
+	if err != nil {
+		t.Error(err)
+	}
 	fmt.Printf("%v\n", data)
 }
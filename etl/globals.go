@@ -10,7 +10,7 @@ const datePath = `(?P<datepath>\d{4}/[01]\d/[0123]\d)/`
 const dateTime = `(\d{4}[01]\d[0123]\d)T000000Z`
 const mlabN_podNN = `-(mlab\d)-([[:alpha:]]{3}\d[0-9t])-`
 const exp_NNNN = `(.*)-(\d{4})`
-const suffix = `(?:\.tar|\.tar.gz|\.tgz)$`
+const suffix = `(?:\.tar|\.tar.gz|\.tgz|\.tar.xz)$`
 const MlabDomain = `measurement-lab.org`
 
 // These are here to facilitate use across queue-pusher and parsing components.
@@ -49,7 +49,7 @@ func ValidateTestPath(path string) (*DataPath, error) {
 			return nil, errors.New("Path should begin with gs://.../.../: " + path)
 		}
 		if !endPattern.MatchString(path) {
-			return nil, errors.New("Path should end in .tar, .tgz, or .tar.gz: " + path)
+			return nil, errors.New("Path should end in .tar, .tgz, .tar.gz, or .tar.xz: " + path)
 		}
 		if !podPattern.MatchString(path) {
 			return nil, errors.New("Path should contain -mlabN-podNN: " + path)
@@ -0,0 +1,121 @@
+package etl
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Severity is the level of a structured log entry.
+type Severity int
+
+const (
+	LogInfo Severity = iota
+	LogWarning
+	LogError
+)
+
+var severityNames = [...]string{LogInfo: "INFO", LogWarning: "WARNING", LogError: "ERROR"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// LogSink receives each formatted log entry.  The default sink writes to the
+// standard logger.
+type LogSink func(severity Severity, entry string)
+
+var (
+	sinkMu sync.RWMutex
+	sink   LogSink = defaultSink
+)
+
+func defaultSink(severity Severity, entry string) {
+	log.Output(4, severity.String()+" "+entry)
+}
+
+// SetLogSink replaces the destination of structured log entries, e.g. with a
+// sink that calls the AppEngine context logger's Infof, Warningf and Errorf.
+// A nil sink restores the default.
+func SetLogSink(s LogSink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	if s == nil {
+		s = defaultSink
+	}
+	sink = s
+}
+
+// Logger writes structured log entries, each consisting of a message and
+// key/value fields, such as table, test_type, test_id, task_filename and
+// reason.  The zero Logger has no fields.
+type Logger struct {
+	fields []interface{}
+}
+
+// NewLogger creates a Logger that adds the given key/value pairs to every
+// entry.
+func NewLogger(kv ...interface{}) Logger {
+	return Logger{fields: kv}
+}
+
+// With returns a Logger that adds the given key/value pairs to those of l.
+func (l Logger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return Logger{fields: append(fields, kv...)}
+}
+
+// Info logs an informational entry.
+func (l Logger) Info(msg string, kv ...interface{}) {
+	l.output(LogInfo, msg, kv)
+}
+
+// Warning logs an entry for a problem that does not lose data.
+func (l Logger) Warning(msg string, kv ...interface{}) {
+	l.output(LogWarning, msg, kv)
+}
+
+// Error logs an entry for a problem that loses data.
+func (l Logger) Error(msg string, kv ...interface{}) {
+	l.output(LogError, msg, kv)
+}
+
+func (l Logger) output(severity Severity, msg string, kv []interface{}) {
+	entry := FormatLogEntry(msg, append(append([]interface{}{}, l.fields...), kv...)...)
+	sinkMu.RLock()
+	s := sink
+	sinkMu.RUnlock()
+	s(severity, entry)
+}
+
+// FormatLogEntry formats a message and key/value pairs as
+//   msg key=value key="quoted value"
+// A trailing key without a value is given the value MISSING.
+func FormatLogEntry(msg string, kv ...interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], quoteValue(fmt.Sprint(value)))
+	}
+	return b.String()
+}
+
+// quoteValue quotes values that are empty, or contain spaces, quotes, or '=',
+// so that entries can be split unambiguously.
+func quoteValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package etl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-lab/etl/etl"
+)
+
+func TestFormatLogEntry(t *testing.T) {
+	tests := []struct {
+		kv   []interface{}
+		want string
+	}{
+		{nil, "msg"},
+		{[]interface{}{"table", "ndt", "count", 3}, "msg table=ndt count=3"},
+		{[]interface{}{"reason", errors.New("bad data"), "test_id", ""}, `msg reason="bad data" test_id=""`},
+		{[]interface{}{"quote", `a"b`, "eq", "a=b"}, `msg quote="a\"b" eq="a=b"`},
+		{[]interface{}{"table"}, "msg table=MISSING"},
+	}
+	for _, test := range tests {
+		if got := etl.FormatLogEntry("msg", test.kv...); got != test.want {
+			t.Errorf("Got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	type entry struct {
+		severity etl.Severity
+		text     string
+	}
+	var entries []entry
+	etl.SetLogSink(func(severity etl.Severity, text string) {
+		entries = append(entries, entry{severity, text})
+	})
+	defer etl.SetLogSink(nil)
+
+	l := etl.NewLogger("table", "ndt")
+	l.Info("first")
+	l.With("test_type", "c2s").Warning("second", "reason", "x")
+	l.Error("third")
+	want := []entry{
+		{etl.LogInfo, "first table=ndt"},
+		{etl.LogWarning, "second table=ndt test_type=c2s reason=x"},
+		{etl.LogError, "third table=ndt"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Got %v, want %v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("Got %v, want %v", entries[i], want[i])
+		}
+	}
+	if etl.LogWarning.String() != "WARNING" {
+		t.Errorf("Got %s, want WARNING", etl.LogWarning)
+	}
+}
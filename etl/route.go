@@ -0,0 +1,71 @@
+package etl
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNoRoute is returned when no route matches a task path.
+var ErrNoRoute = errors.New("no route for path")
+
+// Route specifies the parser and BigQuery destination for archives under a
+// path prefix.  Empty Project and Dataset fields mean the worker defaults.
+type Route struct {
+	// Prefix is the object path prefix, excluding the bucket, such as "ndt"
+	// or "sandbox/switch".  It must match complete path segments.
+	Prefix   string
+	DataType DataType
+	Project  string
+	Dataset  string
+	Table    string
+}
+
+// RoutingTable maps path prefixes to Routes, so that a single worker can
+// handle every experiment type.
+type RoutingTable struct {
+	routes []Route // Sorted by decreasing prefix length.
+}
+
+// NewRoutingTable creates a RoutingTable from the given routes.  Where
+// prefixes overlap, the longest matching prefix is used.
+func NewRoutingTable(routes []Route) *RoutingTable {
+	rt := &RoutingTable{routes: append([]Route{}, routes...)}
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].Prefix) > len(rt.routes[j].Prefix)
+	})
+	return rt
+}
+
+// DefaultRoutingTable routes each of the DirToDataType directories to the
+// default table for its data type.
+func DefaultRoutingTable() *RoutingTable {
+	routes := make([]Route, 0, len(DirToDataType))
+	for dir, dt := range DirToDataType {
+		routes = append(routes, Route{Prefix: dir, DataType: dt, Table: DataTypeToTable[dt]})
+	}
+	// Sort for determinism, since map iteration order is random.
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Prefix < routes[j].Prefix })
+	return NewRoutingTable(routes)
+}
+
+// Route returns the route for a gs:// path, or ErrNoRoute if there is none.
+func (rt *RoutingTable) Route(path string) (*Route, error) {
+	if !strings.HasPrefix(path, "gs://") {
+		return nil, ErrNoRoute
+	}
+	// Strip the bucket.
+	parts := strings.SplitN(path[len("gs://"):], "/", 2)
+	if len(parts) != 2 {
+		return nil, ErrNoRoute
+	}
+	object := parts[1]
+	for i := range rt.routes {
+		prefix := strings.Trim(rt.routes[i].Prefix, "/")
+		if object == prefix || strings.HasPrefix(object, prefix+"/") {
+			r := rt.routes[i]
+			return &r, nil
+		}
+	}
+	return nil, ErrNoRoute
+}
@@ -0,0 +1,76 @@
+package etl_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/parser"
+)
+
+func TestDefaultRoutingTable(t *testing.T) {
+	rt := etl.DefaultRoutingTable()
+	tests := []struct {
+		path   string
+		dt     etl.DataType
+		table  string
+		parser interface{}
+	}{
+		{path: "gs://m-lab-sandbox/ndt/2016/01/26/20160126T000000Z-mlab1-prg01-ndt-0007.tgz",
+			dt: etl.NDT, table: "ndt", parser: &parser.NDTParser{}},
+		{path: "gs://m-lab-sandbox/paris-traceroute/2017/03/20/20170320T000000Z-mlab1-lax04-paris-traceroute-0000.tgz",
+			dt: etl.PT, table: "pt_test", parser: &parser.PTParser{}},
+		{path: "gs://m-lab-sandbox/switch/2017/05/01/20170501T000000Z-mlab1-vie01-switch-0000.tgz",
+			dt: etl.SW, table: "disco_test", parser: &parser.DiscoParser{}},
+		{path: "gs://m-lab-sandbox/sidestream/2017/05/01/20170501T000000Z-mlab1-vie01-sidestream-0000.tgz",
+			dt: etl.SS, table: "ss_test", parser: &parser.TestParser{}},
+	}
+	for _, test := range tests {
+		route, err := rt.Route(test.path)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if route.DataType != test.dt || route.Table != test.table {
+			t.Errorf("%s: got %s %s; want %s %s", test.path,
+				route.DataType, route.Table, test.dt, test.table)
+		}
+		p := parser.NewParser(route.DataType, nil)
+		if fmt.Sprintf("%T", p) != fmt.Sprintf("%T", test.parser) {
+			t.Errorf("%s: got parser %T; want %T", test.path, p, test.parser)
+		}
+	}
+
+	// Unrecognized paths are rejected.
+	for _, path := range []string{
+		"gs://m-lab-sandbox/unknown/2017/05/01/20170501T000000Z-mlab1-vie01-unknown-0000.tgz",
+		"gs://m-lab-sandbox/ndtx/2017/05/01/20170501T000000Z-mlab1-vie01-ndt-0000.tgz",
+		"m-lab-sandbox/ndt/2017/05/01/20170501T000000Z-mlab1-vie01-ndt-0000.tgz",
+	} {
+		if _, err := rt.Route(path); err != etl.ErrNoRoute {
+			t.Errorf("%s: expected ErrNoRoute, got %v", path, err)
+		}
+	}
+}
+
+func TestRoutingTableDestinations(t *testing.T) {
+	rt := etl.NewRoutingTable([]etl.Route{
+		{Prefix: "ndt", DataType: etl.NDT, Table: "ndt"},
+		{Prefix: "sandbox/ndt", DataType: etl.NDT, Project: "mlab-sandbox",
+			Dataset: "test", Table: "ndt_sandbox"},
+	})
+	route, err := rt.Route("gs://archive/sandbox/ndt/2017/05/01/20170501T000000Z-mlab1-vie01-ndt-0000.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Project != "mlab-sandbox" || route.Dataset != "test" || route.Table != "ndt_sandbox" {
+		t.Errorf("Longest prefix should win: %+v", route)
+	}
+	route, err = rt.Route("gs://archive/ndt/2017/05/01/20170501T000000Z-mlab1-vie01-ndt-0000.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Project != "" || route.Dataset != "" || route.Table != "ndt" {
+		t.Errorf("Wrong route: %+v", route)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"reflect"
 	"regexp"
 	"runtime/debug"
+	"sort"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
@@ -45,6 +47,11 @@ func bqTagParser(t reflect.StructTag) (name string, keep bool, other interface{}
 		if s == "-" {
 			return "", false, nil, nil
 		}
+		// Options, such as nullable, follow the name.
+		s = strings.Split(s, ",")[0]
+		if s == "" {
+			return "", true, nil, nil
+		}
 		if !validFieldName.MatchString(s) {
 			return "", false, nil, errInvalidFieldName
 		}
@@ -254,15 +261,30 @@ type FakeUploader struct {
 	IgnoreUnknownValues bool
 	TableTemplateSuffix string
 
+	// If non-nil, rows are checked for fields that are not in the schema,
+	// emulating the backend handling of SkipInvalidRows and IgnoreUnknownValues.
+	Schema bigquery.Schema
+
 	Rows    []*InsertionRow // Most recently inserted rows, for testing/debugging.
 	Request *bqv2.TableDataInsertAllRequest
 	Err     error
+
+	// Errors for rows in the most recent Put that the real uploader could not
+	// serialize, or, if Schema is set, that do not match the Schema.
+	ValidationErrors []error
 }
 
 func NewFakeUploader() etl.Uploader {
 	return new(FakeUploader)
 }
 
+// SetRowOptions sets the SkipInvalidRows and IgnoreUnknownValues options.
+// It is called by bq.NewBQInserter, using the InserterParams.
+func (u *FakeUploader) SetRowOptions(skipInvalidRows, ignoreUnknownValues bool) {
+	u.SkipInvalidRows = skipInvalidRows
+	u.IgnoreUnknownValues = ignoreUnknownValues
+}
+
 // Put uploads one or more rows to the BigQuery service.
 //
 // If src is ValueSaver, then its Save method is called to produce a row for uploading.
@@ -283,11 +305,13 @@ func NewFakeUploader() etl.Uploader {
 // the call will run indefinitely. Pass a context with a timeout to prevent
 // hanging calls.
 func (u *FakeUploader) Put(ctx context.Context, src interface{}) error {
+	u.ValidationErrors = nil
 	savers, err := valueSavers(src)
 	if err != nil {
 		log.Printf("Put: %v\n", err)
 		log.Printf("src: %v\n", src)
 		debug.PrintStack()
+		u.ValidationErrors = append(u.ValidationErrors, err)
 		return err
 	}
 	return u.putMulti(ctx, savers)
@@ -324,6 +348,14 @@ func valueSavers(src interface{}) ([]bigquery.ValueSaver, error) {
 // Make a ValueSaver from x, which must implement ValueSaver already
 // or be a struct or pointer to struct.
 func toValueSaver(x interface{}) (bigquery.ValueSaver, bool, error) {
+	// As in the real uploader, the schema of a StructSaver may be inferred.
+	if ss, ok := x.(*bigquery.StructSaver); ok && ss.Schema == nil {
+		schema, err := inferSchemaReflect(reflect.Indirect(reflect.ValueOf(ss.Struct)).Type())
+		if err != nil {
+			return nil, false, err
+		}
+		return &bigquery.StructSaver{Struct: ss.Struct, Schema: schema, InsertID: ss.InsertID}, true, nil
+	}
 	if saver, ok := x.(bigquery.ValueSaver); ok {
 		return saver, ok, nil
 	}
@@ -357,13 +389,133 @@ func (u *FakeUploader) putMulti(ctx context.Context, src []bigquery.ValueSaver)
 		rows = append(rows, &InsertionRow{InsertID: insertID, Row: row})
 	}
 
-	u.Rows = rows
+	// The real uploader fails the whole request if any row cannot be
+	// converted to JSON.
+	for i, row := range rows {
+		if err := checkSerializable(row.Row); err != nil {
+			u.ValidationErrors = append(u.ValidationErrors, fmt.Errorf("row %d: %v", i, err))
+		}
+	}
+	if len(u.ValidationErrors) > 0 {
+		u.Rows = nil
+		return u.ValidationErrors[0]
+	}
 
 	// Substitute for service call.
-	u.Request, u.Err = insertRows(rows)
+	u.Request, u.Err = insertRows(rows, u.SkipInvalidRows, u.IgnoreUnknownValues)
+	if u.Schema == nil {
+		u.Rows = rows
+		return nil
+	}
+	var pme bigquery.PutMultiError
+	u.Rows, pme = u.validateRows(rows)
+	if len(pme) > 0 {
+		for i := range pme {
+			u.ValidationErrors = append(u.ValidationErrors, &pme[i])
+		}
+		return pme
+	}
 	return nil
 }
 
+// validateRows emulates the backend validation of rows against the Schema.
+// It returns the rows that would be committed, and an error for each row that
+// would fail.
+func (u *FakeUploader) validateRows(rows []*InsertionRow) ([]*InsertionRow, bigquery.PutMultiError) {
+	known := make(map[string]bool, len(u.Schema))
+	for _, field := range u.Schema {
+		known[field.Name] = true
+	}
+
+	var valid []*InsertionRow
+	var pme bigquery.PutMultiError
+	for i, row := range rows {
+		filtered := make(map[string]bigquery.Value, len(row.Row))
+		for k, v := range row.Row {
+			if known[k] {
+				filtered[k] = v
+			}
+		}
+		if location, message := checkRecord(u.Schema, row.Row, u.IgnoreUnknownValues); message != "" {
+			pme = append(pme, bigquery.RowInsertionError{InsertID: row.InsertID, RowIndex: i,
+				Errors: bigquery.MultiError{&bigquery.Error{
+					Location: location, Message: message, Reason: "invalid"}}})
+			continue
+		}
+		valid = append(valid, &InsertionRow{InsertID: row.InsertID, Row: filtered})
+	}
+	if len(pme) > 0 && !u.SkipInvalidRows {
+		// Without SkipInvalidRows, the backend rejects every row in the request.
+		invalid := make(map[int]bool, len(pme))
+		for _, rie := range pme {
+			invalid[rie.RowIndex] = true
+		}
+		for i, row := range rows {
+			if !invalid[i] {
+				pme = append(pme, bigquery.RowInsertionError{InsertID: row.InsertID, RowIndex: i,
+					Errors: bigquery.MultiError{&bigquery.Error{
+						Message: "stopped due to invalid rows", Reason: "stopped"}}})
+			}
+		}
+		return nil, pme
+	}
+	return valid, pme
+}
+
+// checkSerializable returns an error if v, or any value nested in v, has a
+// type that the real uploader could not convert to JSON.  Structs must have a
+// schema that can be inferred.
+func checkSerializable(v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	switch v.(type) {
+	case time.Time, civil.Date, civil.Time, civil.DateTime, []byte:
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if isSupportedIntType(rv.Type()) {
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64, reflect.Uint64:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return checkSerializable(rv.Elem().Interface())
+	case reflect.Struct:
+		_, err := inferSchemaReflectCached(rv.Type())
+		return err
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := checkSerializable(rv.Index(i).Interface()); err != nil {
+				return fmt.Errorf("[%d]: %v", i, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", rv.Type().Key())
+		}
+		// Sort for a deterministic error.
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value := rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()))
+			if err := checkSerializable(value.Interface()); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported type %T", v)
+}
+
 // An InsertionRow represents a row of data to be inserted into a table.
 type InsertionRow struct {
 	// If InsertID is non-empty, BigQuery will use it to de-duplicate insertions of
@@ -376,8 +528,11 @@ type InsertionRow struct {
 //---------------------------------------------------------------------------------------
 // Stuff from service.go
 //---------------------------------------------------------------------------------------
-func insertRows(rows []*InsertionRow) (*bqv2.TableDataInsertAllRequest, error) {
-	req := &bqv2.TableDataInsertAllRequest{}
+func insertRows(rows []*InsertionRow, skipInvalidRows, ignoreUnknownValues bool) (*bqv2.TableDataInsertAllRequest, error) {
+	req := &bqv2.TableDataInsertAllRequest{
+		SkipInvalidRows:     skipInvalidRows,
+		IgnoreUnknownValues: ignoreUnknownValues,
+	}
 	for _, row := range rows {
 		m := make(map[string]bqv2.JsonValue)
 		for k, v := range row.Row {
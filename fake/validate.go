@@ -0,0 +1,149 @@
+package fake
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+)
+
+// NewValidatingInserter creates an inserter that checks each row against the
+// schema, in the same way as the backend, but does not upload anything.  Rows
+// that match the schema are counted as Committed, and those that do not as
+// Failed, with the mismatches logged and counted in metrics.
+func NewValidatingInserter(params etl.InserterParams, schema bigquery.Schema) (etl.Inserter, error) {
+	uploader := NewFakeUploader().(*FakeUploader)
+	uploader.Schema = schema
+	return bq.NewBQInserter(params, uploader)
+}
+
+// checkRecord returns the location and message of the first value in record
+// that does not match the schema, or "", "" if all values match.  Fields with
+// no Type in the schema are not type checked.
+func checkRecord(schema bigquery.Schema, record map[string]bigquery.Value, ignoreUnknown bool) (string, string) {
+	known := make(map[string]bool, len(schema))
+	for _, field := range schema {
+		known[field.Name] = true
+		v, ok := record[field.Name]
+		if !ok || v == nil {
+			if field.Required {
+				return field.Name, "missing required field"
+			}
+			continue
+		}
+		if location, message := checkField(field, v, ignoreUnknown); message != "" {
+			return location, message
+		}
+	}
+	if !ignoreUnknown {
+		// Sort for a deterministic location.
+		unknown := []string{}
+		for k := range record {
+			if !known[k] {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return unknown[0], "no such field"
+		}
+	}
+	return "", ""
+}
+
+// checkField checks a single, non-nil value against the field schema.
+func checkField(field *bigquery.FieldSchema, v bigquery.Value, ignoreUnknown bool) (string, string) {
+	if !field.Repeated {
+		return checkValue(field, v, ignoreUnknown)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return field.Name, "array specified for non-repeated field"
+	}
+	for i := 0; i < rv.Len(); i++ {
+		location, message := checkValue(field, rv.Index(i).Interface(), ignoreUnknown)
+		if message != "" {
+			// Insert the index after the field name.
+			return field.Name + "[" + strconv.Itoa(i) + "]" +
+				strings.TrimPrefix(location, field.Name), message
+		}
+	}
+	return "", ""
+}
+
+// checkValue checks a single, non-repeated, value against the field type.
+func checkValue(field *bigquery.FieldSchema, v bigquery.Value, ignoreUnknown bool) (string, string) {
+	ok := true
+	switch field.Type {
+	case "":
+		// Untyped fields accept anything.
+	case bigquery.RecordFieldType:
+		record, isRecord := toRecord(v)
+		if !isRecord {
+			return field.Name, "This field is not a record."
+		}
+		location, message := checkRecord(field.Schema, record, ignoreUnknown)
+		if message != "" {
+			return field.Name + "." + location, message
+		}
+	case bigquery.StringFieldType:
+		_, ok = v.(string)
+	case bigquery.IntegerFieldType:
+		switch x := v.(type) {
+		case string:
+			_, err := strconv.ParseInt(x, 10, 64)
+			ok = err == nil
+		default:
+			ok = isSupportedIntType(reflect.TypeOf(v)) || reflect.TypeOf(v).Kind() == reflect.Uint64
+		}
+	case bigquery.FloatFieldType:
+		switch reflect.TypeOf(v).Kind() {
+		case reflect.Float32, reflect.Float64:
+		default:
+			ok = isSupportedIntType(reflect.TypeOf(v))
+		}
+	case bigquery.BooleanFieldType:
+		_, ok = v.(bool)
+	case bigquery.TimestampFieldType, bigquery.DateFieldType,
+		bigquery.TimeFieldType, bigquery.DateTimeFieldType:
+		switch v.(type) {
+		case string, time.Time, civil.Date, civil.Time, civil.DateTime:
+		default:
+			ok = field.Type == bigquery.TimestampFieldType && isSupportedIntType(reflect.TypeOf(v))
+		}
+	case bigquery.BytesFieldType:
+		switch v.(type) {
+		case []byte, string:
+		default:
+			ok = false
+		}
+	}
+	if !ok {
+		return field.Name, "Cannot convert value to " + string(field.Type) + "."
+	}
+	return "", ""
+}
+
+// toRecord returns v as a map, if it is a map keyed by strings, such as
+// schema.Web100ValueMap.
+func toRecord(v bigquery.Value) (map[string]bigquery.Value, bool) {
+	if m, ok := v.(map[string]bigquery.Value); ok {
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]bigquery.Value, rv.Len())
+	for _, k := range rv.MapKeys() {
+		m[k.String()] = rv.MapIndex(k).Interface()
+	}
+	return m, true
+}
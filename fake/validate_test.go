@@ -0,0 +1,133 @@
+package fake_test
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/fake"
+	"github.com/m-lab/etl/schema"
+)
+
+func TestValidatingInserter(t *testing.T) {
+	s := bigquery.Schema{
+		{Name: "test_id", Type: bigquery.StringFieldType, Required: true},
+		{Name: "log_time", Type: bigquery.TimestampFieldType},
+		{Name: "rtt", Type: bigquery.FloatFieldType, Repeated: true},
+		{Name: "connection_spec", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "client_ip", Type: bigquery.StringFieldType},
+			{Name: "client_af", Type: bigquery.IntegerFieldType},
+		}},
+	}
+	tests := []struct {
+		row   map[string]bigquery.Value
+		valid bool
+	}{
+		{map[string]bigquery.Value{"test_id": "a", "log_time": time.Now(), "rtt": []float64{1.5, 2},
+			"connection_spec": schema.Web100ValueMap{"client_ip": "1.2.3.4", "client_af": int64(2)}}, true},
+		{map[string]bigquery.Value{"test_id": "b", "log_time": "2017-05-09T13:45:13Z", "rtt": []interface{}{3}}, true},
+		// Missing required field.
+		{map[string]bigquery.Value{"log_time": time.Now()}, false},
+		// Wrong types.
+		{map[string]bigquery.Value{"test_id": 1}, false},
+		{map[string]bigquery.Value{"test_id": "c", "rtt": 1.5}, false},
+		{map[string]bigquery.Value{"test_id": "d", "rtt": []interface{}{"x"}}, false},
+		{map[string]bigquery.Value{"test_id": "e", "connection_spec": "1.2.3.4"}, false},
+		{map[string]bigquery.Value{"test_id": "f",
+			"connection_spec": schema.Web100ValueMap{"client_af": "IPv4"}}, false},
+		// Unknown fields, top level and nested.
+		{map[string]bigquery.Value{"test_id": "g", "extra": 1}, false},
+		{map[string]bigquery.Value{"test_id": "h",
+			"connection_spec": schema.Web100ValueMap{"client_port": int64(80)}}, false},
+	}
+
+	for i, test := range tests {
+		ins, err := fake.NewValidatingInserter(etl.InserterParams{
+			Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 10}, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ins.InsertRow(&bq.MapSaver{Values: test.row})
+		if err := ins.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if test.valid && (ins.Committed() != 1 || ins.Failed() != 0) {
+			t.Errorf("%d: expected valid row: %v", i, test.row)
+		}
+		if !test.valid && (ins.Committed() != 0 || ins.Failed() != 1) {
+			t.Errorf("%d: expected invalid row: %v", i, test.row)
+		}
+	}
+}
+
+func TestStructRows(t *testing.T) {
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	ins, err := bq.NewBQInserter(etl.InserterParams{
+		Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tag options, such as nullable, must not be mistaken for field names.
+	ins.InsertRow(schema.PT{Test_id: "a", Paris_traceroute_hop: schema.ParisTracerouteHop{
+		Dest_geolocation: &schema.GeolocationIP{City: "Vienna"}}})
+	if err := ins.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ins.Committed() != 1 || len(uploader.Rows) != 1 {
+		t.Fatalf("Expected 1 row, committed %d", ins.Committed())
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	ins, err := bq.NewBQInserter(etl.InserterParams{
+		Dataset: "dataset", Table: "table", Timeout: time.Minute, BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value that cannot be converted to JSON rejects the whole request.
+	ins.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "ok"}})
+	ins.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{
+		"spec": schema.Web100ValueMap{"bad": make(chan int)}}})
+	ins.Flush()
+	if len(uploader.ValidationErrors) != 1 {
+		t.Fatalf("Expected 1 validation error, got %v", uploader.ValidationErrors)
+	}
+	if msg := uploader.ValidationErrors[0].Error(); msg != "row 1: spec: bad: unsupported type chan int" {
+		t.Error("Wrong error:", msg)
+	}
+	if ins.Committed() != 0 || ins.Failed() != 2 || len(uploader.Rows) != 0 {
+		t.Errorf("Expected 2 failed rows, committed %d, failed %d", ins.Committed(), ins.Failed())
+	}
+
+	// So does a struct with an unsupported field type.
+	ins.InsertRow(struct{ Value complex128 }{})
+	ins.Flush()
+	if len(uploader.ValidationErrors) != 1 {
+		t.Errorf("Expected 1 validation error, got %v", uploader.ValidationErrors)
+	}
+
+	// Schema mismatches are recorded for each invalid row.
+	uploader.Schema = bigquery.Schema{{Name: "name", Type: bigquery.StringFieldType}}
+	ins.InsertRows([]interface{}{
+		&bq.MapSaver{Values: map[string]bigquery.Value{"name": 1}},
+		&bq.MapSaver{Values: map[string]bigquery.Value{"name": "ok"}},
+		&bq.MapSaver{Values: map[string]bigquery.Value{"name": true}},
+	})
+	ins.Flush()
+	if len(uploader.ValidationErrors) != 2 || len(uploader.Rows) != 1 {
+		t.Errorf("Expected 2 validation errors and 1 row, got %v, %d",
+			uploader.ValidationErrors, len(uploader.Rows))
+	}
+
+	// Errors are only kept for the most recent Put.
+	ins.InsertRow(&bq.MapSaver{Values: map[string]bigquery.Value{"name": "ok"}})
+	ins.Flush()
+	if len(uploader.ValidationErrors) != 0 {
+		t.Errorf("Unexpected validation errors %v", uploader.ValidationErrors)
+	}
+}
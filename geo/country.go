@@ -0,0 +1,115 @@
+// The geo package provides lightweight IP geolocation lookups used to
+// annotate test rows.
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ipRange is a contiguous range of addresses, in 16 byte form, that map to a
+// single country.
+type ipRange struct {
+	first   net.IP
+	last    net.IP
+	country string
+}
+
+// CountryDB maps IPv4 and IPv6 addresses to ISO 3166 country codes.
+// It is safe for concurrent use once loaded.
+type CountryDB struct {
+	ranges []ipRange // Sorted by first address.
+}
+
+// NewCountryDB reads a country database from r.  Each line contains a CIDR
+// network and a country code, separated by a comma, e.g.
+//   1.0.0.0/24,AU
+//   2001:200::/32,JP
+// Blank lines, lines beginning with #, and a leading "network,..." header line
+// are ignored.
+func NewCountryDB(r io.Reader) (*CountryDB, error) {
+	db := &CountryDB{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "network,") {
+			continue
+		}
+		parts := strings.Split(line, ",")
+		if len(parts) < 2 {
+			return nil, errors.New("malformed country db line: " + line)
+		}
+		first, last, err := cidrRange(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		db.ranges = append(db.ranges,
+			ipRange{first, last, strings.TrimSpace(parts[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(byFirst(db.ranges))
+	return db, nil
+}
+
+// cidrRange returns the first and last addresses, in 16 byte form, of the
+// CIDR network.
+func cidrRange(cidr string) (net.IP, net.IP, error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, nil, err
+	}
+	first := network.IP.To16()
+	last := make(net.IP, len(first))
+	copy(last, first)
+	// Set all host bits.  For IPv4, the mask is only 4 bytes long and
+	// applies to the trailing bytes of the 16 byte form.
+	offset := len(last) - len(network.Mask)
+	for i := range network.Mask {
+		last[offset+i] |= ^network.Mask[i]
+	}
+	return first, last, nil
+}
+
+// LoadCountryDB reads a country database from the named file.
+func LoadCountryDB(path string) (*CountryDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewCountryDB(f)
+}
+
+// CountryCode returns the country code for the given IP address, and true, or
+// "", false if the address is invalid or not in the database.
+func (db *CountryDB) CountryCode(ipString string) (string, bool) {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return "", false
+	}
+	ip = ip.To16()
+	// Find the last range that starts at or before ip.
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].first, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].last) > 0 {
+		return "", false
+	}
+	return db.ranges[i].country, true
+}
+
+type byFirst []ipRange
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].first, r[j].first) < 0 }
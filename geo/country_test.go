@@ -0,0 +1,57 @@
+package geo_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/m-lab/etl/geo"
+)
+
+const testCountryDB = `network,country_code
+# Comments are ignored.
+45.56.96.0/20,US
+213.208.128.0/19,AT
+2001:200::/32,JP
+2a00:1450::/32,IE
+`
+
+func TestCountryCode(t *testing.T) {
+	db, err := geo.NewCountryDB(strings.NewReader(testCountryDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		country string
+		ok      bool
+	}{
+		{"45.56.98.222", "US", true},
+		{"45.56.96.0", "US", true},
+		{"45.56.111.255", "US", true},
+		{"45.56.112.0", "", false},
+		{"213.208.152.37", "AT", true},
+		{"2001:200::1", "JP", true},
+		{"2001:200:ffff:ffff::1", "JP", true},
+		{"2001:201::1", "", false},
+		{"2a00:1450:4001:80b::200e", "IE", true},
+		{"8.8.8.8", "", false},
+		{"not an ip", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		country, ok := db.CountryCode(test.ip)
+		if country != test.country || ok != test.ok {
+			t.Errorf("CountryCode(%q): got %q, %v; want %q, %v",
+				test.ip, country, ok, test.country, test.ok)
+		}
+	}
+}
+
+func TestNewCountryDBErrors(t *testing.T) {
+	if _, err := geo.NewCountryDB(strings.NewReader("1.2.3.0/24\n")); err == nil {
+		t.Error("Expected error for missing country")
+	}
+	if _, err := geo.NewCountryDB(strings.NewReader("1.2.3.0/33,US\n")); err == nil {
+		t.Error("Expected error for bad network")
+	}
+}
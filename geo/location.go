@@ -0,0 +1,148 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/etl/schema"
+)
+
+// locationRange is a contiguous range of addresses, in 16 byte form, that map
+// to a single location.
+type locationRange struct {
+	first    net.IP
+	last     net.IP
+	location *schema.GeolocationIP
+}
+
+// LocationDB maps IPv4 and IPv6 addresses to full geolocation records.
+// It is safe for concurrent use once loaded.
+type LocationDB struct {
+	ranges []locationRange // Sorted by first address.
+}
+
+// NewLocationDB reads a location database from r.  The data is CSV, in the
+// style of the MaxMind city blocks files, with the locations already joined.
+// The first record is a header naming the columns, which must include
+// "network".  The other recognized columns are the GeolocationIP column
+// names, e.g.
+//   network,country_code,city,latitude,longitude
+//   45.56.96.0/20,US,"New York",40.7,-74.0
+// Unrecognized columns are ignored, and lines beginning with # are comments.
+func NewLocationDB(r io.Reader) (*LocationDB, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("location db has no header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["network"]; !ok {
+		return nil, errors.New("location db header has no network column")
+	}
+
+	db := &LocationDB{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		first, last, err := cidrRange(field("network"))
+		if err != nil {
+			return nil, err
+		}
+		loc := &schema.GeolocationIP{
+			ContinentCode: field("continent_code"),
+			CountryCode:   field("country_code"),
+			CountryCode3:  field("country_code3"),
+			CountryName:   field("country_name"),
+			Region:        field("region"),
+			City:          field("city"),
+			PostalCode:    field("postal_code"),
+		}
+		// Numeric fields are often blank, which leaves them zero.
+		if loc.MetroCode, err = parseInt(field("metro_code")); err != nil {
+			return nil, err
+		}
+		if loc.AreaCode, err = parseInt(field("area_code")); err != nil {
+			return nil, err
+		}
+		if loc.Latitude, err = parseFloat(field("latitude")); err != nil {
+			return nil, err
+		}
+		if loc.Longitude, err = parseFloat(field("longitude")); err != nil {
+			return nil, err
+		}
+		db.ranges = append(db.ranges, locationRange{first, last, loc})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].first, db.ranges[j].first) < 0
+	})
+	return db, nil
+}
+
+func parseInt(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func parseFloat(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// LoadLocationDB reads a location database from the named file.
+func LoadLocationDB(path string) (*LocationDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewLocationDB(f)
+}
+
+// Location returns a copy of the location for the given IP address, and true,
+// or nil, false if the address is invalid or not in the database.
+func (db *LocationDB) Location(ipString string) (*schema.GeolocationIP, bool) {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return nil, false
+	}
+	ip = ip.To16()
+	// Find the last range that starts at or before ip.
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].first, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].last) > 0 {
+		return nil, false
+	}
+	loc := *db.ranges[i].location
+	return &loc, true
+}
@@ -0,0 +1,66 @@
+package geo_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/m-lab/etl/geo"
+)
+
+const testLocationDB = `network,continent_code,country_code,city,metro_code,latitude,longitude,unused
+# Comments are ignored.
+45.56.96.0/20,NA,US,"Newark, NJ",501,40.7357,-74.1724,x
+213.208.128.0/19,EU,AT,Vienna,,48.2,16.3667,
+2001:200::/32,AS,JP,,,35.69,139.69,
+`
+
+func TestLocation(t *testing.T) {
+	db, err := geo.NewLocationDB(strings.NewReader(testLocationDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := db.Location("45.56.98.222")
+	if !ok {
+		t.Fatal("Expected location for 45.56.98.222")
+	}
+	if loc.ContinentCode != "NA" || loc.CountryCode != "US" ||
+		loc.City != "Newark, NJ" || loc.MetroCode != 501 ||
+		loc.Latitude != 40.7357 || loc.Longitude != -74.1724 {
+		t.Errorf("Wrong location: %+v", *loc)
+	}
+	// Changes to the result must not affect the database.
+	loc.City = "Elsewhere"
+	if loc, _ = db.Location("45.56.96.1"); loc.City != "Newark, NJ" {
+		t.Errorf("Database modified through result: %+v", *loc)
+	}
+
+	loc, ok = db.Location("213.208.152.37")
+	if !ok || loc.CountryCode != "AT" || loc.MetroCode != 0 {
+		t.Errorf("Wrong location for 213.208.152.37: %+v, %v", loc, ok)
+	}
+	loc, ok = db.Location("2001:200::1")
+	if !ok || loc.CountryCode != "JP" || loc.City != "" {
+		t.Errorf("Wrong location for 2001:200::1: %+v, %v", loc, ok)
+	}
+
+	for _, ip := range []string{"45.56.112.0", "8.8.8.8", "2001:201::1", "not an ip", ""} {
+		if loc, ok := db.Location(ip); ok || loc != nil {
+			t.Errorf("Location(%q): got %+v, %v; want nil, false", ip, loc, ok)
+		}
+	}
+}
+
+func TestNewLocationDBErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"country_code\nUS\n",
+		"network,country_code\n1.2.3.0/33,US\n",
+		"network,latitude\n1.2.3.0/24,north\n",
+		"network,metro_code\n1.2.3.0/24,1.5\n",
+	}
+	for _, data := range bad {
+		if _, err := geo.NewLocationDB(strings.NewReader(data)); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
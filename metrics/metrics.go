@@ -26,13 +26,16 @@ func init() {
 	prometheus.MustRegister(ErrorCount)
 	prometheus.MustRegister(WarningCount)
 	prometheus.MustRegister(BackendFailureCount)
+	prometheus.MustRegister(SnapLayoutCount)
 	prometheus.MustRegister(GCSRetryCount)
 	prometheus.MustRegister(BigQueryInsert)
 	prometheus.MustRegister(RowSizeHistogram)
 	prometheus.MustRegister(DeltaNumFieldsHistogram)
 	prometheus.MustRegister(EntryFieldCountHistogram)
+	prometheus.MustRegister(SnapCountHistogram)
 	prometheus.MustRegister(DurationHistogram)
 	prometheus.MustRegister(InsertionHistogram)
+	prometheus.MustRegister(ParseDuration)
 	prometheus.MustRegister(FileSizeHistogram)
 }
 
@@ -160,6 +163,25 @@ var (
 		[]string{"table", "filetype", "kind"},
 	)
 
+	// Counts the snaplog variables that are not in the snap schema, and the
+	// schema fields that are missing from snaplogs, by field name.  These give
+	// early warning of a change in the web100 layout.  Extra names that are
+	// not valid variable names are counted as "invalid", and those beyond a
+	// fixed number of distinct names as "other".
+	//
+	// Provides metrics:
+	//   etl_web100_layout_count{table, kind, field}
+	// Example usage:
+	//   metrics.SnapLayoutCount.WithLabelValues(TableName(), "extra", "NewVar").Inc()
+	SnapLayoutCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_web100_layout_count",
+			Help: "Snaplog variables that differ from the snap schema.",
+		},
+		// extra/missing, field name.
+		[]string{"table", "kind", "field"},
+	)
+
 	// Counts the all bulk backend failures.  This does not count, e.g.
 	// single row errors.
 	//
@@ -281,6 +303,30 @@ var (
 		[]string{"table"},
 	)
 
+	// A histogram of snapshot counts per test, before any truncation.  It is
+	// intended for NDT, to tune MAX_NUM_SNAPSHOTS.  A 10 second test, with
+	// snapshots every 10 msec, has about 1000 snapshots.
+	//
+	// Provides metrics:
+	//   etl_snap_count_bucket{table="...", le="..."}
+	//   ...
+	//   etl_snap_count_sum{table="...", le="..."}
+	//   etl_snap_count_count{table="...", le="..."}
+	// Usage example:
+	//   metrics.SnapCountHistogram.WithLabelValues(
+	//           "ndt").Observe(snapCount)
+	SnapCountHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_snap_count",
+			Help: "Number of snapshots per test distribution.",
+			Buckets: []float64{0, 1, 10, 100, 200, 400, 600, 800, 900,
+				1000, 1100, 1200, 1400, 1600, 1800, 2000, 2400, 2800,
+				3200, 4000, 5000, 6000, 8000, 10000, 20000, 50000,
+			},
+		},
+		[]string{"table"},
+	)
+
 	// A histogram of bigquery insertion times. The buckets should use
 	// periods that are intuitive for people.
 	//
@@ -307,6 +353,32 @@ var (
 		[]string{"table", "status"},
 	)
 
+	// A histogram of parse times for individual tests, by test type, to show
+	// which test types dominate processing time.
+	//
+	// Provides metrics:
+	//   etl_parse_duration_seconds_bucket{table="...", type="...", le="..."}
+	//   ...
+	//   etl_parse_duration_seconds_sum{table="...", type="..."}
+	//   etl_parse_duration_seconds_count{table="...", type="..."}
+	// Usage example:
+	//   t := time.Now()
+	//   // parse and insert a test.
+	//   metrics.ParseDuration.WithLabelValues(
+	//           "ndt", "s2c").Observe(time.Since(t).Seconds())
+	ParseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_parse_duration_seconds",
+			Help: "Per test parse time distributions.",
+			Buckets: []float64{
+				0.0001, 0.0003, 0.001, 0.003, 0.01, 0.03, 0.1, 0.2, 0.5,
+				1.0, 2.0, 5.0, 10.0, 30.0, math.Inf(+1),
+			},
+		},
+		// Test type, e.g. c2s, s2c, meta, disco, pt.
+		[]string{"table", "type"},
+	)
+
 	// A histogram of worker processing times. The buckets should use
 	// periods that are intuitive for people.
 	//
@@ -341,6 +413,15 @@ var (
 			Help: "Size of individual snaplog files.",
 			Buckets: []float64{
 				0,
+				1024,       // 1k
+				4095,       // Isolates snaplogs truncated to exactly 4k.
+				4096,       // 4k
+				8192,       // 8k
+				16384,      // 16k
+				32768,      // 32k
+				65536,      // 64k
+				131072,     // 128k
+				262144,     // 256k
 				400000,     // 400k
 				500000,     // 500k
 				600000,     // 600k
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// IPAnonymizer masks client IP addresses, and produces a salted hash of the
+// full address, so that distinct clients can still be counted.  The salt
+// should be configured per run, so that hashes cannot be joined across
+// datasets.
+type IPAnonymizer struct {
+	salt []byte
+}
+
+// NewIPAnonymizer creates an IPAnonymizer using the given salt.
+func NewIPAnonymizer(salt string) *IPAnonymizer {
+	return &IPAnonymizer{salt: []byte(salt)}
+}
+
+var (
+	ipv4Mask = net.CIDRMask(24, 32)
+	ipv6Mask = net.CIDRMask(64, 128)
+)
+
+// Mask returns the address with the host portion zeroed, keeping the /24 for
+// IPv4 and the /64 for IPv6.  Unparseable addresses are returned as "".
+func (a *IPAnonymizer) Mask(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(ipv4Mask).String()
+	}
+	return addr.Mask(ipv6Mask).String()
+}
+
+// Hash returns the hex encoded HMAC-SHA256 of the address, keyed by the salt.
+// The address is canonicalized first, so equivalent forms hash the same.
+func (a *IPAnonymizer) Hash(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil {
+		ip = addr.String()
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashName replaces the first occurrence of the client address in a test file
+// name with its Hash, so that the name still distinguishes tests, but no longer
+// identifies the client.  The name is unchanged if address is empty.
+func (a *IPAnonymizer) HashName(name, address string) string {
+	if address == "" {
+		return name
+	}
+	return strings.Replace(name, address, a.Hash(address), 1)
+}
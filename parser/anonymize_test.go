@@ -0,0 +1,57 @@
+package parser_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl/parser"
+)
+
+func TestIPAnonymizerMask(t *testing.T) {
+	a := parser.NewIPAnonymizer("salt")
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "45.56.98.222", want: "45.56.98.0"},
+		{ip: "::ffff:45.56.98.222", want: "45.56.98.0"},
+		{ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::"},
+		{ip: "not an ip", want: ""},
+	}
+	for _, test := range tests {
+		if got := a.Mask(test.ip); got != test.want {
+			t.Errorf("Mask(%q) = %q; want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestIPAnonymizerHash(t *testing.T) {
+	a := parser.NewIPAnonymizer("salt")
+	h := a.Hash("45.56.98.222")
+	if len(h) != 64 {
+		t.Errorf("Wrong hash length: %q", h)
+	}
+	if parser.NewIPAnonymizer("salt").Hash("45.56.98.222") != h {
+		t.Error("Hash should be stable for the same ip and salt")
+	}
+	if a.Hash("::ffff:45.56.98.222") != h {
+		t.Error("Equivalent addresses should have the same hash")
+	}
+	if a.Hash("45.56.98.223") == h {
+		t.Error("Different addresses should have different hashes")
+	}
+	if parser.NewIPAnonymizer("pepper").Hash("45.56.98.222") == h {
+		t.Error("Different salts should produce different hashes")
+	}
+}
+
+func TestIPAnonymizerHashName(t *testing.T) {
+	a := parser.NewIPAnonymizer("salt")
+	name := "20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace"
+	want := "20170509T13:45:13.590210000Z_" + a.Hash("45.56.98.222") + ".c2s_ndttrace"
+	if got := a.HashName(name, "45.56.98.222"); got != want {
+		t.Errorf("HashName(%q) = %q; want %q", name, got, want)
+	}
+	if got := a.HashName(name, ""); got != name {
+		t.Errorf("HashName with no address changed the name: %q", got)
+	}
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/geo"
+	"github.com/m-lab/etl/schema"
+)
+
+// BatchAnnotator annotates many connection specs in one call, so that the cost
+// of a remote lookup service can be shared by all the rows of a task.
+type BatchAnnotator interface {
+	// AnnotateBatch adds fields to specs[i] for the client address ips[i].
+	// Addresses that are not found should be left unannotated.
+	AnnotateBatch(ips []string, specs []schema.Web100ValueMap)
+}
+
+// BatchAnnotatingInserter holds rows until Flush, or until batchSize rows are
+// pending, then annotates their connection specs with a single BatchAnnotator
+// call, and passes them to the wrapped Inserter.  Rows without a
+// connection_spec.client_ip are passed through unannotated.
+//
+// The annotator sees the addresses as inserted, so a parser that anonymizes
+// client addresses must leave that to the afterAnnotate function.  See
+// NDTParser.SetBatchAnnotator.
+type BatchAnnotatingInserter struct {
+	etl.Inserter
+	annotator BatchAnnotator
+	batchSize int
+	pending   []interface{}
+	// Optional function applied to the values of each row after annotation.
+	afterAnnotate func(schema.Web100ValueMap)
+}
+
+// NewBatchAnnotatingInserter wraps ins.  A batchSize < 1 holds all rows until
+// Flush.
+func NewBatchAnnotatingInserter(ins etl.Inserter, a BatchAnnotator, batchSize int) *BatchAnnotatingInserter {
+	return &BatchAnnotatingInserter{Inserter: ins, annotator: a, batchSize: batchSize}
+}
+
+func (bi *BatchAnnotatingInserter) InsertRow(data interface{}) error {
+	return bi.InsertRows([]interface{}{data})
+}
+
+func (bi *BatchAnnotatingInserter) InsertRows(data []interface{}) error {
+	bi.pending = append(bi.pending, data...)
+	if bi.batchSize > 0 && len(bi.pending) >= bi.batchSize {
+		return bi.release()
+	}
+	return nil
+}
+
+// Flush annotates and inserts any pending rows, then flushes the wrapped
+// Inserter.
+func (bi *BatchAnnotatingInserter) Flush() error {
+	if err := bi.release(); err != nil {
+		return err
+	}
+	return bi.Inserter.Flush()
+}
+
+// release annotates the pending rows, and passes them to the wrapped Inserter.
+func (bi *BatchAnnotatingInserter) release() error {
+	if len(bi.pending) == 0 {
+		return nil
+	}
+	ips := make([]string, 0, len(bi.pending))
+	specs := make([]schema.Web100ValueMap, 0, len(bi.pending))
+	for _, row := range bi.pending {
+		ms, ok := row.(*bq.MapSaver)
+		if !ok {
+			continue
+		}
+		spec, ok := ms.Values["connection_spec"].(schema.Web100ValueMap)
+		if !ok {
+			continue
+		}
+		if ip, ok := spec.GetString([]string{"client_ip"}); ok && ip != "" {
+			ips = append(ips, ip)
+			specs = append(specs, spec)
+		}
+	}
+	if len(ips) > 0 {
+		bi.annotator.AnnotateBatch(ips, specs)
+	}
+	if bi.afterAnnotate != nil {
+		for _, row := range bi.pending {
+			if ms, ok := row.(*bq.MapSaver); ok {
+				bi.afterAnnotate(schema.Web100ValueMap(ms.Values))
+			}
+		}
+	}
+	rows := bi.pending
+	bi.pending = nil
+	return bi.Inserter.InsertRows(rows)
+}
+
+func (bi *BatchAnnotatingInserter) RowsInBuffer() int {
+	return bi.Inserter.RowsInBuffer() + len(bi.pending)
+}
+
+func (bi *BatchAnnotatingInserter) Accepted() int {
+	return bi.Inserter.Accepted() + len(bi.pending)
+}
+
+// LocationAnnotator is a BatchAnnotator that adds the client_geolocation from a
+// local location database.
+type LocationAnnotator struct {
+	db *geo.LocationDB
+}
+
+// NewLocationAnnotator returns a LocationAnnotator that looks up addresses in db.
+func NewLocationAnnotator(db *geo.LocationDB) *LocationAnnotator {
+	return &LocationAnnotator{db: db}
+}
+
+func (la *LocationAnnotator) AnnotateBatch(ips []string, specs []schema.Web100ValueMap) {
+	for i, ip := range ips {
+		loc, ok := la.db.Location(ip)
+		if !ok {
+			continue
+		}
+		specs[i]["client_geolocation"] = schema.Web100ValueMap{
+			"continent_code": loc.ContinentCode,
+			"country_code":   loc.CountryCode,
+			"country_code3":  loc.CountryCode3,
+			"country_name":   loc.CountryName,
+			"region":         loc.Region,
+			"metro_code":     loc.MetroCode,
+			"city":           loc.City,
+			"area_code":      loc.AreaCode,
+			"postal_code":    loc.PostalCode,
+			"latitude":       loc.Latitude,
+			"longitude":      loc.Longitude,
+		}
+	}
+}
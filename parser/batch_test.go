@@ -0,0 +1,199 @@
+package parser_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/geo"
+	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
+)
+
+// latencyAnnotator simulates a remote lookup service.  Each call costs one
+// round trip of callLatency, and each address costs a further lookupCost.
+type latencyAnnotator struct {
+	callLatency time.Duration
+	lookupCost  time.Duration
+	calls       int
+	ips         []string
+}
+
+func (a *latencyAnnotator) call(ips ...string) {
+	a.calls++
+	a.ips = append(a.ips, ips...)
+	time.Sleep(a.callLatency + time.Duration(len(ips))*a.lookupCost)
+}
+
+func (a *latencyAnnotator) lookup(ip string) schema.Web100ValueMap {
+	return schema.Web100ValueMap{"city": "city of " + ip}
+}
+
+func (a *latencyAnnotator) Annotate(ip string, spec schema.Web100ValueMap) {
+	a.call(ip)
+	spec["client_geolocation"] = a.lookup(ip)
+}
+
+func (a *latencyAnnotator) AnnotateBatch(ips []string, specs []schema.Web100ValueMap) {
+	a.call(ips...)
+	for i := range ips {
+		specs[i]["client_geolocation"] = a.lookup(ips[i])
+	}
+}
+
+func makeRows(n int) []*bq.MapSaver {
+	rows := make([]*bq.MapSaver, n)
+	for i := range rows {
+		rows[i] = &bq.MapSaver{Values: map[string]bigquery.Value{
+			"test_id": fmt.Sprintf("test%d", i),
+			"connection_spec": schema.Web100ValueMap{
+				"client_ip": fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			},
+		}}
+	}
+	return rows
+}
+
+func TestBatchAnnotatingInserter(t *testing.T) {
+	ins := newInMemoryInserter()
+	a := &latencyAnnotator{}
+	bi := parser.NewBatchAnnotatingInserter(ins, a, 4)
+
+	rows := makeRows(6)
+	// Rows without a client_ip are passed through unannotated.
+	noIP := &bq.MapSaver{Values: map[string]bigquery.Value{"test_id": "noip"}}
+	bi.InsertRow(noIP)
+	for _, row := range rows {
+		bi.InsertRow(row)
+	}
+	// The first batch of 4 rows has been released.
+	if a.calls != 1 || len(ins.data) != 4 {
+		t.Fatalf("Expected 1 call and 4 rows, got %d and %d", a.calls, len(ins.data))
+	}
+	if bi.Accepted() != 7 || bi.RowsInBuffer() != 7 {
+		t.Errorf("Wrong row stats: %d accepted, %d in buffer", bi.Accepted(), bi.RowsInBuffer())
+	}
+	if err := bi.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if a.calls != 2 || len(ins.data) != 7 || bi.RowsInBuffer() != 0 {
+		t.Fatalf("Expected 2 calls and 7 rows, got %d and %d", a.calls, len(ins.data))
+	}
+	for _, row := range rows {
+		spec := row.Values["connection_spec"].(schema.Web100ValueMap)
+		ip, _ := spec.GetString([]string{"client_ip"})
+		if city, _ := spec.GetString([]string{"client_geolocation", "city"}); city != "city of "+ip {
+			t.Errorf("Wrong annotation for %s: %v", ip, spec)
+		}
+	}
+	if _, ok := noIP.Values["connection_spec"]; ok {
+		t.Errorf("Unexpected annotation: %v", noIP.Values)
+	}
+
+	// Flush with nothing pending does not call the annotator.
+	bi.Flush()
+	if a.calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", a.calls)
+	}
+}
+
+func TestNDTBatchAnnotator(t *testing.T) {
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	a := &latencyAnnotator{}
+	n.SetBatchAnnotator(a, 0)
+	n.SetIPAnonymizer(parser.NewIPAnonymizer("test salt"))
+
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Finish()
+	// The row is held until Flush.
+	if len(ins.data) != 0 || n.Accepted() != 1 {
+		t.Fatalf("Expected 1 pending row, got %d inserted, %d accepted", len(ins.data), n.Accepted())
+	}
+	n.Flush()
+	if len(ins.data) != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", len(ins.data))
+	}
+
+	// The annotator must see the full address, and the row the masked address.
+	if a.calls != 1 || len(a.ips) != 1 || a.ips[0] != "45.56.98.222" {
+		t.Errorf("Wrong annotator calls: %d %v", a.calls, a.ips)
+	}
+	connSpec := ins.data[0].(*bq.MapSaver).Values["connection_spec"].(schema.Web100ValueMap)
+	if ip, _ := connSpec.GetString([]string{"client_ip"}); ip != "45.56.98.0" {
+		t.Errorf("Client address not anonymized: %v", connSpec)
+	}
+	if city, _ := connSpec.GetString([]string{"client_geolocation", "city"}); city != "city of 45.56.98.222" {
+		t.Errorf("Wrong annotation: %v", connSpec)
+	}
+}
+
+func TestLocationAnnotator(t *testing.T) {
+	db, err := geo.NewLocationDB(strings.NewReader(
+		"network,country_code,city,latitude\n" +
+			"45.56.96.0/20,AT,Vienna,48.2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := []schema.Web100ValueMap{{}, {}}
+	parser.NewLocationAnnotator(db).AnnotateBatch([]string{"45.56.98.222", "10.0.0.1"}, specs)
+	if city, _ := specs[0].GetString([]string{"client_geolocation", "city"}); city != "Vienna" {
+		t.Errorf("Wrong annotation: %v", specs[0])
+	}
+	// Unknown addresses are left unannotated.
+	if _, ok := specs[1]["client_geolocation"]; ok {
+		t.Errorf("Unexpected annotation: %v", specs[1])
+	}
+}
+
+// The benchmarks compare per-row and batched annotation, with a simulated
+// round trip to a remote service for each call.
+const benchRows = 3000
+const benchCallLatency = 200 * time.Microsecond
+const benchLookupCost = 2 * time.Microsecond
+
+func BenchmarkAnnotatePerRow(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rows := makeRows(benchRows)
+		ins := newInMemoryInserter()
+		a := &latencyAnnotator{callLatency: benchCallLatency, lookupCost: benchLookupCost}
+		b.StartTimer()
+		for _, row := range rows {
+			spec := row.Values["connection_spec"].(schema.Web100ValueMap)
+			ip, _ := spec.GetString([]string{"client_ip"})
+			a.Annotate(ip, spec)
+			ins.InsertRow(row)
+		}
+		ins.Flush()
+	}
+}
+
+func BenchmarkAnnotateBatched(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rows := makeRows(benchRows)
+		a := &latencyAnnotator{callLatency: benchCallLatency, lookupCost: benchLookupCost}
+		bi := parser.NewBatchAnnotatingInserter(newInMemoryInserter(), a, 0)
+		b.StartTimer()
+		for _, row := range rows {
+			bi.InsertRow(row)
+		}
+		bi.Flush()
+	}
+}
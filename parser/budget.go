@@ -0,0 +1,60 @@
+package parser
+
+// SnapshotBudget limits the total number of snapshots decoded across all the
+// tests in a task, independent of the per-test MAX_NUM_SNAPSHOTS cap.  As the
+// budget is depleted, the stride between decoded snapshots increases, so that
+// very large archives degrade to coarser deltas rather than producing an
+// enormous number of rows and fields.
+//
+// A SnapshotBudget is not thread safe, and should be used by a single parser.
+type SnapshotBudget struct {
+	Total int // Total snapshots that may be decoded.  Zero or less is unlimited.
+	Used  int // Snapshots decoded so far.
+}
+
+// NewSnapshotBudget creates a budget allowing total snapshots to be decoded.
+func NewSnapshotBudget(total int) *SnapshotBudget {
+	return &SnapshotBudget{Total: total}
+}
+
+// Remaining returns the number of snapshots that may still be decoded, or -1
+// if the budget is unlimited.
+func (b *SnapshotBudget) Remaining() int {
+	if b == nil || b.Total <= 0 {
+		return -1
+	}
+	if b.Used >= b.Total {
+		return 0
+	}
+	return b.Total - b.Used
+}
+
+// Stride returns the stride to use when decoding count snapshots from a
+// single test.  The stride doubles each time the remaining budget halves,
+// and is also large enough that the decoded snapshots fit in the remaining
+// budget.  Returns 0 if the budget is exhausted, in which case no snapshots
+// should be decoded.
+func (b *SnapshotBudget) Stride(count int) int {
+	remaining := b.Remaining()
+	if remaining < 0 {
+		return 1
+	}
+	if remaining == 0 {
+		return 0
+	}
+	stride := 1
+	for threshold := b.Total / 2; remaining <= threshold && threshold > 0; threshold /= 2 {
+		stride *= 2
+	}
+	for (count+stride-1)/stride > remaining {
+		stride *= 2
+	}
+	return stride
+}
+
+// Spend records that n snapshots were decoded.
+func (b *SnapshotBudget) Spend(n int) {
+	if b != nil {
+		b.Used += n
+	}
+}
@@ -0,0 +1,87 @@
+package parser_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
+)
+
+func TestSnapshotBudgetUnlimited(t *testing.T) {
+	var nilBudget *parser.SnapshotBudget
+	if nilBudget.Stride(2000) != 1 {
+		t.Error("Nil budget should have stride 1")
+	}
+	b := parser.NewSnapshotBudget(0)
+	b.Spend(1000000)
+	if b.Stride(2000) != 1 {
+		t.Error("Unlimited budget should have stride 1")
+	}
+}
+
+func TestSnapshotBudgetStride(t *testing.T) {
+	// 100 tests of 2000 snapshots each, with a budget for only 10 full tests.
+	b := parser.NewSnapshotBudget(20000)
+	last := 1
+	tests := 0
+	for i := 0; i < 100; i++ {
+		stride := b.Stride(2000)
+		if stride == 0 {
+			break
+		}
+		if stride < last {
+			t.Errorf("Stride should not decrease: %d after %d", stride, last)
+		}
+		last = stride
+		tests++
+		b.Spend((2000 + stride - 1) / stride)
+		if b.Used > b.Total {
+			t.Fatalf("Budget exceeded after %d tests: %d > %d", tests, b.Used, b.Total)
+		}
+	}
+	if last == 1 {
+		t.Error("Stride should increase as budget depletes")
+	}
+	// Adaptive stride should allow many more than 10 tests to be decoded.
+	if tests <= 10 {
+		t.Errorf("Expected more than 10 tests, got %d", tests)
+	}
+	if b.Remaining() != 0 && b.Stride(2000) == 0 {
+		t.Error("Stride should only be zero when budget is exhausted")
+	}
+}
+
+func TestNDTSnapshotBudget(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	meta := testMeta()
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	budget := parser.NewSnapshotBudget(100)
+	n.SetSnapshotBudget(budget)
+	// The same test, repeated, is enough to exhaust the budget.
+	for i := 0; i < 10; i++ {
+		n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+		n.Flush()
+	}
+	if budget.Used > budget.Total {
+		t.Errorf("Budget exceeded: %d > %d", budget.Used, budget.Total)
+	}
+	if ins.Accepted() != 10 {
+		t.Fatalf("Expected 10 rows, got %d", ins.Accepted())
+	}
+	// Rows are still written once the budget is exhausted, but without deltas.
+	first := ins.data[0].(*bq.MapSaver).Values["web100_log_entry"].(schema.Web100ValueMap)
+	lastRow := ins.data[9].(*bq.MapSaver).Values["web100_log_entry"].(schema.Web100ValueMap)
+	if len(first["deltas"].([]schema.Web100ValueMap)) == 0 {
+		t.Error("First test should have deltas")
+	}
+	if len(lastRow["deltas"].([]schema.Web100ValueMap)) != 0 {
+		t.Error("Last test should have no deltas")
+	}
+	if len(lastRow["snap"].(schema.Web100ValueMap)) == 0 {
+		t.Error("Last test should still have final snapshot values")
+	}
+}
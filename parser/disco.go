@@ -7,11 +7,13 @@ package parser
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 
+	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
 )
@@ -19,13 +21,17 @@ import (
 //=====================================================================================
 //                       Disco Parser
 //=====================================================================================
+
+// PortStatsMeta holds the task meta data for each DISCO row.
+type PortStatsMeta struct {
+	FileName  string `json:"filename, string"` // The archive filename.
+	TestName  string `json:"testname, string"` // The test file within the archive.
+	ParseTime int64  `json:"parsetime, int64"` // Unix time of parsing.
+}
+
 type PortStats struct {
 	// TODO - replace these with standard meta data.
-	Meta struct {
-		FileName  string `json:"filename, string"`
-		TestName  string `json:"testname, string"`
-		ParseTime int64  `json:"parsetime, int64"`
-	} `json:"meta"`
+	Meta PortStatsMeta `json:"meta"`
 
 	Sample []struct { //    []Sample `json: "sample"`
 		Timestamp int64   `json:"timestamp, int64"`
@@ -35,14 +41,44 @@ type PortStats struct {
 	Hostname   string `json:"hostname"`
 	Experiment string `json:"experiment"`
 
+	// The verbatim JSON object, in raw mode.  Otherwise empty.
+	Raw string `json:"-" bigquery:"raw"`
+
+	// Position of the file in the archive, or -1 if unknown.
+	Index int64 `json:"-" bigquery:"archive_index"`
+
+	// ID of the worker instance, set by bq.WorkerIDWrapper.  Otherwise empty.
+	WorkerID string `json:"-" bigquery:"worker_id"`
+
 	// bigquery doesn't handle maps within structs.  8-(
 	// Meta       map[string]bigquery.Value `json:"meta"`
 }
 
+// WithWorkerID returns a copy of the row with the WorkerID set, for
+// bq.WorkerIDWrapper.
+func (ps PortStats) WithWorkerID(id string) interface{} {
+	ps.WorkerID = id
+	return ps
+}
+
+// ArchiveIndex returns the position of the file within its archive, for
+// bq.OrderedInserter.
+func (ps PortStats) ArchiveIndex() int64 {
+	return ps.Index
+}
+
 // TODO(dev) add tests
 type DiscoParser struct {
 	inserter     etl.Inserter
 	etl.RowStats // RowStats implemented for DiscoParser with an embedded struct.
+
+	// If true, each JSON object is stored verbatim in the raw column, instead
+	// of being decoded into a PortStats.
+	rawJSON bool
+}
+
+func init() {
+	RegisterParser("switch", NewDiscoParser)
 }
 
 func NewDiscoParser(ins etl.Inserter) etl.Parser {
@@ -51,37 +87,31 @@ func NewDiscoParser(ins etl.Inserter) etl.Parser {
 		RowStats: ins} // Delegate RowStats functions to the Inserter.
 }
 
+// SetRawJSON controls whether each JSON object is stored verbatim in a raw
+// column, along with the meta data.  This preserves any fields that are not
+// in PortStats, so new DISCO metrics do not require a code change.
+func (dp *DiscoParser) SetRawJSON(enable bool) {
+	dp.rawJSON = enable
+}
+
 // Disco data a JSON representation that should be pushed directly into BigQuery.
 // For now, though, we parse into a struct, for compatibility with current inserter
 // backend.
 //
+// Records with values of the wrong type are skipped, and counted.  Malformed
+// JSON cannot be resynchronized, so the rest of the file is abandoned, after
+// inserting the records that preceded it.
+//
 // Returns:
-//   error on Decode error
+//   error on malformed JSON
 //   error on InsertRows error
 //   nil on success
 //
 // TODO - optimize this to use the JSON directly, if possible.
 func (dp *DiscoParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
-	meta["testname"] = testName
-	ms := struct {
-		FileName  string `json:"filename, string"`
-		TestName  string `json:"testname, string"`
-		ParseTime int64  `json:"parsetime, int64"`
-	}{meta["filename"].(string), meta["testname"].(string), meta["parsetime"].(time.Time).Unix()}
-
-	rdr := bytes.NewReader(test)
-	dec := json.NewDecoder(rdr)
-	for dec.More() {
-		var ps PortStats
-		ps.Meta = ms
-		err := dec.Decode(&ps)
-		if err != nil {
-			metrics.TestCount.WithLabelValues(
-				dp.TableName(), "disco", "Decode").Inc()
-			// TODO(dev) Should accumulate errors, instead of aborting?
-			return err
-		}
-		err = dp.inserter.InsertRow(ps)
+	rows, parseErr := dp.Parse(meta, testName, test)
+	for _, row := range rows {
+		err := dp.inserter.InsertRow(row)
 		if err != nil {
 			switch t := err.(type) {
 			case bigquery.PutMultiError:
@@ -97,13 +127,110 @@ func (dp *DiscoParser) ParseAndInsert(meta map[string]bigquery.Value, testName s
 			return err
 		}
 	}
+	if parseErr != nil {
+		metrics.TestCount.WithLabelValues(
+			dp.TableName(), "disco", "Decode").Inc()
+		return parseErr
+	}
 	metrics.TestCount.WithLabelValues(dp.TableName(), "disco", "ok").Inc()
 
 	return nil
 }
 
+// Parse returns the rows for a DISCO file, without inserting them.  Records
+// with values of the wrong type are skipped, and counted.  On malformed JSON,
+// the rows that preceded it are returned, with the error.
+func (dp *DiscoParser) Parse(meta map[string]bigquery.Value, testName string, test []byte) ([]interface{}, error) {
+	start := time.Now()
+	defer func() {
+		metrics.ParseDuration.WithLabelValues(
+			dp.TableName(), "disco").Observe(time.Since(start).Seconds())
+	}()
+
+	// The task meta data is attached to every row, so that samples can be
+	// joined back to the source archive.
+	var ms PortStatsMeta
+	ms.FileName, _ = meta["filename"].(string)
+	ms.TestName = testName
+	if parseTime, ok := meta["parse_time"].(time.Time); ok {
+		ms.ParseTime = parseTime.Unix()
+	}
+
+	rows := []interface{}{}
+	rdr := bytes.NewReader(test)
+	dec := json.NewDecoder(rdr)
+	for record := 0; dec.More(); record++ {
+		row, err := dp.decodeRow(dec, ms, meta, record)
+		if err != nil {
+			metrics.ErrorCount.WithLabelValues(
+				dp.TableName(), "disco", "malformed record").Inc()
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				// The whole value was consumed, so continue with the next.
+				log.Printf("Skipping record %d in %s: %v\n", record, testName, err)
+				continue
+			}
+			return rows, fmt.Errorf("malformed JSON at record %d in %s: %v", record, testName, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// decodeRow decodes the next JSON object, and returns the row to insert, with
+// an insertID derived from the record index.
+func (dp *DiscoParser) decodeRow(dec *json.Decoder, ms PortStatsMeta, meta map[string]bigquery.Value, record int) (interface{}, error) {
+	var ps PortStats
+	ps.Meta = ms
+	ps.Index = archiveIndex(meta)
+	if !dp.rawJSON {
+		if err := dec.Decode(&ps); err != nil {
+			return nil, err
+		}
+		return &bigquery.StructSaver{Struct: ps,
+			InsertID: taskInsertID(meta, ms.TestName, record)}, nil
+	}
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	// The typed fields are also decoded, as far as possible, so that the row
+	// matches the PortStats schema.  Values of the wrong type are left empty,
+	// since they are preserved in the raw column.
+	if err := json.Unmarshal(raw, &ps); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return nil, err
+		}
+		metrics.WarningCount.WithLabelValues(
+			dp.TableName(), "disco", "raw record type mismatch").Inc()
+	}
+	samples := make([]bigquery.Value, len(ps.Sample))
+	for i, sample := range ps.Sample {
+		samples[i] = map[string]bigquery.Value{
+			"Timestamp": sample.Timestamp, "Value": sample.Value}
+	}
+	// The column names match those inferred from PortStats.
+	return &bq.MapSaver{Values: map[string]bigquery.Value{
+		"Meta": map[string]bigquery.Value{
+			"FileName": ms.FileName, "TestName": ms.TestName,
+			"ParseTime": ms.ParseTime},
+		"Sample":        samples,
+		"Metric":        ps.Metric,
+		"Hostname":      ps.Hostname,
+		"Experiment":    ps.Experiment,
+		"raw":           string(raw),
+		"archive_index": ps.Index,
+		"worker_id":     ps.WorkerID},
+		InsertID: taskInsertID(meta, ms.TestName, record)}, nil
+}
+
 // These functions are also required to complete the etl.Parser interface.  For Disco,
 // we just forward the calls to the Inserter.
+
+// Finish does nothing, since each Disco file is inserted as it is parsed.
+func (dp *DiscoParser) Finish() error {
+	return nil
+}
+
 func (dp *DiscoParser) Flush() error {
 	return dp.inserter.Flush()
 }
@@ -47,11 +47,12 @@ func TestJSONParsing(t *testing.T) {
 	// This creates a real inserter, with a fake uploader, for local testing.
 	uploader := fake.FakeUploader{}
 	ins, err := bq.NewBQInserter(etl.InserterParams{
-		"mlab_sandbox", "disco_test", "", 10 * time.Second, 3}, &uploader)
+		Dataset: "mlab_sandbox", Table: "disco_test", Suffix: "",
+		Timeout: 10 * time.Second, BufferSize: 3}, &uploader)
 
 	var parser etl.Parser = parser.NewDiscoParser(ins)
 
-	meta := map[string]bigquery.Value{"filename": "filename", "parsetime": time.Now()}
+	meta := map[string]bigquery.Value{"filename": "filename", "parse_time": time.Now()}
 	// Should result in two tests sent to inserter, but no call to uploader.
 	err = parser.ParseAndInsert(meta, "testName", test_data)
 	if ins.Accepted() != 2 {
@@ -86,13 +87,175 @@ func TestJSONParsing(t *testing.T) {
 	}
 }
 
+func TestDiscoMeta(t *testing.T) {
+	uploader := fake.FakeUploader{}
+	ins, err := bq.NewBQInserter(etl.InserterParams{
+		Dataset: "mlab_sandbox", Table: "disco_test", Suffix: "",
+		Timeout: 10 * time.Second, BufferSize: 10}, &uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewDiscoParser(ins)
+
+	// This is the meta data provided by the Task.
+	parseTime := time.Unix(1500000000, 0)
+	filename := "gs://m-lab-sandbox/switch/2017/05/01/20170501T000000Z-mlab1-vie01-switch-0000.tgz"
+	meta := map[string]bigquery.Value{"filename": filename, "parse_time": parseTime, "attempt": 1, "archive_index": 3}
+	if err = p.ParseAndInsert(meta, "20170501T00:00:00-to-20170502T00:00:00-switch.json", test_data); err != nil {
+		t.Fatal(err)
+	}
+	p.Flush()
+	if len(uploader.Rows) != 2 {
+		t.Fatal("Uploader Row Count = ", len(uploader.Rows))
+	}
+	for _, row := range uploader.Rows {
+		rowMeta, ok := row.Row["Meta"].(map[string]bigquery.Value)
+		if !ok {
+			t.Fatalf("Missing Meta: %v", row.Row)
+		}
+		if rowMeta["FileName"] != filename ||
+			rowMeta["TestName"] != "20170501T00:00:00-to-20170502T00:00:00-switch.json" ||
+			rowMeta["ParseTime"] != int64(1500000000) {
+			t.Errorf("Wrong meta: %v", rowMeta)
+		}
+		if row.Row["archive_index"] != int64(3) {
+			t.Errorf("Wrong archive_index: %v", row.Row["archive_index"])
+		}
+	}
+}
+
+func TestRawJSON(t *testing.T) {
+	// The rows must match the table schema, which is inferred from PortStats.
+	schema, err := bq.InferSchema(parser.PortStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader := fake.FakeUploader{Schema: schema}
+	ins, err := bq.NewBQInserter(etl.InserterParams{
+		Dataset: "mlab_sandbox", Table: "disco_test", Suffix: "",
+		Timeout: 10 * time.Second, BufferSize: 10}, &uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewDiscoParser(ins)
+	p.(*parser.DiscoParser).SetRawJSON(true)
+
+	// The new_metric field is not in PortStats, but should be preserved.
+	data := []byte(`{"metric": "switch.multicast.local.rx", "new_metric": 7}
+		{"metric": "switch.octets.uplink.tx"}`)
+	meta := map[string]bigquery.Value{"filename": "filename", "parse_time": time.Now()}
+	if err = p.ParseAndInsert(meta, "testName", data); err != nil {
+		t.Fatal(err)
+	}
+	p.Flush()
+	if len(uploader.Rows) != 2 {
+		t.Fatal("Uploader Row Count = ", len(uploader.Rows))
+	}
+	raw := uploader.Rows[0].Row["raw"]
+	if raw != `{"metric": "switch.multicast.local.rx", "new_metric": 7}` {
+		t.Errorf("Wrong raw value: %v", raw)
+	}
+	rowMeta, ok := uploader.Rows[1].Row["Meta"].(map[string]bigquery.Value)
+	if !ok || rowMeta["FileName"] != "filename" || rowMeta["TestName"] != "testName" {
+		t.Errorf("Wrong meta: %v", uploader.Rows[1].Row["Meta"])
+	}
+
+	// A retried task produces the same insertIDs, so the rows can be deduped.
+	ids := []string{uploader.Rows[0].InsertID, uploader.Rows[1].InsertID}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("Bad insertIDs %q", ids)
+	}
+	meta["attempt"] = 2
+	if err = p.ParseAndInsert(meta, "testName", data); err != nil {
+		t.Fatal(err)
+	}
+	p.Flush()
+	// The uploader holds only the rows of the last request.
+	if len(uploader.Rows) != 2 {
+		t.Fatal("Uploader Row Count = ", len(uploader.Rows))
+	}
+	for i, id := range ids {
+		if uploader.Rows[i].InsertID != id {
+			t.Errorf("Row %d insertID changed on retry", i)
+		}
+	}
+}
+
+func TestDiscoWorkerID(t *testing.T) {
+	schema, err := bq.InferSchema(parser.PortStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both raw map rows and struct rows are tagged.
+	for _, raw := range []bool{true, false} {
+		uploader := fake.FakeUploader{Schema: schema}
+		ins, err := bq.NewBQInserter(etl.InserterParams{
+			Dataset: "mlab_sandbox", Table: "disco_test", Suffix: "",
+			Timeout: 10 * time.Second, BufferSize: 10}, &uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := parser.NewDiscoParser(bq.WorkerIDWrapper{Inserter: ins, ID: "worker-1"})
+		p.(*parser.DiscoParser).SetRawJSON(raw)
+
+		data := []byte(`{"metric": "switch.multicast.local.rx"}`)
+		meta := map[string]bigquery.Value{"filename": "filename", "parse_time": time.Now()}
+		if err = p.ParseAndInsert(meta, "testName", data); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(uploader.Rows) != 1 || uploader.Rows[0].Row["worker_id"] != "worker-1" {
+			t.Errorf("raw %v: Expected a row with worker_id, got %v", raw, uploader.Rows)
+		}
+	}
+}
+
+func TestMalformedRecords(t *testing.T) {
+	good := `{"metric": "switch.multicast.local.rx", "hostname": "mlab1.sea05.measurement-lab.org"}`
+	tests := []struct {
+		name    string
+		data    string
+		rows    int
+		wantErr bool
+	}{
+		// The wrong type is skipped, and the following record is still parsed.
+		{name: "type", data: good + "\n" + `{"metric": 17}` + "\n" + good, rows: 2},
+		// Malformed JSON aborts the file, keeping the preceding rows.
+		{name: "syntax", data: good + "\n" + `{"metric": "x",, }` + "\n" + good, rows: 1, wantErr: true},
+		{name: "truncated", data: good + "\n" + `{"metric": "sw`, rows: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		uploader := fake.FakeUploader{}
+		ins, err := bq.NewBQInserter(etl.InserterParams{
+			Dataset: "mlab_sandbox", Table: "disco_test", Suffix: "",
+			Timeout: 10 * time.Second, BufferSize: 10}, &uploader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := parser.NewDiscoParser(ins)
+		meta := map[string]bigquery.Value{"filename": "filename", "parse_time": time.Now()}
+
+		// This should terminate, rather than spinning on the bad record.
+		err = p.ParseAndInsert(meta, "testName", []byte(test.data))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		p.Flush()
+		if len(uploader.Rows) != test.rows {
+			t.Errorf("%s: %d rows, want %d", test.name, len(uploader.Rows), test.rows)
+		}
+	}
+}
+
 // DISABLED
 // This tests insertion into a test table in the cloud.  Should not normally be executed.
 func xTestRealBackend(t *testing.T) {
 	ins, err := bq.NewInserter("mlab_sandbox", etl.SW, time.Now())
 	var parser etl.Parser = parser.NewDiscoParser(ins)
 
-	meta := map[string]bigquery.Value{"filename": "filename", "parsetime": time.Now()}
+	meta := map[string]bigquery.Value{"filename": "filename", "parse_time": time.Now()}
 	for i := 0; i < 3; i++ {
 		// Iterations:
 		// Add two rows, no upload.
@@ -116,3 +279,37 @@ func xTestRealBackend(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDiscoParse(t *testing.T) {
+	ins := newInMemoryInserter()
+	dp := parser.NewDiscoParser(ins).(*parser.DiscoParser)
+	meta := map[string]bigquery.Value{"filename": "filename"}
+	rows, err := dp.Parse(meta, "testName", test_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || ins.Accepted() != 0 {
+		t.Fatalf("Got %d rows, %d inserted, want 2, 0", len(rows), ins.Accepted())
+	}
+	if ps := rows[1].(*bigquery.StructSaver).Struct.(parser.PortStats); ps.Hostname != "mlab1.sea05.measurement-lab.org" || ps.Meta.TestName != "testName" {
+		t.Errorf("Wrong row %+v", ps)
+	}
+
+	// Struct rows also have insertIDs, which are the same for a retried task.
+	again, _ := dp.Parse(meta, "testName", test_data)
+	ids := []string{rows[0].(*bigquery.StructSaver).InsertID, rows[1].(*bigquery.StructSaver).InsertID}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("Bad insertIDs %q", ids)
+	}
+	for i, id := range ids {
+		if again[i].(*bigquery.StructSaver).InsertID != id {
+			t.Errorf("Row %d insertID changed on retry", i)
+		}
+	}
+
+	// The rows preceding malformed JSON are returned, with the error.
+	rows, err = dp.Parse(meta, "testName", append(append([]byte{}, test_data...), "{bad"...))
+	if err == nil || len(rows) != 2 {
+		t.Errorf("Got %d rows, error %v, want 2 rows and an error", len(rows), err)
+	}
+}
@@ -0,0 +1,17 @@
+package parser
+
+import "strings"
+
+// UnregisterParser removes the factory registered for pathPrefix, if any, so
+// that tests can remove the fake parsers they register.
+func UnregisterParser(pathPrefix string) {
+	prefix := strings.Trim(pathPrefix, "/")
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for i := range registry {
+		if registry[i].prefix == prefix {
+			registry = append(registry[:i], registry[i+1:]...)
+			return
+		}
+	}
+}
@@ -1,18 +1,23 @@
 package parser
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"regexp"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 
 	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/geo"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/etl/web100"
@@ -26,25 +31,30 @@ const (
 	// to 2800 snapshots, which corresponds to 14 seconds, and should be long
 	// after the data transfer has completed.
 	//
-	// TODO - in future, we should probably detect when the connection state changes
-	// from established, as there is little reason to parse snapshots beyond that
-	// point.
+	// See also NDTParser.SetStateStopCount, which stops processing once the
+	// connection state is no longer ESTABLISHED.
 	MIN_NUM_SNAPSHOTS = 1600 // If fewer than this, then set anomalies.num_snaps
-	MAX_NUM_SNAPSHOTS = 2800 // If more than this, truncate, and set anomolies.num_snaps
+	MAX_NUM_SNAPSHOTS = 2800 // Default cap.  If more than this, truncate, and set anomolies.num_snaps
 )
 
 //=========================================================================
 // NDT Test filename parsing related stuff.
 //=========================================================================
 
-// TODO - should this be optional?
+// The leading date directory is optional, as some pipelines pass bare file
+// names.  When present, it must match the date field.
 const dateDir = `^(?P<dir>\d{4}/\d{2}/\d{2}/)?`
 
 // TODO - use time.Parse to parse this part of the filename.
 const dateField = `(?P<date>\d{8})`
 const timeField = `(?P<time>[012]\d:[0-6]\d:\d{2}\.\d{1,10})`
-const address = `(?P<address>.*)`
-const suffix = `(?P<suffix>[a-z2].*)`
+
+// The address is either a bracketed IPv6 literal, with optional port, or any
+// string without brackets, such as a hostname:port or an IPv4 address.  The
+// suffix may not contain dots or colons, so that the address/suffix split is
+// at the last dot, and a port is never mistaken for part of the suffix.
+const address = `(?P<address>\[[0-9A-Fa-f:.]+\](?::\d+)?|[^\[\]]*)`
+const suffix = `(?P<suffix>[a-z2][a-z0-9_]*)`
 
 var (
 	// Pattern for any valid test file name
@@ -68,6 +78,15 @@ type testInfo struct {
 	Timestamp time.Time // The parsed timestamp, with microsecond resolution
 }
 
+// ErrDateDirMismatch is returned, with the parsed testInfo, when the date
+// directory of a test file path does not match the date in the file name,
+// which indicates a misfiled test.
+var ErrDateDirMismatch = errors.New("Date dir does not match test date")
+
+// ParseNDTFileName parses an NDT test file name, with or without a leading
+// yyyy/mm/dd/ date directory, which is returned in DateDir if present.  If
+// the date directory does not match the test date, the testInfo is returned
+// with ErrDateDirMismatch.  Any other error returns a nil testInfo.
 func ParseNDTFileName(path string) (*testInfo, error) {
 	fields := gzTestFilePattern.FindStringSubmatch(path)
 
@@ -87,10 +106,14 @@ func ParseNDTFileName(path string) (*testInfo, error) {
 	}
 	timestamp, err := time.Parse("20060102T15:04:05.999999999Z_", fields[2]+"T"+fields[3]+"Z_")
 	if err != nil {
-		log.Println(fields[2] + "T" + fields[3] + "   " + err.Error())
+		etl.Logger{}.Warning("bad timestamp", "test_id", path, "reason", err)
 		return nil, errors.New("Invalid test path: " + path)
 	}
-	return &testInfo{fields[1], fields[2], fields[3], fields[4], fields[5], timestamp}, nil
+	info := &testInfo{fields[1], fields[2], fields[3], fields[4], fields[5], timestamp}
+	if info.DateDir != "" && strings.Replace(info.DateDir, "/", "", -1) != info.Date {
+		return info, ErrDateDirMismatch
+	}
+	return info, nil
 }
 
 //=========================================================================
@@ -98,9 +121,10 @@ func ParseNDTFileName(path string) (*testInfo, error) {
 //=========================================================================
 
 type fileInfoAndData struct {
-	fn   string
-	info testInfo
-	data []byte
+	fn    string
+	info  testInfo
+	data  []byte
+	index int64 // Position in the archive, or -1 if unknown.
 }
 
 type NDTParser struct {
@@ -115,21 +139,227 @@ type NDTParser struct {
 	c2s *fileInfoAndData
 	s2c *fileInfoAndData
 
-	metaFile *MetaFileData
+	// Summaries of the c2s and s2c ndttrace files, if any.
+	c2sTrace *TraceSummary
+	s2cTrace *TraceSummary
+	// Summary of the server cputime file, if any, which covers both tests.
+	cputime *CPUTimeSummary
+
+	// The distinct file names, without any .gz, seen for each suffix in the
+	// current group, to detect collisions between different tests.
+	names map[string][]string
+
+	metaFile  *MetaFileData
+	metaIndex int64 // Position of the meta file in the archive.
+
+	// The number of files seen over the whole task, by suffix category.
+	suffixCounts map[string]int
+
+	// Optional database used to annotate rows with the client country code.
+	countryDB *geo.CountryDB
+
+	// Optional annotator, used to add client fields to the connection spec.
+	annotator Annotator
+	// True if the inserter is a BatchAnnotatingInserter, which will anonymize
+	// the rows once they are annotated.
+	batchAnnotating bool
+
+	// If true, snaplogs with no snapshots produce a row containing only the
+	// connection spec.  Otherwise they are dropped.
+	keepEmptySnaplogs bool
+
+	// Optional limit on the total snapshots decoded across the task.
+	snapshotBudget *SnapshotBudget
+
+	// If true, a test group with a meta file, but no snaplogs, produces a
+	// row with the connection spec and any client reported values.
+	metaOnlyRows bool
+
+	// If true, rows for tests with a meta file include the meta column.
+	metaColumn bool
+
+	// Optional anonymizer, used to mask client addresses and add client_ip_hash.
+	anonymizer *IPAnonymizer
+
+	// If non-zero, snapshot processing stops once the connection has left the
+	// ESTABLISHED state for this many consecutive snapshots.
+	stateStopCount int
+
+	// Maximum number of snapshots processed per snaplog.  Zero is unlimited.
+	maxSnapshots int
+
+	// If true, a test whose snaplog cannot be parsed produces a minimal row
+	// with an error_message.  Otherwise it is only counted in metrics.
+	errorRows bool
+
+	// Snaplogs smaller than smallFileSize are counted in a warning, and those
+	// larger than maxFileSize, compressed or not, are streamed without deltas.
+	smallFileSize int
+	maxFileSize   int
+}
+
+// Default snaplog size thresholds.
+const (
+	DefaultSmallFileSize = 16 * 1024
+	DefaultMaxFileSize   = 10 * 1024 * 1024
+)
+
+func init() {
+	RegisterParser("ndt", func(ins etl.Inserter) etl.Parser { return NewNDTParser(ins) })
 }
 
 func NewNDTParser(ins etl.Inserter) *NDTParser {
 	return &NDTParser{
-		inserter: ins,
-		RowStats: ins} // Use the Inserter to provide the RowStats interface.
+		inserter:      ins,
+		RowStats:      ins, // Use the Inserter to provide the RowStats interface.
+		maxSnapshots:  MAX_NUM_SNAPSHOTS,
+		smallFileSize: DefaultSmallFileSize,
+		maxFileSize:   DefaultMaxFileSize}
+}
+
+// SuffixCounts returns the number of files seen by the parser with each of the
+// c2s_snaplog, s2c_snaplog and meta suffixes, and all "other" files, including
+// those with bad names.  It implements etl.SuffixCounter.
+func (n *NDTParser) SuffixCounts() map[string]int {
+	counts := make(map[string]int, len(n.suffixCounts))
+	for suffix, count := range n.suffixCounts {
+		counts[suffix] = count
+	}
+	return counts
+}
+
+// countSuffix counts a file in the SuffixCounts category for its suffix.
+func (n *NDTParser) countSuffix(suffix string) {
+	if n.suffixCounts == nil {
+		n.suffixCounts = make(map[string]int, 4)
+	}
+	switch suffix {
+	case "c2s_snaplog", "s2c_snaplog", "meta":
+		n.suffixCounts[suffix]++
+	default:
+		n.suffixCounts["other"]++
+	}
+}
+
+// logger returns a Logger with the table and task_filename fields.
+func (n *NDTParser) logger() etl.Logger {
+	return etl.NewLogger("table", n.TableName(), "task_filename", n.taskFileName)
+}
+
+// SetCountryDB enables annotation of connection_spec.client_geolocation.country_code
+// using the given database.  A nil db disables the annotation.
+func (n *NDTParser) SetCountryDB(db *geo.CountryDB) {
+	n.countryDB = db
+}
+
+// Annotator adds fields, such as geolocation, for the client address ip to
+// the connection spec of an NDT row.
+type Annotator interface {
+	Annotate(ip string, spec schema.Web100ValueMap)
+}
+
+// SetAnnotator enables annotation of the connection spec by a.  A nil
+// annotator disables the annotation.
+func (n *NDTParser) SetAnnotator(a Annotator) {
+	n.annotator = a
+}
+
+// SetKeepEmptySnaplogs controls whether snaplogs with a valid header but no
+// snapshots produce a connection-spec-only row (true), or are dropped (false,
+// the default).
+func (n *NDTParser) SetKeepEmptySnaplogs(keep bool) {
+	n.keepEmptySnaplogs = keep
+}
+
+// SetMetaColumn controls whether rows for tests with a meta file include the
+// meta column, holding the meta file fields that are not in the connection
+// spec, such as tcp_cc and cputime_file.
+func (n *NDTParser) SetMetaColumn(enable bool) {
+	n.metaColumn = enable
+}
+
+// SetMetaOnlyRows controls whether test groups with a meta file but no
+// snaplogs produce a row (true), or are dropped (false, the default).
+func (n *NDTParser) SetMetaOnlyRows(enable bool) {
+	n.metaOnlyRows = enable
+}
+
+// SetSnapshotBudget limits the total number of snapshots decoded for deltas
+// across all tests processed by this parser.  A nil budget is unlimited.
+func (n *NDTParser) SetSnapshotBudget(budget *SnapshotBudget) {
+	n.snapshotBudget = budget
+}
+
+// SetBatchAnnotator enables annotation of the connection specs by a, in batches
+// of batchSize rows, or of all the rows of the task if batchSize < 1.  The rows
+// are held until they are annotated, and only then anonymized, so a sees the
+// full client address.  It must be called before any rows are inserted.
+func (n *NDTParser) SetBatchAnnotator(a BatchAnnotator, batchSize int) {
+	bi := NewBatchAnnotatingInserter(n.inserter, a, batchSize)
+	bi.afterAnnotate = n.anonymizeClient
+	n.inserter = bi
+	n.RowStats = bi
+	n.batchAnnotating = true
+}
+
+// SetIPAnonymizer enables masking of the client address, and the addition of
+// connection_spec.client_ip_hash.  A nil anonymizer disables anonymization.
+func (n *NDTParser) SetIPAnonymizer(a *IPAnonymizer) {
+	n.anonymizer = a
+}
+
+// SetErrorRows controls whether snaplog parsing failures produce a minimal row
+// containing the error_message, so that failed tests can be accounted for.
+func (n *NDTParser) SetErrorRows(enable bool) {
+	n.errorRows = enable
+}
+
+// SetMaxSnapshots sets the maximum number of snapshots processed in each
+// snaplog, replacing the default of MAX_NUM_SNAPSHOTS.  Zero or negative
+// removes the cap, in which case large snaplogs are not flagged in
+// anomalies.num_snaps.
+func (n *NDTParser) SetMaxSnapshots(max int) {
+	if max < 0 {
+		max = 0
+	}
+	n.maxSnapshots = max
+}
+
+// SetFileSizeThresholds sets the size below which a snaplog is counted as
+// small, and the size above which it is streamed without deltas, replacing
+// DefaultSmallFileSize and DefaultMaxFileSize.  Values that are zero or
+// negative leave the threshold unchanged.
+func (n *NDTParser) SetFileSizeThresholds(small, max int) {
+	if small > 0 {
+		n.smallFileSize = small
+	}
+	if max > 0 {
+		n.maxFileSize = max
+	}
+}
+
+// SetStateStopCount stops snapshot processing once the connection has left
+// the ESTABLISHED state for count consecutive snapshots, avoiding the cost of
+// trailing idle snapshots.  The final values are then taken from the last
+// processed snapshot.  Zero, the default, processes up to the snapshot cap.
+func (n *NDTParser) SetStateStopCount(count int) {
+	n.stateStopCount = count
 }
 
 // These functions are also required to complete the etl.Parser interface.
-func (n *NDTParser) Flush() error {
-	// Process the last group (if it exists) before flushing the inserter.
+
+// Finish processes the last test group, if any, which would otherwise wait
+// for a test with a later timestamp.
+func (n *NDTParser) Finish() error {
 	if n.timestamp != "" {
 		n.processGroup()
 	}
+	return nil
+}
+
+func (n *NDTParser) Flush() error {
+	// Process the last group (if it exists) before flushing the inserter.
+	n.Finish()
 	return n.inserter.Flush()
 }
 
@@ -150,13 +380,15 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 	// If we detect a new prefix before getting all three, we should log appropriate
 	// information about that, and possibly place error rows in the BQ table.
 	// TODO(prod) Ensure that archive files are also date sorted.
-	info, err := ParseNDTFileName(testName)
+	info, err := n.parseFileName(testName)
 	if err != nil {
+		n.countSuffix("")
 		metrics.TestCount.WithLabelValues(
 			n.TableName(), "unknown", "bad filename").Inc()
-		log.Println(err)
+		n.logger().Warning("bad filename", "test_id", testName, "reason", err)
 		return nil
 	}
+	n.countSuffix(info.Suffix)
 
 	if info.Time != n.timestamp {
 		// Handle previous test group before processing new group.
@@ -167,8 +399,7 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 		if info.Time < n.timestamp {
 			metrics.ErrorCount.WithLabelValues(
 				n.TableName(), "unknown", "TIMESTAMPS OUT OF ORDER").Inc()
-			log.Printf("Timestamps out of order in: %s\n",
-				n.taskFileName, err)
+			n.logger().Error("timestamps out of order", "test_id", testName)
 			panic("Timestamps out of order in tar file")
 		}
 
@@ -182,12 +413,14 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 		}
 	}
 
+	n.addName(info.Suffix, testName)
+
 	// Because of port number, the c2s, s2c, and meta files may come in
 	// any order.  We defer processing until Flush or new test group.
 	switch info.Suffix {
 	case "c2s_snaplog":
 		if n.c2s == nil {
-			n.c2s = &fileInfoAndData{testName, *info, content}
+			n.c2s = &fileInfoAndData{testName, *info, content, archiveIndex(taskInfo)}
 		} else {
 			// There are occasional collisions between tests that
 			// have the same timestamp.
@@ -195,7 +428,7 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// When rsync collects both the original file and
 				// the gzipped file, prefer the zipped file, since
 				// the unzipped file may be incomplete.
-				n.c2s = &fileInfoAndData{testName, *info, content}
+				n.c2s = &fileInfoAndData{testName, *info, content, archiveIndex(taskInfo)}
 			} else if n.c2s.fn == (testName + ".gz") {
 				// Unzipped file follows zipped file is unexpected,
 				// but harmless. We just ignore the unzipped file.
@@ -203,12 +436,13 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// Unexpected name collision...
 				metrics.WarningCount.WithLabelValues(
 					n.TableName(), "c2s", "timestamp collision").Inc()
-				log.Printf("Collision: %s and %s\n", n.c2s.fn, testName)
+				n.logger().Warning("timestamp collision", "test_type", "c2s",
+					"test_id", testName, "other_test_id", n.c2s.fn)
 			}
 		}
 	case "s2c_snaplog":
 		if n.s2c == nil {
-			n.s2c = &fileInfoAndData{testName, *info, content}
+			n.s2c = &fileInfoAndData{testName, *info, content, archiveIndex(taskInfo)}
 		} else {
 			// There are occasional collisions between tests that
 			// have the same timestamp.
@@ -216,7 +450,7 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// When rsync collects both the original file and
 				// the gzipped file, prefer the zipped file, since
 				// the unzipped file may be incomplete.
-				n.s2c = &fileInfoAndData{testName, *info, content}
+				n.s2c = &fileInfoAndData{testName, *info, content, archiveIndex(taskInfo)}
 			} else if n.s2c.fn == (testName + ".gz") {
 				// Unzipped file follows zipped file is unexpected,
 				// but harmless. We just ignore the unzipped file.
@@ -224,7 +458,8 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// Unexpected name collision...
 				metrics.WarningCount.WithLabelValues(
 					n.TableName(), "s2c", "timestamp collision").Inc()
-				log.Printf("Collision: %s and %s\n", n.s2c.fn, testName)
+				n.logger().Warning("timestamp collision", "test_type", "s2c",
+					"test_id", testName, "other_test_id", n.s2c.fn)
 			}
 		}
 	case "meta":
@@ -232,11 +467,40 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 			metrics.WarningCount.WithLabelValues(
 				n.TableName(), "meta", "timestamp collision").Inc()
 		}
+		start := time.Now()
 		n.metaFile = ProcessMetaFile(
 			n.TableName(), n.inserter.TableSuffix(), testName, content)
-	case "c2s_ndttrace":
-	case "s2c_ndttrace":
+		n.metaIndex = archiveIndex(taskInfo)
+		metrics.ParseDuration.WithLabelValues(
+			n.TableName(), "meta").Observe(time.Since(start).Seconds())
+	case "c2s_ndttrace", "s2c_ndttrace":
+		testType := strings.TrimSuffix(info.Suffix, "_ndttrace")
+		summary, err := ParseNDTTrace(content)
+		if err != nil {
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), testType, "unparseable ndttrace").Inc()
+			n.logger().Warning("unparseable ndttrace", "test_type", testType,
+				"test_id", testName, "reason", err)
+			break
+		}
+		if testType == "c2s" {
+			n.c2sTrace = summary
+		} else {
+			n.s2cTrace = summary
+		}
 	case "cputime":
+		if n.cputime != nil {
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), "cputime", "timestamp collision").Inc()
+		}
+		summary, err := ParseCPUTime(content)
+		if err != nil {
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), "cputime", "unparseable cputime").Inc()
+			n.logger().Warning("unparseable cputime", "test_id", testName, "reason", err)
+			break
+		}
+		n.cputime = summary
 	default:
 		metrics.TestCount.WithLabelValues(
 			n.TableName(), "unknown", "unknown suffix").Inc()
@@ -246,6 +510,78 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 	return nil
 }
 
+// parseFileName parses the test file name.  A misfiled test is still parsed,
+// as the test itself is valid, but the date dir mismatch is counted and logged.
+func (n *NDTParser) parseFileName(testName string) (*testInfo, error) {
+	info, err := ParseNDTFileName(testName)
+	if err == ErrDateDirMismatch {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), "unknown", "date dir mismatch").Inc()
+		n.logger().Warning("date dir mismatch", "test_id", testName)
+		return info, nil
+	}
+	return info, err
+}
+
+// Parse returns the row for a single c2s or s2c snaplog, without inserting
+// it.  Unlike ParseAndInsert, the test is parsed on its own, without the
+// meta, ndttrace or cputime files of its group, so the row is marked no_meta.
+// Other files produce no rows.  Parse does not affect any test group pending
+// in ParseAndInsert.
+func (n *NDTParser) Parse(taskInfo map[string]bigquery.Value, testName string, content []byte) ([]interface{}, error) {
+	info, err := n.parseFileName(testName)
+	if err != nil {
+		return nil, err
+	}
+	var testType string
+	switch info.Suffix {
+	case "c2s_snaplog":
+		testType = "c2s"
+	case "s2c_snaplog":
+		testType = "s2c"
+	default:
+		return nil, nil
+	}
+	test := &fileInfoAndData{testName, *info, content, archiveIndex(taskInfo)}
+	n.checkFileSize(test, testType)
+
+	// Use a separate parser, so that any pending group is unaffected.
+	taskFileName, _ := taskInfo["filename"].(string)
+	p := n.standalone(taskFileName)
+	results, err := p.getValues(test, testType)
+	if err != nil || results == nil {
+		return nil, err
+	}
+	if p.batchAnnotating {
+		// The row does not go through the BatchAnnotatingInserter, which
+		// would otherwise anonymize it.
+		p.anonymizeClient(results)
+	}
+	return []interface{}{p.newRow(results, testName, info.Timestamp)}, nil
+}
+
+// standalone returns a parser with the configuration of n, for the task
+// taskFileName, but none of the test group or suffix count state of n.
+func (n *NDTParser) standalone(taskFileName string) *NDTParser {
+	return &NDTParser{
+		inserter:          n.inserter,
+		RowStats:          n.RowStats,
+		taskFileName:      taskFileName,
+		countryDB:         n.countryDB,
+		annotator:         n.annotator,
+		batchAnnotating:   n.batchAnnotating,
+		keepEmptySnaplogs: n.keepEmptySnaplogs,
+		snapshotBudget:    n.snapshotBudget,
+		metaOnlyRows:      n.metaOnlyRows,
+		metaColumn:        n.metaColumn,
+		anonymizer:        n.anonymizer,
+		stateStopCount:    n.stateStopCount,
+		maxSnapshots:      n.maxSnapshots,
+		errorRows:         n.errorRows,
+		smallFileSize:     n.smallFileSize,
+		maxFileSize:       n.maxFileSize}
+}
+
 func (n *NDTParser) reportAnomalies() {
 	// Report all groups that are missing files.
 	tag := ""
@@ -275,9 +611,47 @@ func (n *NDTParser) reportAnomalies() {
 	}
 }
 
+// addName records the file name for the suffix, ignoring any .gz, so that the
+// original and gzipped copies of a file are not treated as a collision.
+func (n *NDTParser) addName(suffix, testName string) {
+	if n.names == nil {
+		n.names = make(map[string][]string)
+	}
+	name := strings.TrimSuffix(testName, ".gz")
+	for _, seen := range n.names[suffix] {
+		if seen == name {
+			return
+		}
+	}
+	n.names[suffix] = append(n.names[suffix], name)
+}
+
+// reportCollisions reports each suffix for which the current group contains
+// more than one distinct file.  Only one of the files is used.
+func (n *NDTParser) reportCollisions() {
+	suffixes := make([]string, 0, len(n.names))
+	for suffix := range n.names {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	for _, suffix := range suffixes {
+		if names := n.names[suffix]; len(names) > 1 {
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), suffix, "multi-file collision").Inc()
+			n.logger().Warning("multi-file collision", "test_type", suffix,
+				"count", len(names), "test_ids", strings.Join(names, ","))
+		}
+	}
+}
+
 // processGroup processes tests in the current timestamp grouping.
 func (n *NDTParser) processGroup() {
+	// The group is processed when a later group starts, or in Finish, so it
+	// must be reset even if processing panics.  Otherwise, it would be
+	// processed again with each later test.
+	defer n.resetGroup()
 	n.reportAnomalies()
+	n.reportCollisions()
 	// Now process the tests, with or without meta file.
 	if n.s2c != nil {
 		n.processTest(n.s2c, "s2c")
@@ -285,106 +659,329 @@ func (n *NDTParser) processGroup() {
 	if n.c2s != nil {
 		n.processTest(n.c2s, "c2s")
 	}
+	if n.s2c == nil && n.c2s == nil && n.metaFile != nil && n.metaOnlyRows {
+		n.insertMetaOnlyRow()
+	}
+}
 
+// resetGroup clears the state of the current test group.
+func (n *NDTParser) resetGroup() {
 	n.taskFileName = ""
 	n.timestamp = ""
 	n.s2c = nil
 	n.c2s = nil
+	n.c2sTrace = nil
+	n.s2cTrace = nil
+	n.cputime = nil
+	n.names = nil
 	n.metaFile = nil
 }
 
+// newRow returns the row for insertion, with an insertID derived from the
+// test_id, so that BigQuery can dedup retried inserts of the same test, and
+// dated with the test's log_time, so that the row goes to the table for that
+// day, even if the task is for a different day.
+func (n *NDTParser) newRow(results schema.Web100ValueMap, testID string, logTime time.Time) *bq.MapSaver {
+	return &bq.MapSaver{Values: results,
+		InsertID:      bq.InsertID(testID, n.inserter.TableSuffix()),
+		PartitionDate: logTime}
+}
+
+// setArchiveIndex sets the archive_index column, if the index is known.  The
+// group is processed after later files have been read, so the index is that
+// of the file the row is derived from, rather than the current task index.
+func setArchiveIndex(results schema.Web100ValueMap, index int64) {
+	if index >= 0 {
+		results["archive_index"] = index
+	}
+}
+
+// insertMetaOnlyRow writes a row for a test group that has only a meta file,
+// containing the connection spec, and the client reported throughput, if any.
+func (n *NDTParser) insertMetaOnlyRow() {
+	connSpec := schema.EmptyConnectionSpec()
+	n.metaFile.PopulateConnSpec(connSpec)
+	results := schema.Web100ValueMap{
+		"test_id":         n.metaFile.TestName,
+		"task_filename":   n.taskFileName,
+		"anomalies":       schema.Web100ValueMap{"no_snaplog": true},
+		"connection_spec": connSpec,
+	}
+	if n.metaFile.HasClientReportedThroughput {
+		results["client_reported_throughput"] = n.metaFile.ClientReportedThroughput
+	}
+	if n.metaColumn {
+		results["meta"] = n.metaFile.Values()
+	}
+	setArchiveIndex(results, n.metaIndex)
+	if !n.metaFile.DateTime.IsZero() {
+		if lt, err := n.metaFile.DateTime.MarshalText(); err == nil {
+			results["log_time"] = string(lt)
+		}
+	}
+	if now, err := time.Now().MarshalText(); err == nil {
+		results["parse_time"] = string(now)
+	}
+	n.annotateCountry(connSpec, "meta")
+	n.annotate(connSpec)
+	n.anonymizeBeforeInsert(results)
+
+	err := n.inserter.InsertRow(n.newRow(results, n.metaFile.TestName, n.metaFile.DateTime))
+	if err != nil {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), "meta", "insert-err: "+bq.InsertErrorCategory(err)).Inc()
+		n.logger().Error("insert error", "test_type", "meta",
+			"test_id", n.metaFile.TestName, "reason", err)
+		return
+	}
+	metrics.TestCount.WithLabelValues(
+		n.TableName(), "meta", "no snaplog").Inc()
+}
+
+// insertErrorRow writes a minimal row for a test whose snaplog could not be
+// parsed, if error rows are enabled.
+func (n *NDTParser) insertErrorRow(test *fileInfoAndData, testType string, parseErr error) {
+	if !n.errorRows {
+		return
+	}
+	results := schema.Web100ValueMap{
+		"test_id":       test.fn,
+		"task_filename": n.taskFileName,
+		"error_message": parseErr.Error(),
+		"anomalies":     schema.Web100ValueMap{"snaplog_error": true},
+	}
+	setArchiveIndex(results, test.index)
+	if lt, err := test.info.Timestamp.MarshalText(); err == nil {
+		results["log_time"] = string(lt)
+	}
+	if now, err := time.Now().MarshalText(); err == nil {
+		results["parse_time"] = string(now)
+	}
+	n.anonymizeBeforeInsert(results)
+
+	err := n.inserter.InsertRow(n.newRow(results, test.fn, test.info.Timestamp))
+	if err != nil {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), testType, "insert-err: "+bq.InsertErrorCategory(err)).Inc()
+		n.logger().Error("insert error", "test_type", testType,
+			"test_id", test.fn, "reason", err)
+		return
+	}
+	metrics.TestCount.WithLabelValues(
+		n.TableName(), testType, "error row").Inc()
+}
+
 // processTest digests a single s2c or c2s test, and writes a row to the Inserter.
 // ProcessMetaFile should already have been called and produced valid data in n.metaFile
 // However, we often get s2c and c2s without corresponding meta files.  When this happens,
 // we proceed with an empty metaFile.
 func (n *NDTParser) processTest(test *fileInfoAndData, testType string) {
-	// NOTE: this file size threshold and the number of simultaneous workers
-	// defined in etl_worker.go must guarantee that all files written to
-	// /mnt/tmpfs will fit.
-	if len(test.data) > 10*1024*1024 {
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, ">10MB").Inc()
-		log.Printf("Ignoring oversize snaplog: %d, %s\n",
-			len(test.data), test.fn)
+	// A panic would otherwise be reported for whichever later test triggered
+	// processing of the group, and lose the rest of the group.
+	defer func() {
+		if r := recover(); r != nil {
+			n.logger().Error("recovered from panic", "test_type", testType,
+				"test_id", test.fn, "reason", r, "stack", string(debug.Stack()))
+			metrics.TestCount.WithLabelValues(
+				n.TableName(), testType, "panic").Inc()
+		}
+	}()
+	n.checkFileSize(test, testType)
+
+	metrics.WorkerState.WithLabelValues("ndt").Inc()
+	defer metrics.WorkerState.WithLabelValues("ndt").Dec()
+
+	n.getAndInsertValues(test, testType)
+}
+
+// checkFileSize records the snaplog size.  Snaplogs larger than maxFileSize
+// are streamed by getValues, rather than parsed whole.
+func (n *NDTParser) checkFileSize(test *fileInfoAndData, testType string) {
+	if len(test.data) > n.maxFileSize {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, ">"+sizeLabel(n.maxFileSize)).Inc()
+		n.logger().Info("oversize snaplog", "test_type", testType,
+			"test_id", test.fn, "size", len(test.data))
 		metrics.FileSizeHistogram.WithLabelValues(
 			"huge").Observe(float64(len(test.data)))
 		return
-	} else {
-		// Record the file size.
-		metrics.FileSizeHistogram.WithLabelValues(
-			"normal").Observe(float64(len(test.data)))
 	}
+	// Record the file size.  The histogram buckets also isolate snaplogs
+	// truncated to exactly 4KB.
+	metrics.FileSizeHistogram.WithLabelValues(
+		"normal").Observe(float64(len(test.data)))
 
-	if len(test.data) < 16*1024 {
+	if len(test.data) < n.smallFileSize {
 		metrics.WarningCount.WithLabelValues(
-			n.TableName(), testType, "<16KB").Inc()
-		log.Printf("Note: small rawSnapLog: %d, %s\n",
-			len(test.data), test.fn)
+			n.TableName(), testType, "<"+sizeLabel(n.smallFileSize)).Inc()
+		n.logger().Info("small snaplog", "test_type", testType,
+			"test_id", test.fn, "size", len(test.data))
 	}
 	if len(test.data) == 4096 {
 		metrics.WarningCount.WithLabelValues(
 			n.TableName(), testType, "4KB").Inc()
 	}
+}
 
-	metrics.WorkerState.WithLabelValues("ndt").Inc()
-	defer metrics.WorkerState.WithLabelValues("ndt").Dec()
+// sizeLabel formats a size for a metric label, such as 16KB or 10MB.
+func sizeLabel(size int) string {
+	switch {
+	case size%(1024*1024) == 0:
+		return fmt.Sprintf("%dMB", size/(1024*1024))
+	case size%1024 == 0:
+		return fmt.Sprintf("%dKB", size/1024)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
 
-	n.getAndInsertValues(test, testType)
+// snapSchemaFields is the set of snap fields in the schema.
+var snapSchemaFields = func() map[string]bool {
+	fields := make(map[string]bool, len(schema.SnapFieldNames))
+	for _, name := range schema.SnapFieldNames {
+		fields[name] = true
+	}
+	return fields
+}()
+
+// maxExtraLayoutLabels limits the distinct extra variable names used as
+// SnapLayoutCount labels.
+const maxExtraLayoutLabels = 100
+
+// layoutLabels bounds the cardinality of the SnapLayoutCount field label for
+// extra variables, whose names come from the snaplog headers.  Names that are
+// not valid variable names are labelled "invalid", and new names beyond the
+// limit are labelled "other".
+type layoutLabels struct {
+	mu    sync.Mutex
+	limit int
+	names map[string]bool
 }
 
-func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
-	// Extract the values from the last snapshot.
-	metrics.WorkerState.WithLabelValues("parse").Inc()
-	defer metrics.WorkerState.WithLabelValues("parse").Dec()
+var validVariableName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,39}$`)
 
-	if !strings.HasSuffix(test.fn, ".gz") {
-		metrics.WarningCount.WithLabelValues(
-			n.TableName(), testType, "uncompressed file").Inc()
+func (l *layoutLabels) label(name string) string {
+	if !validVariableName.MatchString(name) {
+		return "invalid"
 	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.names[name] {
+		if len(l.names) >= l.limit {
+			return "other"
+		}
+		l.names[name] = true
+	}
+	return name
+}
 
-	snaplog, err := web100.NewSnapLog(test.data)
-	if err != nil {
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "snaplog failure").Inc()
-		log.Printf("Unable to parse snaplog for %s, when processing: %s\n%s\n",
-			test.fn, n.taskFileName, err)
+var extraLayoutLabels = &layoutLabels{
+	limit: maxExtraLayoutLabels, names: make(map[string]bool)}
+
+// checkLayout counts the snaplog variables that are not in the snap schema,
+// and so are not in the row, and the snap schema fields that the snaplog
+// lacks.  Deprecated variables are never saved, so they are ignored.
+func (n *NDTParser) checkLayout(snaplog snaplogHeader) {
+	found := 0
+	for _, v := range snaplog.Variables() {
+		if strings.HasPrefix(v.Name, "_") {
+			continue
+		}
+		if snapSchemaFields[v.CanonicalName] {
+			found++
+			continue
+		}
+		metrics.SnapLayoutCount.WithLabelValues(
+			n.TableName(), "extra", extraLayoutLabels.label(v.CanonicalName)).Inc()
+	}
+	if found == len(snapSchemaFields) {
 		return
 	}
+	present := make(map[string]bool, found)
+	for _, v := range snaplog.Variables() {
+		present[v.CanonicalName] = true
+	}
+	for _, name := range schema.SnapFieldNames {
+		if !present[name] {
+			metrics.SnapLayoutCount.WithLabelValues(
+				n.TableName(), "missing", name).Inc()
+		}
+	}
+}
 
-	valid := true
-	err = snaplog.ValidateSnapshots()
-	if err != nil {
-		log.Printf("ValidateSnapshots failed for %s, when processing: %s (%s)\n",
-			test.fn, n.taskFileName, err)
-		metrics.WarningCount.WithLabelValues(
-			n.TableName(), testType, "validate failed").Inc()
-		// If ValidateSnapshots returns error, it generally means that there
-		// is a problem with the last snapshot, typically a truncated file.
-		// In most cases, there are still many valid snapshots.
-		valid = false
+// finalSnapshotIndex returns the index of the snapshot used for the final values.
+// If the snapshots are capped, this is the last snapshot within the cap.
+func (n *NDTParser) finalSnapshotIndex(snaplog *web100.SnapLog) int {
+	final := snaplog.SnapCount() - 1
+	if n.maxSnapshots > 0 && final >= n.maxSnapshots {
+		final = n.maxSnapshots - 1
 	}
+	return final
+}
 
-	// HACK - just to see how expensive the Values() call is...
-	// parse ALL the snapshots.
+// deltaPool holds the maps for deltas that are not retained in a row.
+var deltaPool = schema.NewSnapPool(schema.DeltaFields)
+
+// getDeltas returns the deltas between successive snapshots, and the total
+// number of fields in all the deltas.  If the final snapshot was visited, it
+// is also returned, so that it need not be fetched again.
+func (n *NDTParser) getDeltas(snaplog *web100.SnapLog, testType string) ([]schema.Web100ValueMap, int, *web100.Snapshot, error) {
+	// This is the only pass over the snapshots.  The per-snapshot cost is just
+	// the comparison with the previous snapshot, and the final values are
+	// extracted once, by getFinalValues.
 	last := &web100.Snapshot{}
+	var final *web100.Snapshot
 	var deltas []schema.Web100ValueMap
 	deltaFieldCount := 0
 	snapshotCount := 0
-	for count := 0; count < snaplog.SnapCount() && count < MAX_NUM_SNAPSHOTS; count++ {
-		snap, err := snaplog.Snapshot(count)
+
+	limit := snaplog.SnapCount()
+	if n.maxSnapshots > 0 && limit > n.maxSnapshots {
+		limit = n.maxSnapshots
+	}
+	stride := n.snapshotBudget.Stride(limit)
+	if stride == 0 {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "snapshot budget exhausted").Inc()
+		return nil, 0, nil, nil
+	}
+	if stride > 1 {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "snapshot budget stride").Inc()
+	}
+	decoded := 0
+	defer func() { n.snapshotBudget.Spend(decoded) }()
+
+	// The iterator reuses its Snapshot, so a copy of the previous snapshot
+	// is kept for computing deltas.
+	prev := web100.Snapshot{}
+	visited := web100.Snapshot{}
+	iter := snaplog.Snapshots(limit)
+	iter.SetStride(stride)
+	iter.SetStopAfterNonEstablished(n.stateStopCount)
+	for snap, err := iter.Next(); err != io.EOF; snap, err = iter.Next() {
 		if err != nil {
 			// TODO - refine label and maybe write a log?
 			metrics.TestCount.WithLabelValues(
 				n.TableName(), testType, "snapshot failure").Inc()
-			return
+			return nil, 0, nil, err
+		}
+		decoded++
+		visited = *snap
+		count := iter.Index()
+		if count == n.finalSnapshotIndex(snaplog) {
+			f := *snap
+			final = &f
 		}
 		// Proper sizing avoids evacuate, saving about 20%, excluding BQ code.
-		delta := schema.EmptySnap10()
-		snap.SnapshotDeltas(last, delta)
+		// Most deltas are discarded, so their maps are pooled.
+		delta := deltaPool.Get()
+		err = snap.SnapshotDeltas(last, delta)
 		if err != nil {
+			deltaPool.Put(delta)
 			metrics.ErrorCount.WithLabelValues(
 				n.TableName(), testType, "snapValues failure").Inc()
-			return
+			return nil, 0, nil, err
 		}
 
 		// Delete the constant fields.
@@ -401,6 +998,7 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		if len(delta) == 1 {
 			_, ok := delta["Duration"]
 			if ok {
+				deltaPool.Put(delta)
 				continue
 			}
 		}
@@ -412,7 +1010,14 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 
 		deltaFieldCount += len(delta)
 		deltas = append(deltas, delta)
-		last = &snap
+		prev = *snap
+		last = &prev
+	}
+
+	if iter.Stopped() {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "state stop").Inc()
+		final = &visited
 	}
 
 	if len(deltas) > 0 {
@@ -421,51 +1026,283 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		// out the most useful tags.
 		deltas[len(deltas)-1]["is_last"] = true
 	}
-	final := snaplog.SnapCount() - 1
-	if final > MAX_NUM_SNAPSHOTS {
-		final = MAX_NUM_SNAPSHOTS
+	return deltas, deltaFieldCount, final, nil
+}
+
+// getFinalValues fills snapValues with the values from the final snapshot.
+// If final is nil, the final snapshot is fetched from the snaplog, which is
+// otherwise unused.
+func (n *NDTParser) getFinalValues(snaplog *web100.SnapLog, testType string, final *web100.Snapshot, snapValues schema.Web100ValueMap) error {
+	if final == nil {
+		snap, err := snaplog.Snapshot(n.finalSnapshotIndex(snaplog))
+		if err != nil {
+			metrics.ErrorCount.WithLabelValues(
+				n.TableName(), testType, "final snapshot failure").Inc()
+			metrics.TestCount.WithLabelValues(
+				n.TableName(), testType, "final snapshot failure").Inc()
+			return err
+		}
+		final = &snap
 	}
-	snap, err := snaplog.Snapshot(final)
+	err := final.SnapshotValues(snapValues)
 	if err != nil {
 		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "final snapshot failure").Inc()
+			n.TableName(), testType, "final snapValues failure").Inc()
 		metrics.TestCount.WithLabelValues(
-			n.TableName(), testType, "final snapshot failure").Inc()
+			n.TableName(), testType, "final snapValues failure").Inc()
+		return err
+	}
+	return nil
+}
+
+// snaplogHeader provides the header values of either a web100.SnapLog or a
+// web100.SnapLogReader.
+type snaplogHeader interface {
+	AgentVersion() string
+	ConnectionSpecValues(saver web100.Saver) error
+	Variables() []web100.VariableInfo
+}
+
+// snaplogValues holds the values extracted from a snaplog, whether it was
+// parsed whole or streamed.
+type snaplogValues struct {
+	header          snaplogHeader
+	logTime         uint32
+	snapCount       int
+	valid           bool // False if ValidateSnapshots, or streaming, failed.
+	snapValues      schema.Web100ValueMap
+	deltas          []schema.Web100ValueMap
+	deltaFieldCount int
+}
+
+// snaplogFailure records a snaplog that cannot be parsed.
+func (n *NDTParser) snaplogFailure(test *fileInfoAndData, testType string, err error) {
+	if _, ok := err.(*web100.FieldCountError); ok {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), testType, "field count mismatch").Inc()
+	}
+	metrics.ErrorCount.WithLabelValues(
+		n.TableName(), testType, "snaplog failure").Inc()
+	n.logger().Error("snaplog failure", "test_type", testType,
+		"test_id", test.fn, "reason", err)
+}
+
+// validateFailed records a snaplog whose last snapshot is invalid, typically
+// because the file is truncated.  In most cases, there are still many valid
+// snapshots.
+func (n *NDTParser) validateFailed(test *fileInfoAndData, testType string, err error) {
+	n.logger().Warning("validate failed", "test_type", testType,
+		"test_id", test.fn, "reason", err)
+	metrics.WarningCount.WithLabelValues(
+		n.TableName(), testType, "validate failed").Inc()
+}
+
+// readSnaplog parses the whole snaplog in memory, and extracts the deltas and
+// the final values.  It returns web100.ErrInflatedTooLarge, without counting
+// a failure, if the snaplog should be streamed instead.
+func (n *NDTParser) readSnaplog(test *fileInfoAndData, testType string) (*snaplogValues, error) {
+	snaplog, err := web100.NewSnapLogLimit(test.data, n.maxFileSize)
+	if err == web100.ErrInflatedTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		n.snaplogFailure(test, testType, err)
+		return nil, err
+	}
+
+	metrics.SnapCountHistogram.WithLabelValues(
+		n.TableName()).Observe(float64(snaplog.SnapCount()))
+	n.checkLayout(snaplog)
+
+	// With no snapshots, the row contains only the connection spec.
+	sv := &snaplogValues{header: snaplog, logTime: snaplog.LogTime,
+		snapCount: snaplog.SnapCount(), valid: true, snapValues: schema.EmptySnap()}
+	if sv.snapCount == 0 {
+		return sv, nil
+	}
+	if err = snaplog.ValidateSnapshots(); err != nil {
+		n.validateFailed(test, testType, err)
+		sv.valid = false
+	}
+
+	var final *web100.Snapshot
+	sv.deltas, sv.deltaFieldCount, final, err = n.getDeltas(snaplog, testType)
+	if err != nil {
+		return nil, err
+	}
+	err = n.getFinalValues(snaplog, testType, final, sv.snapValues)
+	if err != nil {
+		n.logger().Error("final snapshot failure", "test_type", testType,
+			"test_id", test.fn, "reason", err)
+		return nil, err
+	}
+	return sv, nil
+}
+
+// streamSnaplog reads a snaplog that is too large to hold in memory one
+// snapshot at a time, keeping only the final snapshot.  The row has the final
+// values, but no deltas.
+func (n *NDTParser) streamSnaplog(test *fileInfoAndData, testType string) (*snaplogValues, error) {
+	metrics.WarningCount.WithLabelValues(
+		n.TableName(), testType, "streamed snaplog").Inc()
+	rdr, err := web100.NewSnapLogReader(bytes.NewReader(test.data))
+	if err != nil {
+		n.snaplogFailure(test, testType, err)
+		return nil, err
+	}
+	n.checkLayout(rdr)
+
+	sv := &snaplogValues{header: rdr, logTime: rdr.LogTime, valid: true,
+		snapValues: schema.EmptySnap()}
+	var final *web100.Snapshot
+	for {
+		snap, err := rdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == web100.ErrTruncatedSnapshot {
+			n.validateFailed(test, testType, err)
+			sv.valid = false
+			break
+		}
+		if err != nil {
+			metrics.TestCount.WithLabelValues(
+				n.TableName(), testType, "snapshot failure").Inc()
+			return nil, err
+		}
+		// Snapshots beyond the cap are counted, but not used.
+		if n.maxSnapshots <= 0 || rdr.Count() <= n.maxSnapshots {
+			final = snap
+		}
+	}
+	sv.snapCount = rdr.Count()
+	metrics.SnapCountHistogram.WithLabelValues(
+		n.TableName()).Observe(float64(sv.snapCount))
+
+	if final == nil {
+		return sv, nil
+	}
+	if err = n.getFinalValues(nil, testType, final, sv.snapValues); err != nil {
+		n.logger().Error("final snapshot failure", "test_type", testType,
+			"test_id", test.fn, "reason", err)
+		return nil, err
+	}
+	return sv, nil
+}
+
+// getAndInsertValues extracts the row for a single s2c or c2s test, and writes
+// it to the Inserter.
+func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
+	results, err := n.getValues(test, testType)
+	if err != nil {
+		n.insertErrorRow(test, testType, err)
+		return
+	}
+	if results == nil {
 		return
 	}
-	snapValues := schema.EmptySnap()
-	snap.SnapshotValues(snapValues)
+
+	// TODO - estimate the size of the json (or fields) to allow more rows per request,
+	// but avoid going over the 10MB limit.
+	err = n.inserter.InsertRow(n.newRow(results, test.fn, test.info.Timestamp))
 	if err != nil {
 		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "final snapValues failure").Inc()
+			n.TableName(), testType, "insert-err: "+bq.InsertErrorCategory(err)).Inc()
+		// TODO: This is an insert error, that might be recoverable if we try again.
+		n.logger().Error("insert error", "test_type", testType,
+			"test_id", test.fn, "reason", err)
+		return
+	} else {
 		metrics.TestCount.WithLabelValues(
-			n.TableName(), testType, "final snapValues failure").Inc()
-		log.Printf("Error calling SnapshotValues() in test %s, when processing: %s\n%s\n",
-			test.fn, n.taskFileName, err)
+			n.TableName(), testType, "ok").Inc()
 		return
 	}
+}
+
+// getValues extracts the row values for a single s2c or c2s test.  It returns
+// an error if the snaplog cannot be parsed, and nil values, with no error, if
+// the test should be dropped.
+func (n *NDTParser) getValues(test *fileInfoAndData, testType string) (schema.Web100ValueMap, error) {
+	// Extract the values from the last snapshot.
+	metrics.WorkerState.WithLabelValues("parse").Inc()
+	defer metrics.WorkerState.WithLabelValues("parse").Dec()
+	start := time.Now()
+	defer func() {
+		metrics.ParseDuration.WithLabelValues(
+			n.TableName(), testType).Observe(time.Since(start).Seconds())
+	}()
+
+	if !strings.HasSuffix(test.fn, ".gz") {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "uncompressed file").Inc()
+	}
+
+	// Snaplogs too large to hold in memory are streamed, without deltas.
+	var sv *snaplogValues
+	var err error
+	if len(test.data) <= n.maxFileSize {
+		sv, err = n.readSnaplog(test, testType)
+	}
+	if len(test.data) > n.maxFileSize || err == web100.ErrInflatedTooLarge {
+		sv, err = n.streamSnaplog(test, testType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A snaplog may have a valid header, but no snapshots, if collection
+	// started but nothing was captured.
+	if sv.snapCount == 0 {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "zero snapshots").Inc()
+		if !n.keepEmptySnaplogs {
+			metrics.TestCount.WithLabelValues(
+				n.TableName(), testType, "zero snapshots").Inc()
+			n.logger().Warning("zero snapshots", "test_type", testType,
+				"test_id", test.fn)
+			return nil, nil
+		}
+	}
 
-	// TODO(prod) Write a row with this data, even if the snapshot parsing fails?
 	nestedConnSpec := make(schema.Web100ValueMap, 6)
-	snaplog.ConnectionSpecValues(nestedConnSpec)
+	if err := sv.header.ConnectionSpecValues(nestedConnSpec); err != nil {
+		// The snapshot addresses are used instead, in fixValues.
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "bad connection spec").Inc()
+		n.logger().Warning("bad connection spec", "test_type", testType,
+			"test_id", test.fn, "reason", err)
+	}
 
 	results := schema.NewWeb100MinimalRecord(
-		snaplog.Version, int64(snaplog.LogTime),
-		nestedConnSpec, snapValues, deltas)
+		sv.header.AgentVersion(), int64(sv.logTime),
+		nestedConnSpec, sv.snapValues, sv.deltas)
 
 	results["test_id"] = test.fn
 	results["task_filename"] = n.taskFileName
-	if snaplog.SnapCount() > MAX_NUM_SNAPSHOTS || snaplog.SnapCount() < MIN_NUM_SNAPSHOTS {
-		results["anomalies"].(schema.Web100ValueMap)["num_snaps"] = snaplog.SnapCount()
+	setArchiveIndex(results, test.index)
+	results["web100_version"] = sv.header.AgentVersion()
+	if (n.maxSnapshots > 0 && sv.snapCount > n.maxSnapshots) ||
+		sv.snapCount < MIN_NUM_SNAPSHOTS {
+		results["anomalies"].(schema.Web100ValueMap)["num_snaps"] = sv.snapCount
 	}
-	if !valid {
+	if !sv.valid {
 		results["anomalies"].(schema.Web100ValueMap)["snaplog_error"] = true
 	}
+	trace := n.c2sTrace
+	if testType == "s2c" {
+		trace = n.s2cTrace
+	}
+	if trace != nil {
+		results["trace_summary"] = trace.Values()
+	}
+	if n.cputime != nil {
+		results["cputime"] = n.cputime.Values()
+	}
 
 	// This is the timestamp parsed from the filename.
 	lt, err := test.info.Timestamp.MarshalText()
 	if err != nil {
-		log.Println(err)
+		n.logger().Error("log_time marshal error", "test_id", test.fn, "reason", err)
 		metrics.ErrorCount.WithLabelValues(
 			n.inserter.TableBase(), "log_time marshal error").Inc()
 	} else {
@@ -473,7 +1310,7 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 	}
 	now, err := time.Now().MarshalText()
 	if err != nil {
-		log.Println(err)
+		n.logger().Error("parse_time marshal error", "test_id", test.fn, "reason", err)
 		metrics.ErrorCount.WithLabelValues(
 			n.inserter.TableBase(), "parse_time marshal error").Inc()
 	} else {
@@ -482,9 +1319,10 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 
 	connSpec := schema.EmptyConnectionSpec()
 	if n.metaFile != nil {
-		// TODO - metaFile is currently used only to populate the connection spec.
-		// Should we be using it for anything else?
 		n.metaFile.PopulateConnSpec(connSpec)
+		if n.metaColumn {
+			results["meta"] = n.metaFile.Values()
+		}
 	} else {
 		// TODO Add a log once noise is reduced.
 		metrics.WarningCount.WithLabelValues(
@@ -504,38 +1342,121 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 	results["connection_spec"] = connSpec
 
 	n.fixValues(results)
+	n.annotateCountry(connSpec, testType)
+	n.annotate(connSpec)
+	n.anonymizeBeforeInsert(results)
 	// TODO fix InsertRow so that we can distinguish errors from prior rows.
 	metrics.EntryFieldCountHistogram.WithLabelValues(n.TableName()).
-		Observe(float64(deltaFieldCount))
-	if deltaFieldCount > 43000 {
-		log.Printf("Lots of fields (%d) processing %s from %s\n",
-			deltaFieldCount, test.fn, n.taskFileName)
+		Observe(float64(sv.deltaFieldCount))
+	if sv.deltaFieldCount > 43000 {
+		n.logger().Info("lots of fields", "test_type", testType,
+			"test_id", test.fn, "fields", sv.deltaFieldCount)
 	}
 	// Do this just once in a while, so it doesn't take much resource.
-	if deltaFieldCount > 30000 { // Roughly the top 5%
+	if sv.deltaFieldCount > 30000 { // Roughly the top 5%
 		jsonRow, _ := json.Marshal(results)
 		metrics.RowSizeHistogram.WithLabelValues(n.TableName()).
 			Observe(float64(len(jsonRow)))
 		if len(jsonRow) > 800000 {
-			log.Printf("Large json (%d bytes, %d fields) processing %s from %s\n",
-				len(jsonRow), deltaFieldCount, test.fn, n.taskFileName)
+			n.logger().Info("large json", "test_type", testType, "test_id", test.fn,
+				"size", len(jsonRow), "fields", sv.deltaFieldCount)
 		}
 	}
 
-	// TODO - estimate the size of the json (or fields) to allow more rows per request,
-	// but avoid going over the 10MB limit.
-	err = n.inserter.InsertRow(&bq.MapSaver{results})
-	if err != nil {
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "insert-err").Inc()
-		// TODO: This is an insert error, that might be recoverable if we try again.
-		log.Println("insert-err: " + err.Error())
+	return results, nil
+}
+
+// annotateCountry sets the client country code, if a country database is
+// available and the client_ip is found in it.  Otherwise the country code is
+// left empty.
+func (n *NDTParser) annotateCountry(connSpec schema.Web100ValueMap, testType string) {
+	if n.countryDB == nil {
 		return
-	} else {
-		metrics.TestCount.WithLabelValues(
-			n.TableName(), testType, "ok").Inc()
+	}
+	ip, ok := connSpec.GetString([]string{"client_ip"})
+	if !ok || ip == "" {
+		return
+	}
+	country, ok := n.countryDB.CountryCode(ip)
+	if !ok {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "unknown client country").Inc()
+		return
+	}
+	clientGeo := connSpec.Get("client_geolocation")
+	if clientGeo == nil {
+		clientGeo = schema.EmptyGeolocation()
+		connSpec["client_geolocation"] = clientGeo
+	}
+	clientGeo.SetString("country_code", country)
+}
+
+// annotate passes the connection spec to the annotator, if there is one and
+// the client_ip is known.
+func (n *NDTParser) annotate(connSpec schema.Web100ValueMap) {
+	if n.annotator == nil {
+		return
+	}
+	ip, ok := connSpec.GetString([]string{"client_ip"})
+	if !ok || ip == "" {
 		return
 	}
+	n.annotator.Annotate(ip, connSpec)
+}
+
+// anonymizeBeforeInsert anonymizes the row, unless a BatchAnnotatingInserter
+// will anonymize it after annotation.
+func (n *NDTParser) anonymizeBeforeInsert(r schema.Web100ValueMap) {
+	if !n.batchAnnotating {
+		n.anonymizeClient(r)
+	}
+}
+
+// anonymizeClient masks the client address in the connection specs and the
+// snap, and adds the salted connection_spec.client_ip_hash.  The client address
+// or hostname in the test_id and the meta column file names is replaced by its
+// hash, and the client_hostname and the client supplied meta additional fields
+// are removed.  It must be called after any annotation that requires the full
+// address.
+func (n *NDTParser) anonymizeClient(r schema.Web100ValueMap) {
+	if n.anonymizer == nil {
+		return
+	}
+	if testID, ok := r["test_id"].(string); ok {
+		if info, _ := ParseNDTFileName(testID); info != nil {
+			r["test_id"] = n.anonymizer.HashName(testID, info.Address)
+		}
+	}
+	connSpec := r.GetMap([]string{"connection_spec"})
+	if ip, ok := connSpec.GetString([]string{"client_ip"}); ok && ip != "" {
+		connSpec.SetString("client_ip_hash", n.anonymizer.Hash(ip))
+		connSpec.SetString("client_ip", n.anonymizer.Mask(ip))
+	}
+	delete(connSpec, "client_hostname")
+	if meta := r.GetMap([]string{"meta"}); meta != nil {
+		for _, column := range metaColumns {
+			name, ok := meta.GetString([]string{column})
+			if !ok || !strings.HasSuffix(column, "_file") {
+				continue
+			}
+			if info, _ := ParseNDTFileName(name); info != nil {
+				meta.SetString(column, n.anonymizer.HashName(name, info.Address))
+			} else {
+				delete(meta, column)
+			}
+		}
+		delete(meta, "additional")
+	}
+	if nested := r.GetMap([]string{"web100_log_entry", "connection_spec"}); nested != nil {
+		if ip, ok := nested.GetString([]string{"remote_ip"}); ok {
+			nested.SetString("remote_ip", n.anonymizer.Mask(ip))
+		}
+	}
+	if snap := r.GetMap([]string{"web100_log_entry", "snap"}); snap != nil {
+		if ip, ok := snap.GetString([]string{"RemAddress"}); ok {
+			snap.SetString("RemAddress", n.anonymizer.Mask(ip))
+		}
+	}
 }
 
 const (
@@ -568,8 +1489,8 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 		data, err := etl.ValidateTestPath(n.taskFileName)
 		if err != nil {
 			// The current filename is ambiguous, but the timestamp should help.
-			log.Printf("WARNING: taskFileName is unexpectedly invalid: %s %s: %q",
-				n.taskFileName, n.timestamp, err)
+			n.logger().Warning("invalid task filename", "timestamp", n.timestamp,
+				"reason", err)
 		} else {
 			connSpec.SetString("server_hostname", fmt.Sprintf(
 				"%s.%s.%s", data.Host, data.Pod, etl.MlabDomain))
@@ -587,8 +1508,7 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 	// Handle local_af.
 	// Translate LocalAddressType values of WC_ADDRTYPE_IPV4 (1) or WC_ADDRTYPE_IPV6 (2)
 	// to legacy tables local_af values (LOCAL_AF_IPV*.)
-	localAddrType, ok := snap["LocalAddressType"]
-	if ok {
+	if localAddrType, ok := snap.GetInt64([]string{"LocalAddressType"}); ok {
 		switch localAddrType {
 		case WC_ADDRTYPE_IPV4:
 			nestedConnSpec.SetInt64("local_af", LOCAL_AF_IPV4)
@@ -605,12 +1525,27 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 	// TODO - make these the ONLY representation of client/server tuple.
 	r.SubstituteString(false, []string{"connection_spec", "server_ip"},
 		[]string{"web100_log_entry", "connection_spec", "local_ip"})
-	r.SubstituteInt64(false, []string{"connection_spec", "server_af"},
-		[]string{"web100_log_entry", "connection_spec", "local_af"})
 	r.SubstituteString(false, []string{"connection_spec", "client_ip"},
 		[]string{"web100_log_entry", "connection_spec", "remote_ip"})
-	r.SubstituteInt64(false, []string{"connection_spec", "client_af"},
-		[]string{"web100_log_entry", "connection_spec", "local_af"})
+	// The top level server_af and client_af use the IPv4_AF and IPv6_AF
+	// values, as in the meta file, so local_af must be translated.  Both ends
+	// of the connection have the same address family.
+	if localAF, ok := nestedConnSpec.GetInt64([]string{"local_af"}); ok {
+		var af int64
+		switch localAF {
+		case LOCAL_AF_IPV4:
+			af = int64(IPv4_AF)
+		case LOCAL_AF_IPV6:
+			af = int64(IPv6_AF)
+		}
+		if af != 0 {
+			for _, name := range []string{"server_af", "client_af"} {
+				if _, ok := connSpec[name]; !ok {
+					connSpec.SetInt64(name, af)
+				}
+			}
+		}
+	}
 
 	start, ok := snap.GetInt64([]string{"StartTimeStamp"})
 	if ok {
@@ -620,6 +1555,16 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 			start += usec
 		}
 		snap.SetInt64("StartTimeStamp", start)
+		// StartTimeStamp is constant for the connection, so the final
+		// snapshot value is also the start time of the first snapshot.
+		if st, err := time.Unix(0, 1000*start).UTC().MarshalText(); err == nil {
+			r["test_start_time"] = string(st)
+		}
 	}
 
+	// Promote the final snapshot Duration, which is used by nearly every
+	// analysis.  The nested value is retained.
+	if duration, ok := snap.GetInt64([]string{"Duration"}); ok {
+		r["test_duration_usec"] = duration
+	}
 }
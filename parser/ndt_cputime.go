@@ -0,0 +1,92 @@
+package parser
+
+// ndt_cputime.go contains code for summarizing the ndt .cputime files.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/etl/schema"
+)
+
+// The cputime times are in clock ticks, which are 1/100 sec on the servers.
+const cpuTicksPerSecond = 100
+
+// CPUTimeSummary summarizes the server CPU utilization during a test, as a
+// fraction of one CPU, over the sample intervals of the cputime file.
+type CPUTimeSummary struct {
+	Min  float64
+	Max  float64
+	Mean float64 // Weighted by interval length.
+}
+
+// Values returns the summary as a record for the cputime column.
+func (cs *CPUTimeSummary) Values() schema.Web100ValueMap {
+	return schema.Web100ValueMap{
+		"min":  cs.Min,
+		"max":  cs.Max,
+		"mean": cs.Mean,
+	}
+}
+
+// ParseCPUTime summarizes a cputime file.  Each line holds a sample of the
+// elapsed time in seconds, followed by the cumulative user, system, child
+// user, and child system times in clock ticks, e.g.
+//   25.93 11 31 0 1
+func ParseCPUTime(data []byte) (*CPUTimeSummary, error) {
+	summary := &CPUTimeSummary{}
+	var elapsed, ticks float64 // Totals for the mean.
+	var lastTime, lastTicks float64
+	first := true
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("cputime line %d: %d fields, want 5", line, len(fields))
+		}
+		values := make([]float64, len(fields))
+		for i, f := range fields {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cputime line %d: %v", line, err)
+			}
+			values[i] = v
+		}
+		sampleTime, sampleTicks := values[0], values[1]+values[2]+values[3]+values[4]
+		dt, dticks := sampleTime-lastTime, sampleTicks-lastTicks
+		if !first && dt <= 0 {
+			// Skip samples that are out of order, or not yet updated.
+			continue
+		}
+		lastTime, lastTicks = sampleTime, sampleTicks
+		// The times occasionally decrease, making the interval unusable.
+		if first || dticks < 0 {
+			first = false
+			continue
+		}
+		cpu := dticks / cpuTicksPerSecond / dt
+		if elapsed == 0 || cpu < summary.Min {
+			summary.Min = cpu
+		}
+		if elapsed == 0 || cpu > summary.Max {
+			summary.Max = cpu
+		}
+		elapsed += dt
+		ticks += dticks
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if elapsed == 0 {
+		return nil, errors.New("cputime has no sample intervals")
+	}
+	summary.Mean = ticks / cpuTicksPerSecond / elapsed
+	return summary, nil
+}
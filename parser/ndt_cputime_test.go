@@ -0,0 +1,85 @@
+package parser_test
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
+)
+
+func TestParseCPUTime(t *testing.T) {
+	data, err := ioutil.ReadFile(`testdata/20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.cputime`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want parser.CPUTimeSummary
+	}{
+		// 55 ticks over 25.83 seconds, excluding two intervals where the
+		// times decrease.
+		{"testdata", data, parser.CPUTimeSummary{Min: 0, Max: 0.7, Mean: 0.55 / 25.83}},
+		{"busy", []byte("0.00 0 0 0 0\n0.10 5 5 0 0\n0.20 5 10 0 0\n"),
+			parser.CPUTimeSummary{Min: 0.5, Max: 1, Mean: 0.75}},
+		// Samples that are not yet updated are skipped.
+		{"stale", []byte("0.00 0 0 0 0\n0.00 0 1 0 0\n0.10 1 1 0 0\n\n"),
+			parser.CPUTimeSummary{Min: 0.2, Max: 0.2, Mean: 0.2}},
+	}
+	for _, test := range tests {
+		summary, err := parser.ParseCPUTime(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if math.Abs(summary.Min-test.want.Min) > 1e-9 || math.Abs(summary.Max-test.want.Max) > 1e-9 ||
+			math.Abs(summary.Mean-test.want.Mean) > 1e-9 {
+			t.Errorf("%s: got %+v, want %+v", test.name, *summary, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "0.00 0 0 0 0\n", "0.00 0 0 0\n0.10 0 0 0\n", "0.00 0 0 0 0\n0.10 x 0 0 0\n"} {
+		if _, err := parser.ParseCPUTime([]byte(bad)); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestNDTCPUTime(t *testing.T) {
+	prefix := `20170509T13:45:13.590210000Z_eb.measurementlab.net:`
+	s2cName := prefix + `44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	cpuName := prefix + `53000.cputime`
+	cpuData, err := ioutil.ReadFile(`testdata/` + cpuName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+	// The cputime file may precede the snaplog.
+	n.ParseAndInsert(meta, cpuName+".gz", cpuData)
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	// A test group with an unparseable cputime file has no cputime.
+	n.ParseAndInsert(meta, `20170509T13:50:13.590210000Z_eb.measurementlab.net:53000.cputime.gz`, []byte("garbage"))
+	n.ParseAndInsert(meta, `20170509T13:50:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz`, s2cData)
+	n.Flush()
+	if len(ins.data) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(ins.data))
+	}
+
+	cputime, ok := ins.data[0].(*bq.MapSaver).Values["cputime"].(schema.Web100ValueMap)
+	if !ok {
+		t.Fatalf("Missing cputime: %v", ins.data[0].(*bq.MapSaver).Values["cputime"])
+	}
+	if max, _ := cputime["max"].(float64); math.Abs(max-0.7) > 1e-9 {
+		t.Errorf("Wrong cputime max %v", cputime["max"])
+	}
+	if cputime, ok := ins.data[1].(*bq.MapSaver).Values["cputime"]; ok {
+		t.Errorf("Unexpected cputime %v", cputime)
+	}
+}
@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl/schema"
+)
+
+// afRow returns a row with no meta file values, for a snapshot with the given
+// LocalAddressType.
+func afRow(localAddrType int64, local, remote string) schema.Web100ValueMap {
+	return schema.Web100ValueMap{
+		"connection_spec": schema.Web100ValueMap{
+			"server_hostname": "mlab1.lga02.measurement-lab.org",
+		},
+		"web100_log_entry": schema.Web100ValueMap{
+			// The snaplog connection spec is always IPv4.
+			"connection_spec": schema.Web100ValueMap{"local_af": int64(LOCAL_AF_IPV4)},
+			"snap": schema.Web100ValueMap{
+				"LocalAddressType": localAddrType,
+				"LocalAddress":     local,
+				"RemAddress":       remote,
+			},
+		},
+	}
+}
+
+func TestFixValuesAF(t *testing.T) {
+	tests := []struct {
+		name     string
+		addrType int64
+		local    string
+		remote   string
+		localAF  int64
+		af       int64
+	}{
+		{"ipv4", WC_ADDRTYPE_IPV4, "213.208.152.37", "45.56.98.222", LOCAL_AF_IPV4, int64(IPv4_AF)},
+		{"ipv6", WC_ADDRTYPE_IPV6, "2001:db8::1", "2001:db8::2", LOCAL_AF_IPV6, int64(IPv6_AF)},
+	}
+	n := &NDTParser{}
+	for _, test := range tests {
+		r := afRow(test.addrType, test.local, test.remote)
+		n.fixValues(r)
+		if af, _ := r.GetInt64([]string{"web100_log_entry", "connection_spec", "local_af"}); af != test.localAF {
+			t.Errorf("%s: local_af = %d, want %d", test.name, af, test.localAF)
+		}
+		for _, name := range []string{"server_af", "client_af"} {
+			if af, _ := r.GetInt64([]string{"connection_spec", name}); af != test.af {
+				t.Errorf("%s: %s = %d, want %d", test.name, name, af, test.af)
+			}
+		}
+		if ip, _ := r.GetString([]string{"connection_spec", "client_ip"}); ip != test.remote {
+			t.Errorf("%s: client_ip = %s, want %s", test.name, ip, test.remote)
+		}
+	}
+
+	// Values from the meta file are not replaced.
+	r := afRow(WC_ADDRTYPE_IPV6, "2001:db8::1", "2001:db8::2")
+	r.GetMap([]string{"connection_spec"}).SetInt64("client_af", int64(IPv4_AF))
+	n.fixValues(r)
+	if af, _ := r.GetInt64([]string{"connection_spec", "client_af"}); af != int64(IPv4_AF) {
+		t.Errorf("client_af = %d, want %d", af, int64(IPv4_AF))
+	}
+}
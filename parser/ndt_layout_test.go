@@ -0,0 +1,28 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayoutLabels(t *testing.T) {
+	l := &layoutLabels{limit: 2, names: make(map[string]bool)}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"CurCwnX", "CurCwnX"},
+		{"X_NewVar", "X_NewVar"},
+		// Names already seen keep their label after the limit is reached.
+		{"CurCwnX", "CurCwnX"},
+		{"ThirdVar", "other"},
+		{"Bad Name", "invalid"},
+		{"", "invalid"},
+		{strings.Repeat("A", 41), "invalid"},
+	}
+	for _, test := range tests {
+		if got := l.label(test.name); got != test.want {
+			t.Errorf("label(%q) = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -3,14 +3,15 @@ package parser
 // ndt_meta.go contains code for processing the ndt .meta files.
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
-	"io"
+	"errors"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/m-lab/etl/metrics"
@@ -18,6 +19,31 @@ import (
 )
 
 // MetaFileData is the parsed info from the .meta file.
+//
+// The .meta file is line oriented, with one "key: value" pair per line.  The
+// recognized keys, and the fields they populate, are:
+//   Date/Time                DateTime
+//   c2s_snaplog file         C2SSnaplog
+//   s2c_snaplog file         S2CSnaplog
+//   c2s_ndttrace file        C2SNdttrace
+//   s2c_ndttrace file        S2CNdttrace
+//   cputime file             Cputime
+//   server IP address        ServerIP
+//   server hostname          ServerHostname
+//   server kernel version    ServerKernelVersion
+//   tcp_cc                   TCPCongestionControl
+//   client IP address        ClientIP
+//   client hostname          ClientHostname
+//   client OS name           ClientOS
+//   client_browser name      ClientBrowser
+//   client_application name  ClientApplication
+//   client.kernel.version    ClientKernelVersion
+//   client.version           ClientVersion
+//   Summary data             SummaryData
+//   tls                      Tls
+//   websockets               Websockets
+//   client.s2c.throughput    ClientReportedThroughput
+// All other keys are retained, as strings, only in Fields.
 type MetaFileData struct {
 	TestName    string
 	DateTime    time.Time
@@ -25,6 +51,32 @@ type MetaFileData struct {
 	Tls         bool
 	Websockets  bool
 
+	// Names of the other files that make up the test.
+	C2SSnaplog  string
+	S2CSnaplog  string
+	C2SNdttrace string
+	S2CNdttrace string
+	Cputime     string
+
+	ServerIP            string
+	ServerHostname      string
+	ServerKernelVersion string
+	ClientIP            string
+	ClientHostname      string
+	ClientOS            string
+	ClientBrowser       string
+	ClientApplication   string
+	ClientKernelVersion string
+	ClientVersion       string
+
+	// The server's TCP congestion control algorithm, such as "cubic".
+	TCPCongestionControl string
+
+	// The s2c throughput in kbps, as measured by the client.  Only reported
+	// by some clients, and valid only if HasClientReportedThroughput is true.
+	ClientReportedThroughput    float64
+	HasClientReportedThroughput bool
+
 	Fields map[string]string // All of the string fields.
 }
 
@@ -65,9 +117,9 @@ func handleIP(connSpec schema.Web100ValueMap, prefix string, ipString string) {
 	} else {
 		connSpec.SetString(prefix+"_ip", ip.String())
 		if ip.To4() != nil {
-			connSpec.SetInt64(prefix+"_af", syscall.AF_INET)
+			connSpec.SetInt64(prefix+"_af", int64(IPv4_AF))
 		} else if ip.To16() != nil {
-			connSpec.SetInt64(prefix+"_af", syscall.AF_INET6)
+			connSpec.SetInt64(prefix+"_af", int64(IPv6_AF))
 		}
 	}
 }
@@ -114,9 +166,56 @@ func (mfd *MetaFileData) PopulateConnSpec(connSpec schema.Web100ValueMap) {
 	}
 }
 
+// metaColumns maps the meta file keys to the fields of the NDT meta column.
+var metaColumns = map[string]string{
+	"tcp_cc":            "tcp_cc",
+	"c2s_snaplog file":  "c2s_snaplog_file",
+	"s2c_snaplog file":  "s2c_snaplog_file",
+	"c2s_ndttrace file": "c2s_ndttrace_file",
+	"s2c_ndttrace file": "s2c_ndttrace_file",
+	"cputime file":      "cputime_file",
+}
+
+// Values returns the contents of the meta file for the NDT meta column,
+// excluding the fields in the connection spec, or other columns.  Empty values
+// are omitted.  Keys without a column of their own are retained, as strings,
+// in the repeated additional {key, value} field, sorted by key.
+func (mfd *MetaFileData) Values() schema.Web100ValueMap {
+	values := make(schema.Web100ValueMap, len(metaColumns)+2)
+	var additional []string
+	for k, v := range mfd.Fields {
+		if v == "" {
+			continue
+		}
+		if column, ok := metaColumns[k]; ok {
+			values.SetString(column, v)
+		} else if _, ok := fieldPairs[k]; !ok && k != clientThroughputKey {
+			additional = append(additional, k)
+		}
+	}
+	if len(mfd.SummaryData) > 0 {
+		summary := make([]int64, len(mfd.SummaryData))
+		for i, v := range mfd.SummaryData {
+			summary[i] = int64(v)
+		}
+		values["summary_data"] = summary
+	}
+	if len(additional) > 0 {
+		sort.Strings(additional)
+		kvs := make([]schema.Web100ValueMap, len(additional))
+		for i, k := range additional {
+			kvs[i] = schema.Web100ValueMap{"key": k, "value": mfd.Fields[k]}
+		}
+		values["additional"] = kvs
+	}
+	return values
+}
+
+// clientThroughputKey is the "Additional" meta key some clients use to report
+// the s2c throughput they measured.
+const clientThroughputKey = "client.s2c.throughput"
+
 // createMetaFileData uses the key:value pairs to populate the interpreted fields.
-// TODO(dev) - more unit tests?
-// TODO(dev) - move to separate file - meta.go
 func createMetaFileData(testName string, fields map[string]string) (*MetaFileData, error) {
 	var data MetaFileData
 	data.TestName = testName
@@ -134,12 +233,26 @@ func createMetaFileData(testName string, fields map[string]string) (*MetaFileDat
 		case "websockets":
 			data.Websockets, err = strconv.ParseBool(v)
 			data.Fields[k] = v
+		case clientThroughputKey:
+			data.Fields[k] = v
+			// A bad value should not invalidate the rest of the meta file.
+			t, parseErr := strconv.ParseFloat(v, 64)
+			if parseErr != nil {
+				metrics.WarningCount.WithLabelValues(
+					"ndt", "meta", "bad client throughput").Inc()
+			} else {
+				data.ClientReportedThroughput = t
+				data.HasClientReportedThroughput = true
+			}
 		case "Summary data":
 			err = json.Unmarshal(
 				[]byte(`{"SummaryData":[`+v+`]}`),
 				&data)
 		default:
 			data.Fields[k] = v
+			if field := data.stringField(k); field != nil {
+				*field = v
+			}
 		}
 		if err != nil {
 			return nil, err
@@ -148,6 +261,51 @@ func createMetaFileData(testName string, fields map[string]string) (*MetaFileDat
 	return &data, nil
 }
 
+// stringField returns a pointer to the typed string field for the given key,
+// or nil if the key does not have a typed field.
+func (mfd *MetaFileData) stringField(key string) *string {
+	switch key {
+	case "c2s_snaplog file":
+		return &mfd.C2SSnaplog
+	case "s2c_snaplog file":
+		return &mfd.S2CSnaplog
+	case "c2s_ndttrace file":
+		return &mfd.C2SNdttrace
+	case "s2c_ndttrace file":
+		return &mfd.S2CNdttrace
+	case "cputime file":
+		return &mfd.Cputime
+	case "server IP address":
+		return &mfd.ServerIP
+	case "server hostname":
+		return &mfd.ServerHostname
+	case "server kernel version":
+		return &mfd.ServerKernelVersion
+	case "tcp_cc":
+		return &mfd.TCPCongestionControl
+	case "client IP address":
+		return &mfd.ClientIP
+	case "client hostname":
+		return &mfd.ClientHostname
+	case "client OS name":
+		return &mfd.ClientOS
+	case "client_browser name":
+		return &mfd.ClientBrowser
+	case "client_application name":
+		return &mfd.ClientApplication
+	case "client.kernel.version":
+		return &mfd.ClientKernelVersion
+	case "client.version":
+		return &mfd.ClientVersion
+	default:
+		return nil
+	}
+}
+
+// additionalDataLine separates the server provided fields from the
+// "Additional" fields optionally provided by the client.
+const additionalDataLine = " * Additional data:"
+
 // parseMetaFile converts the raw content into key value map.
 // Meta file has .meta suffix, and contains mostly key value pairs separated by ':', some with no value, e.g.
 // Date/Time: 20170512T17:55:18.538553000Z
@@ -162,36 +320,37 @@ func createMetaFileData(testName string, fields map[string]string) (*MetaFileDat
 // websockets: true
 //
 // Notable exception is the * Additional data: line, which also parses as a key value pair, but isn't.
-// TODO pass fileInfoAndData
+// Other lines that do not contain a ':' separator are malformed.  They are
+// counted and skipped, and the remaining lines are still parsed.
 func parseMetaFile(rawContent []byte) (map[string]string, error) {
 	result := make(map[string]string, 20)
 
-	buf := bytes.NewBuffer(rawContent)
-	var err error
-	var line string
-	for {
-		line, err = buf.ReadString('\n')
-		if err != nil {
-			break
+	scanner := bufio.NewScanner(bytes.NewReader(rawContent))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || line == additionalDataLine {
+			continue
 		}
 		kv := strings.SplitN(line, ":", 2)
-		if len(kv) != 2 {
-			// Does this trigger for " * Additional data:"?
-			// TODO Error message or counter?
+		if len(kv) != 2 || kv[0] == "" {
+			metrics.WarningCount.WithLabelValues(
+				"ndt", "meta", "malformed line").Inc()
 			continue
 		}
 		// TODO(dev) - filter out binary data that sometimes shows up in corrupted files.
 		result[kv[0]] = kv[1]
 	}
-	if err != io.EOF {
-		// TODO Error message or counter?
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	if len(result) == 0 {
+		return nil, errors.New("no fields found in meta file")
+	}
 	return result, nil
 }
 
-// ProcessMeta parses the .meta file.
-// TODO(dev) - add unit tests
+// ProcessMetaFile parses the .meta file.  Returns nil if the content can't be
+// parsed.
 // TODO(prod) - For tests that include a meta file, should respect the test filenames.
 // See ndt_meta_log_parser_lib.cc
 func ProcessMetaFile(tableName string, suffix string, testName string, content []byte) *MetaFileData {
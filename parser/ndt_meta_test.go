@@ -2,7 +2,7 @@ package parser_test
 
 import (
 	"io/ioutil"
-	"syscall"
+	"reflect"
 	"testing"
 	"time"
 
@@ -61,7 +61,7 @@ func TestMetaParser(t *testing.T) {
 		t.Logf("missing client_af annotation")
 		t.Error("missing client_af")
 	} else {
-		if v.(int64) != syscall.AF_INET {
+		if v.(int64) != int64(parser.IPv4_AF) {
 			t.Logf("Wrong client_af value: ", v.(int64))
 		}
 
@@ -86,3 +86,179 @@ func TestMetaParser(t *testing.T) {
 			connSpec["client_os"])
 	}
 }
+
+// A complete meta file, including the Additional data section.
+var completeMeta = []byte(`Date/Time: 20170509T13:45:13.590210000Z
+c2s_snaplog file: 20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog.gz
+c2s_ndttrace file: 20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace.gz
+s2c_snaplog file: 20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz
+s2c_ndttrace file: 20170509T13:45:13.590210000Z_45.56.98.222.s2c_ndttrace.gz
+cputime file: 20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.cputime.gz
+server IP address: 213.208.152.37
+server hostname: mlab3.vie01.measurement-lab.org
+server kernel version: 2.6.32-131.vs230.web10027.xidmask.2.mlab.i686
+tcp_cc: cubic
+client IP address: 45.56.98.222
+client hostname: eb.measurementlab.net
+client OS name: CLIWebsockets
+client_browser name: firefox
+client_application name: ndt
+Summary data: 0,36,1346
+ * Additional data:
+client.version: 3.7.0
+client.kernel.version: 3.14.0
+tls: false
+websockets: true`)
+
+func TestMetaFileFields(t *testing.T) {
+	meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta", completeMeta)
+	if meta == nil {
+		t.Fatal("metaFile has not been populated.")
+	}
+	expected := map[string]string{
+		"C2SSnaplog":           "20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog.gz",
+		"S2CSnaplog":           "20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz",
+		"C2SNdttrace":          "20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace.gz",
+		"S2CNdttrace":          "20170509T13:45:13.590210000Z_45.56.98.222.s2c_ndttrace.gz",
+		"Cputime":              "20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.cputime.gz",
+		"ServerIP":             "213.208.152.37",
+		"ServerHostname":       "mlab3.vie01.measurement-lab.org",
+		"ServerKernelVersion":  "2.6.32-131.vs230.web10027.xidmask.2.mlab.i686",
+		"ClientIP":             "45.56.98.222",
+		"ClientHostname":       "eb.measurementlab.net",
+		"ClientOS":             "CLIWebsockets",
+		"ClientBrowser":        "firefox",
+		"ClientApplication":    "ndt",
+		"ClientKernelVersion":  "3.14.0",
+		"ClientVersion":        "3.7.0",
+		"TCPCongestionControl": "cubic",
+	}
+	actual := map[string]string{
+		"C2SSnaplog":           meta.C2SSnaplog,
+		"S2CSnaplog":           meta.S2CSnaplog,
+		"C2SNdttrace":          meta.C2SNdttrace,
+		"S2CNdttrace":          meta.S2CNdttrace,
+		"Cputime":              meta.Cputime,
+		"ServerIP":             meta.ServerIP,
+		"ServerHostname":       meta.ServerHostname,
+		"ServerKernelVersion":  meta.ServerKernelVersion,
+		"ClientIP":             meta.ClientIP,
+		"ClientHostname":       meta.ClientHostname,
+		"ClientOS":             meta.ClientOS,
+		"ClientBrowser":        meta.ClientBrowser,
+		"ClientApplication":    meta.ClientApplication,
+		"ClientKernelVersion":  meta.ClientKernelVersion,
+		"ClientVersion":        meta.ClientVersion,
+		"TCPCongestionControl": meta.TCPCongestionControl,
+	}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("Incorrect %s: got %q; want %q", k, actual[k], v)
+		}
+	}
+	timestamp, _ := time.Parse("20060102T15:04:05.999999999Z", "20170509T13:45:13.59021Z")
+	if meta.DateTime != timestamp {
+		t.Error("Incorrect time: ", meta.DateTime)
+	}
+	if len(meta.SummaryData) != 3 || meta.SummaryData[2] != 1346 {
+		t.Error("Incorrect SummaryData: ", meta.SummaryData)
+	}
+	if meta.Tls || !meta.Websockets {
+		t.Errorf("Incorrect tls/websockets: got %v/%v; want false/true",
+			meta.Tls, meta.Websockets)
+	}
+	// The final line has no trailing newline, and must not be dropped.
+	if meta.Fields["websockets"] != "true" {
+		t.Error("Missing final line")
+	}
+	if _, ok := meta.Fields[" * Additional data"]; ok {
+		t.Error("Additional data line should not be treated as a field")
+	}
+
+	connSpec := schema.EmptyConnectionSpec()
+	meta.PopulateConnSpec(connSpec)
+	if connSpec["server_ip"] != "213.208.152.37" {
+		t.Errorf("Incorrect server_ip: got %v", connSpec["server_ip"])
+	}
+	if connSpec["client_browser"] != "firefox" {
+		t.Errorf("Incorrect client_browser: got %v", connSpec["client_browser"])
+	}
+}
+
+func TestMetaFileValues(t *testing.T) {
+	meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta",
+		append(append([]byte{}, completeMeta...), "\nweb values file: \nclient.os.name: CLIWebsockets"...))
+	if meta == nil {
+		t.Fatal("metaFile has not been populated.")
+	}
+	expected := schema.Web100ValueMap{
+		"tcp_cc":            "cubic",
+		"c2s_snaplog_file":  "20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog.gz",
+		"s2c_snaplog_file":  "20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz",
+		"c2s_ndttrace_file": "20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace.gz",
+		"s2c_ndttrace_file": "20170509T13:45:13.590210000Z_45.56.98.222.s2c_ndttrace.gz",
+		"cputime_file":      "20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.cputime.gz",
+		"summary_data":      []int64{0, 36, 1346},
+		// The empty web values file is omitted, and the connection spec
+		// fields are not repeated.
+		"additional": []schema.Web100ValueMap{
+			{"key": "client.os.name", "value": "CLIWebsockets"},
+		},
+	}
+	if values := meta.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("Got %v, want %v", values, expected)
+	}
+}
+
+func TestMetaFileMissingClientIP(t *testing.T) {
+	content := []byte("Date/Time: 20170509T13:45:13.590210000Z\n" +
+		"server hostname: mlab3.vie01.measurement-lab.org\n" +
+		"client hostname: eb.measurementlab.net\n")
+	meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta", content)
+	if meta == nil {
+		t.Fatal("metaFile has not been populated.")
+	}
+	if meta.ClientIP != "" {
+		t.Errorf("Incorrect ClientIP: got %q; want empty", meta.ClientIP)
+	}
+	if meta.ClientHostname != "eb.measurementlab.net" {
+		t.Errorf("Incorrect ClientHostname: got %q", meta.ClientHostname)
+	}
+
+	connSpec := schema.EmptyConnectionSpec()
+	meta.PopulateConnSpec(connSpec)
+	if _, ok := connSpec["client_ip"]; ok {
+		t.Error("expected client_ip to be empty")
+	}
+	if _, ok := connSpec["client_af"]; ok {
+		t.Error("expected client_af to be empty")
+	}
+}
+
+func TestMetaFileMalformedLine(t *testing.T) {
+	// A line without a separator is skipped, and the rest of the file is parsed.
+	content := []byte("Date/Time: 20170509T13:45:13.590210000Z\n" +
+		"this line has no separator\n" +
+		"client IP address: 45.56.98.222\n")
+	meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta", content)
+	if meta == nil {
+		t.Fatal("metaFile has not been populated.")
+	}
+	if meta.ClientIP != "45.56.98.222" {
+		t.Errorf("Incorrect ClientIP: got %q", meta.ClientIP)
+	}
+	if len(meta.Fields) != 1 {
+		t.Errorf("Incorrect number of fields: got %d; want 1", len(meta.Fields))
+	}
+
+	// A line with a value that can't be interpreted invalidates the file.
+	content = []byte("Date/Time: not a time\n" +
+		"client IP address: 45.56.98.222\n")
+	if meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta", content); meta != nil {
+		t.Error("Expected nil for invalid Date/Time")
+	}
+	content = []byte("tls: maybe\n")
+	if meta := parser.ProcessMetaFile("ndt", "suffix", "test.meta", content); meta != nil {
+		t.Error("Expected nil for invalid tls value")
+	}
+}
@@ -1,19 +1,46 @@
 package parser_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/geo"
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
 	"github.com/m-lab/etl/schema"
+	"github.com/m-lab/etl/web100"
 
 	"github.com/kr/pretty"
+	dto "github.com/prometheus/client_model/go"
 
 	"cloud.google.com/go/bigquery"
 )
 
+// testArchive is the task filename used with the testdata snaplogs.
+const testArchive = "gs://mlab-test-bucket/ndt/2017/05/09/20170509T000000Z-mlab3-vie01-ndt-0186.tgz"
+
+// testMeta returns the task metadata for tests from testArchive.
+func testMeta() map[string]bigquery.Value {
+	return map[string]bigquery.Value{"filename": testArchive}
+}
+
+// readSnaplog returns the content of the named snaplog in testdata.
+func readSnaplog(t testing.TB, name string) []byte {
+	data, err := ioutil.ReadFile(`testdata/` + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
 // A handful of file names from a single ndt tar file.
 var testFileNames []string = []string{
 	`20170509T00:05:13.863119000Z_45.56.98.222.c2s_ndttrace`,
@@ -59,6 +86,32 @@ func TestValidation(t *testing.T) {
 	}
 }
 
+func TestDateDirValidation(t *testing.T) {
+	test := testFileNames[0]
+	tests := []struct {
+		path    string
+		dateDir string
+		err     error
+	}{
+		{"2017/05/09/" + test, "2017/05/09/", nil},
+		{"2017/05/10/" + test, "2017/05/10/", parser.ErrDateDirMismatch},
+		{test, "", nil},
+	}
+	for _, tt := range tests {
+		info, err := parser.ParseNDTFileName(tt.path)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.path, tt.err, err)
+		}
+		if info == nil {
+			t.Errorf("%s: expected testInfo", tt.path)
+			continue
+		}
+		if info.DateDir != tt.dateDir || info.Date != "20170509" {
+			t.Errorf("%s: got DateDir %q, Date %q", tt.path, info.DateDir, info.Date)
+		}
+	}
+}
+
 func TestNDTParser(t *testing.T) {
 	// Load test data.
 	ins := newInMemoryInserter()
@@ -66,14 +119,11 @@ func TestNDTParser(t *testing.T) {
 
 	// TODO(prod) - why are so many of the tests to this endpoint and a few others?
 	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
-	s2cData, err := ioutil.ReadFile(`testdata/` + s2cName)
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	s2cData := readSnaplog(t, s2cName)
 
 	// Use a valid archive name.
-	meta := map[string]bigquery.Value{"filename": "gs://mlab-test-bucket/ndt/2017/06/13/20170613T000000Z-mlab3-vie01-ndt-0186.tgz"}
-	err = n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	meta := testMeta()
+	err := n.ParseAndInsert(meta, s2cName+".gz", s2cData)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -101,6 +151,7 @@ func TestNDTParser(t *testing.T) {
 	// Extract the values saved to the inserter.
 	actualValues := ins.data[0].(*bq.MapSaver).Values
 	expectedValues := schema.Web100ValueMap{
+		"web100_version": "2.5.27 201001301335 net100",
 		"connection_spec": schema.Web100ValueMap{
 			"server_hostname": "mlab3.vie01.measurement-lab.org",
 		},
@@ -124,10 +175,7 @@ func TestNDTParser(t *testing.T) {
 	}
 
 	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
-	c2sData, err := ioutil.ReadFile(`testdata/` + c2sName)
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	c2sData := readSnaplog(t, c2sName)
 
 	err = n.ParseAndInsert(meta, c2sName+".gz", c2sData)
 	if err != nil {
@@ -139,6 +187,252 @@ func TestNDTParser(t *testing.T) {
 	}
 }
 
+func TestNDTZeroSnapshots(t *testing.T) {
+	// This snaplog has a valid header, but no snapshots.
+	emptyName := `20170509T13:50:13.590210000Z_eb.measurementlab.net:44162.s2c_snaplog`
+	emptyData := readSnaplog(t, emptyName)
+	meta := testMeta()
+
+	// By default, the test is dropped.
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.ParseAndInsert(meta, emptyName+".gz", emptyData)
+	n.Flush()
+	if ins.Accepted() != 0 {
+		t.Fatalf("Empty snaplog should be dropped. %d", ins.Accepted())
+	}
+
+	// Optionally, a connection spec only row is written.
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetKeepEmptySnaplogs(true)
+	n.ParseAndInsert(meta, emptyName+".gz", emptyData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Empty snaplog should produce a row. %d", ins.Accepted())
+	}
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"anomalies": schema.Web100ValueMap{
+			"num_snaps": 0,
+		},
+		"web100_log_entry": schema.Web100ValueMap{
+			"connection_spec": schema.Web100ValueMap{
+				"remote_ip":   "45.56.98.222",
+				"remote_port": int64(44160),
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	snap := actualValues["web100_log_entry"].(schema.Web100ValueMap)["snap"].(schema.Web100ValueMap)
+	if len(snap) != 0 {
+		t.Errorf("Expected empty snap, got %d fields", len(snap))
+	}
+}
+
+func TestNDTMetaOnlyRow(t *testing.T) {
+	// This meta file includes the client reported throughput, but there are
+	// no corresponding snaplogs.
+	metaName := `20170509T13:55:13.590210000Z_eb.measurementlab.net:53002.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := testMeta()
+
+	// By default, no row is written.
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 0 {
+		t.Fatalf("Unexpected meta only row. %d", ins.Accepted())
+	}
+
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetMetaOnlyRows(true)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Expected meta only row. %d", ins.Accepted())
+	}
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"test_id": metaName,
+		"anomalies": schema.Web100ValueMap{
+			"no_snaplog": true,
+		},
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip":       "45.56.98.222",
+			"server_hostname": "mlab3.vie01.measurement-lab.org",
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	if actualValues["client_reported_throughput"] != 9876.5 {
+		t.Error("Wrong client_reported_throughput:", actualValues["client_reported_throughput"])
+	}
+
+	// Without the throughput in the meta file, the field is absent.
+	metaName = `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err = ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 2 {
+		t.Fatalf("Expected meta only row. %d", ins.Accepted())
+	}
+	if _, ok := ins.data[1].(*bq.MapSaver).Values["client_reported_throughput"]; ok {
+		t.Error("Unexpected client_reported_throughput")
+	}
+}
+
+func TestNDTMetaColumn(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaData = append(metaData, "\ntcp_cc: cubic\n"...)
+	meta := testMeta()
+
+	tests := []struct {
+		enable   bool
+		withMeta bool
+		want     bool // Whether the row has a meta column.
+	}{
+		{false, true, false},
+		{true, true, true},
+		// A test without a meta file has no meta column.
+		{true, false, false},
+	}
+	for _, test := range tests {
+		ins := newInMemoryInserter()
+		n := parser.NewNDTParser(ins)
+		n.SetMetaColumn(test.enable)
+		n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+		if test.withMeta {
+			n.ParseAndInsert(meta, metaName, metaData)
+		}
+		n.Flush()
+		if ins.Accepted() != 1 {
+			t.Fatalf("Expected 1 row, got %d", ins.Accepted())
+		}
+		values := ins.data[0].(*bq.MapSaver).Values
+		column, ok := values["meta"].(schema.Web100ValueMap)
+		if ok != test.want {
+			t.Errorf("%+v: got meta column %v", test, values["meta"])
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if column["tcp_cc"] != "cubic" || column["cputime_file"] != "20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.cputime.gz" {
+			t.Errorf("Wrong meta column %v", column)
+		}
+		if _, ok := column["server_hostname"]; ok {
+			t.Error("server_hostname should only be in the connection spec")
+		}
+	}
+}
+
+func TestNDTMetaColumnAnonymized(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := testMeta()
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	anon := parser.NewIPAnonymizer("test salt")
+	n.SetIPAnonymizer(anon)
+	n.SetMetaColumn(true)
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Expected 1 row, got %d", ins.Accepted())
+	}
+	column := ins.data[0].(*bq.MapSaver).Values["meta"].(schema.Web100ValueMap)
+	expected := schema.Web100ValueMap{
+		"c2s_ndttrace_file": "20170509T13:45:13.590210000Z_" + anon.Hash("45.56.98.222") + ".c2s_ndttrace.gz",
+		"s2c_ndttrace_file": "20170509T13:45:13.590210000Z_" + anon.Hash("45.56.98.222") + ".s2c_ndttrace.gz",
+		"cputime_file":      "20170509T13:45:13.590210000Z_" + anon.Hash("eb.measurementlab.net:53000") + ".cputime.gz",
+	}
+	if !compare(t, column, expected) {
+		t.Errorf("Wrong meta column %v", column)
+	}
+	// The additional fields are supplied by the client, so are dropped.
+	if _, ok := column["additional"]; ok {
+		t.Errorf("Unexpected additional fields: %v", column["additional"])
+	}
+}
+
+func TestNDTCountryAnnotation(t *testing.T) {
+	db, err := geo.NewCountryDB(strings.NewReader("45.56.96.0/20,US\n2001:db8::/32,ZZ\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.SetCountryDB(db)
+
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip": "45.56.98.222",
+			"client_geolocation": schema.Web100ValueMap{
+				"country_code": "US",
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+
+	// Without a database, the country code is left empty.
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	connSpec := ins.data[0].(*bq.MapSaver).Values["connection_spec"].(schema.Web100ValueMap)
+	if _, ok := connSpec.GetString([]string{"client_geolocation", "country_code"}); ok {
+		t.Error("Country code should be empty without a database")
+	}
+}
+
 // compare recursively checks whether actual values equal values in the expected values.
 // The expected values may be a subset of the actual values, but not a superset.
 func compare(t *testing.T, actual schema.Web100ValueMap, expected schema.Web100ValueMap) bool {
@@ -190,6 +484,12 @@ func compare(t *testing.T, actual schema.Web100ValueMap, expected schema.Web100V
 				}
 			}
 
+		case bool:
+			if v != act.(bool) {
+				t.Logf("Wrong bools for key %q: got %v; want %v",
+					key, act, v)
+				match = false
+			}
 		default:
 			fmt.Printf("Unsupported type. %T\n", v)
 			panic(nil)
@@ -198,6 +498,49 @@ func compare(t *testing.T, actual schema.Web100ValueMap, expected schema.Web100V
 	return match
 }
 
+// cityAnnotator is a fake Annotator that records the addresses it is given.
+type cityAnnotator struct {
+	ips []string
+}
+
+func (a *cityAnnotator) Annotate(ip string, spec schema.Web100ValueMap) {
+	a.ips = append(a.ips, ip)
+	spec["client_geolocation"] = schema.Web100ValueMap{"city": "Vienna"}
+}
+
+func TestNDTAnnotator(t *testing.T) {
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	a := &cityAnnotator{}
+	n.SetAnnotator(a)
+	n.SetIPAnonymizer(parser.NewIPAnonymizer("test salt"))
+
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	// The annotator must see the full address, before anonymization.
+	if len(a.ips) != 1 || a.ips[0] != "45.56.98.222" {
+		t.Errorf("Wrong annotator addresses: %v", a.ips)
+	}
+	connSpec := ins.data[0].(*bq.MapSaver).Values["connection_spec"].(schema.Web100ValueMap)
+	if city, _ := connSpec.GetString([]string{"client_geolocation", "city"}); city != "Vienna" {
+		t.Errorf("Missing annotation: %v", connSpec)
+	}
+}
+
 type inMemoryInserter struct {
 	data      []interface{}
 	committed int
@@ -244,3 +587,778 @@ func (in *inMemoryInserter) Committed() int {
 func (in *inMemoryInserter) Failed() int {
 	return 0
 }
+
+func TestNDTAnonymizeClient(t *testing.T) {
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	anon := parser.NewIPAnonymizer("test salt")
+	n.SetIPAnonymizer(anon)
+
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.ParseAndInsert(meta, metaName, metaData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"test_id": "20170509T13:45:13.590210000Z_" + anon.Hash("eb.measurementlab.net:44160") + ".s2c_snaplog.gz",
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip":      "45.56.98.0",
+			"client_ip_hash": anon.Hash("45.56.98.222"),
+		},
+		"web100_log_entry": schema.Web100ValueMap{
+			"connection_spec": schema.Web100ValueMap{
+				"remote_ip": "45.56.98.0",
+			},
+			"snap": schema.Web100ValueMap{
+				"RemAddress": "45.56.98.0",
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	connSpec := actualValues["connection_spec"].(schema.Web100ValueMap)
+	if _, ok := connSpec["client_hostname"]; ok {
+		t.Errorf("Client hostname not removed: %v", connSpec)
+	}
+}
+
+func TestNDTPromotedSnapValues(t *testing.T) {
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+
+	// This is the snaplog used for the old2000 snapshot fixture in web100.
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	meta := testMeta()
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	// StartTimeStamp 1494337514 and StartTimeUsec 369834, as in old2000.
+	expectedValues := schema.Web100ValueMap{
+		"test_start_time":    "2017-05-09T13:45:14.369834Z",
+		"test_duration_usec": int64(13348832),
+		"web100_log_entry": schema.Web100ValueMap{
+			"snap": schema.Web100ValueMap{
+				"StartTimeStamp": int64(1494337514369834),
+				"Duration":       int64(13348832),
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+}
+
+func TestParseNDTFileNameAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		suffix  string
+	}{
+		{name: `20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace`,
+			address: "45.56.98.222", suffix: "c2s_ndttrace"},
+		{name: `20170509T13:45:13.590210000Z_45.56.98.222:48716.c2s_snaplog.gz`,
+			address: "45.56.98.222:48716", suffix: "c2s_snaplog"},
+		{name: `20170509T13:45:13.590210000Z_[2001:db8::1]:48716.c2s_snaplog`,
+			address: "[2001:db8::1]:48716", suffix: "c2s_snaplog"},
+		{name: `20170509T13:45:13.590210000Z_[2001:db8::1]:48716.s2c_snaplog.gz`,
+			address: "[2001:db8::1]:48716", suffix: "s2c_snaplog"},
+		{name: `20170509T13:45:13.590210000Z_[2001:db8::ffff:1.2.3.4].meta`,
+			address: "[2001:db8::ffff:1.2.3.4]", suffix: "meta"},
+		{name: `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`,
+			address: "eb.measurementlab.net:44160", suffix: "s2c_snaplog"},
+		{name: `20170509T13:45:13.590210000Z_vm-jcanat-measures.rezopole.net:55712.cputime`,
+			address: "vm-jcanat-measures.rezopole.net:55712", suffix: "cputime"},
+	}
+	for _, test := range tests {
+		info, err := parser.ParseNDTFileName(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if info.Address != test.address || info.Suffix != test.suffix {
+			t.Errorf("%s: got %q %q; want %q %q", test.name,
+				info.Address, info.Suffix, test.address, test.suffix)
+		}
+	}
+
+	// Unbalanced brackets are rejected.
+	if _, err := parser.ParseNDTFileName(`20170509T13:45:13.590210000Z_[2001:db8::1:48716.c2s_snaplog`); err == nil {
+		t.Error("Expected error for unbalanced brackets")
+	}
+}
+
+// setState returns a copy of the uncompressed snaplog raw, with the State of
+// each snapshot from index first onwards set to state.
+func setState(t *testing.T, raw []byte, first int, state web100.TCPState) []byte {
+	slog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Index(raw, []byte(web100.BEGIN_SNAP_DATA))
+	for _, v := range slog.Variables() {
+		if v.Name != "State" {
+			continue
+		}
+		out := append([]byte{}, raw...)
+		for n := first; n < slog.SnapCount(); n++ {
+			offset := body + n*slog.SnapshotNumBytes() + len(web100.BEGIN_SNAP_DATA) + v.Offset
+			slog.ByteOrder().PutUint32(out[offset:], uint32(state))
+		}
+		return out
+	}
+	t.Fatal("No State variable")
+	return nil
+}
+
+func TestNDTStateStop(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	// Connection leaves ESTABLISHED for CLOSE_WAIT at snapshot 1500.
+	c2sData = setState(t, c2sData, 1500, web100.CloseWait)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slog.Snapshot(1502)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSnap := make(schema.Web100ValueMap)
+	snap.SnapshotValues(expectedSnap)
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.SetStateStopCount(3)
+	meta := testMeta()
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	// The final values come from the third snapshot after the transition.
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"test_duration_usec": expectedSnap["Duration"],
+		"web100_log_entry": schema.Web100ValueMap{
+			"snap": schema.Web100ValueMap{
+				"State":    int64(web100.CloseWait),
+				"Duration": expectedSnap["Duration"],
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	deltas := actualValues["web100_log_entry"].(schema.Web100ValueMap)["deltas"].([]schema.Web100ValueMap)
+	lastDelta := deltas[len(deltas)-1]
+	if lastDelta["snapshot_num"].(int) > 1502 {
+		t.Errorf("Processed past the stop index: %v", lastDelta["snapshot_num"])
+	}
+}
+
+func TestNDTMaxSnapshots(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The final values come from the last snapshot within the cap.
+	snap, err := slog.Snapshot(99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSnap := make(schema.Web100ValueMap)
+	snap.SnapshotValues(expectedSnap)
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.SetMaxSnapshots(100)
+	meta := testMeta()
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"anomalies": schema.Web100ValueMap{
+			"num_snaps": 2124,
+		},
+		"web100_log_entry": schema.Web100ValueMap{
+			"snap": schema.Web100ValueMap{
+				"Duration": expectedSnap["Duration"],
+			},
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	deltas := actualValues["web100_log_entry"].(schema.Web100ValueMap)["deltas"].([]schema.Web100ValueMap)
+	if deltas[len(deltas)-1]["snapshot_num"].(int) >= 100 {
+		t.Errorf("Processed past the cap: %v", deltas[len(deltas)-1]["snapshot_num"])
+	}
+
+	// With no cap, the final snapshot is used, and there is no num_snaps anomaly.
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetMaxSnapshots(0)
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	n.Flush()
+	actualValues = ins.data[0].(*bq.MapSaver).Values
+	if _, ok := actualValues["anomalies"].(schema.Web100ValueMap)["num_snaps"]; ok {
+		t.Error("Unexpected num_snaps anomaly")
+	}
+	if actualValues["test_duration_usec"] != int64(13348832) {
+		t.Errorf("Wrong final duration: %v", actualValues["test_duration_usec"])
+	}
+}
+
+func TestNDTErrorRows(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	// Truncating the header makes the snaplog unparseable.
+	badData := c2sData[:200]
+	meta := testMeta()
+
+	// By default, no row is written.
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	n.ParseAndInsert(meta, c2sName+".gz", badData)
+	n.Flush()
+	if ins.Accepted() != 0 {
+		t.Fatalf("Unexpected row for bad snaplog. %d", ins.Accepted())
+	}
+
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetErrorRows(true)
+	n.ParseAndInsert(meta, c2sName+".gz", badData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert error row. %d", ins.Accepted())
+	}
+	actualValues := ins.data[0].(*bq.MapSaver).Values
+	expectedValues := schema.Web100ValueMap{
+		"test_id":       c2sName + ".gz",
+		"task_filename": testArchive,
+		"log_time":      "2017-05-09T13:45:13.59021Z",
+		"anomalies": schema.Web100ValueMap{
+			"snaplog_error": true,
+		},
+	}
+	if !compare(t, actualValues, expectedValues) {
+		t.Errorf("Missing expected values:")
+		t.Error(pretty.Sprint(expectedValues))
+	}
+	if msg, ok := actualValues["error_message"].(string); !ok || msg == "" {
+		t.Errorf("Missing error_message: %v", actualValues["error_message"])
+	}
+
+	// The good snaplog still produces a normal row with no error_message.
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetErrorRows(true)
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert snaplog data. %d", ins.Accepted())
+	}
+	if _, ok := ins.data[0].(*bq.MapSaver).Values["error_message"]; ok {
+		t.Error("Unexpected error_message in normal row")
+	}
+
+	// The client address in the test_id of an error row is hashed.
+	ins = newInMemoryInserter()
+	n = parser.NewNDTParser(ins)
+	n.SetErrorRows(true)
+	anon := parser.NewIPAnonymizer("test salt")
+	n.SetIPAnonymizer(anon)
+	n.ParseAndInsert(meta, c2sName+".gz", badData)
+	n.Flush()
+	if ins.Accepted() != 1 {
+		t.Fatalf("Failed to insert error row. %d", ins.Accepted())
+	}
+	want := "20170509T13:45:13.590210000Z_" + anon.Hash("eb.measurementlab.net:48716") + ".c2s_snaplog.gz"
+	if id := ins.data[0].(*bq.MapSaver).Values["test_id"]; id != want {
+		t.Errorf("Error row test_id %v, want %s", id, want)
+	}
+}
+
+func TestNDTInsertID(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	meta := testMeta()
+
+	// A retry of the same test must produce the same insertID.
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		ins := newInMemoryInserter()
+		n := parser.NewNDTParser(ins)
+		n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+		n.Flush()
+		if len(ins.data) != 1 {
+			t.Fatalf("Expected 1 row, got %d", len(ins.data))
+		}
+		row := ins.data[0].(*bq.MapSaver)
+		testID, _ := row.Values["test_id"].(string)
+		if row.InsertID != bq.InsertID(testID, ins.TableSuffix()) {
+			t.Errorf("Wrong insertID %q for %s", row.InsertID, testID)
+		}
+		ids = append(ids, row.InsertID)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Expected matching insertIDs, got %v", ids)
+	}
+}
+
+func TestNDTPartitionDate(t *testing.T) {
+	s2cData := readSnaplog(t, `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`)
+	meta := testMeta()
+
+	// Two tests in a task for 2017-05-09, on either side of midnight UTC.
+	before := `20170509T23:59:59.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	after := `20170510T00:00:01.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	task := newInMemoryInserter()
+	others := map[string]*inMemoryInserter{}
+	ins := bq.NewPartitionedInserter(task, time.Date(2017, 5, 9, 0, 0, 0, 0, time.UTC),
+		func(partition time.Time) (etl.Inserter, error) {
+			others[partition.Format("20060102")] = newInMemoryInserter()
+			return others[partition.Format("20060102")], nil
+		})
+	n := parser.NewNDTParser(ins)
+	n.ParseAndInsert(meta, before+".gz", s2cData)
+	n.ParseAndInsert(meta, after+".gz", s2cData)
+	n.Flush()
+
+	if ins.Accepted() != 2 {
+		t.Fatalf("Expected 2 rows, got %d", ins.Accepted())
+	}
+	if len(task.data) != 1 {
+		t.Fatalf("Expected 1 row for 20170509, got %d", len(task.data))
+	}
+	if len(others) != 1 || others["20170510"] == nil || len(others["20170510"].data) != 1 {
+		t.Fatalf("Expected 1 row for 20170510, got %v", others)
+	}
+	rows := []*bq.MapSaver{task.data[0].(*bq.MapSaver), others["20170510"].data[0].(*bq.MapSaver)}
+	for i, want := range []string{"2017-05-09", "2017-05-10"} {
+		if got := rows[i].PartitionDate.Format("2006-01-02"); got != want {
+			t.Errorf("PartitionDate = %s, want %s", got, want)
+		}
+	}
+}
+
+// warningCount returns the current value of the WarningCount metric for the
+// in memory inserter table.
+func warningCount(t *testing.T, filetype, label string) float64 {
+	var m dto.Metric
+	if err := metrics.WarningCount.WithLabelValues("ndt_test", filetype, label).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestNDTMultiFileCollision(t *testing.T) {
+	s2cData := readSnaplog(t, `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`)
+	meta := testMeta()
+	tests := []struct {
+		name       string
+		files      []string
+		collisions float64
+	}{
+		{"gz pair", []string{
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`,
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz`,
+		}, 0},
+		{"three files", []string{
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`,
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz`,
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44170.s2c_snaplog.gz`,
+		}, 1},
+		// Collisions are counted once per group.
+		{"two groups", []string{
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz`,
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44170.s2c_snaplog.gz`,
+			`20170509T13:45:13.590210000Z_eb.measurementlab.net:44180.s2c_snaplog.gz`,
+			`20170509T13:50:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz`,
+			`20170509T13:50:13.590210000Z_eb.measurementlab.net:44170.s2c_snaplog.gz`,
+		}, 2},
+	}
+	for _, test := range tests {
+		before := warningCount(t, "s2c_snaplog", "multi-file collision")
+		n := parser.NewNDTParser(newInMemoryInserter())
+		for _, name := range test.files {
+			n.ParseAndInsert(meta, name, s2cData)
+		}
+		n.Flush()
+		if got := warningCount(t, "s2c_snaplog", "multi-file collision") - before; got != test.collisions {
+			t.Errorf("%s: %v collisions, want %v", test.name, got, test.collisions)
+		}
+	}
+}
+
+func TestNDTGzSupersedes(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/` + metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := testMeta()
+
+	// Tests are processed only when the group is complete, so the gz file
+	// is used, and inserted once, whether it precedes or follows the
+	// uncompressed file and the meta file.
+	orders := [][]string{
+		{c2sName, metaName, c2sName + ".gz"},
+		{c2sName, c2sName + ".gz", metaName},
+		{c2sName + ".gz", metaName, c2sName},
+	}
+	for _, order := range orders {
+		ins := newInMemoryInserter()
+		n := parser.NewNDTParser(ins)
+		for _, name := range order {
+			data := c2sData
+			if name == metaName {
+				data = metaData
+			}
+			if err := n.ParseAndInsert(meta, name, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n.Flush()
+		if len(ins.data) != 1 {
+			t.Errorf("%v: expected 1 row, got %d", order, len(ins.data))
+			continue
+		}
+		if id := ins.data[0].(*bq.MapSaver).Values["test_id"]; id != c2sName+".gz" {
+			t.Errorf("%v: got test_id %v, want the gz file", order, id)
+		}
+	}
+}
+
+func TestNDTFinish(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	if ins.Accepted() != 0 {
+		t.Fatal("Data processed prematurely.")
+	}
+	// Finish inserts the last group, without flushing the inserter.
+	if err := n.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if ins.Accepted() != 1 || ins.Committed() != 0 {
+		t.Fatalf("Accepted %d, Committed %d, want 1, 0", ins.Accepted(), ins.Committed())
+	}
+	// A second Finish, or Flush, does not insert the group again.
+	n.Finish()
+	n.Flush()
+	if ins.Accepted() != 1 || ins.Committed() != 1 {
+		t.Errorf("Accepted %d, Committed %d, want 1, 1", ins.Accepted(), ins.Committed())
+	}
+}
+
+func TestNDTArchiveOrder(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	metaName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(bq.NewOrderedInserter(ins))
+	// The group is processed in Finish, after all of its files have been
+	// read, and the s2c test is processed first.
+	for i, name := range []string{c2sName, metaName, s2cName} {
+		data, err := ioutil.ReadFile(`testdata/` + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := map[string]bigquery.Value{"filename": testArchive, "archive_index": i}
+		if err := n.ParseAndInsert(meta, name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ins.data) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(ins.data))
+	}
+	// Each row has the index of its own snaplog, so the rows are in archive
+	// order.
+	for i, want := range []struct {
+		testID string
+		index  int64
+	}{{c2sName, 0}, {s2cName, 2}} {
+		values := ins.data[i].(*bq.MapSaver).Values
+		if values["test_id"] != want.testID || values["archive_index"] != want.index {
+			t.Errorf("Row %d: got %v, %v, want %s, %d", i,
+				values["test_id"], values["archive_index"], want.testID, want.index)
+		}
+	}
+}
+
+func TestNDTSuffixCounts(t *testing.T) {
+	n := parser.NewNDTParser(newInMemoryInserter())
+	meta := testMeta()
+	for _, name := range []string{
+		`20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`,
+		`20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`,
+		`20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`,
+		`20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_ndttrace`,
+		`bad filename`,
+	} {
+		// The content is not parsed until the group is processed.
+		n.ParseAndInsert(meta, name, []byte{})
+	}
+	want := map[string]int{"c2s_snaplog": 1, "s2c_snaplog": 1, "meta": 1, "other": 2}
+	if got := n.SuffixCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestNDTBadConnectionSpec(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	// Zero the connection spec, which follows the log time and group name.
+	specOffset := bytes.Index(s2cData, []byte(web100.END_OF_HEADER)) +
+		len(web100.END_OF_HEADER) + 4 + web100.GROUPNAME_LEN_MAX
+	copy(s2cData[specOffset:specOffset+16], make([]byte, 16))
+
+	before := warningCount(t, "s2c", "bad connection spec")
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.Flush()
+	if got := warningCount(t, "s2c", "bad connection spec") - before; got != 1 {
+		t.Errorf("Got %v warnings, want 1", got)
+	}
+	if len(ins.data) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(ins.data))
+	}
+	// The snapshot addresses are used instead.
+	values := ins.data[0].(*bq.MapSaver).Values
+	logEntry := values["web100_log_entry"].(schema.Web100ValueMap)
+	if ip, _ := logEntry.GetString([]string{"connection_spec", "remote_ip"}); ip != "45.56.98.222" {
+		t.Errorf("Wrong remote_ip %q", ip)
+	}
+}
+
+func TestNDTParse(t *testing.T) {
+	s2cName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData := readSnaplog(t, s2cName)
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+
+	// Parse does not disturb a pending group.
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	rows, err := n.Parse(meta, c2sName+".gz", c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || ins.Accepted() != 0 {
+		t.Fatalf("Got %d rows, %d inserted, want 1, 0", len(rows), ins.Accepted())
+	}
+	values := rows[0].(*bq.MapSaver).Values
+	if values["test_id"] != c2sName+".gz" || values["task_filename"] != meta["filename"] {
+		t.Errorf("Wrong test_id %v or task_filename %v", values["test_id"], values["task_filename"])
+	}
+	if !compare(t, values, schema.Web100ValueMap{"anomalies": schema.Web100ValueMap{"no_meta": true}}) {
+		t.Error("Expected no_meta anomaly")
+	}
+	n.Flush()
+	if len(ins.data) != 1 || ins.data[0].(*bq.MapSaver).Values["test_id"] != s2cName+".gz" {
+		t.Fatalf("Expected only the s2c row to be inserted, got %d rows", len(ins.data))
+	}
+
+	// The parsed values match those inserted by ParseAndInsert.
+	rows, err = n.Parse(meta, s2cName+".gz", s2cData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rows[0].(*bq.MapSaver).Values["web100_log_entry"]
+	if want := ins.data[0].(*bq.MapSaver).Values["web100_log_entry"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse and ParseAndInsert differ: %v", pretty.Diff(got, want))
+	}
+
+	// Other files produce no rows, and unparseable snaplogs an error.
+	if rows, err = n.Parse(meta, `20170509T13:45:13.590210000Z_eb.measurementlab.net.meta`, nil); rows != nil || err != nil {
+		t.Errorf("Got %v, %v for meta file", rows, err)
+	}
+	if _, err = n.Parse(meta, c2sName, []byte("garbage")); err == nil {
+		t.Error("Expected error for bad snaplog")
+	}
+
+	// Parse anonymizes the row, even with a batch annotator, which only
+	// anonymizes the rows that are inserted.
+	n = parser.NewNDTParser(newInMemoryInserter())
+	anon := parser.NewIPAnonymizer("test salt")
+	n.SetIPAnonymizer(anon)
+	n.SetBatchAnnotator(&latencyAnnotator{}, 10)
+	if rows, err = n.Parse(meta, c2sName+".gz", c2sData); err != nil {
+		t.Fatal(err)
+	}
+	values = rows[0].(*bq.MapSaver).Values
+	want := "20170509T13:45:13.590210000Z_" + anon.Hash("eb.measurementlab.net:48716") + ".c2s_snaplog.gz"
+	if values["test_id"] != want {
+		t.Errorf("Parse test_id %v, want %s", values["test_id"], want)
+	}
+	connSpec := values["connection_spec"].(schema.Web100ValueMap)
+	if ip, _ := connSpec.GetString([]string{"client_ip"}); ip != "45.56.98.0" {
+		t.Errorf("Parse client_ip %q, want masked 45.56.98.0", ip)
+	}
+}
+
+// BenchmarkNDTParseAndInsert measures the full parse of a c2s snaplog, with a
+// counting inserter, so that only the parse cost is measured.
+func BenchmarkNDTParseAndInsert(b *testing.B) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(b, c2sName)
+	ins := &countingInserter{Inserter: newInMemoryInserter()}
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := n.ParseAndInsert(meta, c2sName+".gz", c2sData); err != nil {
+			b.Fatal(err)
+		}
+		n.Flush()
+	}
+	b.StopTimer()
+	if ins.RowCount != b.N {
+		b.Errorf("Inserted %d rows, want %d", ins.RowCount, b.N)
+	}
+}
+
+func layoutCount(t *testing.T, kind, field string) float64 {
+	var m dto.Metric
+	if err := metrics.SnapLayoutCount.WithLabelValues("ndt_test", kind, field).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestNDTLayoutCheck(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	meta := testMeta()
+	n := parser.NewNDTParser(newInMemoryInserter())
+
+	// The standard layout matches the schema.
+	missing := make(map[string]float64, len(schema.SnapFieldNames))
+	for _, name := range schema.SnapFieldNames {
+		missing[name] = layoutCount(t, "missing", name)
+	}
+	if _, err := n.Parse(meta, c2sName+".gz", c2sData); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range schema.SnapFieldNames {
+		if c := layoutCount(t, "missing", name); c != missing[name] {
+			t.Errorf("%s: got %v missing", name, c-missing[name])
+		}
+	}
+
+	// Renaming a variable in the header makes it both extra and missing.
+	extra := layoutCount(t, "extra", "CurCwnX")
+	renamed := bytes.Replace(c2sData, []byte("\nCurCwnd "), []byte("\nCurCwnX "), -1)
+	if _, err := n.Parse(meta, c2sName+".gz", renamed); err != nil {
+		t.Fatal(err)
+	}
+	if c := layoutCount(t, "extra", "CurCwnX") - extra; c != 1 {
+		t.Errorf("Got %v extra CurCwnX, want 1", c)
+	}
+	if c := layoutCount(t, "missing", "CurCwnd") - missing["CurCwnd"]; c != 1 {
+		t.Errorf("Got %v missing CurCwnd, want 1", c)
+	}
+}
+
+func TestNDTFileSizeThresholds(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	meta := testMeta()
+	n := parser.NewNDTParser(newInMemoryInserter())
+
+	// Snaplogs below the small threshold are still processed.
+	n.SetFileSizeThresholds(2*1024*1024, 0)
+	small := warningCount(t, "c2s", "<2MB")
+	if rows, err := n.Parse(meta, c2sName+".gz", c2sData); err != nil || len(rows) != 1 {
+		t.Fatalf("Got %d rows, %v, want 1 row", len(rows), err)
+	}
+	if warningCount(t, "c2s", "<2MB") != small+1 {
+		t.Error("Expected a <2MB warning")
+	}
+
+	whole, err := n.Parse(meta, c2sName+".gz", c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSnap := whole[0].(*bq.MapSaver).Values["web100_log_entry"].(schema.Web100ValueMap)["snap"]
+
+	// Snaplogs above the max threshold, compressed or not, are streamed, and
+	// have the same final values, but no deltas.
+	n.SetFileSizeThresholds(0, 1024*1024)
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(c2sData)
+	zw.Close()
+	for _, data := range [][]byte{c2sData, zipped.Bytes()} {
+		oversize := warningCount(t, "c2s", ">1MB")
+		streamed := warningCount(t, "c2s", "streamed snaplog")
+		rows, err := n.Parse(meta, c2sName+".gz", data)
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("Got %d rows, %v, want 1 row", len(rows), err)
+		}
+		if len(data) > 1024*1024 && warningCount(t, "c2s", ">1MB") != oversize+1 {
+			t.Error("Expected a >1MB warning")
+		}
+		if warningCount(t, "c2s", "streamed snaplog") != streamed+1 {
+			t.Error("Expected a streamed snaplog warning")
+		}
+		entry := rows[0].(*bq.MapSaver).Values["web100_log_entry"].(schema.Web100ValueMap)
+		if deltas := entry["deltas"].([]schema.Web100ValueMap); len(deltas) != 0 {
+			t.Errorf("Got %d deltas, want none", len(deltas))
+		}
+		if !reflect.DeepEqual(entry["snap"], wantSnap) {
+			t.Errorf("Streamed values differ: %v", pretty.Diff(entry["snap"], wantSnap))
+		}
+	}
+
+	// Snaplogs truncated to exactly 4KB get their own warning.
+	truncated := warningCount(t, "c2s", "4KB")
+	n.Parse(meta, c2sName+".gz", c2sData[:4096])
+	if warningCount(t, "c2s", "4KB") != truncated+1 {
+		t.Error("Expected a 4KB warning")
+	}
+}
@@ -0,0 +1,161 @@
+package parser
+
+// ndt_trace.go contains code for summarizing the ndt .c2s_ndttrace and
+// .s2c_ndttrace files, which are tcpdump (pcap) captures of the test
+// connection, usually truncated to the packet headers.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/m-lab/etl/schema"
+)
+
+// Link layer header types, from http://www.tcpdump.org/linktypes.html
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// TraceSummary summarizes the packets captured in an ndttrace file.
+type TraceSummary struct {
+	Packets     int64 // Number of packets captured.
+	Bytes       int64 // Total length of the packets on the wire.
+	Retransmits int64 // Number of TCP segments that resend earlier data.
+}
+
+// Values returns the summary as a record for the trace_summary column.
+func (ts *TraceSummary) Values() schema.Web100ValueMap {
+	return schema.Web100ValueMap{
+		"packets":     ts.Packets,
+		"bytes":       ts.Bytes,
+		"retransmits": ts.Retransmits,
+	}
+}
+
+// flow identifies one direction of a TCP connection.
+type flow struct {
+	src, dst         string
+	srcPort, dstPort uint16
+}
+
+// ParseNDTTrace summarizes the pcap data from an ndttrace file.  A truncated
+// final packet, as left by an interrupted capture, is ignored.
+func ParseNDTTrace(data []byte) (*TraceSummary, error) {
+	if len(data) < 24 {
+		return nil, errors.New("ndttrace too short for pcap header")
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xa1b2c3d4, 0xa1b23c4d: // Microsecond and nanosecond timestamps.
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("ndttrace is not a pcap file")
+	}
+	linkType := order.Uint32(data[20:])
+	switch linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL:
+	default:
+		return nil, fmt.Errorf("unsupported ndttrace link type %d", linkType)
+	}
+
+	summary := &TraceSummary{}
+	// The end of the highest sequence number sent so far, for each flow.
+	sent := make(map[flow]uint32)
+	for rest := data[24:]; len(rest) >= 16; {
+		capLen := order.Uint32(rest[8:])
+		origLen := order.Uint32(rest[12:])
+		if uint32(len(rest)-16) < capLen {
+			break
+		}
+		packet := rest[16 : 16+capLen]
+		rest = rest[16+capLen:]
+
+		summary.Packets++
+		summary.Bytes += int64(origLen)
+		f, seq, payload, ok := parseTCP(linkType, packet)
+		if !ok || payload == 0 {
+			continue
+		}
+		end := seq + payload
+		if last, seen := sent[f]; seen {
+			// Sequence numbers wrap, so compare the signed difference.
+			if int32(seq-last) < 0 {
+				summary.Retransmits++
+			}
+			if int32(end-last) <= 0 {
+				continue
+			}
+		}
+		sent[f] = end
+	}
+	return summary, nil
+}
+
+// parseTCP returns the flow, sequence number and payload length of a TCP
+// packet.  It returns false for other packets, and for packets truncated
+// before the end of the TCP header.
+func parseTCP(linkType uint32, packet []byte) (flow, uint32, uint32, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return flow{}, 0, 0, false
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		if etherType == 0x8100 && len(packet) >= 4 {
+			// Skip the 802.1Q VLAN tag.
+			etherType, packet = binary.BigEndian.Uint16(packet[2:]), packet[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return flow{}, 0, 0, false
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[14:]), packet[16:]
+	case linkTypeRaw:
+		if len(packet) > 0 && packet[0]>>4 == 6 {
+			etherType = 0x86dd
+		} else {
+			etherType = 0x0800
+		}
+	}
+
+	var f flow
+	var tcpLen int // IP payload length, including the TCP header.
+	switch etherType {
+	case 0x0800: // IPv4
+		if len(packet) < 20 || packet[9] != 6 {
+			return flow{}, 0, 0, false
+		}
+		hdrLen := int(packet[0]&0x0f) * 4
+		tcpLen = int(binary.BigEndian.Uint16(packet[2:])) - hdrLen
+		f.src, f.dst = string(packet[12:16]), string(packet[16:20])
+		if len(packet) < hdrLen {
+			return flow{}, 0, 0, false
+		}
+		packet = packet[hdrLen:]
+	case 0x86dd: // IPv6, without extension headers.
+		if len(packet) < 40 || packet[6] != 6 {
+			return flow{}, 0, 0, false
+		}
+		tcpLen = int(binary.BigEndian.Uint16(packet[4:]))
+		f.src, f.dst = string(packet[8:24]), string(packet[24:40])
+		packet = packet[40:]
+	default:
+		return flow{}, 0, 0, false
+	}
+	if len(packet) < 20 {
+		return flow{}, 0, 0, false
+	}
+	f.srcPort, f.dstPort = binary.BigEndian.Uint16(packet), binary.BigEndian.Uint16(packet[2:])
+	seq := binary.BigEndian.Uint32(packet[4:])
+	payload := tcpLen - int(packet[12]>>4)*4
+	if payload < 0 {
+		return flow{}, 0, 0, false
+	}
+	return f, seq, uint32(payload), true
+}
@@ -0,0 +1,97 @@
+package parser_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
+)
+
+func TestParseNDTTrace(t *testing.T) {
+	c2s, err := ioutil.ReadFile(`testdata/20170509T13:45:13.590210000Z_45.56.98.222.c2s_ndttrace`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2c, err := ioutil.ReadFile(`testdata/20170509T13:45:13.590210000Z_45.56.98.222.s2c_ndttrace`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want parser.TraceSummary
+	}{
+		{"c2s", c2s, parser.TraceSummary{Packets: 2066, Bytes: 2109994, Retransmits: 0}},
+		// The s2c test was very lossy.
+		{"s2c", s2c, parser.TraceSummary{Packets: 108, Bytes: 110164, Retransmits: 32}},
+		// The incomplete final packet of an interrupted capture is ignored.
+		{"truncated", s2c[:len(s2c)-10], parser.TraceSummary{Packets: 107, Bytes: 110098, Retransmits: 32}},
+		{"header only", s2c[:24], parser.TraceSummary{}},
+	}
+	for _, test := range tests {
+		summary, err := parser.ParseNDTTrace(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if *summary != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *summary, test.want)
+		}
+	}
+
+	for _, bad := range [][]byte{s2c[:20], []byte("0.00 0 0 0 0\n0.10 0 0 0 0\n0.20 0 0 0 0\n")} {
+		if _, err := parser.ParseNDTTrace(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestNDTTraceSummary(t *testing.T) {
+	prefix := `20170509T13:45:13.590210000Z_`
+	s2cName := prefix + `eb.measurementlab.net:44160.s2c_snaplog`
+	s2cData, err := ioutil.ReadFile(`testdata/` + s2cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2sName := prefix + `eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData, err := ioutil.ReadFile(`testdata/` + c2sName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceName := prefix + `45.56.98.222.s2c_ndttrace`
+	traceData, err := ioutil.ReadFile(`testdata/` + traceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins)
+	meta := testMeta()
+	n.ParseAndInsert(meta, c2sName+".gz", c2sData)
+	// A c2s trace that is not a pcap file is ignored.
+	n.ParseAndInsert(meta, prefix+`45.56.98.222.c2s_ndttrace.gz`, []byte("garbage"))
+	n.ParseAndInsert(meta, traceName+".gz", traceData)
+	n.ParseAndInsert(meta, s2cName+".gz", s2cData)
+	n.Flush()
+	if len(ins.data) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(ins.data))
+	}
+
+	for _, row := range ins.data {
+		values := row.(*bq.MapSaver).Values
+		summary, ok := values["trace_summary"]
+		testID, _ := values["test_id"].(string)
+		if testID == c2sName+".gz" {
+			if ok {
+				t.Errorf("Unexpected c2s trace_summary %v", summary)
+			}
+			continue
+		}
+		want := schema.Web100ValueMap{"packets": int64(108), "bytes": int64(110164), "retransmits": int64(32)}
+		if !compare(t, values, schema.Web100ValueMap{"trace_summary": want}) {
+			t.Errorf("Wrong s2c trace_summary %v", summary)
+		}
+	}
+}
@@ -3,6 +3,8 @@
 package parser
 
 import (
+	"fmt"
+
 	"cloud.google.com/go/bigquery"
 
 	"github.com/m-lab/etl/bq"
@@ -11,19 +13,31 @@ import (
 )
 
 func NewParser(dt etl.DataType, ins etl.Inserter) etl.Parser {
-	switch dt {
-	case etl.NDT:
-		return NewNDTParser(ins)
-	case etl.SS:
-		// TODO - substitute appropriate parsers here and below.
-		return NewTestParser(ins)
-	case etl.PT:
-		return NewPTParser(ins)
-	case etl.SW:
-		return NewDiscoParser(ins)
-	default:
-		return nil
+	// Use the parser registered for the data type's gs:// directory.
+	for dir, t := range etl.DirToDataType {
+		if t != dt {
+			continue
+		}
+		if factory, ok := lookupPrefix(dir); ok {
+			return factory(ins)
+		}
+	}
+	return nil
+}
+
+// NewParserForPath returns the parser registered for the archive at a gs://
+// path, such as gs://archive-mlab-oti/ndt/....  Returns an error if the path
+// is not a valid archive path, or there is no parser for the path.
+func NewParserForPath(path string, ins etl.Inserter) (etl.Parser, error) {
+	data, err := etl.ValidateTestPath(path)
+	if err != nil {
+		return nil, err
 	}
+	factory, ok := LookupParser(path)
+	if !ok {
+		return nil, fmt.Errorf("No parser for experiment %q: %s", data.Exp1, path)
+	}
+	return factory(ins), nil
 }
 
 //=====================================================================================
@@ -67,12 +81,27 @@ func (np *NullParser) TableName() string {
 type TestParser struct {
 	inserter     etl.Inserter
 	etl.RowStats // Allows RowStats to be implemented through an embedded struct.
+
+	// Optional anonymizer, used to hash the client address in SideStream
+	// test names.
+	anonymizer *IPAnonymizer
+}
+
+func init() {
+	// TODO - substitute the SideStream parser, when there is one.
+	RegisterParser("sidestream", NewTestParser)
 }
 
 func NewTestParser(ins etl.Inserter) etl.Parser {
 	return &TestParser{
-		ins,
-		&FakeRowStats{}} // Use a FakeRowStats to provide the RowStats functions.
+		inserter: ins,
+		RowStats: &FakeRowStats{}} // Use a FakeRowStats to provide the RowStats functions.
+}
+
+// SetIPAnonymizer enables replacement of the remote address in SideStream test
+// names by its hash.  A nil anonymizer disables anonymization.
+func (tp *TestParser) SetIPAnonymizer(a *IPAnonymizer) {
+	tp.anonymizer = a
 }
 
 func (tp *TestParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
@@ -83,10 +112,40 @@ func (tp *TestParser) ParseAndInsert(meta map[string]bigquery.Value, testName st
 		values[k] = v
 	}
 	values["testname"] = testName
-	return tp.inserter.InsertRow(bq.MapSaver{values})
+	if tp.anonymizer != nil {
+		if info, err := ParseSSFilename(testName); err == nil {
+			values["testname"] = tp.anonymizer.HashName(testName, info.Address)
+		}
+	}
+	return tp.inserter.InsertRow(&bq.MapSaver{Values: values,
+		InsertID: taskInsertID(meta, testName, 0)})
+}
+
+// archiveIndex returns the position of the test within the task's archive,
+// from the task meta data, or -1 if it is unknown.
+func archiveIndex(meta map[string]bigquery.Value) int64 {
+	switch index := meta["archive_index"].(type) {
+	case int:
+		return int64(index)
+	case int64:
+		return index
+	}
+	return -1
+}
+
+// taskInsertID returns a deterministic insertID for the index'th row of a
+// test in the task's archive.  It does not depend on the task attempt, so a
+// retried task produces the same insertIDs.
+func taskInsertID(meta map[string]bigquery.Value, testName string, index int) string {
+	filename, _ := meta["filename"].(string)
+	return bq.InsertID(fmt.Sprintf("%s/%s/%d", filename, testName, index), "")
 }
 
 // These functions are also required to complete the etl.Parser interface.
+func (tp *TestParser) Finish() error {
+	return nil
+}
+
 func (tp *TestParser) Flush() error {
 	return nil
 }
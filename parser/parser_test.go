@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/parser"
 )
@@ -47,3 +48,105 @@ func TestPlumbing(t *testing.T) {
 		t.Error("Should have called the inserter")
 	}
 }
+
+func TestTestParserAnonymize(t *testing.T) {
+	ins := newInMemoryInserter()
+	p := parser.NewTestParser(ins).(*parser.TestParser)
+	anon := parser.NewIPAnonymizer("test salt")
+	p.SetIPAnonymizer(anon)
+	err := p.ParseAndInsert(nil, "2017/05/16/20170516T22:00:00Z_163.7.129.73_0.web100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2017/05/16/20170516T22:00:00Z_" + anon.Hash("163.7.129.73") + "_0.web100"
+	if got := ins.data[0].(*bq.MapSaver).Values["testname"]; got != want {
+		t.Errorf("Wrong testname: got %v, want %s", got, want)
+	}
+}
+
+func TestNewParserForPath(t *testing.T) {
+	ins := &countingInserter{}
+	tests := []struct {
+		path string
+		want string // The parser type, or empty for an error.
+	}{
+		{"gs://m-lab/ndt/2017/05/09/20170509T000000Z-mlab3-vie01-ndt-0186.tgz", "*parser.NDTParser"},
+		{"gs://m-lab/sidestream/2017/05/09/20170509T000000Z-mlab3-vie01-sidestream-0000.tgz", "*parser.TestParser"},
+		{"gs://m-lab/paris-traceroute/2017/05/09/20170509T000000Z-mlab3-vie01-paris-traceroute-0000.tgz", "*parser.PTParser"},
+		{"gs://m-lab/switch/2017/05/09/20170509T000000Z-mlab3-vie01-switch-0000.tgz", "*parser.DiscoParser"},
+		{"gs://m-lab/foobar/2017/05/09/20170509T000000Z-mlab3-vie01-foobar-0000.tgz", ""},
+		{"gs://m-lab/ndt/2017/05/09/not-an-archive.txt", ""},
+	}
+	for _, test := range tests {
+		p, err := parser.NewParserForPath(test.path, ins)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %T", test.path, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", p); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRegisterParser(t *testing.T) {
+	var got string
+	fake := func(name string) func(etl.Inserter) etl.Parser {
+		return func(ins etl.Inserter) etl.Parser {
+			got = name
+			return parser.NewTestParser(ins)
+		}
+	}
+	parser.RegisterParser("fake", fake("fake"))
+	defer parser.UnregisterParser("fake")
+	parser.RegisterParser("/fake/sandbox/", fake("sandbox"))
+	defer parser.UnregisterParser("/fake/sandbox/")
+
+	tests := []struct {
+		path string
+		want string // The registered factory, or empty for none.
+	}{
+		{"gs://m-lab/fake/2017/05/09/20170509T000000Z-mlab3-vie01-fake-0000.tgz", "fake"},
+		{"gs://m-lab/fake/sandbox/2017/05/09/20170509T000000Z-mlab3-vie01-fake-0000.tgz", "sandbox"},
+		{"gs://m-lab/fakeexp/2017/05/09/20170509T000000Z-mlab3-vie01-fake-0000.tgz", ""},
+		{"gs://m-lab/other/fake/2017/05/09/20170509T000000Z-mlab3-vie01-fake-0000.tgz", ""},
+		{"m-lab/fake/2017/05/09/20170509T000000Z-mlab3-vie01-fake-0000.tgz", ""},
+	}
+	for _, test := range tests {
+		got = ""
+		factory, ok := parser.LookupParser(test.path)
+		if ok != (test.want != "") {
+			t.Errorf("%s: got %v, want %v", test.path, ok, test.want != "")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		factory(nil)
+		if got != test.want {
+			t.Errorf("%s: got factory %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// NewParserForPath uses the registered parsers.
+	got = ""
+	if _, err := parser.NewParserForPath(tests[1].path, nil); err != nil || got != "sandbox" {
+		t.Errorf("NewParserForPath: got factory %q, %v", got, err)
+	}
+
+	// Unregistering a prefix falls back to any shorter prefix.
+	parser.UnregisterParser("fake/sandbox")
+	if _, ok := parser.LookupParser(tests[1].path); !ok {
+		t.Error("Expected fallback to the fake prefix")
+	}
+	parser.UnregisterParser("fake")
+	if _, ok := parser.LookupParser(tests[0].path); ok {
+		t.Error("Unregistered prefix should not match")
+	}
+}
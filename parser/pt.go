@@ -12,7 +12,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/m-lab/etl/bq"
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/geo"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/schema"
 )
@@ -32,6 +34,12 @@ func (f *PTFileName) GetDate() (string, bool) {
 type PTParser struct {
 	inserter etl.Inserter
 	etl.RowStats
+
+	// Optional anonymizer, used to mask client addresses and add client_ip_hash.
+	anonymizer *IPAnonymizer
+
+	// Optional database used to annotate hops with src and dest geolocation.
+	locationDB *geo.LocationDB
 }
 
 type Node struct {
@@ -48,11 +56,77 @@ type Node struct {
 	flow int
 }
 
+// The Linux AF_INET and AF_INET6 values, used for the address family columns
+// of all tables, whatever the platform.
 const IPv4_AF int32 = 2
 const IPv6_AF int32 = 10
 
+func init() {
+	RegisterParser("paris-traceroute", func(ins etl.Inserter) etl.Parser { return NewPTParser(ins) })
+}
+
 func NewPTParser(ins etl.Inserter) *PTParser {
-	return &PTParser{ins, ins}
+	return &PTParser{inserter: ins, RowStats: ins}
+}
+
+// SetIPAnonymizer enables masking of the client address, and the addition of
+// connection_spec.client_ip_hash.  A nil anonymizer disables anonymization.
+func (pt *PTParser) SetIPAnonymizer(a *IPAnonymizer) {
+	pt.anonymizer = a
+}
+
+// SetLocationDB enables annotation of the hop src_geolocation and
+// dest_geolocation using the given database.  A nil db disables the annotation.
+func (pt *PTParser) SetLocationDB(db *geo.LocationDB) {
+	pt.locationDB = db
+}
+
+// annotateHops sets the geolocation of each hop address found in the location
+// database.  Addresses that are not found are left without geolocation.
+func (pt *PTParser) annotateHops(hops []schema.ParisTracerouteHop) {
+	if pt.locationDB == nil {
+		return
+	}
+	lookup := func(ip string) *schema.GeolocationIP {
+		loc, ok := pt.locationDB.Location(ip)
+		if !ok {
+			metrics.WarningCount.WithLabelValues(
+				pt.TableName(), "pt", "unknown hop location").Inc()
+		}
+		return loc
+	}
+	for i := range hops {
+		hops[i].Src_geolocation = lookup(hops[i].Src_ip)
+		hops[i].Dest_geolocation = lookup(hops[i].Dest_ip)
+	}
+}
+
+// anonymizeClient masks the client address in the connection spec, and in any
+// hops that reference it, and returns the test_id with the client address
+// replaced by its hash.
+func (pt *PTParser) anonymizeClient(testID string, connSpec *schema.MLabConnectionSpecification, hops []schema.ParisTracerouteHop) string {
+	if pt.anonymizer == nil || connSpec.Client_ip == "" {
+		return testID
+	}
+	client := connSpec.Client_ip
+	masked := pt.anonymizer.Mask(client)
+	connSpec.Client_ip_hash = pt.anonymizer.Hash(client)
+	connSpec.Client_ip = masked
+	for i := range hops {
+		if hops[i].Src_ip == client {
+			hops[i].Src_ip = masked
+		}
+		if hops[i].Dest_ip == client {
+			hops[i].Dest_ip = masked
+		}
+		if hops[i].Dest_hostname == client {
+			hops[i].Dest_hostname = masked
+		}
+		if hops[i].Src_hostname == client {
+			hops[i].Src_hostname = masked
+		}
+	}
+	return pt.anonymizer.HashName(testID, client)
 }
 
 // ProcessAllNodes take the array of the Nodes, and generate one ParisTracerouteHop entry from each node.
@@ -169,6 +243,11 @@ func (pt *PTParser) FullTableName() string {
 	return pt.inserter.FullTableName()
 }
 
+// Finish does nothing, since each PT file is inserted as it is parsed.
+func (pt *PTParser) Finish() error {
+	return nil
+}
+
 func (pt *PTParser) Flush() error {
 	return pt.inserter.Flush()
 }
@@ -188,6 +267,11 @@ func CreateTestId(fn string, bn string) string {
 func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, rawContent []byte) error {
 	metrics.WorkerState.WithLabelValues("pt").Inc()
 	defer metrics.WorkerState.WithLabelValues("pt").Dec()
+	start := time.Now()
+	defer func() {
+		metrics.ParseDuration.WithLabelValues(
+			pt.TableName(), "pt").Observe(time.Since(start).Seconds())
+	}()
 	test_id := filepath.Base(testName)
 	if meta["filename"] != nil {
 		test_id = CreateTestId(meta["filename"].(string), filepath.Base(testName))
@@ -203,8 +287,12 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 		return err
 	}
 
+	// Annotation requires the full addresses, so must precede anonymization.
+	pt.annotateHops(hops)
+	test_id = pt.anonymizeClient(test_id, conn_spec, hops)
+
 	insertErr := false
-	for _, hop := range hops {
+	for i, hop := range hops {
 		pt_test := schema.PT{
 			Test_id:              test_id,
 			Log_time:             logTime,
@@ -212,11 +300,13 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 			Paris_traceroute_hop: hop,
 			Type:                 int32(2),
 			Project:              int32(3),
+			Archive_index:        archiveIndex(meta),
 		}
-		err := pt.inserter.InsertRow(pt_test)
+		err := pt.inserter.InsertRow(&bigquery.StructSaver{Struct: pt_test,
+			InsertID: taskInsertID(meta, testName, i)})
 		if err != nil {
 			metrics.ErrorCount.WithLabelValues(
-				pt.TableName(), "pt", "insert-err").Inc()
+				pt.TableName(), "pt", "insert-err: "+bq.InsertErrorCategory(err)).Inc()
 			insertErr = true
 			log.Printf("insert-err: %v\n", err)
 		}
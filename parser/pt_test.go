@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
 
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/geo"
 	"github.com/m-lab/etl/parser"
 	"github.com/m-lab/etl/schema"
 )
@@ -133,7 +137,8 @@ func TestPTInserter(t *testing.T) {
 	if err != nil {
 		t.Fatalf("cannot read testdata.")
 	}
-	err = n.ParseAndInsert(nil, "testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris", rawData)
+	meta := map[string]bigquery.Value{"archive_index": 5}
+	err = n.ParseAndInsert(meta, "testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris", rawData)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -162,11 +167,79 @@ func TestPTInserter(t *testing.T) {
 			Dest_hostname: "74.125.224.100",
 			Rtt:           []float64{0.895},
 		},
-		Type: 2,
+		Type:          2,
+		Archive_index: 5,
 	}
-	if !reflect.DeepEqual(ins.data[0], *expectedValues) {
+	row := ins.data[0].(*bigquery.StructSaver)
+	if !reflect.DeepEqual(row.Struct, *expectedValues) {
 		fmt.Printf("Here is expected    : %v\n", expectedValues)
-		fmt.Printf("Here is what is real: %v\n", ins.data[0])
+		fmt.Printf("Here is what is real: %v\n", row.Struct)
 		t.Errorf("Not the expected values:")
 	}
+	// Each hop has a distinct insertID, so that a retried task is deduped.
+	if row.InsertID == "" || row.InsertID == ins.data[1].(*bigquery.StructSaver).InsertID {
+		t.Errorf("Expected distinct insertIDs, got %q", row.InsertID)
+	}
+}
+
+func TestPTAnonymizeClient(t *testing.T) {
+	ins := &inMemoryInserter{}
+	n := parser.NewPTParser(ins)
+	anon := parser.NewIPAnonymizer("test salt")
+	n.SetIPAnonymizer(anon)
+	rawData, err := ioutil.ReadFile("testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris")
+	if err != nil {
+		t.Fatalf("cannot read testdata.")
+	}
+	err = n.ParseAndInsert(nil, "testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris", rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range ins.data {
+		pt := row.(*bigquery.StructSaver).Struct.(schema.PT)
+		if pt.Connection_spec.Client_ip != "74.125.224.0" {
+			t.Fatalf("Client ip not masked: %s", pt.Connection_spec.Client_ip)
+		}
+		if pt.Connection_spec.Client_ip_hash != anon.Hash("74.125.224.100") {
+			t.Fatalf("Wrong client ip hash: %s", pt.Connection_spec.Client_ip_hash)
+		}
+		if pt.Test_id != "20170320T23:53:10Z-172.17.94.34-33456-"+anon.Hash("74.125.224.100")+"-33457.paris" {
+			t.Fatalf("Client ip not hashed in test_id: %s", pt.Test_id)
+		}
+		hop := pt.Paris_traceroute_hop
+		if hop.Dest_ip == "74.125.224.100" || hop.Dest_hostname == "74.125.224.100" {
+			t.Fatalf("Client ip not masked in hop: %v", hop)
+		}
+	}
+}
+
+func TestPTLocation(t *testing.T) {
+	db, err := geo.NewLocationDB(strings.NewReader(
+		"network,country_code,city\n74.125.224.0/24,US,Mountain View\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins := &inMemoryInserter{}
+	n := parser.NewPTParser(ins)
+	n.SetLocationDB(db)
+	// Annotation must use the full address, before it is masked.
+	n.SetIPAnonymizer(parser.NewIPAnonymizer("test salt"))
+	rawData, err := ioutil.ReadFile("testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris")
+	if err != nil {
+		t.Fatalf("cannot read testdata.")
+	}
+	err = n.ParseAndInsert(nil, "testdata/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris", rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hop := ins.data[0].(*bigquery.StructSaver).Struct.(schema.PT).Paris_traceroute_hop
+	if hop.Dest_geolocation == nil || hop.Dest_geolocation.City != "Mountain View" {
+		t.Errorf("Missing dest geolocation: %v", hop.Dest_geolocation)
+	}
+	// Addresses not in the database have no geolocation.
+	if hop.Src_geolocation != nil {
+		t.Errorf("Unexpected src geolocation: %v", hop.Src_geolocation)
+	}
 }
@@ -0,0 +1,74 @@
+package parser
+
+// This file defines the registry of parsers by archive path prefix.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/etl/etl"
+)
+
+// registration associates a parser factory with an object path prefix.
+type registration struct {
+	prefix  string
+	factory func(etl.Inserter) etl.Parser
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []registration // Sorted by decreasing prefix length.
+)
+
+// RegisterParser registers the factory for archives under pathPrefix, which is
+// the object path prefix, excluding the bucket, such as "ndt" or
+// "sandbox/switch".  Like etl.Route prefixes, it must match complete path
+// segments, and the longest matching prefix is used.  Each parser registers
+// itself in init().  Registering the same prefix again replaces the factory,
+// so that tests can substitute a fake parser.
+func RegisterParser(pathPrefix string, factory func(etl.Inserter) etl.Parser) {
+	if factory == nil {
+		panic("parser: RegisterParser factory is nil for " + pathPrefix)
+	}
+	prefix := strings.Trim(pathPrefix, "/")
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for i := range registry {
+		if registry[i].prefix == prefix {
+			registry[i].factory = factory
+			return
+		}
+	}
+	registry = append(registry, registration{prefix: prefix, factory: factory})
+	sort.SliceStable(registry, func(i, j int) bool {
+		return len(registry[i].prefix) > len(registry[j].prefix)
+	})
+}
+
+// LookupParser returns the factory registered for a gs:// archive path, or
+// false if no registered prefix matches.
+func LookupParser(path string) (func(etl.Inserter) etl.Parser, bool) {
+	if !strings.HasPrefix(path, "gs://") {
+		return nil, false
+	}
+	// Strip the bucket.
+	parts := strings.SplitN(path[len("gs://"):], "/", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	return lookupPrefix(parts[1])
+}
+
+// lookupPrefix returns the factory for the longest registered prefix of an
+// object path.
+func lookupPrefix(object string) (func(etl.Inserter) etl.Parser, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		if object == r.prefix || strings.HasPrefix(object, r.prefix+"/") {
+			return r.factory, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//=========================================================================
+// SideStream filename parsing related stuff.
+//=========================================================================
+
+// SideStream names look like 20170516T22:00:00Z_163.7.129.73_0.web100.  Unlike
+// NDT names, the time has no fractional seconds, the remote address is
+// followed by an underscore and an integer index, and the suffix is fixed.
+const ssTimeField = `(?P<time>[012]\d:[0-6]\d:\d{2})`
+const ssAddress = `(?P<address>[^_/]+)`
+const ssIndex = `(?P<index>\d+)`
+const ssSuffix = `\.web100`
+
+var (
+	// Pattern for any valid SideStream test file name
+	ssFilePattern = regexp.MustCompile(
+		"^" + dateDir + dateField + "T" + ssTimeField + "Z_" + ssAddress + "_" + ssIndex + ssSuffix + "$")
+
+	ssTimePattern    = regexp.MustCompile("T" + ssTimeField + "Z_")
+	ssAddressPattern = regexp.MustCompile("Z_" + ssAddress + "_" + ssIndex + `\.`)
+	ssEndPattern     = regexp.MustCompile(ssSuffix + "$")
+)
+
+// ssTestInfo contains all the fields from a valid SideStream test file name.
+type ssTestInfo struct {
+	DateDir   string    // Optional leading date yyyy/mm/dd/
+	Date      string    // The date field from the test file name
+	Time      string    // The time field
+	Address   string    // The remote address field
+	Index     int       // The integer suffix, distinguishing tests in the same second
+	Timestamp time.Time // The parsed timestamp, with second resolution
+	// True if DateDir is present and does not match Date, which indicates
+	// a misfiled test.
+	DateDirMismatch bool
+}
+
+// ParseSSFilename parses a SideStream test file name, returning an error that
+// identifies the part of the name that does not match.
+func ParseSSFilename(path string) (*ssTestInfo, error) {
+	fields := ssFilePattern.FindStringSubmatch(path)
+	if fields == nil {
+		if !datePattern.MatchString(path) {
+			return nil, errors.New("Path should contain yyyymmddT: " + path)
+		} else if !ssTimePattern.MatchString(path) {
+			return nil, errors.New("Path should contain Thh:mm:ssZ_: " + path)
+		} else if !ssAddressPattern.MatchString(path) {
+			return nil, errors.New("Path should contain Z_address_N.: " + path)
+		} else if !ssEndPattern.MatchString(path) {
+			return nil, errors.New("Path should end in .web100: " + path)
+		}
+		return nil, errors.New("Invalid test path: " + path)
+	}
+	timestamp, err := time.Parse("20060102T15:04:05Z", fields[2]+"T"+fields[3]+"Z")
+	if err != nil {
+		return nil, errors.New("Invalid test path: " + path + " (" + err.Error() + ")")
+	}
+	index, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, errors.New("Invalid index in test path: " + path)
+	}
+	mismatch := fields[1] != "" && strings.Replace(fields[1], "/", "", -1) != fields[2]
+	return &ssTestInfo{DateDir: fields[1], Date: fields[2], Time: fields[3],
+		Address: fields[4], Index: index, Timestamp: timestamp,
+		DateDirMismatch: mismatch}, nil
+}
@@ -0,0 +1,53 @@
+package parser_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl/parser"
+)
+
+func TestParseSSFilename(t *testing.T) {
+	info, err := parser.ParseSSFilename("2017/05/16/20170516T22:00:00Z_163.7.129.73_0.web100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DateDir != "2017/05/16/" || info.Date != "20170516" || info.Time != "22:00:00" {
+		t.Errorf("Wrong date or time: %+v", info)
+	}
+	if info.Address != "163.7.129.73" || info.Index != 0 {
+		t.Errorf("Wrong address or index: %+v", info)
+	}
+	if !info.Timestamp.Equal(time.Date(2017, 5, 16, 22, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong timestamp: %v", info.Timestamp)
+	}
+
+	info, err = parser.ParseSSFilename("20170516T22:00:05Z_2001:db8::1_12.web100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Address != "2001:db8::1" || info.Index != 12 || info.DateDir != "" {
+		t.Errorf("Wrong fields: %+v", info)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"2017051T22:00:00Z_163.7.129.73_0.web100", "yyyymmddT"},
+		{"20170516T22:00:00.123456Z_163.7.129.73_0.web100", "Thh:mm:ssZ_"},
+		{"20170516T22:00:00Z_163.7.129.73.web100", "Z_address_N."},
+		{"20170516T22:00:00Z_163.7.129.73_0.snaplog", ".web100"},
+	}
+	for _, test := range tests {
+		_, err := parser.ParseSSFilename(test.name)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q should mention %q", test.name, err, test.want)
+		}
+	}
+}
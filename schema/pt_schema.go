@@ -1,19 +1,20 @@
 // This files contains schema for Paris TraceRoute tests.
 package schema
 
-// TODO(dev): use mixed case Go variable names throughout
+// GeolocationIP holds the geolocation annotation for an IP address.  The
+// column names match the *_geolocation records in legacy.json.
 type GeolocationIP struct {
-	continent_code string
-	country_code   string
-	country_code3  string
-	country_name   string
-	region         string
-	metro_code     int64
-	city           string
-	area_code      int64
-	postal_code    string
-	latitude       float64
-	longitude      float64
+	ContinentCode string  `json:"continent_code" bigquery:"continent_code"`
+	CountryCode   string  `json:"country_code" bigquery:"country_code"`
+	CountryCode3  string  `json:"country_code3" bigquery:"country_code3"`
+	CountryName   string  `json:"country_name" bigquery:"country_name"`
+	Region        string  `json:"region" bigquery:"region"`
+	MetroCode     int64   `json:"metro_code" bigquery:"metro_code"`
+	City          string  `json:"city" bigquery:"city"`
+	AreaCode      int64   `json:"area_code" bigquery:"area_code"`
+	PostalCode    string  `json:"postal_code" bigquery:"postal_code"`
+	Latitude      float64 `json:"latitude" bigquery:"latitude"`
+	Longitude     float64 `json:"longitude" bigquery:"longitude"`
 }
 
 type ParisTracerouteHop struct {
@@ -25,12 +26,16 @@ type ParisTracerouteHop struct {
 	Src_hostname  string    `json:"src_hostname, string"`
 	Dest_hostname string    `json:"dest_hostname, string"`
 	Rtt           []float64 `json:"rtt, []float64"`
+	// Optional geolocation of the hop addresses.  Nil if not annotated.
+	Src_geolocation  *GeolocationIP `json:"src_geolocation,omitempty" bigquery:",nullable"`
+	Dest_geolocation *GeolocationIP `json:"dest_geolocation,omitempty" bigquery:",nullable"`
 }
 
 type MLabConnectionSpecification struct {
 	Server_ip      string `json:"server_ip, string"`
 	Server_af      int32  `json:"server_af, int32"`
 	Client_ip      string `json:"client_ip, string"`
+	Client_ip_hash string `json:"client_ip_hash"`
 	Client_af      int32  `json:"client_af, int32"`
 	Data_direction int32  `json:"data_direction, int32"`
 }
@@ -42,4 +47,11 @@ type PT struct {
 	Connection_spec      MLabConnectionSpecification `json:"connection_spec"`
 	Paris_traceroute_hop ParisTracerouteHop          `json:"paris_traceroute_hop"`
 	Type                 int32                       `json:"type, int32"`
+	Archive_index        int64                       `json:"archive_index"`
+}
+
+// ArchiveIndex returns the position of the test within its archive, for
+// bq.OrderedInserter.
+func (pt PT) ArchiveIndex() int64 {
+	return pt.Archive_index
 }
@@ -0,0 +1,29 @@
+package schema_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/etl/schema"
+)
+
+// The geolocation fields must be exported, or bigquery will silently omit them.
+func TestGeolocationIPSchema(t *testing.T) {
+	s, err := bigquery.InferSchema(schema.GeolocationIP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range s {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"area_code", "city", "continent_code", "country_code",
+		"country_code3", "country_name", "latitude", "longitude", "metro_code",
+		"postal_code", "region"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
@@ -5,12 +5,11 @@ package schema
 // TODO(prod) Improve unit test coverage.
 import (
 	"log"
+	"sync"
 
 	"cloud.google.com/go/bigquery"
 )
 
-// TODO(prod): Create a struct that satisfies the web100.Saver interface?
-
 // Web100ValueMap implements the web100.Saver interface for recording web100 values.
 type Web100ValueMap map[string]bigquery.Value
 
@@ -63,6 +62,41 @@ func (vm Web100ValueMap) GetInt64(path []string) (int64, bool) {
 	}
 }
 
+// Get the float64 at a path in the nested map.  A float32, such as a DISCO
+// sample value, is converted.  Return value, true if found, or 0, false if not
+// found, or not a float.
+func (vm Web100ValueMap) GetFloat64(path []string) (float64, bool) {
+	if len(path) <= 1 {
+		switch val := vm[path[0]].(type) {
+		case float64:
+			return val, true
+		case float32:
+			return float64(val), true
+		default:
+			return 0, false
+		}
+	}
+	next := vm.Get(path[0])
+	if next == nil {
+		return 0, false
+	}
+	return next.GetFloat64(path[1:])
+}
+
+// Get the []float64 at a path in the nested map, such as PT RTTs.  Return
+// value, true if found, or nil, false if not found.
+func (vm Web100ValueMap) GetFloat64Slice(path []string) ([]float64, bool) {
+	if len(path) <= 1 {
+		val, ok := vm[path[0]].([]float64)
+		return val, ok
+	}
+	next := vm.Get(path[0])
+	if next == nil {
+		return nil, false
+	}
+	return next.GetFloat64Slice(path[1:])
+}
+
 // Get the int64 at a path in the nested map.  Return value or nil.
 func (vm Web100ValueMap) GetMap(path []string) Web100ValueMap {
 	if len(path) == 0 {
@@ -85,6 +119,16 @@ func (s Web100ValueMap) SetString(name string, value string) {
 	s[name] = value
 }
 
+// SetFloat64 saves a float64 in a field with the given name.
+func (s Web100ValueMap) SetFloat64(name string, value float64) {
+	s[name] = value
+}
+
+// SetFloat64Slice saves a []float64 in a field with the given name.
+func (s Web100ValueMap) SetFloat64Slice(name string, value []float64) {
+	s[name] = value
+}
+
 // SetBool saves a boolean in a field with the given name.
 func (s Web100ValueMap) SetBool(name string, value bool) {
 	s[name] = value
@@ -132,6 +176,53 @@ func (r Web100ValueMap) SubstituteInt64(overwrite bool, target []string, source
 	m[target[len(target)-1]] = value
 }
 
+// if overwrite is false, will only add missing values.
+// if overwrite is true, will overwrite existing values.
+func (r Web100ValueMap) SubstituteFloat64(overwrite bool, target []string, source []string) {
+	m := r.GetMap(target[:len(target)-1])
+	if m == nil {
+		// Error ?
+		log.Printf("No such path: %v\n", target)
+		return
+	}
+	if _, notNull := m[target[len(target)-1]]; notNull && !overwrite {
+		// All good
+		return
+	}
+	value, ok := r.GetFloat64(source)
+	if !ok {
+		log.Printf("Source not available: %v\n", source)
+		return
+	}
+	m[target[len(target)-1]] = value
+}
+
+// Merge copies the values from other into r, recursing into nested maps, so
+// that other's nested maps are copied rather than shared.  As for the
+// Substitute functions, if overwrite is false, will only add missing values,
+// and if overwrite is true, will overwrite existing values.
+func (r Web100ValueMap) Merge(other Web100ValueMap, overwrite bool) {
+	for name, value := range other {
+		existing, exists := r[name]
+		if src, ok := value.(Web100ValueMap); ok {
+			dst, ok := existing.(Web100ValueMap)
+			if !ok {
+				if exists && !overwrite {
+					continue
+				}
+				dst = make(Web100ValueMap, len(src))
+				r[name] = dst
+			}
+			dst.Merge(src, overwrite)
+			continue
+		}
+		if exists && !overwrite {
+			continue
+		}
+		r[name] = value
+	}
+}
+
 // NewWeb100FullRecord creates a web100 value map with all supported fields.
 // This is suitable when creating a schema definition for a new bigquery table.
 func NewWeb100FullRecord(version string, logTime int64, connSpec, snapValues map[string]bigquery.Value) Web100ValueMap {
@@ -150,12 +241,87 @@ func NewWeb100FullRecord(version string, logTime int64, connSpec, snapValues map
 	}
 }
 
+// Expected map sizes.  Proper sizing avoids evacuate when the maps are filled.
+const (
+	// SnapFields is the number of fields in each web100 snapshot, 112 integers
+	// and 2 strings.
+	SnapFields = 114
+	// DeltaFields is the typical number of fields that change between
+	// consecutive snapshots.
+	DeltaFields = 10
+	// ConnectionSpecFields is the number of fields in FullConnectionSpec.
+	ConnectionSpecFields = 17
+)
+
+// SnapFieldNames lists the web100_log_entry.snap fields in ndt.json, which
+// are the canonical names of the snapshot variables that are saved.
+var SnapFieldNames = []string{
+	"AbruptTimeouts", "ActiveOpen", "CERcvd", "CongAvoid", "CongOverCount",
+	"CongSignals", "CountRTT", "CurAppRQueue", "CurAppWQueue", "CurCwnd",
+	"CurMSS", "CurRTO", "CurReasmQueue", "CurRetxQueue", "CurRwinRcvd",
+	"CurRwinSent", "CurSsthresh", "CurTimeoutCount", "DSACKDups", "DataSegsIn",
+	"DataSegsOut", "DupAcksIn", "DupAcksOut", "Duration", "ECN", "FastRetran",
+	"HCDataOctetsIn", "HCDataOctetsOut", "HCThruOctetsAcked",
+	"HCThruOctetsReceived", "LimCwnd", "LimRwin", "LocalAddress",
+	"LocalAddressType", "LocalPort", "MSSRcvd", "MaxAppRQueue", "MaxAppWQueue",
+	"MaxMSS", "MaxRTO", "MaxRTT", "MaxReasmQueue", "MaxRetxQueue",
+	"MaxRwinRcvd", "MaxRwinSent", "MaxSsCwnd", "MaxSsthresh", "MinMSS",
+	"MinRTO", "MinRTT", "MinRwinRcvd", "MinRwinSent", "MinSsthresh", "Nagle",
+	"NonRecovDA", "OctetsRetrans", "OtherReductions", "PostCongCountRTT",
+	"PostCongSumRTT", "PreCongSumCwnd", "PreCongSumRTT", "QuenchRcvd", "RTTVar",
+	"RcvNxt", "RcvRTT", "RcvWindScale", "RecInitial", "RemAddress", "RemPort",
+	"RetranThresh", "SACK", "SACKBlocksRcvd", "SACKsRcvd", "SampleRTT",
+	"SegsIn", "SegsOut", "SegsRetrans", "SendStall", "SlowStart", "SmoothedRTT",
+	"SndInitial", "SndLimBytesCwnd", "SndLimBytesRwin", "SndLimBytesSender",
+	"SndLimTimeCwnd", "SndLimTimeRwin", "SndLimTimeSnd", "SndLimTransCwnd",
+	"SndLimTransRwin", "SndLimTransSnd", "SndMax", "SndNxt", "SndUna",
+	"SndWindScale", "SpuriousFrDetected", "StartTimeStamp", "StartTimeUsec",
+	"State", "SubsequentTimeouts", "SumRTT", "TimeStamps", "Timeouts",
+	"WinScaleRcvd", "WinScaleSent", "X_OtherReductionsCM",
+	"X_OtherReductionsCV", "X_Rcvbuf", "X_Sndbuf", "X_dbg1", "X_dbg2", "X_dbg3",
+	"X_dbg4", "X_rcv_ssthresh", "X_wnd_clamp",
+}
+
+// EmptySnap10 creates a map sized for the changed fields of a snapshot delta.
 func EmptySnap10() Web100ValueMap {
-	return make(Web100ValueMap, 10)
+	return make(Web100ValueMap, DeltaFields)
 }
 
+// EmptySnap creates a map sized for all the fields of a snapshot.
 func EmptySnap() Web100ValueMap {
-	return make(Web100ValueMap, 120)
+	return make(Web100ValueMap, SnapFields)
+}
+
+// Reset deletes all the values, so that the map can be reused.
+func (vm Web100ValueMap) Reset() {
+	for k := range vm {
+		delete(vm, k)
+	}
+}
+
+// SnapPool holds empty snapshot value maps for reuse, to reduce allocation
+// and GC pressure when many snapshots are decoded, and then discarded.
+type SnapPool struct {
+	pool sync.Pool
+}
+
+// NewSnapPool creates a SnapPool of maps sized for the given number of
+// fields, such as SnapFields or DeltaFields.
+func NewSnapPool(fields int) *SnapPool {
+	return &SnapPool{pool: sync.Pool{
+		New: func() interface{} { return make(Web100ValueMap, fields) }}}
+}
+
+// Get returns an empty map, reusing one returned by Put, if available.
+func (p *SnapPool) Get() Web100ValueMap {
+	return p.pool.Get().(Web100ValueMap)
+}
+
+// Put resets the map, and returns it to the pool.  The caller must not use
+// the map, or any record that contains it, afterwards.
+func (p *SnapPool) Put(vm Web100ValueMap) {
+	vm.Reset()
+	p.pool.Put(vm)
 }
 
 // NewWeb100Skeleton creates the tree structure, with no leaf fields.
@@ -191,11 +357,13 @@ func FullConnectionSpec() Web100ValueMap {
 	}
 }
 
+// EmptyConnectionSpec creates a connection spec with empty geolocations, sized
+// for all the fields of FullConnectionSpec.
 func EmptyConnectionSpec() Web100ValueMap {
-	return Web100ValueMap{
-		"client_geolocation": EmptyGeolocation(),
-		"server_geolocation": EmptyGeolocation(),
-	}
+	spec := make(Web100ValueMap, ConnectionSpecFields)
+	spec["client_geolocation"] = EmptyGeolocation()
+	spec["server_geolocation"] = EmptyGeolocation()
+	return spec
 }
 
 func FullGeolocation() Web100ValueMap {
@@ -221,6 +389,16 @@ func EmptyGeolocation() Web100ValueMap {
 // NewWeb100MinimalRecord creates a web100 value map with only the given fields.
 // All undefined fields will be set to null after a BQ insert.
 func NewWeb100MinimalRecord(version string, logTime int64, connSpec, snapValues Web100ValueMap, deltas []Web100ValueMap) Web100ValueMap {
+	record := NewWeb100SnapshotRecord(version, logTime, connSpec, snapValues)
+	record.Get("web100_log_entry")["deltas"] = deltas
+	return record
+}
+
+// NewWeb100SnapshotRecord creates a web100 value map for a single snapshot,
+// such as each SideStream snapshot, which is recorded in its own row.  It has
+// the same structure as NewWeb100MinimalRecord, without the deltas, so that
+// the web100 tables share their schema.
+func NewWeb100SnapshotRecord(version string, logTime int64, connSpec, snapValues Web100ValueMap) Web100ValueMap {
 	return Web100ValueMap{
 		"anomalies": Web100ValueMap{},
 		"web100_log_entry": Web100ValueMap{
@@ -228,7 +406,6 @@ func NewWeb100MinimalRecord(version string, logTime int64, connSpec, snapValues
 			"log_time":        logTime,
 			"connection_spec": connSpec, // TODO - deprecate connection_spec here.
 			"snap":            snapValues,
-			"deltas":          deltas,
 		},
 	}
 }
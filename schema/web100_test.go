@@ -0,0 +1,267 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/schema"
+	"github.com/m-lab/etl/web100"
+)
+
+var _ web100.Saver = schema.Web100ValueMap{}
+
+func TestMerge(t *testing.T) {
+	other := schema.Web100ValueMap{
+		"test_id": "new",
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip":          "1.2.3.4",
+			"server_ip":          "5.6.7.8",
+			"client_geolocation": schema.Web100ValueMap{"city": "Paris"},
+		},
+		"anomalies": schema.Web100ValueMap{"no_meta": true},
+	}
+	tests := []struct {
+		overwrite bool
+		want      schema.Web100ValueMap
+	}{
+		{false, schema.Web100ValueMap{
+			"test_id": "old",
+			"connection_spec": schema.Web100ValueMap{
+				"client_ip":          "1.2.3.4",
+				"server_ip":          "",
+				"client_geolocation": schema.Web100ValueMap{"city": "Paris"},
+			},
+			"anomalies": "not a map",
+		}},
+		{true, schema.Web100ValueMap{
+			"test_id": "new",
+			"connection_spec": schema.Web100ValueMap{
+				"client_ip":          "1.2.3.4",
+				"server_ip":          "5.6.7.8",
+				"client_geolocation": schema.Web100ValueMap{"city": "Paris"},
+			},
+			"anomalies": schema.Web100ValueMap{"no_meta": true},
+		}},
+	}
+	for _, test := range tests {
+		vm := schema.Web100ValueMap{
+			"test_id":         "old",
+			"connection_spec": schema.Web100ValueMap{"server_ip": ""},
+			"anomalies":       "not a map",
+		}
+		vm.Merge(other, test.overwrite)
+		if !reflect.DeepEqual(vm, test.want) {
+			t.Errorf("overwrite %v: got %v, want %v", test.overwrite, vm, test.want)
+		}
+		// Nested maps are copied, rather than shared.
+		vm.GetMap([]string{"connection_spec", "client_geolocation"})["city"] = "Rome"
+		if city, _ := other.GetString([]string{"connection_spec", "client_geolocation", "city"}); city != "Paris" {
+			t.Errorf("overwrite %v: merged map shares nested map", test.overwrite)
+		}
+	}
+}
+
+func TestFloat64(t *testing.T) {
+	vm := schema.Web100ValueMap{"hop": schema.Web100ValueMap{}}
+	hop := vm.Get("hop")
+	hop.SetFloat64("rtt", 1.5)
+	hop.SetFloat64Slice("rtts", []float64{1.5, 2.5})
+	hop["value"] = float32(0.25)
+	hop["count"] = int64(3)
+
+	if v, ok := vm.GetFloat64([]string{"hop", "rtt"}); !ok || v != 1.5 {
+		t.Errorf("rtt: got %v, %v", v, ok)
+	}
+	if v, ok := vm.GetFloat64([]string{"hop", "value"}); !ok || v != 0.25 {
+		t.Errorf("float32 value: got %v, %v", v, ok)
+	}
+	for _, path := range [][]string{{"hop", "count"}, {"hop", "missing"}, {"missing", "rtt"}} {
+		if v, ok := vm.GetFloat64(path); ok {
+			t.Errorf("%v: unexpected %v", path, v)
+		}
+	}
+	if v, ok := vm.GetFloat64Slice([]string{"hop", "rtts"}); !ok || !reflect.DeepEqual(v, []float64{1.5, 2.5}) {
+		t.Errorf("rtts: got %v, %v", v, ok)
+	}
+	if v, ok := vm.GetFloat64Slice([]string{"hop", "rtt"}); ok {
+		t.Errorf("rtt slice: unexpected %v", v)
+	}
+}
+
+func TestSubstituteFloat64(t *testing.T) {
+	for _, test := range []struct {
+		overwrite bool
+		want      float64
+	}{
+		{false, 1.5},
+		{true, 2.5},
+	} {
+		vm := schema.Web100ValueMap{
+			"hop":  schema.Web100ValueMap{"rtt": 1.5},
+			"snap": schema.Web100ValueMap{"rtt": 2.5},
+		}
+		vm.SubstituteFloat64(test.overwrite, []string{"hop", "rtt"}, []string{"snap", "rtt"})
+		if v, _ := vm.GetFloat64([]string{"hop", "rtt"}); v != test.want {
+			t.Errorf("overwrite %v: got %v, want %v", test.overwrite, v, test.want)
+		}
+		// A missing value is always added.
+		vm.SubstituteFloat64(test.overwrite, []string{"hop", "min_rtt"}, []string{"snap", "rtt"})
+		if v, ok := vm.GetFloat64([]string{"hop", "min_rtt"}); !ok || v != 2.5 {
+			t.Errorf("overwrite %v: got %v, %v for missing value", test.overwrite, v, ok)
+		}
+		// A missing source leaves the value unchanged.
+		vm.SubstituteFloat64(true, []string{"hop", "rtt"}, []string{"snap", "missing"})
+		if v, _ := vm.GetFloat64([]string{"hop", "rtt"}); v != test.want {
+			t.Errorf("overwrite %v: got %v after missing source", test.overwrite, v)
+		}
+	}
+}
+
+func TestNewWeb100SnapshotRecord(t *testing.T) {
+	connSpec := schema.Web100ValueMap{"local_ip": "1.2.3.4"}
+	snap := schema.Web100ValueMap{"CurCwnd": int64(4344)}
+	record := schema.NewWeb100SnapshotRecord("2.5.27", 1494337516, connSpec, snap)
+	if v, ok := record.GetInt64([]string{"web100_log_entry", "snap", "CurCwnd"}); !ok || v != 4344 {
+		t.Errorf("Wrong snap value %v, %v", v, ok)
+	}
+	if _, ok := record.Get("web100_log_entry")["deltas"]; ok {
+		t.Error("Snapshot record should not have deltas")
+	}
+
+	// Apart from the deltas, NDT records have the same structure.
+	deltas := []schema.Web100ValueMap{{"CurCwnd": int64(1448)}}
+	minimal := schema.NewWeb100MinimalRecord("2.5.27", 1494337516, connSpec, snap, deltas)
+	if !reflect.DeepEqual(minimal.Get("web100_log_entry")["deltas"], deltas) {
+		t.Errorf("Wrong deltas %v", minimal.Get("web100_log_entry")["deltas"])
+	}
+	delete(minimal.Get("web100_log_entry"), "deltas")
+	if !reflect.DeepEqual(minimal, record) {
+		t.Errorf("Got %v, want %v", minimal, record)
+	}
+}
+
+// fieldNames returns n distinct field names, and values that do not allocate
+// when stored in a map.
+func fieldNames(n int) ([]string, []bigquery.Value) {
+	names := make([]string, n)
+	values := make([]bigquery.Value, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("Field%d", i)
+		values[i] = int64(i)
+	}
+	return names, values
+}
+
+func fill(vm schema.Web100ValueMap, names []string, values []bigquery.Value) {
+	for i, name := range names {
+		vm[name] = values[i]
+	}
+}
+
+func TestEmptyMapSizes(t *testing.T) {
+	if n := len(schema.FullConnectionSpec()); n != schema.ConnectionSpecFields {
+		t.Errorf("FullConnectionSpec has %d fields, ConnectionSpecFields is %d", n, schema.ConnectionSpecFields)
+	}
+
+	// Filling the maps to the expected size should not grow them.
+	tests := []struct {
+		name   string
+		empty  func() schema.Web100ValueMap
+		fields int
+	}{
+		{"EmptySnap", schema.EmptySnap, schema.SnapFields},
+		{"EmptySnap10", schema.EmptySnap10, schema.DeltaFields},
+		{"EmptyConnectionSpec", schema.EmptyConnectionSpec, schema.ConnectionSpecFields - 2},
+	}
+	for _, test := range tests {
+		names, values := fieldNames(test.fields)
+		base := testing.AllocsPerRun(10, func() { test.empty() })
+		filled := testing.AllocsPerRun(10, func() { fill(test.empty(), names, values) })
+		if filled > base {
+			t.Errorf("%s: %v allocations when filled, want %v", test.name, filled, base)
+		}
+	}
+}
+
+func BenchmarkEmptySnap(b *testing.B) {
+	names, values := fieldNames(schema.SnapFields)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fill(schema.EmptySnap(), names, values)
+	}
+}
+
+func BenchmarkUnsizedSnap(b *testing.B) {
+	names, values := fieldNames(schema.SnapFields)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fill(make(schema.Web100ValueMap), names, values)
+	}
+}
+
+func TestSnapPool(t *testing.T) {
+	pool := schema.NewSnapPool(schema.SnapFields)
+	names, values := fieldNames(schema.SnapFields)
+	vm := pool.Get()
+	fill(vm, names, values)
+	pool.Put(vm)
+	if len(vm) != 0 {
+		t.Errorf("Put did not reset the map: %d values", len(vm))
+	}
+	// Whether or not the map is reused, Get returns an empty map.
+	if vm = pool.Get(); len(vm) != 0 {
+		t.Errorf("Got %d values, want empty map", len(vm))
+	}
+}
+
+func BenchmarkSnapPool(b *testing.B) {
+	pool := schema.NewSnapPool(schema.SnapFields)
+	names, values := fieldNames(schema.SnapFields)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vm := pool.Get()
+		fill(vm, names, values)
+		pool.Put(vm)
+	}
+}
+
+// TestSnapFieldNames checks that SnapFieldNames matches the snap fields in
+// ndt.json.
+func TestSnapFieldNames(t *testing.T) {
+	data, err := ioutil.ReadFile("ndt.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type field struct {
+		Name   string  `json:"name"`
+		Fields []field `json:"fields"`
+	}
+	var fields []field
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range fields {
+		if f.Name != "web100_log_entry" {
+			continue
+		}
+		for _, g := range f.Fields {
+			if g.Name == "snap" {
+				for _, h := range g.Fields {
+					names = append(names, h.Name)
+				}
+			}
+		}
+	}
+	if !reflect.DeepEqual(names, schema.SnapFieldNames) {
+		t.Errorf("Got %v, want snap fields %v", schema.SnapFieldNames, names)
+	}
+	if len(schema.SnapFieldNames) != schema.SnapFields {
+		t.Errorf("Got %d names, want SnapFields %d", len(schema.SnapFieldNames), schema.SnapFields)
+	}
+}
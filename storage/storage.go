@@ -11,18 +11,22 @@ import (
 	"compress/gzip"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	storage "google.golang.org/api/storage/v1"
 )
 
@@ -34,27 +38,73 @@ type TarReader interface {
 type ETLSource struct {
 	TarReader // TarReader interface provided by an embedded struct.
 	io.Closer // Closer interface to be provided by an embedded struct.
+
+	// If true, gzipped tests with a CRC or size mismatch are dropped, and
+	// NextTest returns ErrCorruptGzip.  Otherwise, the data is returned, and
+	// only a warning is recorded.
+	StrictGzip bool
+
+	// If non-nil, OnSkip is called with the name and type of each
+	// non-regular entry that NextTest skips.
+	OnSkip func(name string, typeflag byte)
+
+	skipped int        // Number of non-regular entries skipped by NextTest.
+	logger  etl.Logger // Adds the archive's task_filename to each entry.
+}
+
+// Skipped returns the number of directories, symlinks and other non-regular
+// entries that NextTest has skipped.
+func (rr *ETLSource) Skipped() int {
+	return rr.skipped
+}
+
+// ErrCorruptGzip is returned by NextTest, in strict mode, for a gzipped test
+// whose trailer checksum does not match the content.  Processing may continue
+// with the next test.
+var ErrCorruptGzip = errors.New("gz crc error")
+
+// StreamError is returned by NextTest when reading the archive fails with a
+// GCS or HTTP2 stream error, and retries are exhausted.  These are usually
+// transient, so the whole archive may succeed if the task is retried.
+type StreamError struct {
+	Phase string // The phase of reading that failed, "next" or "read".
+	Err   error  // The underlying error.
+}
+
+func (e *StreamError) Error() string {
+	return e.Phase + ": " + e.Err.Error()
 }
 
+// isStreamError returns true for the GCS stream errors that are usually
+// transient.
+func isStreamError(err error) bool {
+	return strings.Contains(err.Error(), "stream error")
+}
+
+// Initial delay between read retries.  The delay doubles on each retry.
+var retryDelay = 16 * time.Millisecond
+
 // Retrieve next file header.
 // Lots of error handling because of common faults in underlying GCS.
 func (rr *ETLSource) nextHeader(trial int) (*tar.Header, bool, error) {
 	h, err := rr.Next()
 	if err != nil {
-		if err == io.EOF {
+		if err == io.EOF || err == ErrTruncatedXZ {
 			return nil, false, err
 		} else if strings.Contains(err.Error(), "unexpected EOF") {
 			metrics.GCSRetryCount.WithLabelValues(
 				"next", strconv.Itoa(trial), "unexpected EOF").Inc()
-			// TODO: These are likely unrecoverable, so we should
-			// just return.
+			// The archive is truncated, and the tar reader error is
+			// sticky, so retrying won't help.
+			rr.logger.Warning("truncated archive", "attempt", trial, "reason", err)
+			return nil, false, err
 		} else {
 			// Quite a few of these now, and they seem to be
 			// unrecoverable.
 			metrics.GCSRetryCount.WithLabelValues(
 				"next", strconv.Itoa(trial), "other").Inc()
 		}
-		log.Printf("nextHeader: %v\n", err)
+		rr.logger.Warning("next header error", "attempt", trial, "reason", err)
 	}
 	return h, true, err
 }
@@ -76,19 +126,38 @@ func (rr *ETLSource) nextData(h *tar.Header, trial int) ([]byte, bool, error) {
 			}
 			metrics.GCSRetryCount.WithLabelValues(
 				"open zip", strconv.Itoa(trial), "zipReaderError").Inc()
-			log.Printf("zipReaderError(%d): %v in file %s\n", trial, err, h.Name)
+			rr.logger.Warning("zip reader error", "test_id", h.Name,
+				"attempt", trial, "reason", err)
 			return nil, true, err
 		}
 		defer zipReader.Close()
 		phase = "read zip"
+		// The CRC and size in the gzip trailer are only checked when
+		// the reader reaches EOF, so ReadAll is required here.
 		data, err = ioutil.ReadAll(zipReader)
+		if err == gzip.ErrChecksum {
+			// The tar entry has been fully read, so retrying won't help.
+			rr.logger.Warning("gz crc error", "test_id", h.Name)
+			if rr.StrictGzip {
+				metrics.ErrorCount.WithLabelValues(
+					"unknown", "gz", "gz crc error").Inc()
+				return nil, false, ErrCorruptGzip
+			}
+			metrics.WarningCount.WithLabelValues(
+				"unknown", "gz", "gz crc error").Inc()
+			return data, false, nil
+		}
 	} else {
 		phase = "read"
 		data, err = ioutil.ReadAll(rr)
 	}
+	if err == ErrTruncatedXZ {
+		// The rest of the archive is missing, so retrying won't help.
+		return nil, false, err
+	}
 	if err != nil {
 		// These errors seem to be recoverable, at least with zip files.
-		if strings.Contains(err.Error(), "stream error") {
+		if isStreamError(err) {
 			// We are seeing these very rarely, maybe 1 per hour.
 			// They are non-deterministic, so probably related to GCS problems.
 			metrics.GCSRetryCount.WithLabelValues(
@@ -98,67 +167,112 @@ func (rr *ETLSource) nextData(h *tar.Header, trial int) ([]byte, bool, error) {
 			metrics.GCSRetryCount.WithLabelValues(
 				phase, strconv.Itoa(trial), "other error").Inc()
 		}
-		log.Printf("nextData(%d): %v\n", trial, err)
+		rr.logger.Warning("next data error", "test_id", h.Name,
+			"attempt", trial, "reason", err)
 		return nil, true, err
 	}
 
 	return data, false, nil
 }
 
-// Next reads the next test object from the tar file.
-// Returns io.EOF when there are no more tests.
-func (rr *ETLSource) NextTest() (string, []byte, error) {
-	metrics.WorkerState.WithLabelValues("read").Inc()
-	defer metrics.WorkerState.WithLabelValues("read").Dec()
+// sleepContext sleeps for d, returning early with the context error if ctx
+// is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
 
+// Retrieve the next file header, retrying on errors.
+func (rr *ETLSource) retryHeader(ctx context.Context) (*tar.Header, error) {
 	// Try to get the next file.  We retry multiple times, because sometimes
 	// GCS stalls and produces stream errors.
+	// Last trial will be after total delay of 16ms + 32ms + ... + 8192ms,
+	// or about 15 seconds.
+	trial := 0
+	delay := retryDelay
+	for {
+		trial++
+		h, retry, err := rr.nextHeader(trial)
+		if err == nil {
+			return h, nil
+		}
+		if !retry || trial >= 10 {
+			if isStreamError(err) {
+				return nil, &StreamError{Phase: "next", Err: err}
+			}
+			return nil, err
+		}
+		// For each trial, increase backoff delay by 2x.
+		delay *= 2
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Next reads the next test object from the tar file.  Directories, symlinks
+// and other non-regular entries are skipped, and counted in Skipped.
+// Returns io.EOF when there are no more tests, or the context error if ctx
+// is cancelled.
+func (rr *ETLSource) NextTest(ctx context.Context) (string, []byte, error) {
+	metrics.WorkerState.WithLabelValues("read").Inc()
+	defer metrics.WorkerState.WithLabelValues("read").Dec()
+
 	var err error
 	var data []byte
 	var h *tar.Header
 
-	// Last trial will be after total delay of 16ms + 32ms + ... + 8192ms,
-	// or about 15 seconds.
+	for {
+		if err = ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		h, err = rr.retryHeader(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		// Only process regular files.
+		if h.Typeflag == tar.TypeReg {
+			break
+		}
+		rr.skipped++
+		if rr.OnSkip != nil {
+			rr.OnSkip(h.Name, h.Typeflag)
+		}
+		metrics.WarningCount.WithLabelValues(
+			"unknown", "tar", "skipped non-regular").Inc()
+	}
+
 	trial := 0
-	delay := 16 * time.Millisecond
+	delay := retryDelay
 	for {
 		trial++
 		var retry bool
-		h, retry, err = rr.nextHeader(trial)
+		data, retry, err = rr.nextData(h, trial)
 		if err == nil {
 			break
 		}
 		if !retry || trial >= 10 {
-			return "", nil, err
+			// FYI, it appears that stream errors start in the
+			// nextData phase of reading, but then persist on
+			// the next call to nextHeader.
+			break
 		}
 		// For each trial, increase backoff delay by 2x.
 		delay *= 2
-		time.Sleep(delay)
-	}
-
-	// Only process regular files.
-	if h.Typeflag == tar.TypeReg {
-		trial = 0
-		delay = 16 * time.Millisecond
-		for {
-			trial++
-			var retry bool
-			data, retry, err = rr.nextData(h, trial)
-			if err == nil {
-				break
-			}
-			if !retry || trial >= 10 {
-				// FYI, it appears that stream errors start in the
-				// nextData phase of reading, but then persist on
-				// the next call to nextHeader.
-				break
-			}
-			// For each trial, increase backoff delay by 2x.
-			delay *= 2
-			time.Sleep(delay)
-
+		if err = sleepContext(ctx, delay); err != nil {
+			return h.Name, nil, err
 		}
 	}
+	if err == ErrCorruptGzip || err == ErrTruncatedXZ {
+		return h.Name, nil, err
+	}
+	if err != nil && isStreamError(err) {
+		return h.Name, nil, &StreamError{Phase: "read", Err: err}
+	}
 
 	return h.Name, data, nil
 }
@@ -177,61 +291,253 @@ func (t *Closer) Close() error {
 
 var errNoClient = errors.New("client should be non-null")
 
+// ArchiveTimeout bounds the download of a single archive by NewETLSource,
+// including any resumes.
+// TODO(prod) Evaluate whether this is long enough.
+const ArchiveTimeout = 30 * time.Minute
+
 // Create a ETLSource suitable for injecting into Task.
 // Caller is responsible for calling Close on the returned object.
 //
-// uri should be of form gs://bucket/filename.tar or gs://bucket/filename.tgz
+// uri should be of form gs://bucket/filename.tar, gs://bucket/filename.tgz,
+// or gs://bucket/filename.tar.xz
 // FYI Using a persistent client saves about 80 msec, and 220 allocs, totalling 70kB.
 // TODO(now) rename
 func NewETLSource(client *http.Client, uri string) (*ETLSource, error) {
 	if client == nil {
 		return nil, errNoClient
 	}
-	// For now only handle gcs paths.
-	if !strings.HasPrefix(uri, "gs://") {
-		return nil, errors.New("invalid file path: " + uri)
-	}
-	parts := strings.SplitN(uri, "/", 4)
-	if len(parts) != 4 {
-		return nil, errors.New("invalid file path: " + uri)
+	bucket, fn, err := splitURI(uri)
+	if err != nil {
+		return nil, err
 	}
-	bucket := parts[2]
-	fn := parts[3]
 
 	// TODO - consider just always testing for valid gzip file.
-	if !(strings.HasSuffix(fn, ".tgz") || strings.HasSuffix(fn, ".tar") ||
-		strings.HasSuffix(fn, ".tar.gz")) {
-		return nil, errors.New("not tar or tgz: " + uri)
+	if !isArchive(fn) {
+		return nil, errors.New("not tar, tgz or tar.xz: " + uri)
+	}
+
+	retry := retryPolicy{retries: archiveRetries, baseDelay: archiveBaseDelay}
+	return newGCSSource(client, bucket, fn, time.Now().Add(ArchiveTimeout), retry)
+}
+
+// newGCSSource creates an ETLSource for gs://bucket/fn.  The deadline bounds
+// the whole download, including any resumes.
+func newGCSSource(client *http.Client, bucket string, fn string, deadline time.Time, retry retryPolicy) (*ETLSource, error) {
+	obj, err := getObjectRange(client, bucket, fn, 0, 0, deadline, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resume from the same generation, in case the object is replaced.
+	generation, _ := strconv.ParseInt(obj.Header.Get("X-Goog-Generation"), 10, 64)
+	logger := etl.NewLogger("task_filename", "gs://"+bucket+"/"+fn)
+	body := &resumingReader{body: obj.Body, logger: logger, open: func(offset int64) (io.ReadCloser, error) {
+		obj, err := getObjectRange(client, bucket, fn, generation, offset, deadline, retry)
+		if err != nil {
+			return nil, err
+		}
+		return obj.Body, nil
+	}}
+	src, err := newETLSource(fn, body)
+	if err != nil {
+		return nil, err
+	}
+	src.logger = logger
+	return src, nil
+}
+
+// Maximum number of times a resumingReader resumes a failed object stream.
+const maxResumes = 3
+
+// resumingReader reads a GCS object, and if the stream fails partway, resumes
+// with a Range request from the last byte consumed, so that a transient
+// error does not abandon the whole archive.
+type resumingReader struct {
+	body    io.ReadCloser
+	open    func(offset int64) (io.ReadCloser, error) // Opens the object at offset.
+	offset  int64                                     // Bytes consumed so far.
+	resumes int
+	err     error      // Sticky error, once the stream cannot be resumed.
+	logger  etl.Logger // Adds the archive's task_filename to each entry.
+}
+
+func (rr *resumingReader) Read(p []byte) (int, error) {
+	if rr.err != nil {
+		return 0, rr.err
+	}
+	n, err := rr.body.Read(p)
+	rr.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if rr.resumes >= maxResumes || !(isStreamError(err) || isRetryableFetch(err)) {
+		rr.err = err
+		return n, err
 	}
+	metrics.GCSRetryCount.WithLabelValues(
+		"resume", strconv.Itoa(rr.resumes), "stream error").Inc()
+	rr.logger.Warning("resuming stream", "offset", rr.offset, "reason", err)
+	rr.resumes++
+	rr.body.Close()
+	body, openErr := rr.open(rr.offset)
+	if openErr != nil {
+		rr.logger.Error("resume failed", "offset", rr.offset, "reason", openErr)
+		rr.body = ioutil.NopCloser(strings.NewReader(""))
+		rr.err = err
+		return n, err
+	}
+	rr.body = body
+	if n > 0 {
+		return n, nil
+	}
+	return rr.Read(p)
+}
 
-	// TODO(prod) Evaluate whether this is long enough.
-	obj, err := getObject(client, bucket, fn, 30*time.Minute)
+func (rr *resumingReader) Close() error {
+	return rr.body.Close()
+}
+
+// NewFileSource creates an ETLSource reading a .tar, .tgz, .tar.gz or
+// .tar.xz archive from the local filesystem, e.g. for an archive downloaded
+// with gsutil.
+// Caller is responsible for calling Close on the returned object.
+func NewFileSource(path string) (*ETLSource, error) {
+	if !isArchive(path) {
+		return nil, errors.New("not tar, tgz or tar.xz: " + path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newETLSource(path, f)
 	if err != nil {
 		return nil, err
 	}
+	src.logger = etl.NewLogger("task_filename", path)
+	return src, nil
+}
 
-	rdr := obj.Body
-	var closer io.Closer = obj.Body
+// IsArchive returns true if fn has one of the archive suffixes supported by
+// NewETLSource and NewFileSource.
+func IsArchive(fn string) bool {
+	return isArchive(fn)
+}
+
+func isArchive(fn string) bool {
+	return strings.HasSuffix(fn, ".tgz") || strings.HasSuffix(fn, ".tar") ||
+		strings.HasSuffix(fn, ".tar.gz") || strings.HasSuffix(fn, ".tar.xz")
+}
+
+// newETLSource creates an ETLSource reading the archive fn from body,
+// decompressing it according to the file suffix.  body is closed when the
+// ETLSource is closed, or if there is an error.
+func newETLSource(fn string, body io.ReadCloser) (*ETLSource, error) {
+	var rdr io.Reader = body
+	var closer io.Closer = body
+	var err error
+	lower := strings.ToLower(fn)
 	// Handle .tar.gz, .tgz files.
-	if strings.HasSuffix(strings.ToLower(fn), "gz") {
+	if strings.HasSuffix(lower, "gz") {
 		// TODO add unit test
-		// NB: This must not be :=, or it creates local rdr.
 		// TODO - add retries with backoff.
-		rdr, err = gzip.NewReader(obj.Body)
+		var zipper *gzip.Reader
+		zipper, err = gzip.NewReader(body)
 		if err != nil {
-			obj.Body.Close()
+			body.Close()
+			return nil, err
+		}
+		rdr = zipper
+		closer = &Closer{zipper, body}
+	} else if strings.HasSuffix(lower, ".xz") {
+		rdr, err = newXZReader(body)
+		if err != nil {
+			body.Close()
 			return nil, err
 		}
-
-		closer = &Closer{rdr, obj.Body}
 	}
 	tarReader := tar.NewReader(rdr)
 
-	return &ETLSource{tarReader, closer}, nil
+	return &ETLSource{TarReader: tarReader, Closer: closer}, nil
 }
 
-// Create a storage reader client.
-func GetStorageClient(writeAccess bool) (*http.Client, error) {
+// GetGeneration returns the current GCS generation of the object at uri.
+// This only fetches the object metadata, not the content.
+func GetGeneration(client *http.Client, uri string) (int64, error) {
+	if client == nil {
+		return 0, errNoClient
+	}
+	bucket, fn, err := splitURI(uri)
+	if err != nil {
+		return 0, err
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	obj, err := service.Objects.Get(bucket, fn).Context(ctx).Do()
+	if err != nil {
+		return 0, err
+	}
+	return obj.Generation, nil
+}
+
+// GCSCompletionStore records completed archives as empty marker objects in
+// a GCS bucket, named completed/<bucket>/<filename>/<generation>.  It
+// satisfies the task.CompletionStore interface.
+// The client must have write access to the marker bucket.
+type GCSCompletionStore struct {
+	service *storage.Service
+	bucket  string
+}
+
+// NewGCSCompletionStore creates a GCSCompletionStore that writes markers to
+// the given bucket.
+func NewGCSCompletionStore(client *http.Client, bucket string) (*GCSCompletionStore, error) {
+	if client == nil {
+		return nil, errNoClient
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSCompletionStore{service, bucket}, nil
+}
+
+func (gs *GCSCompletionStore) markerName(filename string, generation int64) string {
+	return "completed/" + strings.TrimPrefix(filename, "gs://") + "/" +
+		strconv.FormatInt(generation, 10)
+}
+
+// IsComplete returns true if a marker exists for the archive generation.
+func (gs *GCSCompletionStore) IsComplete(filename string, generation int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := gs.service.Objects.Get(gs.bucket, gs.markerName(filename, generation)).Context(ctx).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// MarkComplete writes a marker for the archive generation.
+func (gs *GCSCompletionStore) MarkComplete(filename string, generation int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	obj := &storage.Object{Name: gs.markerName(filename, generation)}
+	_, err := gs.service.Objects.Insert(gs.bucket, obj).Media(strings.NewReader("")).Context(ctx).Do()
+	return err
+}
+
+// Create a storage client.  The timeout bounds each request made through the
+// client, including reading the response body, so it must allow for the
+// largest download, e.g. ArchiveTimeout.  Zero means no timeout.
+func GetStorageClient(writeAccess bool, timeout time.Duration) (*http.Client, error) {
 	var scope string
 	if writeAccess {
 		scope = storage.DevstorageReadWriteScope
@@ -239,12 +545,13 @@ func GetStorageClient(writeAccess bool) (*http.Client, error) {
 		scope = storage.DevstorageReadOnlyScope
 	}
 
-	// Use a short timeout, so we get an error quickly if there is a problem.
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	client, err := google.DefaultClient(ctx, scope)
+	// The client keeps this context, and uses it to refresh tokens, so it
+	// must not be cancelled, or have a deadline.
+	client, err := google.DefaultClient(context.Background(), scope)
 	if err != nil {
 		return nil, err
 	}
+	client.Timeout = timeout
 	return client, nil
 }
 
@@ -271,24 +578,112 @@ func GetFilename(filename string) (string, error) {
 //          Local functions
 //---------------------------------------------------------------------------------
 
+// Split a gs://bucket/filename uri into bucket and filename.
+func splitURI(uri string) (string, string, error) {
+	// For now only handle gcs paths.
+	if !strings.HasPrefix(uri, "gs://") {
+		return "", "", errors.New("invalid file path: " + uri)
+	}
+	parts := strings.SplitN(uri, "/", 4)
+	if len(parts) != 4 {
+		return "", "", errors.New("invalid file path: " + uri)
+	}
+	return parts[2], parts[3], nil
+}
+
+// retryPolicy controls the retries of getObject after transient errors.
+type retryPolicy struct {
+	retries   int           // Retries after the first attempt.
+	baseDelay time.Duration // Delay before the first retry, doubling on each retry.
+}
+
+// Retries of the archive fetches by NewETLSource.
+const (
+	archiveRetries   = 3
+	archiveBaseDelay = time.Second
+)
+
+// If non-empty, replaces the GCS API endpoint used by getObject, for tests.
+var gcsBasePath string
+
+// isRetryableFetch returns true for the GCS fetch errors that are usually
+// transient, i.e. 429 and 5xx responses, and network errors such as
+// connection resets.
+func isRetryableFetch(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	_, ok := err.(net.Error)
+	return ok || err == io.ErrUnexpectedEOF
+}
+
+// cancelOnClose cancels the context of a download when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// getObject fetches an object, retrying with exponential backoff on transient
+// errors.  The timeout bounds all attempts, and reading the response body.
+// If all attempts fail, the last error is returned.
 // Caller is responsible for closing response body.
-func getObject(client *http.Client, bucket string, fn string, timeout time.Duration) (*http.Response, error) {
+func getObject(client *http.Client, bucket string, fn string, timeout time.Duration, retry retryPolicy) (*http.Response, error) {
+	return getObjectRange(client, bucket, fn, 0, 0, time.Now().Add(timeout), retry)
+}
+
+// getObjectRange fetches an object from offset to the end, as getObject, but
+// with a deadline instead of a timeout.  If generation is non-zero, only that
+// generation of the object is fetched.
+func getObjectRange(client *http.Client, bucket string, fn string, generation, offset int64, deadline time.Time, retry retryPolicy) (*http.Response, error) {
 	// Lightweight, error only if client is nil.
 	service, err := storage.New(client)
 	if err != nil {
 		return nil, err
 	}
+	if gcsBasePath != "" {
+		service.BasePath = gcsBasePath
+	}
 
-	// Lightweight - only setting up the local object.
-	call := service.Objects.Get(bucket, fn)
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	call = call.Context(ctx)
-
-	// Heavyweight.
-	// Doesn't look like any googleapi.CallOptions are useful here.
-	contentResponse, err := call.Download()
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer func() {
+		// Unless the response body has taken over the context.
+		if cancel != nil {
+			cancel()
+		}
+	}()
+	delay := retry.baseDelay
+	for attempt := 0; ; attempt++ {
+		// Heavyweight.
+		// Doesn't look like any googleapi.CallOptions are useful here.
+		call := service.Objects.Get(bucket, fn).Context(ctx)
+		if generation != 0 {
+			call = call.Generation(generation)
+		}
+		if offset > 0 {
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		contentResponse, err := call.Download()
+		if err == nil {
+			contentResponse.Body = &cancelOnClose{ReadCloser: contentResponse.Body, cancel: cancel}
+			cancel = nil
+			return contentResponse, nil
+		}
+		if ctx.Err() != nil || !isRetryableFetch(err) || attempt >= retry.retries {
+			return nil, err
+		}
+		metrics.GCSRetryCount.WithLabelValues(
+			"get", strconv.Itoa(attempt), "transient").Inc()
+		etl.Logger{}.Warning("get object error", "task_filename", "gs://"+bucket+"/"+fn,
+			"attempt", attempt, "reason", err)
+		if sleepContext(ctx, delay) != nil {
+			return nil, err
+		}
+		delay *= 2
 	}
-	return contentResponse, err
 }
@@ -1,29 +1,201 @@
 package storage
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/m-lab/etl/etl"
+
+	"golang.org/x/net/context"
 )
 
 func TestGetObject(t *testing.T) {
-	obj, err := getObject(client, "m-lab-sandbox", "testfile", 10*time.Second)
+	obj, err := getObject(gcsClient(t), "m-lab-sandbox", "testfile", 10*time.Second,
+		retryPolicy{retries: archiveRetries, baseDelay: archiveBaseDelay})
 	if err != nil {
 		t.Fatal(err)
 	}
 	obj.Body.Close()
 }
 
+// flakyGCS returns a test server that fails the first failures requests
+// with status, and then returns the object content.
+func flakyGCS(failures int, status int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	return server, &requests
+}
+
+func TestGetObjectRetry(t *testing.T) {
+	defer func() { gcsBasePath = "" }()
+	retry := retryPolicy{retries: 3, baseDelay: time.Millisecond}
+
+	tests := []struct {
+		failures int
+		status   int
+		requests int
+		wantErr  bool
+	}{
+		// Transient errors are retried, until an attempt succeeds.
+		{failures: 2, status: http.StatusServiceUnavailable, requests: 3},
+		// Once retries are exhausted, the last error is returned.
+		{failures: 10, status: http.StatusInternalServerError, requests: 4, wantErr: true},
+		// Other errors are not retried.
+		{failures: 1, status: http.StatusNotFound, requests: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		server, requests := flakyGCS(test.failures, test.status)
+		gcsBasePath = server.URL + "/storage/v1/"
+		obj, err := getObject(http.DefaultClient, "bucket", "file", 10*time.Second, retry)
+		server.Close()
+		if *requests != test.requests {
+			t.Errorf("%+v: %d requests", test, *requests)
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected error", test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil || string(data) != "content" {
+			t.Errorf("%+v: got %q, %v", test, data, err)
+		}
+	}
+}
+
+func TestNewETLSourceResume(t *testing.T) {
+	defer func() { gcsBasePath = "" }()
+	// A tar archive, with enough content that it is cut off partway.
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"foo", "bar"} {
+		content := bytes.Repeat([]byte(name), 1000)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+	}
+	tw.Close()
+
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Fail the first response after part of the content.
+			w.Header().Set("Content-Length", strconv.Itoa(archive.Len()))
+			w.Write(archive.Bytes()[:1500])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "test.tar", time.Time{}, bytes.NewReader(archive.Bytes()))
+	}))
+	defer server.Close()
+	gcsBasePath = server.URL + "/storage/v1/"
+
+	entries := []string{}
+	etl.SetLogSink(func(severity etl.Severity, entry string) {
+		entries = append(entries, entry)
+	})
+	defer etl.SetLogSink(nil)
+
+	src, err := NewETLSource(http.DefaultClient, "gs://bucket/test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, name := range []string{"foo", "bar"} {
+		fn, data, err := src.NextTest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn != name || !bytes.Equal(data, bytes.Repeat([]byte(name), 1000)) {
+			t.Errorf("Wrong content for %s: %d bytes", fn, len(data))
+		}
+	}
+	if !reflect.DeepEqual(ranges, []string{"", "bytes=1500-"}) {
+		t.Errorf("Wrong ranges: %q", ranges)
+	}
+	// The resume is logged with the archive name.
+	if len(entries) != 1 || !strings.HasPrefix(entries[0], "resuming stream task_filename=gs://bucket/test.tar ") {
+		t.Errorf("Wrong log entries: %q", entries)
+	}
+}
+
+func TestNewGCSSourceDeadline(t *testing.T) {
+	defer func() { gcsBasePath = "" }()
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := bytes.Repeat([]byte("foo"), 1000)
+	tw.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// Fail the first response after part of the content.
+			w.Header().Set("Content-Length", strconv.Itoa(archive.Len()))
+			w.Write(archive.Bytes()[:1500])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		// The resumed response stalls past the deadline of the download.
+		time.Sleep(300 * time.Millisecond)
+		http.ServeContent(w, r, "test.tar", time.Time{}, bytes.NewReader(archive.Bytes()))
+	}))
+	gcsBasePath = server.URL + "/storage/v1/"
+
+	retryDelay = 0
+	defer func() { retryDelay = 16 * time.Millisecond }()
+	retry := retryPolicy{retries: 0, baseDelay: time.Millisecond}
+	deadline := time.Now().Add(100 * time.Millisecond)
+	src, err := newGCSSource(http.DefaultClient, "bucket", "test.tar", deadline, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	// The resume shares the deadline, so fails rather than waiting for the
+	// stalled response.
+	if _, data, err := src.NextTest(context.Background()); err == nil && bytes.Equal(data, content) {
+		t.Error("Expected the read to fail after the deadline")
+	}
+	server.Close() // Waits for the stalled handler.
+	if requests != 2 {
+		t.Errorf("Got %d requests, want 2", requests)
+	}
+}
+
 func TestNewTarReader(t *testing.T) {
-	src, err := NewETLSource(client, "gs://m-lab-sandbox/test.tar")
+	src, err := NewETLSource(gcsClient(t), "gs://m-lab-sandbox/test.tar")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer src.Close()
 
 	count := 0
-	for _, _, err := src.NextTest(); err != io.EOF; _, _, err = src.NextTest() {
+	for _, _, err := src.NextTest(context.Background()); err != io.EOF; _, _, err = src.NextTest(context.Background()) {
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -35,14 +207,14 @@ func TestNewTarReader(t *testing.T) {
 }
 
 func TestNewTarReaderGzip(t *testing.T) {
-	src, err := NewETLSource(client, "gs://m-lab-sandbox/test.tgz")
+	src, err := NewETLSource(gcsClient(t), "gs://m-lab-sandbox/test.tgz")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer src.Close()
 
 	count := 0
-	for _, _, err := src.NextTest(); err != io.EOF; _, _, err = src.NextTest() {
+	for _, _, err := src.NextTest(context.Background()); err != io.EOF; _, _, err = src.NextTest(context.Background()) {
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -53,20 +225,136 @@ func TestNewTarReaderGzip(t *testing.T) {
 	}
 }
 
+func TestNewTarReaderXZ(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newETLSource("test.tar.xz", ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	names := []string{}
+	for fn, _, err := src.NextTest(context.Background()); err != io.EOF; fn, _, err = src.NextTest(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fn)
+	}
+	if !reflect.DeepEqual(names, []string{"foo", "bar", "baz"}) {
+		t.Error("Wrong files: ", names)
+	}
+
+	// A truncated archive should produce ErrTruncatedXZ, rather than EOF.
+	src, err = newETLSource("test.tar.xz", ioutil.NopCloser(bytes.NewReader(data[:len(data)/2])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for err == nil {
+		_, _, err = src.NextTest(context.Background())
+	}
+	if err != ErrTruncatedXZ {
+		t.Error("Expected ErrTruncatedXZ, got ", err)
+	}
+}
+
+func TestNewFileSource(t *testing.T) {
+	src, err := NewFileSource("testdata/test.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, data, err := src.NextTest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn != "foo" || string(data) != "biscuits" {
+		t.Errorf("Wrong first test: %s %q", fn, data)
+	}
+	if err = src.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = NewFileSource("testdata/missing.tgz"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+	if _, err = NewFileSource("testdata/test.zip"); err == nil {
+		t.Error("Expected error for unsupported suffix")
+	}
+}
+
+// errTarReader returns a header for a regular file, unless headerErr is set,
+// and then fails reading the content with readErr.
+type errTarReader struct {
+	headerErr error
+	readErr   error
+}
+
+func (r *errTarReader) Next() (*tar.Header, error) {
+	if r.headerErr != nil {
+		return nil, r.headerErr
+	}
+	return &tar.Header{Name: "foo", Typeflag: tar.TypeReg}, nil
+}
+
+func (r *errTarReader) Read(b []byte) (int, error) {
+	return 0, r.readErr
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func TestStreamError(t *testing.T) {
+	retryDelay = 0
+	defer func() { retryDelay = 16 * time.Millisecond }()
+
+	streamErr := errors.New("stream error: stream ID 801; INTERNAL_ERROR")
+	tests := []struct {
+		rdr   *errTarReader
+		phase string // Expected StreamError phase, or "" if not a StreamError.
+	}{
+		{rdr: &errTarReader{headerErr: streamErr}, phase: "next"},
+		{rdr: &errTarReader{readErr: streamErr}, phase: "read"},
+		{rdr: &errTarReader{headerErr: errors.New("other")}, phase: ""},
+		{rdr: &errTarReader{headerErr: io.EOF}, phase: ""},
+	}
+	for _, test := range tests {
+		src := &ETLSource{TarReader: test.rdr, Closer: nopCloser{}}
+		_, _, err := src.NextTest(context.Background())
+		se, ok := err.(*StreamError)
+		if ok != (test.phase != "") {
+			t.Errorf("%+v: unexpected error type %T: %v", test.rdr, err, err)
+			continue
+		}
+		if ok && (se.Phase != test.phase || se.Err != streamErr) {
+			t.Errorf("%+v: wrong StreamError %+v", test.rdr, se)
+		}
+	}
+}
+
 // Using a persistent client saves about 80 msec, and 220 allocs, totalling 70kB.
 var client *http.Client
 
-func init() {
-	var err error
-	client, err = GetStorageClient(false)
-	if err != nil {
-		panic(err)
+// gcsClient returns the persistent client, creating it on first use.  Tests
+// that need GCS are skipped if the client cannot be created, so that the
+// hermetic tests still run without credentials.
+func gcsClient(tb testing.TB) *http.Client {
+	if client == nil {
+		var err error
+		client, err = GetStorageClient(false, ArchiveTimeout)
+		if err != nil {
+			tb.Skipf("No storage client: %v", err)
+		}
 	}
+	return client
 }
 
 func BenchmarkNewTarReader(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		src, err := NewETLSource(client, "gs://m-lab-sandbox/test.tar")
+		src, err := NewETLSource(gcsClient(b), "gs://m-lab-sandbox/test.tar")
 		if err == nil {
 			src.Close()
 		}
@@ -75,7 +363,7 @@ func BenchmarkNewTarReader(b *testing.B) {
 
 func BenchmarkNewTarReaderGzip(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		src, err := NewETLSource(client, "gs://m-lab-sandbox/test.tgz")
+		src, err := NewETLSource(gcsClient(b), "gs://m-lab-sandbox/test.tgz")
 		if err == nil {
 			src.Close()
 		}
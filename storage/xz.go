@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+// ErrTruncatedXZ is returned when an xz compressed archive ends before the
+// end of the xz stream, for example because the upload was interrupted.
+var ErrTruncatedXZ = errors.New("truncated xz stream")
+
+// xzReader decompresses an xz stream, and reports a stream that ends early as
+// ErrTruncatedXZ, rather than io.ErrUnexpectedEOF.
+type xzReader struct {
+	rdr *xz.Reader
+}
+
+// newXZReader reads the xz stream header from r, and returns a reader for the
+// decompressed data.
+func newXZReader(r io.Reader) (*xzReader, error) {
+	rdr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, xzError(err)
+	}
+	return &xzReader{rdr: rdr}, nil
+}
+
+// Read returns the decompressed data.
+func (xr *xzReader) Read(p []byte) (int, error) {
+	n, err := xr.rdr.Read(p)
+	return n, xzError(err)
+}
+
+// xzError replaces io.ErrUnexpectedEOF with ErrTruncatedXZ.
+func xzError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrTruncatedXZ
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package task
+
+// This file contains the idempotency check that avoids reprocessing archives
+// that have already been completely processed.
+
+import (
+	"log"
+
+	"github.com/m-lab/etl/metrics"
+)
+
+// CompletionStore records which archives have been completely processed.
+// An archive is identified by its filename and its GCS object generation, so
+// that an archive that is replaced by a new upload will be processed again.
+type CompletionStore interface {
+	// IsComplete returns true if the given archive generation has already
+	// been completely processed.
+	IsComplete(filename string, generation int64) (bool, error)
+	// MarkComplete records that the given archive generation has been
+	// completely processed.
+	MarkComplete(filename string, generation int64) error
+}
+
+// AlreadyCompleted returns true if store indicates that the archive generation
+// was already completely processed.  A nil store disables the check.
+// Store errors are logged and treated as not completed, since reprocessing
+// is always safe, if wasteful.
+func AlreadyCompleted(store CompletionStore, filename string, generation int64) bool {
+	if store == nil {
+		return false
+	}
+	done, err := store.IsComplete(filename, generation)
+	if err != nil {
+		metrics.TaskCount.WithLabelValues("Task", "CompletionStoreError").Inc()
+		log.Printf("Completion check failed for %s: %v\n", filename, err)
+		return false
+	}
+	if done {
+		metrics.TaskCount.WithLabelValues("Task", "AlreadyProcessed").Inc()
+	}
+	return done
+}
+
+// CheckCompletion looks up the current generation of the archive with
+// generationOf, and returns it, along with whether store indicates that it
+// was already completely processed.  The generation should be passed to
+// Task.SetCompletion, so that it is marked once the archive is processed.  If store is nil, or the
+// generation cannot be found, it returns zero and false.
+func CheckCompletion(store CompletionStore, filename string,
+	generationOf func(filename string) (int64, error)) (int64, bool) {
+	if store == nil {
+		return 0, false
+	}
+	generation, err := generationOf(filename)
+	if err != nil {
+		log.Printf("Error getting generation for %s: %v\n", filename, err)
+		return 0, false
+	}
+	if AlreadyCompleted(store, filename, generation) {
+		log.Printf("Already processed %s generation %d\n", filename, generation)
+		return generation, true
+	}
+	return generation, false
+}
+
+// MarkCompleted records the archive generation in store.  It should only be
+// called after the archive has been successfully processed.  A nil store, or
+// a zero generation, which means the generation is unknown, is a no-op.
+func MarkCompleted(store CompletionStore, filename string, generation int64) {
+	if store == nil || generation == 0 {
+		return
+	}
+	if err := store.MarkComplete(filename, generation); err != nil {
+		metrics.TaskCount.WithLabelValues("Task", "CompletionStoreError").Inc()
+		log.Printf("Failed to mark %s complete: %v\n", filename, err)
+	}
+}
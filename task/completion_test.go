@@ -0,0 +1,69 @@
+package task_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/m-lab/etl/task"
+)
+
+// fakeStore is an in-memory CompletionStore.
+type fakeStore struct {
+	done map[string]bool
+}
+
+func (fs *fakeStore) key(filename string, generation int64) string {
+	return fmt.Sprintf("%s#%d", filename, generation)
+}
+
+func (fs *fakeStore) IsComplete(filename string, generation int64) (bool, error) {
+	return fs.done[fs.key(filename, generation)], nil
+}
+
+func (fs *fakeStore) MarkComplete(filename string, generation int64) error {
+	fs.done[fs.key(filename, generation)] = true
+	return nil
+}
+
+func TestCheckCompletion(t *testing.T) {
+	store := &fakeStore{make(map[string]bool)}
+	const fn = "gs://bucket/file.tgz"
+	generation := int64(1)
+	generationOf := func(filename string) (int64, error) {
+		if filename != fn {
+			t.Errorf("Generation requested for %s, want %s", filename, fn)
+		}
+		return generation, nil
+	}
+
+	if g, done := task.CheckCompletion(store, fn, generationOf); done || g != 1 {
+		t.Errorf("First delivery: got %d, %v, want 1, false", g, done)
+	}
+	task.MarkCompleted(store, fn, 1)
+	if g, done := task.CheckCompletion(store, fn, generationOf); !done || g != 1 {
+		t.Errorf("Second delivery of same generation: got %d, %v, want 1, true", g, done)
+	}
+
+	// A new generation is processed again.
+	generation = 2
+	if g, done := task.CheckCompletion(store, fn, generationOf); done || g != 2 {
+		t.Errorf("New generation: got %d, %v, want 2, false", g, done)
+	}
+
+	// An unknown generation is processed, and not marked complete.
+	failing := func(string) (int64, error) { return 0, errors.New("no generation") }
+	if g, done := task.CheckCompletion(store, fn, failing); done || g != 0 {
+		t.Errorf("Unknown generation: got %d, %v, want 0, false", g, done)
+	}
+	task.MarkCompleted(store, fn, 0)
+	if len(store.done) != 1 {
+		t.Errorf("Zero generation should not be marked: %v", store.done)
+	}
+
+	// A nil store disables the check.
+	if g, done := task.CheckCompletion(nil, fn, failing); done || g != 0 {
+		t.Errorf("Nil store: got %d, %v, want 0, false", g, done)
+	}
+	task.MarkCompleted(nil, fn, 1)
+}
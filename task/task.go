@@ -6,11 +6,14 @@
 package task
 
 import (
+	"fmt"
 	"io"
-	"log"
+	"runtime/debug"
+	"sort"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -25,30 +28,120 @@ type Task struct {
 	etl.Parser         // Parser to parse the tests.
 
 	meta map[string]bigquery.Value // Metadata about this task.
+
+	// If true, ProcessAllTests logs the name of each skipped directory or
+	// other non-regular entry, and of each entry whose data is nil.
+	Verbose bool
+
+	completion CompletionStore // Records completed archives, if non-nil.
+	generation int64           // The GCS generation of the archive.
 }
 
 // NewTask constructs a task, injecting the source and the parser.
 func NewTask(filename string, src *storage.ETLSource, prsr etl.Parser) *Task {
 	// TODO - should the meta data be a nested type?
-	meta := make(map[string]bigquery.Value, 3)
+	meta := make(map[string]bigquery.Value, 4)
 	meta["filename"] = filename
 	meta["parse_time"] = time.Now()
 	meta["attempt"] = 1
-	t := Task{src, prsr, meta}
+	t := Task{ETLSource: src, Parser: prsr, meta: meta}
 	return &t
 }
 
+// SetAttempt records the task queue attempt number, starting at 1, in the meta
+// data passed to the parser.  Insert IDs do not depend on the attempt, so that
+// BigQuery can dedup the rows of a retry against those of earlier attempts.
+// That dedup only works within BigQuery's short dedup window, so a much later
+// retry may still duplicate rows.  Only parsers that copy the meta data into
+// their rows, i.e. the TestParser used for SideStream, record the attempt, which
+// identifies such duplicates.  The NDT, PT and DISCO rows do not.
+func (tt *Task) SetAttempt(attempt int) {
+	tt.meta["attempt"] = attempt
+}
+
+// SetCompletion has ProcessAllTests record the archive generation in store,
+// once the whole archive has been read and the rows flushed without error.
+func (tt *Task) SetCompletion(store CompletionStore, generation int64) {
+	tt.completion = store
+	tt.generation = generation
+}
+
+// logger returns a Logger with the task_filename field.
+func (tt *Task) logger() etl.Logger {
+	return etl.NewLogger("task_filename", tt.meta["filename"])
+}
+
+// parseAndInsert parses a single test, converting any panic in the parser
+// into a counted error, so that a single malformed test does not terminate
+// the worker and lose the rest of the archive.
+func (tt *Task) parseAndInsert(testname string, data []byte) error {
+	return tt.recoverPanic("parsing "+testname, func() error {
+		return tt.Parser.ParseAndInsert(tt.meta, testname, data)
+	})
+}
+
+// recoverPanic calls f, converting any panic into a counted error.  Parsers
+// may process cached tests in Finish and Flush, so those are also called
+// through recoverPanic.
+func (tt *Task) recoverPanic(during string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			tt.logger().Error("recovered from panic", "during", during,
+				"reason", r, "stack", string(debug.Stack()))
+			metrics.TestCount.WithLabelValues(
+				tt.Parser.TableName(), "unknown", "panic").Inc()
+			err = fmt.Errorf("panic %s: %v", during, r)
+		}
+	}()
+	return f()
+}
+
 // ProcessAllTests loops through all the tests in a tar file, calls the
 // injected parser to parse them, and inserts them into bigquery. Returns the
-// number of files processed.
-func (tt *Task) ProcessAllTests() (int, error) {
+// number of files processed.  If ctx is cancelled, processing stops after the
+// current test, the rows so far are flushed, and the context error is returned.
+// A *storage.StreamError is also returned, as the task may succeed if retried,
+// as are other read errors, such as those of a truncated archive.
+func (tt *Task) ProcessAllTests(ctx context.Context) (int, error) {
 	metrics.WorkerState.WithLabelValues("task").Inc()
 	defer metrics.WorkerState.WithLabelValues("task").Dec()
 	files := 0
 	nilData := 0
+	var readErr error // Read error to be returned to the caller, if any.
+	if tt.Verbose && tt.OnSkip == nil {
+		tt.OnSkip = func(name string, typeflag byte) {
+			tt.logger().Info("skipped non-regular entry", "test_id", name,
+				"typeflag", string(typeflag))
+		}
+	}
 	// Read each file from the tar
-	for testname, data, err := tt.NextTest(); err != io.EOF; testname, data, err = tt.NextTest() {
+	for testname, data, err := tt.NextTest(ctx); err != io.EOF; testname, data, err = tt.NextTest(ctx) {
 		files++
+		if err == storage.ErrCorruptGzip {
+			// Only this test is lost, so continue with the next one.
+			metrics.TestCount.WithLabelValues(
+				tt.Parser.TableName(), "unknown", "gz crc error").Inc()
+			continue
+		}
+		if err != nil && ctx.Err() != nil {
+			// Not a test, so it should not be counted.
+			files--
+			readErr = ctx.Err()
+			metrics.TaskCount.WithLabelValues(
+				"Task", "Cancelled").Inc()
+			tt.logger().Warning("cancelled", "files", files, "reason", err)
+			break
+		}
+		if _, ok := err.(*storage.StreamError); ok {
+			// These are usually transient, so the error is returned, and the
+			// caller may retry the whole task.
+			tt.logger().Warning("stream error", "test_id", testname, "files", files,
+				"duration", time.Since(tt.meta["parse_time"].(time.Time)), "reason", err)
+			metrics.TestCount.WithLabelValues(
+				tt.Parser.TableName(), "unknown", "stream error").Inc()
+			readErr = err
+			break
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -60,43 +153,76 @@ func (tt *Task) ProcessAllTests() (int, error) {
 			// filename:gs://m-lab-sandbox/ndt/2016/04/10/20160410T000000Z-mlab1-ord02-ndt-0002.tgz
 			// files:666 duration:1m47.571825351s
 			// err:stream error: stream ID 801; INTERNAL_ERROR
-			// Because of the break, this error is passed up, and counted at the Task level.
-			log.Printf("filename:%s testname:%s files:%d, duration:%v err:%v",
-				tt.meta["filename"], testname, files,
-				time.Since(tt.meta["parse_time"].(time.Time)), err)
+			// Stream errors are now handled above, and returned.
+			tt.logger().Error("unrecovered read error", "test_id", testname, "files", files,
+				"duration", time.Since(tt.meta["parse_time"].(time.Time)), "reason", err)
 
 			metrics.TestCount.WithLabelValues(
 				tt.Parser.TableName(), "unknown", "unrecovered").Inc()
+			readErr = err
 			break
 		}
 		if data == nil {
-			// TODO(dev) Handle directories (expected) and other
-			// things separately.
+			// Directories and other non-regular entries are skipped by
+			// NextTest, so this only happens when the data could not be read.
 			nilData += 1
-			// If verbose, log the filename that is skipped.
+			if tt.Verbose {
+				tt.logger().Info("skipped nil data", "test_id", testname)
+			}
 			continue
 		}
 
-		err := tt.Parser.ParseAndInsert(tt.meta, testname, data)
+		// The position of the test within the archive.
+		tt.meta["archive_index"] = files - 1
+		err := tt.parseAndInsert(testname, data)
 		// Shouldn't have any of these, as they should be handled in ParseAndInsert.
 		if err != nil {
 			metrics.TaskCount.WithLabelValues(
 				"Task", "ParseAndInsertError").Inc()
-			log.Printf("%v", err)
+			tt.logger().Error("parse and insert error", "test_id", testname, "reason", err)
 			// TODO(dev) Handle this error properly!
 			continue
 		}
 	}
 
-	// Flush any rows cached in the inserter.
-	err := tt.Flush()
+	// Process any tests cached in the parser, then flush any rows cached in
+	// the inserter.
+	if err := tt.recoverPanic("in Finish", tt.Finish); err != nil {
+		tt.logger().Error("finish error", "reason", err)
+	}
+	err := tt.recoverPanic("in Flush", tt.Flush)
 
 	if err != nil {
-		log.Printf("%v", err)
+		tt.logger().Error("flush error", "reason", err)
+	}
+	if readErr != nil {
+		err = readErr
+	}
+	if err == nil {
+		MarkCompleted(tt.completion, tt.meta["filename"].(string), tt.generation)
 	}
 	// TODO - make this debug or remove
-	log.Printf("Processed %d files, %d nil data, %d rows committed, %d failed, from %s into %s",
-		files, nilData, tt.Parser.Committed(), tt.Parser.Failed(),
-		tt.meta["filename"], tt.Parser.FullTableName())
+	summary := []interface{}{"files", files, "nil_data", nilData,
+		"skipped", tt.Skipped(), "committed", tt.Parser.Committed(),
+		"failed", tt.Parser.Failed(), "table", tt.Parser.FullTableName()}
+	if sc, ok := tt.Parser.(etl.SuffixCounter); ok {
+		summary = append(summary, suffixFields(sc.SuffixCounts())...)
+	}
+	tt.logger().Info("processed", summary...)
 	return files, err
 }
+
+// suffixFields returns the suffix counts as key/value log fields, such as
+// "meta_files", 2, sorted by suffix.
+func suffixFields(counts map[string]int) []interface{} {
+	suffixes := make([]string, 0, len(counts))
+	for suffix := range counts {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	fields := make([]interface{}, 0, 2*len(suffixes))
+	for _, suffix := range suffixes {
+		fields = append(fields, suffix+"_files", counts[suffix])
+	}
+	return fields
+}
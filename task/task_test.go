@@ -5,13 +5,22 @@ package task_test
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
 
+	"github.com/m-lab/etl/bq"
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/fake"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/etl/storage" // TODO - would be better not to have this.
 	"github.com/m-lab/etl/task"
 )
@@ -51,7 +60,7 @@ func MakeTestSource(t *testing.T) *storage.ETLSource {
 		t.Fatal(err)
 	}
 
-	return &storage.ETLSource{tar.NewReader(b), NullCloser{}}
+	return &storage.ETLSource{TarReader: tar.NewReader(b), Closer: NullCloser{}}
 }
 
 type TestParser struct {
@@ -65,6 +74,9 @@ func (tp *TestParser) TableName() string {
 func (tp *TestParser) FullTableName() string {
 	return "test-table"
 }
+func (tp *TestParser) Finish() error {
+	return nil
+}
 func (tp *TestParser) Flush() error {
 	return nil
 }
@@ -84,7 +96,7 @@ func TestTarFileInput(t *testing.T) {
 
 	// Among other things, this requires that tp implements etl.Parser.
 	tt := task.NewTask("filename", rdr, tp)
-	fn, bb, err := tt.NextTest()
+	fn, bb, err := tt.NextTest(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -95,7 +107,7 @@ func TestTarFileInput(t *testing.T) {
 		t.Error("Expected biscuits but got ", string(bb))
 	}
 
-	fn, bb, err = tt.NextTest()
+	fn, bb, err = tt.NextTest(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -110,7 +122,7 @@ func TestTarFileInput(t *testing.T) {
 	rdr = MakeTestSource(t)
 
 	tt = task.NewTask("filename", rdr, tp)
-	fc, err := tt.ProcessAllTests()
+	fc, err := tt.ProcessAllTests(context.Background())
 	if err != nil {
 		t.Error("Expected nil error, but got %v", err)
 	}
@@ -125,3 +137,522 @@ func TestTarFileInput(t *testing.T) {
 	}
 
 }
+
+// Create a TarReader with a directory and a symlink among the tests.
+func MakeSourceWithDirs(t *testing.T) *storage.ETLSource {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Mode: 0777, Typeflag: tar.TypeDir})
+	hdr := tar.Header{Name: "dir/foo", Mode: 0666, Typeflag: tar.TypeReg, Size: int64(8)}
+	tw.WriteHeader(&hdr)
+	if _, err := tw.Write([]byte("biscuits")); err != nil {
+		t.Fatal(err)
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: "foo"})
+	hdr = tar.Header{Name: "dir/bar", Mode: 0666, Typeflag: tar.TypeReg, Size: int64(11)}
+	tw.WriteHeader(&hdr)
+	if _, err := tw.Write([]byte("butter milk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &storage.ETLSource{TarReader: tar.NewReader(b), Closer: NullCloser{}}
+}
+
+func TestSkipNonRegular(t *testing.T) {
+	tp := &TestParser{}
+	tt := task.NewTask("filename", MakeSourceWithDirs(t), tp)
+	fc, err := tt.ProcessAllTests(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc != 2 {
+		t.Error("Expected 2 files, got", fc)
+	}
+	if !reflect.DeepEqual(tp.files, []string{"dir/foo", "dir/bar"}) {
+		t.Error("Not expected files: ", tp.files)
+	}
+	if tt.Skipped() != 2 {
+		t.Error("Expected 2 skipped entries, got", tt.Skipped())
+	}
+}
+
+func TestVerboseSkips(t *testing.T) {
+	var entries []string
+	etl.SetLogSink(func(severity etl.Severity, entry string) {
+		entries = append(entries, entry)
+	})
+	defer etl.SetLogSink(nil)
+
+	tt := task.NewTask("filename", MakeSourceWithDirs(t), &TestParser{})
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "skipped") {
+			t.Error("Unexpected entry when not verbose:", entry)
+		}
+	}
+
+	entries = nil
+	tt = task.NewTask("filename", MakeSourceWithDirs(t), &TestParser{})
+	tt.Verbose = true
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var skipped []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "skipped non-regular entry") {
+			skipped = append(skipped, entry)
+		}
+	}
+	if len(skipped) != 2 || !strings.Contains(skipped[0], "test_id=dir/") {
+		t.Error("Expected 2 skipped entries, got", skipped)
+	}
+}
+
+// Create a TarReader containing a gzipped test with a corrupted CRC, followed
+// by a valid test.
+func MakeCorruptGzipSource(t *testing.T) *storage.ETLSource {
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("biscuits"))
+	zw.Close()
+	corrupt := gz.Bytes()
+	// The trailer is the CRC32 followed by ISIZE.  Corrupt just the CRC.
+	corrupt[len(corrupt)-8] ^= 0xFF
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	hdr := tar.Header{Name: "foo.gz", Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(corrupt))}
+	tw.WriteHeader(&hdr)
+	if _, err := tw.Write(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	hdr = tar.Header{Name: "bar", Mode: 0666, Typeflag: tar.TypeReg, Size: int64(11)}
+	tw.WriteHeader(&hdr)
+	tw.Write([]byte("butter milk"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &storage.ETLSource{TarReader: tar.NewReader(b), Closer: NullCloser{}}
+}
+
+func TestGzipChecksum(t *testing.T) {
+	// By default, the data is returned, despite the bad CRC.
+	src := MakeCorruptGzipSource(t)
+	fn, bb, err := src.NextTest(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if fn != "foo.gz" || string(bb) != "biscuits" {
+		t.Errorf("Expected foo.gz biscuits, got %s %s", fn, string(bb))
+	}
+
+	// In strict mode, the corruption is detected, and the test dropped.
+	src = MakeCorruptGzipSource(t)
+	src.StrictGzip = true
+	fn, bb, err = src.NextTest(context.Background())
+	if err != storage.ErrCorruptGzip {
+		t.Error("Expected ErrCorruptGzip, got", err)
+	}
+	if bb != nil {
+		t.Error("Expected nil data")
+	}
+	// Processing continues with the next test.
+	fn, bb, err = src.NextTest(context.Background())
+	if err != nil || fn != "bar" {
+		t.Errorf("Expected bar, got %s %v", fn, err)
+	}
+
+	src = MakeCorruptGzipSource(t)
+	src.StrictGzip = true
+	tp := &TestParser{}
+	_, err = task.NewTask("filename", src, tp).ProcessAllTests(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(tp.files, []string{"bar"}) {
+		t.Error("Not expected files: ", tp.files)
+	}
+}
+
+// PanicParser panics when parsing the named file.
+type PanicParser struct {
+	TestParser
+	panicOn string
+}
+
+func (pp *PanicParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
+	if testName == pp.panicOn {
+		var snaps []int
+		_ = snaps[len(test)] // index out of range
+	}
+	return pp.TestParser.ParseAndInsert(meta, testName, test)
+}
+
+func TestParserPanic(t *testing.T) {
+	pp := &PanicParser{panicOn: "foo"}
+	fc, err := task.NewTask("filename", MakeTestSource(t), pp).ProcessAllTests(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if fc != 2 {
+		t.Error("Expected 2 files, got", fc)
+	}
+	if !reflect.DeepEqual(pp.files, []string{"bar"}) {
+		t.Error("Not expected files: ", pp.files)
+	}
+}
+
+// panicAnnotator panics on the first Annotate call, as a bug in the NDT
+// parser's processing of a cached test group would.
+type panicAnnotator struct {
+	calls int
+}
+
+func (pa *panicAnnotator) Annotate(ip string, connSpec schema.Web100ValueMap) {
+	pa.calls++
+	if pa.calls == 1 {
+		panic("annotator bug")
+	}
+}
+
+func TestNDTParserPanic(t *testing.T) {
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "ndt", Timeout: time.Minute,
+			BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := parser.NewNDTParser(ins)
+	pa := &panicAnnotator{}
+	n.SetAnnotator(pa)
+	tt := task.NewTask("filename", MakeNDTSource(t), n)
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The first group panics when it is processed, at the start of the second
+	// group.  The first group is not processed again, and the second group
+	// is processed by Finish.
+	if pa.calls != 2 {
+		t.Errorf("Expected 2 Annotate calls, got %d", pa.calls)
+	}
+	if tt.Committed() != 1 || len(uploader.Rows) != 1 {
+		t.Fatalf("Expected 1 row, committed %d", tt.Committed())
+	}
+	if id := uploader.Rows[0].Row["test_id"]; id != "20170509T13:50:13.590210000Z_eb.measurementlab.net:44162.s2c_snaplog" {
+		t.Errorf("Wrong test %v", id)
+	}
+}
+
+// FinishPanicParser panics in Finish, as a parser processing its cached
+// tests might.
+type FinishPanicParser struct {
+	TestParser
+}
+
+func (fp *FinishPanicParser) Finish() error {
+	panic("finish bug")
+}
+
+func TestFinishPanic(t *testing.T) {
+	fp := &FinishPanicParser{}
+	fc, err := task.NewTask("filename", MakeTestSource(t), fp).ProcessAllTests(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if fc != 2 || len(fp.files) != 2 {
+		t.Errorf("Expected 2 files, got %d, %v", fc, fp.files)
+	}
+}
+
+// MetaParser records the attempt in the meta data for each test.
+type MetaParser struct {
+	TestParser
+	attempts []bigquery.Value
+}
+
+func (mp *MetaParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
+	mp.attempts = append(mp.attempts, meta["attempt"])
+	return mp.TestParser.ParseAndInsert(meta, testName, test)
+}
+
+func TestSetAttempt(t *testing.T) {
+	mp := &MetaParser{}
+	tt := task.NewTask("filename", MakeTestSource(t), mp)
+	tt.SetAttempt(3)
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mp.attempts, []bigquery.Value{3, 3}) {
+		t.Errorf("Wrong attempts %v", mp.attempts)
+	}
+}
+
+// RowParser inserts a row for each test into a real BQInserter.  The row for
+// the named file has a field that is not in the schema, so it fails.
+type RowParser struct {
+	etl.Inserter
+	failOn string
+}
+
+func (rp *RowParser) TableName() string {
+	return "test-table"
+}
+
+func (rp *RowParser) Finish() error {
+	return nil
+}
+
+func (rp *RowParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
+	row := map[string]bigquery.Value{"name": testName}
+	if testName == rp.failOn {
+		row["extra"] = 1
+	}
+	return rp.InsertRow(&bq.MapSaver{Values: row})
+}
+
+func TestCommittedAndFailed(t *testing.T) {
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	uploader.Schema = bigquery.Schema{{Name: "name"}}
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "test-table", Timeout: time.Minute,
+			BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := &RowParser{Inserter: ins, failOn: "foo"}
+	tt := task.NewTask("filename", MakeTestSource(t), rp)
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tt.Committed() != 1 || tt.Failed() != 1 {
+		t.Errorf("Committed %d, Failed %d; want 1, 1", tt.Committed(), tt.Failed())
+	}
+	if tt.Accepted() != tt.Committed()+tt.Failed()+tt.RowsInBuffer() {
+		t.Errorf("Accepted %d does not match", tt.Accepted())
+	}
+}
+
+// CancelParser cancels the context after parsing the first test.
+type CancelParser struct {
+	TestParser
+	cancel  context.CancelFunc
+	flushed bool
+}
+
+func (cp *CancelParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error {
+	cp.cancel()
+	return cp.TestParser.ParseAndInsert(meta, testName, test)
+}
+
+func (cp *CancelParser) Flush() error {
+	cp.flushed = true
+	return nil
+}
+
+func TestProcessAllTestsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cp := &CancelParser{cancel: cancel}
+	fc, err := task.NewTask("filename", MakeTestSource(t), cp).ProcessAllTests(ctx)
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled, got", err)
+	}
+	if fc != 1 || !reflect.DeepEqual(cp.files, []string{"foo"}) {
+		t.Error("Expected only foo, got", fc, cp.files)
+	}
+	if !cp.flushed {
+		t.Error("Expected flush after cancel")
+	}
+}
+
+// MakeNDTSource creates a TarReader with a complete NDT test group, followed
+// by a final group with only a snaplog.
+func MakeNDTSource(t *testing.T) *storage.ETLSource {
+	s2c, err := ioutil.ReadFile(`../parser/testdata/20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ioutil.ReadFile(`../parser/testdata/20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog", s2c},
+		{"20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta", meta},
+		{"20170509T13:50:13.590210000Z_eb.measurementlab.net:44162.s2c_snaplog", s2c},
+	} {
+		hdr := tar.Header{Name: f.name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(f.data))}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &storage.ETLSource{TarReader: tar.NewReader(b), Closer: NullCloser{}}
+}
+
+func TestProcessAllTestsLastGroup(t *testing.T) {
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "ndt", Timeout: time.Minute,
+			BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary string
+	etl.SetLogSink(func(severity etl.Severity, entry string) {
+		if strings.HasPrefix(entry, "processed") {
+			summary = entry
+		}
+	})
+	defer etl.SetLogSink(nil)
+	tt := task.NewTask("filename", MakeNDTSource(t), parser.NewNDTParser(ins))
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The summary includes the NDT parser's counts by suffix.
+	if !strings.HasSuffix(summary, " meta_files=1 s2c_snaplog_files=2") {
+		t.Errorf("Wrong summary %q", summary)
+	}
+
+	// The last group, with no meta file, is processed at the end of the
+	// archive, even though no later timestamp follows it.
+	if tt.Committed() != 2 || len(uploader.Rows) != 2 {
+		t.Fatalf("Expected 2 rows, committed %d", tt.Committed())
+	}
+	last := uploader.Rows[1].Row
+	if id := last["test_id"]; id != "20170509T13:50:13.590210000Z_eb.measurementlab.net:44162.s2c_snaplog" {
+		t.Errorf("Wrong last test %v", id)
+	}
+	anomalies, _ := last["anomalies"].(schema.Web100ValueMap)
+	if anomalies["no_meta"] != true {
+		t.Errorf("Expected no_meta anomaly, got %v", anomalies)
+	}
+}
+
+// LifecycleParser records the order of the Finish and Flush calls.
+type LifecycleParser struct {
+	TestParser
+	calls []string
+}
+
+func (lp *LifecycleParser) Finish() error {
+	lp.calls = append(lp.calls, "Finish")
+	return nil
+}
+
+func (lp *LifecycleParser) Flush() error {
+	lp.calls = append(lp.calls, "Flush")
+	return nil
+}
+
+func TestProcessAllTestsFinish(t *testing.T) {
+	lp := &LifecycleParser{}
+	if _, err := task.NewTask("filename", MakeTestSource(t), lp).ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lp.calls, []string{"Finish", "Flush"}) {
+		t.Error("Expected Finish, then Flush, got", lp.calls)
+	}
+}
+
+func TestGzippedSnaplogMember(t *testing.T) {
+	s2c, err := ioutil.ReadFile(`../parser/testdata/20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(s2c)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain tar, with an individually gzipped snaplog.
+	name := "20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz"
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	hdr := tar.Header{Name: name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(gz.Len())}
+	tw.WriteHeader(&hdr)
+	if _, err := tw.Write(gz.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src := &storage.ETLSource{TarReader: tar.NewReader(b), Closer: NullCloser{}}
+
+	uploader := fake.NewFakeUploader().(*fake.FakeUploader)
+	ins, err := bq.NewBQInserter(
+		etl.InserterParams{Dataset: "dataset", Table: "ndt", Timeout: time.Minute,
+			BufferSize: 10}, uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := task.NewTask("filename", src, parser.NewNDTParser(ins)).ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The member is decompressed before it reaches the snaplog parser.
+	if len(uploader.Rows) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(uploader.Rows))
+	}
+	entry, _ := uploader.Rows[0].Row["web100_log_entry"].(schema.Web100ValueMap)
+	if addr, _ := entry.GetString([]string{"snap", "RemAddress"}); addr != "45.56.98.222" {
+		t.Errorf("Wrong RemAddress %q in %v", addr, uploader.Rows[0].Row["test_id"])
+	}
+}
+
+func TestTruncatedArchive(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, name := range []string{"foo", "bar"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(8)})
+		tw.Write([]byte("biscuits"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeStore{make(map[string]bool)}
+
+	// The archive ends part way through the second header.
+	truncated := bytes.NewReader(b.Bytes()[:1024+100])
+	src := &storage.ETLSource{TarReader: tar.NewReader(truncated), Closer: NullCloser{}}
+	tp := &TestParser{}
+	tt := task.NewTask("filename", src, tp)
+	tt.SetCompletion(store, 1)
+	if _, err := tt.ProcessAllTests(context.Background()); err == nil {
+		t.Error("Expected error for truncated archive")
+	}
+	if !reflect.DeepEqual(tp.files, []string{"foo"}) {
+		t.Error("Not expected files: ", tp.files)
+	}
+	if len(store.done) != 0 {
+		t.Errorf("Truncated archive should not be marked complete: %v", store.done)
+	}
+
+	// The complete archive is marked.
+	src = &storage.ETLSource{TarReader: tar.NewReader(bytes.NewReader(b.Bytes())), Closer: NullCloser{}}
+	tt = task.NewTask("filename", src, &TestParser{})
+	tt.SetCompletion(store, 1)
+	if _, err := tt.ProcessAllTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if done, _ := store.IsComplete("filename", 1); !done {
+		t.Error("Complete archive should be marked complete")
+	}
+}
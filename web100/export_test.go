@@ -0,0 +1,23 @@
+package web100
+
+import "errors"
+
+// SetSnapshotValue returns a copy of the raw snaplog data, with the 32 bit
+// variable name set to value in each snapshot from index first onwards, e.g.
+// to produce state transitions.
+func SetSnapshotValue(raw []byte, name string, first int, value uint32) ([]byte, error) {
+	sl, err := NewSnapLog(raw)
+	if err != nil {
+		return nil, err
+	}
+	v := sl.read.Find(name)
+	if v == nil || v.Size != 4 {
+		return nil, errors.New("No 32 bit variable " + name)
+	}
+	out := append([]byte{}, sl.raw...)
+	for n := first; n < sl.SnapCount(); n++ {
+		offset := sl.bodyOffset + n*sl.read.Length + len(BEGIN_SNAP_DATA) + v.Offset
+		sl.ByteOrder().PutUint32(out[offset:], value)
+	}
+	return out, nil
+}
@@ -0,0 +1,126 @@
+package web100_test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/etl/web100"
+)
+
+// To add a regression case for snapshot N of testdata/<snaplog>, create an
+// empty testdata/golden/<snaplog>.<N>.json, and run
+//   go test -run TestGoldenSnapshots -update
+// then check the new file (and any other changes) before committing.
+var update = flag.Bool("update", false, "Rewrite the golden snapshot files.")
+
+// goldenCase returns the snaplog name and snapshot index for a golden file.
+func goldenCase(path string) (string, int, error) {
+	name := strings.TrimSuffix(filepath.Base(path), ".json")
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return "", 0, fmt.Errorf("%s: expected <snaplog>.<index>.json", path)
+	}
+	index, err := strconv.Atoi(name[dot+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: bad snapshot index: %v", path, err)
+	}
+	return name[:dot], index, nil
+}
+
+// TestGoldenSnapshots compares the full SnapshotValues output for each golden
+// file in testdata/golden to the recorded values.
+func TestGoldenSnapshots(t *testing.T) {
+	paths, err := filepath.Glob(`testdata/golden/*.json`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No golden files")
+	}
+	for _, path := range paths {
+		name, index, err := goldenCase(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		data, err := ioutil.ReadFile(`testdata/` + name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		slog, err := web100.NewSnapLog(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		snap, err := slog.Snapshot(index)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		saver := NewSimpleSaver()
+		if err = snap.SnapshotValues(&saver); err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+
+		if *update {
+			out, err := json.MarshalIndent(saver, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(path, append(out, '\n'), 0664); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		want := NewSimpleSaver()
+		if err = json.Unmarshal(golden, &want); err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(want, saver) {
+			for _, diff := range saverDiffs(want, saver) {
+				t.Errorf("%s: %s", path, diff)
+			}
+		}
+	}
+}
+
+// saverDiffs describes each value that differs between want and got.
+func saverDiffs(want, got SimpleSaver) []string {
+	diffs := []string{}
+	for k, v := range want.Integers {
+		if g, ok := got.Integers[k]; !ok || g != v {
+			diffs = append(diffs, fmt.Sprintf("%s: got %v (present %v), want %d", k, g, ok, v))
+		}
+	}
+	for k, v := range want.Strings {
+		if g, ok := got.Strings[k]; !ok || g != v {
+			diffs = append(diffs, fmt.Sprintf("%s: got %q (present %v), want %q", k, g, ok, v))
+		}
+	}
+	for k := range got.Integers {
+		if _, ok := want.Integers[k]; !ok {
+			diffs = append(diffs, "unexpected integer "+k)
+		}
+	}
+	for k := range got.Strings {
+		if _, ok := want.Strings[k]; !ok {
+			diffs = append(diffs, "unexpected string "+k)
+		}
+	}
+	return diffs
+}
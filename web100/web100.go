@@ -2,13 +2,18 @@
 package web100
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // NOTES:
@@ -77,11 +82,14 @@ import (
 //   including 23% mapassign, and 12% mapassign2_faststr.
 
 // The Saver interface decouples reading data from the web100 log files and
-// saving those values.
+// saving those values.  schema.Web100ValueMap is the Saver used for BigQuery
+// rows, but callers may provide their own.
+//
+// There is no boolean web100 type.  Flags, such as SACK, ECN and Nagle, are
+// INTEGER TruthValues, so they are saved with SetInt64.
 type Saver interface {
 	SetInt64(name string, value int64)
 	SetString(name string, value string)
-	SetBool(name string, value bool)
 }
 
 //=================================================================================
@@ -111,12 +119,13 @@ const (
 	VARNAME_LEN_MAX   = 32
 )
 
-type varType int
+// VarType is the web100 type of a snapshot variable.
+type VarType int
 
 const (
 	// The ordering here is important, as it reflects the type values
 	// defined by the web100 libraries.  Do not change ordering.
-	WEB100_TYPE_INTEGER varType = iota
+	WEB100_TYPE_INTEGER VarType = iota
 	WEB100_TYPE_INTEGER32
 	WEB100_TYPE_INET_ADDRESS_IPV4
 	WEB100_TYPE_COUNTER32
@@ -167,8 +176,10 @@ var web100Sizes = [WEB100_NUM_TYPES + 1]int{
 type variable struct {
 	Name   string  // Encoded field name (before conversion to canonicalName)
 	Offset int     // Offset, beyond the BEGIN_SNAP_HEADER
-	Type   varType // Web100 type of the field
+	Type   VarType // Web100 type of the field
 	Size   int     // Size, in bytes, of the raw data field.
+
+	order binary.ByteOrder // Byte order of integer values.  Nil means little endian.
 }
 
 func NewVariable(s string) (*variable, error) {
@@ -180,19 +191,25 @@ func NewVariable(s string) (*variable, error) {
 		fmt.Printf("NewVariable Error %v, %d: %s\n", err, n, s)
 		return nil, err
 	}
-	vt := varType(typ)
+	if offset < 0 {
+		return nil, fmt.Errorf("Invalid offset for %s field: %d", name, offset)
+	}
+	vt := VarType(typ)
 	if vt > WEB100_TYPE_OCTET || vt < WEB100_TYPE_INTEGER {
 		return nil, errors.New(fmt.Sprintf("Invalid type field: %d\n", typ))
 	}
-	if length != web100Sizes[vt] {
+	// Some IPv6 address variables are recorded as a bare 16 byte address,
+	// without the trailing address type byte.
+	if length != web100Sizes[vt] && !(vt == WEB100_TYPE_INET_ADDRESS_IPV6 && length == net.IPv6len) {
 		return nil, errors.New(fmt.Sprintf("Invalid length for %s field: %d\n",
 			name, length))
 	}
 
-	return &variable{name, offset, vt, length}, nil
+	return &variable{Name: name, Offset: offset, Type: vt, Size: length}, nil
 }
 
 // IPFromBytes handles the 17 byte web100 IP address fields.
+// The returned IP does not share storage with data.
 func IPFromBytes(data []byte) (net.IP, error) {
 	if len(data) != 17 {
 		return net.IP{}, errors.New("Wrong number of bytes")
@@ -201,7 +218,7 @@ func IPFromBytes(data []byte) (net.IP, error) {
 	case WEB100_ADDRTYPE_IPV4:
 		return net.IPv4(data[0], data[1], data[2], data[3]), nil
 	case WEB100_ADDRTYPE_IPV6:
-		return net.IP(data[:16]), nil
+		return ipv6FromBytes(data[:16]), nil
 	case WEB100_ADDRTYPE_UNKNOWN:
 		fallthrough
 	default:
@@ -209,7 +226,41 @@ func IPFromBytes(data []byte) (net.IP, error) {
 	}
 }
 
-// TODO URGENT - unit tests for this!!
+// IPv6FromBytes handles web100 INET_ADDRESS_IPV6 fields, which may be either
+// a bare 16 byte address, or a 17 byte address with trailing address type.
+func IPv6FromBytes(data []byte) (net.IP, error) {
+	switch len(data) {
+	case 16:
+		return ipv6FromBytes(data), nil
+	case 17:
+		// The type byte is sometimes unset for IPV6 typed fields.
+		if addrType(data[16]) == WEB100_ADDRTYPE_UNKNOWN {
+			return ipv6FromBytes(data[:16]), nil
+		}
+		return IPFromBytes(data)
+	default:
+		return net.IP{}, errors.New("Wrong number of bytes")
+	}
+}
+
+func ipv6FromBytes(data []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, data)
+	return ip
+}
+
+// canonical returns the canonical name of a variable.  The variable name
+// known to the web100 kernel at run time lagged behind the official web100
+// spec. So, some variable names need to be translated from their legacy form
+// (read from the kernel and written to the snaplog) to the canonical form (as
+// defined in tcp-kis.txt).
+func canonical(name string) string {
+	if canonical, ok := CanonicalNames[name]; ok {
+		return canonical
+	}
+	return name
+}
+
 // Save interprets data according to the receiver type, and saves the result to snapValues.
 // Most of the types are unused, but included here for completeness.
 func (v *variable) Save(data []byte, snapValues Saver) error {
@@ -217,20 +268,19 @@ func (v *variable) Save(data []byte, snapValues Saver) error {
 	if v.Name[0] == '_' {
 		return nil
 	}
-	// Use the canonical variable name. The variable name known to the web100
-	// kernel at run time lagged behind the official web100 spec. So, some
-	// variable names need to be translated from their legacy form (read from
-	// the kernel and written to the snaplog) to the canonical form (as defined
-	// in tcp-kis.txt).
-	canonicalName := v.Name
-	if legacy, ok := CanonicalNames[canonicalName]; ok {
-		canonicalName = legacy
+	if len(data) != v.Size {
+		return fmt.Errorf("Wrong number of bytes for %s: %d, expected %d", v.Name, len(data), v.Size)
+	}
+	canonicalName := canonical(v.Name)
+	var order binary.ByteOrder = binary.LittleEndian
+	if v.order != nil {
+		order = v.order
 	}
 	switch v.Type {
 	case WEB100_TYPE_INTEGER:
 		fallthrough
 	case WEB100_TYPE_INTEGER32:
-		val := binary.LittleEndian.Uint32(data)
+		val := order.Uint32(data)
 		if val >= 0x7FFFFFFF {
 			snapValues.SetInt64(canonicalName, int64(val)-0x100000000)
 		} else {
@@ -247,20 +297,24 @@ func (v *variable) Save(data []byte, snapValues Saver) error {
 	case WEB100_TYPE_UNSIGNED32:
 		fallthrough
 	case WEB100_TYPE_TIME_TICKS:
-		snapValues.SetInt64(canonicalName, int64(binary.LittleEndian.Uint32(data)))
+		snapValues.SetInt64(canonicalName, int64(order.Uint32(data)))
 	case WEB100_TYPE_COUNTER64:
 		// This conversion to signed may cause overflow panic!
-		snapValues.SetInt64(canonicalName, int64(binary.LittleEndian.Uint64(data)))
+		snapValues.SetInt64(canonicalName, int64(order.Uint64(data)))
 	case WEB100_TYPE_INET_PORT_NUMBER:
-		snapValues.SetInt64(canonicalName, int64(binary.LittleEndian.Uint16(data)))
+		snapValues.SetInt64(canonicalName, int64(order.Uint16(data)))
 	case WEB100_TYPE_INET_ADDRESS:
-		fallthrough
-	case WEB100_TYPE_INET_ADDRESS_IPV6:
 		ip, err := IPFromBytes(data)
 		if err != nil {
 			return err
 		}
 		snapValues.SetString(canonicalName, ip.String())
+	case WEB100_TYPE_INET_ADDRESS_IPV6:
+		ip, err := IPv6FromBytes(data)
+		if err != nil {
+			return err
+		}
+		snapValues.SetString(canonicalName, ip.String())
 	case WEB100_TYPE_STR32:
 		// TODO - is there a better way?
 		snapValues.SetString(canonicalName, strings.SplitN(string(data), "\000", 2)[0])
@@ -283,6 +337,13 @@ type fieldSet struct {
 	Length int
 }
 
+// setByteOrder sets the byte order used to decode the integer fields.
+func (fs *fieldSet) setByteOrder(order binary.ByteOrder) {
+	for i := range fs.Fields {
+		fs.Fields[i].order = order
+	}
+}
+
 // Find returns the variable of a given name, or nil.
 func (fs *fieldSet) Find(name string) *variable {
 	index, ok := fs.FieldMap[name]
@@ -303,13 +364,26 @@ type connectionSpec struct {
 	SrcAddr  []byte
 }
 
+// check returns an error if the connection spec could not have come from a
+// real connection.
+func (cs *connectionSpec) check() error {
+	if len(cs.SrcAddr) != 4 || len(cs.DestAddr) != 4 {
+		return errors.New("Missing connection spec")
+	}
+	if cs.SrcPort == 0 && cs.DestPort == 0 &&
+		bytes.Equal(cs.SrcAddr, make([]byte, 4)) && bytes.Equal(cs.DestAddr, make([]byte, 4)) {
+		return errors.New("Empty connection spec")
+	}
+	return nil
+}
+
 //=================================================================================
 // SnapLog encapsulates the raw data and all elements of the header.
 type SnapLog struct {
 	// The entire raw contents of the file.  Generally 1.5MB, but may be much larger
 	raw []byte
 
-	Version   string
+	Version   string // The full header version line, e.g. "2.5.27 201001301335 net100"
 	LogTime   uint32
 	GroupName string
 
@@ -324,9 +398,26 @@ type SnapLog struct {
 	// Use with caution.  Generally should use connection spec from .meta file or
 	// from snapshot instead.
 	connSpec connectionSpec
+
+	// The byte order of the binary values, and the undecoded header values,
+	// as the byte order is only known once the first snapshot is available.
+	order       binary.ByteOrder
+	rawLogTime  []byte
+	rawConnSpec []byte
+}
+
+// ByteOrder returns the byte order of the binary values in the snaplog.
+func (sl *SnapLog) ByteOrder() binary.ByteOrder {
+	return sl.order
 }
 
-func (sl *SnapLog) ConnectionSpecValues(saver Saver) {
+// ConnectionSpecValues writes the connection spec from the header into saver.
+// It returns an error, without writing any values, if the connection spec is
+// missing or all zero, as it is in some corrupted headers.
+func (sl *SnapLog) ConnectionSpecValues(saver Saver) error {
+	if err := sl.connSpec.check(); err != nil {
+		return err
+	}
 	saver.SetInt64("local_af", int64(0))
 	src := sl.connSpec.SrcAddr
 	saver.SetString("local_ip", net.IPv4(src[0], src[1], src[2], src[3]).String())
@@ -334,6 +425,28 @@ func (sl *SnapLog) ConnectionSpecValues(saver Saver) {
 	dst := sl.connSpec.DestAddr
 	saver.SetString("remote_ip", net.IPv4(dst[0], dst[1], dst[2], dst[3]).String())
 	saver.SetInt64("remote_port", int64(sl.connSpec.DestPort))
+	return nil
+}
+
+// VariableInfo describes a snapshot variable, as declared in the snaplog header.
+type VariableInfo struct {
+	Name          string  // Name in the header.  Deprecated names start with '_'.
+	CanonicalName string  // Name used when the value is saved.
+	Type          VarType // Web100 type, e.g. WEB100_TYPE_COUNTER32.
+	Offset        int     // Offset in the snapshot, beyond BEGIN_SNAP_DATA.
+	Size          int     // Size, in bytes.
+}
+
+// Variables returns the snapshot variables, in header order.  This allows
+// tools to generate a schema from a sample snaplog, and to detect changes in
+// the layout.
+func (sl *SnapLog) Variables() []VariableInfo {
+	vars := make([]VariableInfo, len(sl.read.Fields))
+	for i, v := range sl.read.Fields {
+		vars[i] = VariableInfo{Name: v.Name, CanonicalName: canonical(v.Name),
+			Type: v.Type, Offset: v.Offset, Size: v.Size}
+	}
+	return vars
 }
 
 // SnapshotNumBytes returns the length of snapshot records, including preamble.
@@ -348,8 +461,76 @@ func (sl *SnapLog) SnapshotNumFields() int {
 	return len(sl.read.Fields)
 }
 
+// FieldCountError indicates that the number of variables parsed from a header
+// section does not match the number of distinct variable names.  The header
+// does not declare a field count, so this detects duplicated variable lines
+// only.
+type FieldCountError struct {
+	Section  string
+	Distinct int // Distinct variable names.
+	Parsed   int // Variable lines.
+}
+
+func (e *FieldCountError) Error() string {
+	return fmt.Sprintf("Field count mismatch in %s: %d distinct names, %d variables",
+		e.Section, e.Distinct, e.Parsed)
+}
+
+// checkFieldCount verifies that each parsed variable has a distinct name, so
+// that every entry of the field index maps to exactly one variable.
+func checkFieldCount(section string, fields *fieldSet) error {
+	if len(fields.FieldMap) != len(fields.Fields) {
+		return &FieldCountError{Section: section,
+			Distinct: len(fields.FieldMap), Parsed: len(fields.Fields)}
+	}
+	return nil
+}
+
+// checkRecordLayout verifies that every field of the /read group fits within
+// the snapshot record length, and that the snapshot data is consistent with
+// that length, so that a header that does not match the data is rejected
+// rather than producing garbage values.
+func checkRecordLayout(read *fieldSet, raw []byte, bodyOffset int) error {
+	if err := checkFieldOffsets(read); err != nil {
+		return err
+	}
+	body := raw[bodyOffset:]
+	if len(body) == 0 {
+		// No snapshots to check.
+		return nil
+	}
+	if !bytes.HasPrefix(body, []byte(BEGIN_SNAP_DATA)) {
+		return errors.New("Snapshot data does not start with BeginSnapData")
+	}
+	if len(body) > read.Length && !bytes.HasPrefix(body[read.Length:], []byte(BEGIN_SNAP_DATA)) {
+		return fmt.Errorf("Snapshot length %d does not match snapshot data", read.Length)
+	}
+	return nil
+}
+
+// checkFieldOffsets verifies that every field of the /read group fits within
+// the snapshot record length.
+func checkFieldOffsets(read *fieldSet) error {
+	dataLength := read.Length - len(BEGIN_SNAP_DATA)
+	for i := range read.Fields {
+		f := &read.Fields[i]
+		if f.Offset+f.Size > dataLength {
+			return fmt.Errorf("Field %s (offset %d, size %d) overruns snapshot length %d",
+				f.Name, f.Offset, f.Size, dataLength)
+		}
+	}
+	return nil
+}
+
+// headerReader is implemented by both bytes.Buffer and bufio.Reader, so that
+// the header can be parsed from a byte array or from a stream.
+type headerReader interface {
+	io.Reader
+	ReadString(delim byte) (string, error)
+}
+
 // parseFields parses the newline separated web100 variable types from the header.
-func parseFields(buf *bytes.Buffer, preamble string, terminator string) (*fieldSet, error) {
+func parseFields(buf headerReader, preamble string, terminator string) (*fieldSet, error) {
 	fields := new(fieldSet)
 	fields.FieldMap = make(map[string]int)
 
@@ -374,6 +555,10 @@ func parseFields(buf *bytes.Buffer, preamble string, terminator string) (*fieldS
 			}
 		}
 		if line == terminator {
+			section := strings.Trim(preamble, "/\n")
+			if err := checkFieldCount(section, fields); err != nil {
+				return nil, err
+			}
 			return fields, nil
 		}
 		v, err := NewVariable(line)
@@ -390,31 +575,126 @@ func parseFields(buf *bytes.Buffer, preamble string, terminator string) (*fieldS
 }
 
 // parseConnectionSpec parses the 16 byte binary connection spec field from the header.
-func parseConnectionSpec(buf *bytes.Buffer) (connectionSpec, error) {
+func parseConnectionSpec(raw []byte, order binary.ByteOrder) connectionSpec {
 	// The web100 snaplog only correctly represents ipv4 addresses.
 	// If the later parts of the log are corrupt, this may be all we get,
 	// so for now, read it anyway.
-	raw := make([]byte, 16)
-	n, err := buf.Read(raw)
-	if err != nil || n < 16 {
-		return connectionSpec{}, errors.New("Too few bytes for connection spec")
-	}
 	// WARNING - the web100 code seemingly depends on a 32 bit architecture.
 	// There is no "packed" directive for the web100_connection_spec, and the
 	// fields all seem to be 32 bit aligned.
-	dstPort := binary.LittleEndian.Uint16(raw[0:2])
+	dstPort := order.Uint16(raw[0:2])
 	dstAddr := raw[4:8]
-	srcPort := binary.LittleEndian.Uint16(raw[8:10])
+	srcPort := order.Uint16(raw[8:10])
 	srcAddr := raw[12:16]
 
 	return connectionSpec{DestPort: dstPort, SrcPort: srcPort,
-		DestAddr: dstAddr, SrcAddr: srcAddr}, nil
+		DestAddr: dstAddr, SrcAddr: srcAddr}
+}
+
+// Plausible log times, from 2000 until the signed 32 bit time_t overflows.
+const (
+	minLogTime = 946684800
+	maxLogTime = 1<<31 - 1
+)
+
+// detectByteOrder returns the byte order of the binary values.  The header
+// has no byte order mark, so this is the order in which the log time is
+// plausible, and the State of the first snapshot, if any, is a valid TCP
+// state.  Little endian, the order of the M-Lab hosts, is preferred, and is
+// also used if neither order is plausible.
+func detectByteOrder(logTime []byte, read *fieldSet, first []byte) binary.ByteOrder {
+	state := read.Find("State")
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t := order.Uint32(logTime)
+		if t < minLogTime || t > maxLogTime {
+			continue
+		}
+		if state != nil && state.Size == 4 && len(first) >= state.Offset+state.Size {
+			if s := TCPState(order.Uint32(first[state.Offset:])); !s.valid() {
+				continue
+			}
+		}
+		return order
+	}
+	return binary.LittleEndian
+}
+
+// decodeHeader detects the byte order, using the data of the first snapshot,
+// which may be nil, and decodes the binary header values accordingly.
+func (sl *SnapLog) decodeHeader(first []byte) {
+	sl.order = detectByteOrder(sl.rawLogTime, &sl.read, first)
+	sl.LogTime = sl.order.Uint32(sl.rawLogTime)
+	sl.connSpec = parseConnectionSpec(sl.rawConnSpec, sl.order)
+	sl.spec.setByteOrder(sl.order)
+	sl.read.setByteOrder(sl.order)
+	sl.tune.setByteOrder(sl.order)
 }
 
+// firstSnapshot returns the data of the first snapshot in body, without the
+// BEGIN_SNAP_DATA, or nil if there is no complete first snapshot.
+func firstSnapshot(body []byte, read *fieldSet) []byte {
+	if len(body) < read.Length || !bytes.HasPrefix(body, []byte(BEGIN_SNAP_DATA)) {
+		return nil
+	}
+	return body[len(BEGIN_SNAP_DATA):read.Length]
+}
+
+// gzipMagic is the first two bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// DefaultMaxInflatedSize is the limit on the decompressed size of a gzipped
+// snaplog used by NewSnapLog.
+const DefaultMaxInflatedSize = 10 * 1024 * 1024
+
+// ErrInflatedTooLarge indicates that a gzipped snaplog decompresses to more
+// than the size limit.
+var ErrInflatedTooLarge = errors.New("Decompressed snaplog too large")
+
 // NewSnapLog creates a SnapLog from a byte array.  Returns error if there are problems.
+// Some early 2009 snaplogs were stored gzip compressed, without a .gz suffix.
+// These are detected by the gzip magic number, and decompressed.
 func NewSnapLog(raw []byte) (*SnapLog, error) {
+	return NewSnapLogLimit(raw, DefaultMaxInflatedSize)
+}
+
+// NewSnapLogLimit creates a SnapLog, as NewSnapLog, but returns
+// ErrInflatedTooLarge if a gzipped snaplog decompresses to more than limit
+// bytes, so that a small, highly compressed file cannot exhaust memory.
+func NewSnapLogLimit(raw []byte, limit int) (*SnapLog, error) {
+	if bytes.HasPrefix(raw, gzipMagic) {
+		zipReader, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		raw, err = ioutil.ReadAll(io.LimitReader(zipReader, int64(limit)+1))
+		zipReader.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > limit {
+			return nil, ErrInflatedTooLarge
+		}
+	}
 	buf := bytes.NewBuffer(raw)
+	slog, err := parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	slog.raw = raw
+	slog.bodyOffset = len(raw) - buf.Len()
+	// The connection spec is the last 16 bytes of the header.
+	slog.connSpecOffset = slog.bodyOffset - 16
+	if err = checkRecordLayout(&slog.read, raw, slog.bodyOffset); err != nil {
+		return nil, err
+	}
+	slog.decodeHeader(firstSnapshot(raw[slog.bodyOffset:], &slog.read))
+	return slog, nil
+}
 
+// parseHeader parses the snaplog header, up to and including the connection
+// spec.  The returned SnapLog has no raw data or offsets, and the binary
+// values are not decoded until decodeHeader is called.
+func parseHeader(buf headerReader) (*SnapLog, error) {
 	// First, the version, etc.
 	version, err := buf.ReadString('\n')
 	if err != nil {
@@ -452,11 +732,9 @@ func NewSnapLog(raw []byte) (*SnapLog, error) {
 
 	// Read the timestamp.
 	t := make([]byte, 4)
-	n, err := buf.Read(t)
-	if err != nil || n < 4 {
+	if _, err := io.ReadFull(buf, t); err != nil {
 		return nil, errors.New("Too few bytes for logTime")
 	}
-	logTime := binary.LittleEndian.Uint32(t)
 
 	// Read the group name.
 	// The web100 group is a set of web100 variables from a specific agent.
@@ -464,8 +742,7 @@ func NewSnapLog(raw []byte) (*SnapLog, error) {
 	// The group is typically "read", but the header typically also includes
 	// "spec" and "tune".
 	gn := make([]byte, GROUPNAME_LEN_MAX)
-	n, err = buf.Read(gn)
-	if err != nil || n != GROUPNAME_LEN_MAX {
+	if _, err := io.ReadFull(buf, gn); err != nil {
 		return nil, errors.New("Too few bytes for groupName")
 	}
 	// The groupname is a C char*, terminated with a null character.
@@ -475,27 +752,33 @@ func NewSnapLog(raw []byte) (*SnapLog, error) {
 		return nil, errors.New("Only 'read' group is supported")
 	}
 
-	connSpecOffset := len(raw) - buf.Len()
-	connSpec, err := parseConnectionSpec(buf)
-	if err != nil {
-		return nil, err
+	connSpec := make([]byte, 16)
+	if _, err := io.ReadFull(buf, connSpec); err != nil {
+		return nil, errors.New("Too few bytes for connection spec")
 	}
 
-	bodyOffset := len(raw) - buf.Len()
-
-	slog := SnapLog{raw: raw, Version: version, LogTime: logTime, GroupName: groupName,
-		connSpecOffset: connSpecOffset, bodyOffset: bodyOffset,
-		spec: *spec, read: *read, tune: *tune, connSpec: connSpec}
+	slog := SnapLog{Version: version, GroupName: groupName,
+		spec: *spec, read: *read, tune: *tune, rawLogTime: t, rawConnSpec: connSpec}
 
 	return &slog, nil
 }
 
+// AgentVersion returns the full version and agent identification from the
+// snaplog header, e.g. "2.5.27 201001301335 net100", which identifies the
+// collection software version.
+func (sl *SnapLog) AgentVersion() string {
+	return sl.Version
+}
+
 // SnapCount returns the number of valid snapshots.
 func (sl *SnapLog) SnapCount() int {
 	total := len(sl.raw) - sl.bodyOffset
 	return total / sl.read.Length
 }
 
+// ErrTruncatedSnapshot indicates that the snaplog ends part way through a snapshot.
+var ErrTruncatedSnapshot = errors.New("Last snapshot truncated.")
+
 // ValidateSnapshots checks whether the first and last snapshots are valid and complete.
 func (sl *SnapLog) ValidateSnapshots() error {
 	// Valid first snapshot?
@@ -511,11 +794,59 @@ func (sl *SnapLog) ValidateSnapshots() error {
 	// Verify that body size is integer multiple of body record length.
 	total := len(sl.raw) - sl.bodyOffset
 	if total%sl.read.Length != 0 {
-		return errors.New("Last snapshot truncated.")
+		return ErrTruncatedSnapshot
 	}
 	return nil
 }
 
+// TCPState is the value of the web100 State variable, which uses the
+// tcpConnState values of the TCP-MIB (RFC 4022).
+type TCPState int
+
+const (
+	StateUnknown TCPState = iota // No State variable, or not yet known.
+	Closed
+	Listen
+	SynSent
+	SynReceived
+	Established
+	FinWait1
+	FinWait2
+	CloseWait
+	LastAck
+	Closing
+	TimeWait
+	DeleteTCB
+)
+
+var tcpStateNames = [...]string{
+	StateUnknown: "UNKNOWN",
+	Closed:       "CLOSED",
+	Listen:       "LISTEN",
+	SynSent:      "SYN_SENT",
+	SynReceived:  "SYN_RECEIVED",
+	Established:  "ESTABLISHED",
+	FinWait1:     "FIN_WAIT1",
+	FinWait2:     "FIN_WAIT2",
+	CloseWait:    "CLOSE_WAIT",
+	LastAck:      "LAST_ACK",
+	Closing:      "CLOSING",
+	TimeWait:     "TIME_WAIT",
+	DeleteTCB:    "DELETE_TCB",
+}
+
+// valid returns true for the states defined by the TCP-MIB.
+func (s TCPState) valid() bool {
+	return s >= Closed && s <= DeleteTCB
+}
+
+func (s TCPState) String() string {
+	if s < 0 || int(s) >= len(tcpStateNames) {
+		return fmt.Sprintf("TCPState(%d)", int(s))
+	}
+	return tcpStateNames[s]
+}
+
 //=================================================================================
 type Snapshot struct {
 	// Just the raw data, without BEGIN_SNAP_DATA.
@@ -524,8 +855,9 @@ type Snapshot struct {
 }
 
 // Returns the snapshot at index n, or error if n is not a valid index, or data is corrupted.
+// Valid indices are 0 through SnapCount()-1.
 func (sl *SnapLog) Snapshot(n int) (Snapshot, error) {
-	if n > sl.SnapCount()-1 {
+	if n < 0 || n >= sl.SnapCount() {
 		return Snapshot{}, errors.New(fmt.Sprintf("Invalid snapshot index %d", n))
 	}
 	offset := sl.bodyOffset + n*sl.read.Length
@@ -540,6 +872,308 @@ func (sl *SnapLog) Snapshot(n int) (Snapshot, error) {
 		fields: &sl.read}, nil
 }
 
+// SnapshotIterator walks the snapshots of a SnapLog in order, for callers
+// that do not need random access.  It reuses a single Snapshot, so the value
+// returned by Next is only valid until the following call to Next.
+type SnapshotIterator struct {
+	slog    *SnapLog
+	next    int // Index of the next snapshot to return.
+	limit   int // Iteration stops before this index.
+	stride  int
+	current Snapshot
+
+	// If non-zero, iteration stops after this many consecutive snapshots in
+	// a state other than ESTABLISHED, following an ESTABLISHED snapshot.
+	stopAfter   int
+	established bool // True once an ESTABLISHED snapshot has been seen.
+	notEstab    int  // Number of consecutive snapshots not ESTABLISHED.
+	stopped     bool
+}
+
+// Snapshots returns an iterator over the first limit snapshots.  If limit is
+// zero or negative, or larger than SnapCount, all snapshots are visited.
+func (sl *SnapLog) Snapshots(limit int) *SnapshotIterator {
+	if limit <= 0 || limit > sl.SnapCount() {
+		limit = sl.SnapCount()
+	}
+	return &SnapshotIterator{slog: sl, limit: limit, stride: 1}
+}
+
+// SetStride causes the iterator to visit only every stride'th snapshot,
+// starting with the next one.  Strides less than one are treated as one.
+func (it *SnapshotIterator) SetStride(stride int) {
+	if stride < 1 {
+		stride = 1
+	}
+	it.stride = stride
+}
+
+// SetStopAfterNonEstablished causes iteration to end once the connection has
+// left the ESTABLISHED state for n consecutive visited snapshots.  The n'th
+// such snapshot is still returned, as it holds the final meaningful values.
+// Zero disables the stop condition.
+func (it *SnapshotIterator) SetStopAfterNonEstablished(n int) {
+	it.stopAfter = n
+}
+
+// Stopped returns true if iteration ended because of the state stop condition,
+// in which case Index is the index of the last snapshot returned.
+func (it *SnapshotIterator) Stopped() bool {
+	return it.stopped
+}
+
+// Next returns the next snapshot, or io.EOF when there are no more.
+func (it *SnapshotIterator) Next() (*Snapshot, error) {
+	if it.next >= it.limit || it.stopped {
+		return nil, io.EOF
+	}
+	sl := it.slog
+	offset := sl.bodyOffset + it.next*sl.read.Length
+	if string(sl.raw[offset:offset+len(BEGIN_SNAP_DATA)]) != BEGIN_SNAP_DATA {
+		return nil, errors.New("Missing BeginSnapData")
+	}
+	it.current.raw = sl.raw[offset+len(BEGIN_SNAP_DATA) : offset+sl.read.Length]
+	it.current.fields = &sl.read
+	it.next += it.stride
+	if it.stopAfter > 0 {
+		it.checkState()
+	}
+	return &it.current, nil
+}
+
+// checkState updates the stop condition using the current snapshot.
+func (it *SnapshotIterator) checkState() {
+	state := it.current.State()
+	if state == StateUnknown {
+		return
+	}
+	if state == Established {
+		it.established = true
+		it.notEstab = 0
+		return
+	}
+	if it.established {
+		it.notEstab++
+		if it.notEstab >= it.stopAfter {
+			it.stopped = true
+		}
+	}
+}
+
+// Index returns the index of the snapshot most recently returned by Next.
+func (it *SnapshotIterator) Index() int {
+	return it.next - it.stride
+}
+
+// DecodeSnapshots calls decode for each of the first limit snapshots, using at
+// most workers goroutines.  If limit is zero or negative, or larger than
+// SnapCount, all snapshots are decoded.  Each snapshot is independent, given
+// its offset, so decode is called concurrently, in no particular order, and
+// must record its results by index, e.g. in a slice allocated by the caller.
+// The SnapLog and its variable tables are only read, so they are safely shared.
+//
+// After an error, no further snapshots are started.  The error for the lowest
+// failing index is returned, once all the workers have finished.
+func (sl *SnapLog) DecodeSnapshots(limit, workers int, decode func(index int, snap *Snapshot) error) error {
+	if limit <= 0 || limit > sl.SnapCount() {
+		limit = sl.SnapCount()
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > limit {
+		workers = limit
+	}
+	var next int64 = -1 // Index of the last snapshot claimed by a worker.
+	var failed int32    // Set after any error.
+	errs := make([]error, limit)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= limit {
+					return
+				}
+				snap, err := sl.Snapshot(i)
+				if err == nil {
+					err = decode(i, &snap)
+				}
+				if err != nil {
+					errs[i] = err
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Every index below a failure was claimed first, so was also decoded.
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//=================================================================================
+// SnapLogReader parses a snaplog from a stream, one snapshot at a time, so that
+// very large snaplogs can be processed without holding the whole file in memory.
+//
+// The number of snapshots is not known until the end of the stream, so there is
+// no SnapCount or ValidateSnapshots.  Instead, Next checks each snapshot as it is
+// read, and returns ErrTruncatedSnapshot, rather than io.EOF, if the stream ends
+// part way through the last snapshot.
+type SnapLogReader struct {
+	Version   string // The full header version line.
+	LogTime   uint32
+	GroupName string
+
+	header *SnapLog // The parsed header, without raw data.
+	rdr    *bufio.Reader
+	count  int   // Number of snapshots returned so far.
+	err    error // Sticky error, returned by all calls after the first failure.
+}
+
+// NewSnapLogReader parses the snaplog header from r, and returns a reader for
+// the snapshots that follow.  Like NewSnapLog, it detects and decompresses
+// gzipped snaplogs.
+func NewSnapLogReader(r io.Reader) (*SnapLogReader, error) {
+	rdr := bufio.NewReader(r)
+	if magic, err := rdr.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		zipReader, err := gzip.NewReader(rdr)
+		if err != nil {
+			return nil, err
+		}
+		rdr = bufio.NewReader(zipReader)
+	}
+	header, err := parseHeader(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFieldOffsets(&header.read); err != nil {
+		return nil, err
+	}
+	// Reject a header that does not match the data, as NewSnapLog does.  An
+	// empty body is fine.
+	begin, _ := rdr.Peek(len(BEGIN_SNAP_DATA))
+	if len(begin) > 0 && string(begin) != BEGIN_SNAP_DATA {
+		return nil, errors.New("Snapshot data does not start with BeginSnapData")
+	}
+	body, _ := rdr.Peek(header.read.Length)
+	header.decodeHeader(firstSnapshot(body, &header.read))
+	return &SnapLogReader{Version: header.Version, LogTime: header.LogTime,
+		GroupName: header.GroupName, header: header, rdr: rdr}, nil
+}
+
+// AgentVersion returns the full version and agent identification from the
+// snaplog header.
+func (sr *SnapLogReader) AgentVersion() string {
+	return sr.Version
+}
+
+// ConnectionSpecValues writes the connection spec from the header into saver,
+// or returns an error, as for SnapLog.
+func (sr *SnapLogReader) ConnectionSpecValues(saver Saver) error {
+	return sr.header.ConnectionSpecValues(saver)
+}
+
+// Variables returns the snapshot variables, in header order, as for SnapLog.
+func (sr *SnapLogReader) Variables() []VariableInfo {
+	return sr.header.Variables()
+}
+
+// Count returns the number of snapshots returned by Next so far.
+func (sr *SnapLogReader) Count() int {
+	return sr.count
+}
+
+// Next reads and returns the next snapshot, or io.EOF when there are no more.
+// Each snapshot has its own buffer, so it remains valid after later calls,
+// e.g. for use with SnapshotDeltas.
+func (sr *SnapLogReader) Next() (*Snapshot, error) {
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	record := make([]byte, sr.header.read.Length)
+	_, err := io.ReadFull(sr.rdr, record)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		sr.err = ErrTruncatedSnapshot
+	case err != nil:
+		sr.err = err
+	case string(record[:len(BEGIN_SNAP_DATA)]) != BEGIN_SNAP_DATA:
+		sr.err = errors.New("Missing BeginSnapData")
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	sr.count++
+	return &Snapshot{raw: record[len(BEGIN_SNAP_DATA):], fields: &sr.header.read}, nil
+}
+
+// valueSaver captures a single integer or string value.
+type valueSaver struct {
+	intValue    int64
+	stringValue string
+	isInt       bool
+	isString    bool
+}
+
+func (s *valueSaver) SetInt64(name string, value int64)   { s.intValue, s.isInt = value, true }
+func (s *valueSaver) SetString(name string, value string) { s.stringValue, s.isString = value, true }
+
+// value decodes only the named field.  The name may be either the name in
+// the snaplog header, or the canonical name.
+func (snap *Snapshot) value(name string) *valueSaver {
+	saver := valueSaver{}
+	if snap.raw == nil {
+		return &saver
+	}
+	field := snap.fields.Find(name)
+	if field == nil {
+		// Try the legacy names that map to this canonical name.
+		for legacy, canonical := range CanonicalNames {
+			if canonical == name {
+				if field = snap.fields.Find(legacy); field != nil {
+					break
+				}
+			}
+		}
+	}
+	if field != nil {
+		field.Save(snap.raw[field.Offset:field.Offset+field.Size], &saver)
+	}
+	return &saver
+}
+
+// GetInt64 returns the value of the named integer variable, decoding only
+// that variable.  Returns false if there is no such integer variable.
+func (snap *Snapshot) GetInt64(name string) (int64, bool) {
+	saver := snap.value(name)
+	return saver.intValue, saver.isInt
+}
+
+// GetString returns the value of the named string variable, such as an
+// address, decoding only that variable.  Returns false if there is no such
+// string variable.
+func (snap *Snapshot) GetString(name string) (string, bool) {
+	saver := snap.value(name)
+	return saver.stringValue, saver.isString
+}
+
+// State returns the TCP connection state of the snapshot, or StateUnknown if
+// there is no State variable.
+func (snap *Snapshot) State() TCPState {
+	state, ok := snap.GetInt64("State")
+	if !ok {
+		return StateUnknown
+	}
+	return TCPState(state)
+}
+
 // SnapshotValues writes all values into the provided Saver.
 func (snap *Snapshot) SnapshotValues(snapValues Saver) error {
 	if snap.raw == nil {
@@ -5,26 +5,40 @@ package web100_test
 // to test some of the anomaly cases.
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/m-lab/etl/web100"
 )
 
+// readSnaplog returns the content of the named snaplog in testdata.
+func readSnaplog(t testing.TB, name string) []byte {
+	data, err := ioutil.ReadFile(`testdata/` + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
 func TestHeaderParsing(t *testing.T) {
 	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
-	c2sData, err := ioutil.ReadFile(`testdata/` + c2sName)
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	c2sData := readSnaplog(t, c2sName)
 
 	slog, err := web100.NewSnapLog(c2sData)
 
@@ -43,20 +57,86 @@ func TestHeaderParsing(t *testing.T) {
 	if slog.LogTime != 1494337516 {
 		t.Error("Incorrect LogTime.")
 	}
+	if slog.AgentVersion() != "2.5.27 201001301335 net100" {
+		t.Errorf("Incorrect AgentVersion: %q", slog.AgentVersion())
+	}
 	if err = slog.ValidateSnapshots(); err != nil {
 		t.Error(err)
 	}
 }
 
+func TestFieldCountMismatch(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+
+	// Duplicate the last variable of a section, with a consistent offset, so
+	// that the variable list has one more entry than the field index.
+	tests := []struct {
+		section  string
+		last     string
+		dup      string
+		distinct int
+	}{
+		{"spec", "LocalAddressType 57 0 4\n", "LocalAddressType 61 0 4\n", 7},
+		{"read", "State 641 0 4\n", "State 645 0 4\n", 142},
+	}
+	for _, test := range tests {
+		dup := []byte(test.last + test.dup)
+		bad := bytes.Replace(c2sData, []byte(test.last), dup, 1)
+		if len(bad) == len(c2sData) {
+			t.Fatal("Failed to modify header")
+		}
+
+		_, err := web100.NewSnapLog(bad)
+		if err == nil {
+			t.Errorf("%s: expected field count error", test.section)
+			continue
+		}
+		fce, ok := err.(*web100.FieldCountError)
+		if !ok {
+			t.Errorf("%s: wrong error type: %v", test.section, err)
+			continue
+		}
+		if fce.Section != test.section || fce.Distinct != test.distinct || fce.Parsed != test.distinct+1 {
+			t.Errorf("Wrong counts: %v", err)
+		}
+	}
+}
+
+func TestRecordLayoutMismatch(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+
+	// Declare the last /read variable as a 64 bit counter, so that the header
+	// record length is 4 bytes longer than the actual snapshot records.
+	bad := bytes.Replace(c2sData, []byte("State 641 0 4\n"), []byte("State 641 7 8\n"), 1)
+	if bytes.Equal(bad, c2sData) {
+		t.Fatal("Failed to modify header")
+	}
+	_, err := web100.NewSnapLog(bad)
+	if err == nil {
+		t.Fatal("Expected layout error")
+	}
+	if !strings.Contains(err.Error(), "Snapshot length 673") {
+		t.Error("Wrong error:", err)
+	}
+
+	// Corrupt the first BeginSnapData marker.
+	bad = bytes.Replace(c2sData, []byte(web100.BEGIN_SNAP_DATA), []byte("----Begin-Snap-Date----\n"), 1)
+	if _, err := web100.NewSnapLog(bad); err == nil {
+		t.Error("Expected error for missing BeginSnapData")
+	}
+}
+
 type SimpleSaver struct {
 	Integers map[string]int64
 	Strings  map[string]string
-	Bools    map[string]bool
 }
 
+var _ web100.Saver = SimpleSaver{}
+
 func NewSimpleSaver() SimpleSaver {
-	return SimpleSaver{make(map[string]int64),
-		make(map[string]string), make(map[string]bool)}
+	return SimpleSaver{make(map[string]int64), make(map[string]string)}
 }
 
 func (s SimpleSaver) SetString(name string, val string) {
@@ -67,10 +147,6 @@ func (s SimpleSaver) SetInt64(name string, val int64) {
 	s.Integers[name] = val
 }
 
-func (s SimpleSaver) SetBool(name string, val bool) {
-	s.Bools[name] = val
-}
-
 // These json blobs were created using the old, C web100 based parser.
 var old1 = `{"Integers":{"AbruptTimeouts":0,"ActiveOpen":0,"CERcvd":0,"CongAvoid":2,"CongOverCount":0,"CongSignals":0,"CountRTT":3,"CurAppRQueue":297,"CurAppWQueue":0,"CurCwnd":4344,"CurMSS":1448,"CurRTO":688,"CurReasmQueue":0,"CurRetxQueue":0,"CurRwinRcvd":29312,"CurRwinSent":6912,"CurSsthresh":2896,"CurTimeoutCount":0,"DSACKDups":0,"DataSegsIn":1,"DataSegsOut":3,"DupAcksIn":0,"DupAcksOut":0,"Duration":2343340,"ECN":0,"FastRetran":0,"HCDataOctetsIn":297,"HCDataOctetsOut":254,"HCThruOctetsAcked":158,"HCThruOctetsReceived":297,"LimCwnd":4294965848,"LimRwin":8365440,"LocalAddressType":1,"LocalPort":46024,"MSSRcvd":0,"MaxAppRQueue":297,"MaxAppWQueue":0,"MaxMSS":1448,"MaxRTO":738,"MaxRTT":244,"MaxReasmQueue":0,"MaxRetxQueue":0,"MaxRwinRcvd":29312,"MaxRwinSent":6912,"MaxSsCwnd":4344,"MaxSsthresh":2896,"MinMSS":1448,"MinRTO":687,"MinRTT":229,"MinRwinRcvd":29312,"MinRwinSent":5792,"MinSsthresh":2896,"Nagle":1,"NonRecovDA":0,"OctetsRetrans":0,"OtherReductions":0,"PostCongCountRTT":0,"PostCongSumRTT":0,"PreCongSumCwnd":0,"PreCongSumRTT":0,"QuenchRcvd":0,"RTTVar":110,"RcvNxt":3198753442,"RcvRTT":0,"RcvWindScale":7,"RecInitial":3198753145,"RemPort":48716,"RetranThresh":3,"SACK":3,"SACKBlocksRcvd":0,"SACKsRcvd":0,"SampleRTT":244,"SegsIn":3,"SegsOut":3,"SegsRetrans":0,"SendStall":0,"SlowStart":0,"SmoothedRTT":246,"SndInitial":2301393414,"SndLimBytesCwnd":0,"SndLimBytesRwin":0,"SndLimBytesSender":254,"SndLimTimeCwnd":0,"SndLimTimeRwin":0,"SndLimTimeSnd":234061,"SndLimTransCwnd":0,"SndLimTransRwin":0,"SndLimTransSnd":1,"SndMax":2301393572,"SndNxt":2301393572,"SndUna":2301393572,"SndWindScale":7,"SpuriousFrDetected":0,"StartTimeStamp":1494337514,"StartTimeUsec":369834,"State":5,"SubsequentTimeouts":0,"SumRTT":707,"TimeStamps":1,"Timeouts":0,"WinScaleRcvd":7,"WinScaleSent":7,"X_OtherReductionsCM":0,"X_OtherReductionsCV":0,"X_Rcvbuf":87380,"X_Sndbuf":16384,"X_dbg1":6912,"X_dbg2":536,"X_dbg3":6864,"X_dbg4":0,"X_rcv_ssthresh":6864,"X_wnd_clamp":64087},"Strings":{"LocalAddress":"213.208.152.37","RemAddress":"45.56.98.222"}, "Bools":{}}`
 
@@ -81,10 +157,7 @@ var old2000 = `{"Integers":{"AbruptTimeouts":0,"ActiveOpen":0,"CERcvd":0,"CongAv
 // This tests parsing of snapshot content for three snapshots.
 func TestSnapshotContent(t *testing.T) {
 	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
-	c2sData, err := ioutil.ReadFile(`testdata/` + c2sName)
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	c2sData := readSnaplog(t, c2sName)
 	slog, err := web100.NewSnapLog(c2sData)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -125,6 +198,23 @@ func TestSnapshotContent(t *testing.T) {
 	}
 }
 
+func TestSnapshotBounds(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = slog.Snapshot(slog.SnapCount() - 1); err != nil {
+		t.Error(err)
+	}
+	for _, n := range []int{slog.SnapCount(), slog.SnapCount() + 1, -1} {
+		if _, err = slog.Snapshot(n); err == nil {
+			t.Errorf("Expected error for snapshot %d of %d", n, slog.SnapCount())
+		}
+	}
+}
+
 // The remaining tests just verify that the parser produces valid snapshots.  They
 // do not verify the content accuracy.
 func OneSnapshot(t *testing.T, name string, n int) {
@@ -152,12 +242,27 @@ func OneSnapshot(t *testing.T, name string, n int) {
 	}
 }
 
-// These files are in a different format, so don't try to parse them.
-func xTestSnapshot200903(t *testing.T) {
+// These files are gzip compressed, without a .gz suffix.
+func TestSnapshot200903(t *testing.T) {
 	OneSnapshot(t, "20090301T22:29:43.653205000Z-78.61.75.41:33538.s2c_snaplog", 2000)
 	OneSnapshot(t, "20090301T22:29:43.653205000Z_78.61.75.41:46267.c2s_snaplog", 2000)
 }
 
+func TestNewSnapLogLimit(t *testing.T) {
+	gzName := `20090301T22:29:43.653205000Z-78.61.75.41:33538.s2c_snaplog`
+	gzData := readSnaplog(t, gzName)
+	if _, err := web100.NewSnapLogLimit(gzData, web100.DefaultMaxInflatedSize); err != nil {
+		t.Fatal(err)
+	}
+	// The compressed size is within the limit, but the decompressed size is not.
+	if len(gzData) >= 1024*1024 {
+		t.Fatalf("Test file is too large: %d", len(gzData))
+	}
+	if _, err := web100.NewSnapLogLimit(gzData, 1024*1024); err != web100.ErrInflatedTooLarge {
+		t.Errorf("Expected ErrInflatedTooLarge, got %v", err)
+	}
+}
+
 func TestSnapshot200904(t *testing.T) {
 	OneSnapshot(t, "20090401T09:01:09.490730000Z-131.169.137.246:14884.s2c_snaplog", 2000)
 	OneSnapshot(t, "20090401T09:01:09.490730000Z_131.169.137.246:14881.c2s_snaplog", 2000)
@@ -201,3 +306,711 @@ func TestNewVar(t *testing.T) {
 	//	4 /*UNSIGNED32*/, 4, /*TIME_TICKS*/
 	//	8 /*COUNTER64*/, 2 /*PORT_NUM*/, 17, 17, 32 /*STR32*/, 1 /*OCTET*/, 0}
 }
+
+func TestNewVariableTypes(t *testing.T) {
+	tests := []struct {
+		typ  int
+		size int
+		data []byte
+		want interface{} // int64, or string
+	}{
+		{0, 4, []byte{0xfe, 0xff, 0xff, 0xff}, int64(-2)},                                // INTEGER
+		{1, 4, []byte{1, 2, 3, 4}, int64(0x04030201)},                                    // INTEGER32
+		{2, 4, []byte{10, 0, 0, 1}, "10.0.0.1"},                                          // INET_ADDRESS_IPV4
+		{3, 4, []byte{0xff, 0xff, 0xff, 0xff}, int64(0xffffffff)},                        // COUNTER32
+		{4, 4, []byte{1, 0, 0, 0}, int64(1)},                                             // GAUGE32
+		{5, 4, []byte{0, 1, 0, 0}, int64(256)},                                           // UNSIGNED32
+		{6, 4, []byte{0, 0, 1, 0}, int64(65536)},                                         // TIME_TICKS
+		{7, 8, []byte{1, 0, 0, 0, 1, 0, 0, 0}, int64(0x100000001)},                       // COUNTER64
+		{8, 2, []byte{0x50, 0}, int64(80)},                                               // INET_PORT_NUMBER
+		{9, 17, append([]byte{10, 0, 0, 2}, append(make([]byte, 12), 1)...), "10.0.0.2"}, // INET_ADDRESS
+		{10, 17, append(net.ParseIP("2001:db8::1"), 2), "2001:db8::1"},                   // INET_ADDRESS_IPV6
+		{11, 32, append([]byte("web100"), make([]byte, 26)...), "web100"},                // STR32
+		{12, 1, []byte{7}, int64(7)},                                                     // OCTET
+	}
+	for _, test := range tests {
+		spec := fmt.Sprintf("foo 0 %d %d", test.typ, test.size)
+		v, err := web100.NewVariable(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		saver := NewSimpleSaver()
+		if err = v.Save(test.data, saver); err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		var got interface{} = saver.Strings["foo"]
+		if _, ok := test.want.(int64); ok {
+			got = saver.Integers["foo"]
+		}
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", spec, got, test.want)
+		}
+
+		// Data of the wrong size is rejected.
+		if err = v.Save(test.data[1:], saver); err == nil {
+			t.Errorf("%s: expected error for %d bytes", spec, test.size-1)
+		}
+		// Neighboring sizes are invalid, except for bare 16 byte IPv6
+		// addresses, which are tested in TestIPv6Address.
+		for _, size := range []int{test.size - 1, test.size + 1} {
+			if test.typ == 10 && size == 16 {
+				continue
+			}
+			if _, err = web100.NewVariable(fmt.Sprintf("foo 0 %d %d", test.typ, size)); err == nil {
+				t.Errorf("Expected error for type %d, size %d", test.typ, size)
+			}
+		}
+	}
+
+	// Unknown types, negative offsets, and malformed lines are rejected.
+	for _, spec := range []string{"foo 0 13 0", "foo 0 -1 4", "foo -4 1 4", "foo 0 1", "foo 0 1 4 5"} {
+		if _, err := web100.NewVariable(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestIPv6Address(t *testing.T) {
+	// 2001:db8::1, as raw bytes.
+	v6 := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	tests := []struct {
+		spec string
+		data []byte
+		want string
+	}{
+		// INET_ADDRESS with IPV6 address type.
+		{"RemAddress 0 9 17", append(append([]byte{}, v6...), 2), "2001:db8::1"},
+		// INET_ADDRESS with IPV4 address type.
+		{"RemAddress 0 9 17", []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "1.2.3.4"},
+		// INET_ADDRESS_IPV6 with address type.
+		{"LocalAddress 0 10 17", append(append([]byte{}, v6...), 2), "2001:db8::1"},
+		// INET_ADDRESS_IPV6 with unset address type.
+		{"LocalAddress 0 10 17", append(append([]byte{}, v6...), 0), "2001:db8::1"},
+		// INET_ADDRESS_IPV6 without address type.
+		{"LocalAddress 0 10 16", v6, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		v, err := web100.NewVariable(tt.spec)
+		if err != nil {
+			t.Error(tt.spec, err)
+			continue
+		}
+		saver := NewSimpleSaver()
+		if err = v.Save(tt.data, saver); err != nil {
+			t.Error(tt.spec, err)
+			continue
+		}
+		if saver.Strings[v.Name] != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.spec, saver.Strings[v.Name], tt.want)
+		}
+	}
+
+	// Other 16 byte fields are invalid.
+	if _, err := web100.NewVariable("RemAddress 0 9 16"); err == nil {
+		t.Error("Should have returned error")
+	}
+
+	// A snaplog of an IPv6 connection, with 17 byte INET_ADDRESS variables.
+	v6Name := `20170509T13:45:13.590210000Z_2001:db8::2:48716.c2s_snaplog`
+	v6Data := readSnaplog(t, v6Name)
+	slog, err := web100.NewSnapLog(v6Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slog.Snapshot(slog.SnapCount() - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := NewSimpleSaver()
+	if err = snap.SnapshotValues(&saver); err != nil {
+		t.Fatal(err)
+	}
+	if saver.Strings["RemAddress"] != "2001:db8::2" || saver.Strings["LocalAddress"] != "2001:db8::1" ||
+		saver.Integers["LocalAddressType"] != 2 {
+		t.Errorf("Wrong IPv6 addresses %v, LocalAddressType %d",
+			saver.Strings, saver.Integers["LocalAddressType"])
+	}
+}
+
+func TestConnectionSpecValues(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := NewSimpleSaver()
+	if err = slog.ConnectionSpecValues(&saver); err != nil {
+		t.Fatal(err)
+	}
+	if saver.Strings["local_ip"] != "213.208.152.37" || saver.Strings["remote_ip"] != "45.56.98.222" ||
+		saver.Integers["local_port"] != 46024 || saver.Integers["remote_port"] != 48716 {
+		t.Errorf("Wrong connection spec %v %v", saver.Strings, saver.Integers)
+	}
+
+	// The connection spec follows the log time and group name.
+	specOffset := bytes.Index(c2sData, []byte(web100.END_OF_HEADER)) +
+		len(web100.END_OF_HEADER) + 4 + web100.GROUPNAME_LEN_MAX
+
+	// A zeroed connection spec is reported, and no values are set.
+	zeroed := append([]byte{}, c2sData...)
+	copy(zeroed[specOffset:specOffset+16], make([]byte, 16))
+	slog, err = web100.NewSnapLog(zeroed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver = NewSimpleSaver()
+	if err = slog.ConnectionSpecValues(&saver); err == nil {
+		t.Error("Expected error for zeroed connection spec")
+	}
+	if len(saver.Strings)+len(saver.Integers) != 0 {
+		t.Errorf("Unexpected values %v %v", saver.Strings, saver.Integers)
+	}
+
+	// A header truncated within the connection spec is rejected.
+	truncated := c2sData[:specOffset+10]
+	if _, err = web100.NewSnapLog(truncated); err == nil {
+		t.Error("Expected error for truncated connection spec")
+	}
+	if _, err = web100.NewSnapLogReader(bytes.NewReader(truncated)); err == nil {
+		t.Error("Expected error for truncated connection spec")
+	}
+}
+
+// bigEndian returns a copy of a little endian snaplog, with every binary
+// integer value byte swapped, as it would be written by a big endian host.
+func bigEndian(t *testing.T, data []byte) []byte {
+	out := append([]byte{}, data...)
+	swap := func(b []byte) {
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+
+	// The /read fields give the integer layout of each snapshot.
+	header := string(data[:bytes.Index(data, []byte(web100.END_OF_HEADER))])
+	readLines := header[strings.Index(header, "/read\n")+len("/read\n"):]
+	readLines = readLines[:strings.Index(readLines, "\n\n")+1]
+	type field struct{ offset, size int }
+	fields := []field{}
+	length := len(web100.BEGIN_SNAP_DATA)
+	for _, line := range strings.SplitAfter(readLines, "\n") {
+		if line == "" {
+			continue
+		}
+		v, err := web100.NewVariable(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length += v.Size
+		switch v.Type {
+		case web100.WEB100_TYPE_INET_ADDRESS_IPV4, web100.WEB100_TYPE_INET_ADDRESS,
+			web100.WEB100_TYPE_INET_ADDRESS_IPV6, web100.WEB100_TYPE_STR32, web100.WEB100_TYPE_OCTET:
+		default:
+			fields = append(fields, field{v.Offset, v.Size})
+		}
+	}
+
+	// The log time and connection spec ports follow the header.
+	pos := len(header) + len(web100.END_OF_HEADER)
+	swap(out[pos : pos+4])
+	pos += 4 + web100.GROUPNAME_LEN_MAX
+	swap(out[pos : pos+2])
+	swap(out[pos+8 : pos+10])
+	pos += 16
+
+	for ; pos+length <= len(out); pos += length {
+		snap := out[pos+len(web100.BEGIN_SNAP_DATA):]
+		for _, f := range fields {
+			swap(snap[f.offset : f.offset+f.size])
+		}
+	}
+	return out
+}
+
+func TestBigEndian(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	le, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if le.ByteOrder() != binary.LittleEndian {
+		t.Errorf("Byte order %v, want little endian", le.ByteOrder())
+	}
+	be, err := web100.NewSnapLog(bigEndian(t, c2sData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be.ByteOrder() != binary.BigEndian {
+		t.Fatalf("Byte order %v, want big endian", be.ByteOrder())
+	}
+	if be.LogTime != le.LogTime {
+		t.Errorf("LogTime %d, want %d", be.LogTime, le.LogTime)
+	}
+
+	leSpec := NewSimpleSaver()
+	beSpec := NewSimpleSaver()
+	if err = le.ConnectionSpecValues(&leSpec); err != nil {
+		t.Fatal(err)
+	}
+	if err = be.ConnectionSpecValues(&beSpec); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(leSpec, beSpec) {
+		t.Errorf("Connection spec %v, want %v", beSpec, leSpec)
+	}
+
+	if be.SnapCount() != le.SnapCount() {
+		t.Fatalf("SnapCount %d, want %d", be.SnapCount(), le.SnapCount())
+	}
+	for i := 0; i < le.SnapCount(); i++ {
+		leSnap, err := le.Snapshot(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		beSnap, err := be.Snapshot(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := NewSimpleSaver()
+		got := NewSimpleSaver()
+		leSnap.SnapshotValues(&want)
+		beSnap.SnapshotValues(&got)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Snapshot %d: %v", i, saverDiffs(want, got))
+		}
+	}
+
+	// The streaming reader detects the byte order the same way.
+	rdr, err := web100.NewSnapLogReader(bytes.NewReader(bigEndian(t, c2sData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rdr.LogTime != le.LogTime {
+		t.Errorf("Reader LogTime %d, want %d", rdr.LogTime, le.LogTime)
+	}
+	snap, err := rdr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := le.Snapshot(0)
+	want := NewSimpleSaver()
+	got := NewSimpleSaver()
+	first.SnapshotValues(&want)
+	snap.SnapshotValues(&got)
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Reader snapshot: %v", saverDiffs(want, got))
+	}
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The iterator visits the same snapshots as random access.
+	iter := slog.Snapshots(0)
+	count := 0
+	for snap, err := iter.Next(); err != io.EOF; snap, err = iter.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iter.Index() != count {
+			t.Fatalf("Wrong index %d, expected %d", iter.Index(), count)
+		}
+		if count == 2000 {
+			var old SimpleSaver
+			json.Unmarshal([]byte(old2000), &old)
+			saver := NewSimpleSaver()
+			snap.SnapshotValues(&saver)
+			if !reflect.DeepEqual(old, saver) {
+				t.Error("Does not match old output")
+			}
+		}
+		count++
+	}
+	if count != slog.SnapCount() {
+		t.Errorf("Visited %d snapshots, expected %d", count, slog.SnapCount())
+	}
+
+	// The caller supplied limit and stride are respected.
+	iter = slog.Snapshots(100)
+	iter.SetStride(30)
+	indices := []int{}
+	for _, err := iter.Next(); err != io.EOF; _, err = iter.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, iter.Index())
+	}
+	if !reflect.DeepEqual(indices, []int{0, 30, 60, 90}) {
+		t.Errorf("Wrong indices: %v", indices)
+	}
+}
+
+func TestSnapLogReader(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(c2sData)
+	zw.Close()
+
+	// The streamed snapshots match those of the SnapLog, whether or not the
+	// snaplog is compressed.
+	for _, data := range [][]byte{c2sData, gz.Bytes()} {
+		rdr, err := web100.NewSnapLogReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rdr.AgentVersion() != slog.AgentVersion() || rdr.LogTime != slog.LogTime {
+			t.Errorf("Wrong header: %q %d", rdr.AgentVersion(), rdr.LogTime)
+		}
+		iter := slog.Snapshots(0)
+		var prev *web100.Snapshot
+		for snap, err := rdr.Next(); err != io.EOF; snap, err = rdr.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := iter.Next()
+			wantState, _ := want.GetInt64("State")
+			if state, _ := snap.GetInt64("State"); state != wantState {
+				t.Fatalf("Snapshot %d: wrong State %d", rdr.Count()-1, state)
+			}
+			if rdr.Count() == 2001 {
+				var old SimpleSaver
+				json.Unmarshal([]byte(old2000), &old)
+				saver := NewSimpleSaver()
+				snap.SnapshotValues(&saver)
+				if !reflect.DeepEqual(old, saver) {
+					t.Error("Does not match old output")
+				}
+				// The previous snapshot is still valid.
+				deltas := NewSimpleSaver()
+				if err := snap.SnapshotDeltas(prev, &deltas); err != nil {
+					t.Error(err)
+				}
+				if len(deltas.Integers) == 0 || len(deltas.Integers) == len(saver.Integers) {
+					t.Errorf("Unexpected deltas %v", deltas.Integers)
+				}
+			}
+			prev = snap
+		}
+		if rdr.Count() != slog.SnapCount() {
+			t.Errorf("Read %d snapshots, expected %d", rdr.Count(), slog.SnapCount())
+		}
+	}
+
+	// A truncated final snapshot is reported, after all complete snapshots.
+	rdr, err := web100.NewSnapLogReader(bytes.NewReader(c2sData[:len(c2sData)-10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err = rdr.Next(); err == nil; _, err = rdr.Next() {
+	}
+	if err != web100.ErrTruncatedSnapshot {
+		t.Errorf("Expected ErrTruncatedSnapshot, got %v", err)
+	}
+	if rdr.Count() != slog.SnapCount()-1 {
+		t.Errorf("Read %d snapshots, expected %d", rdr.Count(), slog.SnapCount()-1)
+	}
+}
+
+func TestSnapshotState(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	c2sData, err := web100.SetSnapshotValue(c2sData, "State", 2000, uint32(web100.TimeWait))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		index int
+		state web100.TCPState
+		name  string
+	}{
+		{0, web100.Established, "ESTABLISHED"},
+		{1999, web100.Established, "ESTABLISHED"},
+		{2000, web100.TimeWait, "TIME_WAIT"},
+	} {
+		snap, err := slog.Snapshot(test.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state := snap.State(); state != test.state || state.String() != test.name {
+			t.Errorf("Snapshot %d: state %v, want %v", test.index, state, test.name)
+		}
+	}
+
+	if _, err := web100.SetSnapshotValue(c2sData, "NoSuchVar", 0, 0); err == nil {
+		t.Error("Expected error setting unknown variable")
+	}
+
+	if s := web100.TCPState(42).String(); s != "TCPState(42)" {
+		t.Errorf("Unexpected String %q for undefined state", s)
+	}
+	var empty web100.Snapshot
+	if s := empty.State(); s != web100.StateUnknown {
+		t.Errorf("Empty snapshot state %v, want %v", s, web100.StateUnknown)
+	}
+}
+
+func TestSnapshotIteratorStateStop(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	// Connection leaves ESTABLISHED for CLOSE_WAIT at snapshot 1500.
+	c2sData, err := web100.SetSnapshotValue(c2sData, "State", 1500, uint32(web100.CloseWait))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iter := slog.Snapshots(0)
+	iter.SetStopAfterNonEstablished(3)
+	last := -1
+	for _, err := iter.Next(); err != io.EOF; _, err = iter.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = iter.Index()
+	}
+	if !iter.Stopped() {
+		t.Error("Iterator should have stopped")
+	}
+	if last != 1502 || iter.Index() != 1502 {
+		t.Errorf("Stopped at %d, expected 1502", last)
+	}
+
+	// Without the stop condition, all snapshots are visited.
+	iter = slog.Snapshots(0)
+	count := 0
+	for _, err := iter.Next(); err != io.EOF; _, err = iter.Next() {
+		count++
+	}
+	if iter.Stopped() || count != slog.SnapCount() {
+		t.Errorf("Visited %d snapshots, expected %d", count, slog.SnapCount())
+	}
+}
+
+func TestSnapshotGetValue(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := slog.Snapshot(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := NewSimpleSaver()
+	snapshot.SnapshotValues(&saver)
+
+	// Every value should match the full decoding, using canonical names.
+	for name, expected := range saver.Integers {
+		if v, ok := snapshot.GetInt64(name); !ok || v != expected {
+			t.Errorf("GetInt64(%s) = %d, %v; want %d", name, v, ok, expected)
+		}
+	}
+	for name, expected := range saver.Strings {
+		if v, ok := snapshot.GetString(name); !ok || v != expected {
+			t.Errorf("GetString(%s) = %s, %v; want %s", name, v, ok, expected)
+		}
+	}
+
+	// Legacy names from the snaplog header also work.
+	if v, ok := snapshot.GetInt64("MaxCwnd"); !ok || v != saver.Integers["MaxSsCwnd"] {
+		t.Errorf("GetInt64(MaxCwnd) = %d, %v", v, ok)
+	}
+
+	if _, ok := snapshot.GetInt64("NoSuchVariable"); ok {
+		t.Error("Expected !ok for unknown integer")
+	}
+	if _, ok := snapshot.GetString("NoSuchVariable"); ok {
+		t.Error("Expected !ok for unknown string")
+	}
+	// Wrong type.
+	if _, ok := snapshot.GetString("CurCwnd"); ok {
+		t.Error("Expected !ok for GetString of an integer")
+	}
+	if _, ok := snapshot.GetInt64("RemAddress"); ok {
+		t.Error("Expected !ok for GetInt64 of an address")
+	}
+	// An empty snapshot has no values.
+	empty := web100.Snapshot{}
+	if _, ok := empty.GetInt64("CurCwnd"); ok {
+		t.Error("Expected !ok for empty snapshot")
+	}
+}
+
+// BenchmarkSnapshotValues measures NewSnapLog, and the extraction of the values
+// of every snapshot, which dominates the NDT parse cost.
+func BenchmarkSnapshotValues(b *testing.B) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(b, c2sName)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		slog, err := web100.NewSnapLog(c2sData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		iter := slog.Snapshots(0)
+		for snap, err := iter.Next(); err != io.EOF; snap, err = iter.Next() {
+			if err != nil {
+				b.Fatal(err)
+			}
+			saver := NewSimpleSaver()
+			if err = snap.SnapshotValues(&saver); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDecodeSnapshots(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parallel results match those of the serial iterator.
+	savers := make([]SimpleSaver, slog.SnapCount())
+	err = slog.DecodeSnapshots(0, 8, func(i int, snap *web100.Snapshot) error {
+		savers[i] = NewSimpleSaver()
+		return snap.SnapshotValues(&savers[i])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := slog.Snapshots(0)
+	for snap, err := iter.Next(); err != io.EOF; snap, err = iter.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := NewSimpleSaver()
+		snap.SnapshotValues(&want)
+		if !reflect.DeepEqual(want, savers[iter.Index()]) {
+			t.Fatalf("Snapshot %d: %v", iter.Index(), saverDiffs(want, savers[iter.Index()]))
+		}
+	}
+
+	// The error for the lowest failing index is returned.
+	fail := func(i int, snap *web100.Snapshot) error {
+		if i >= 100 {
+			return fmt.Errorf("snapshot %d", i)
+		}
+		return nil
+	}
+	for _, workers := range []int{0, 1, 8} {
+		if err := slog.DecodeSnapshots(0, workers, fail); err == nil || err.Error() != "snapshot 100" {
+			t.Errorf("%d workers: got %v, want snapshot 100", workers, err)
+		}
+	}
+
+	// Only the first limit snapshots are decoded.
+	var count int32
+	err = slog.DecodeSnapshots(10, 4, func(i int, snap *web100.Snapshot) error {
+		if i >= 10 {
+			t.Errorf("Unexpected snapshot %d", i)
+		}
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	if err != nil || count != 10 {
+		t.Errorf("Got %v, %d snapshots, want 10", err, count)
+	}
+}
+
+func benchmarkDecodeSnapshots(b *testing.B, workers int) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(b, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		b.Fatal(err)
+	}
+	savers := make([]SimpleSaver, slog.SnapCount())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = slog.DecodeSnapshots(0, workers, func(i int, snap *web100.Snapshot) error {
+			savers[i] = NewSimpleSaver()
+			return snap.SnapshotValues(&savers[i])
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeSnapshotsSerial(b *testing.B) {
+	benchmarkDecodeSnapshots(b, 1)
+}
+
+func BenchmarkDecodeSnapshotsParallel(b *testing.B) {
+	benchmarkDecodeSnapshots(b, runtime.NumCPU())
+}
+
+func TestVariables(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData := readSnaplog(t, c2sName)
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := slog.Variables()
+	if len(vars) != 142 {
+		t.Fatalf("Got %d variables, want 142", len(vars))
+	}
+
+	// The variables that are saved match the values of a snapshot.
+	snap, err := slog.Snapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := NewSimpleSaver()
+	snap.SnapshotValues(&saver)
+	integers, strs := 0, 0
+	for _, v := range vars {
+		if v.Offset+v.Size > slog.SnapshotNumBytes() || v.Size <= 0 {
+			t.Errorf("%s: bad offset %d or size %d", v.Name, v.Offset, v.Size)
+		}
+		if strings.HasPrefix(v.Name, "_") {
+			continue
+		}
+		if _, ok := saver.Integers[v.CanonicalName]; ok {
+			integers++
+		} else if _, ok := saver.Strings[v.CanonicalName]; ok {
+			strs++
+		} else {
+			t.Errorf("%s (%s) was not saved", v.Name, v.CanonicalName)
+		}
+	}
+	if integers != 112 || strs != 2 {
+		t.Errorf("Got %d integers and %d strings, want 112 and 2", integers, strs)
+	}
+	want := web100.VariableInfo{Name: "X_RcvRTT", CanonicalName: "RcvRTT",
+		Type: web100.WEB100_TYPE_GAUGE32, Offset: 0, Size: 4}
+	if vars[0] != want {
+		t.Errorf("Got first variable %+v, want %+v", vars[0], want)
+	}
+}